@@ -1,29 +1,66 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	_ "time/tzdata"
+	"unicode"
+	"unicode/utf8"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
-	_ "modernc.org/sqlite"
+	"github.com/wcharczuk/go-chart/v2"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
 )
 
 // Constants for state management
 const (
 	// Operation types
-	OpAddLoan      = "addloan"
-	OpRepayLoan    = "repayloan"
-	OpEditLoan     = "editloan"
-	OpDeleteLoan   = "deleteloan"
-	OpPartialRepay = "partialrepay"
-	OpSearchLoan   = "searchloan"
-	OpNone         = ""
+	OpAddLoan       = "addloan"
+	OpRepayLoan     = "repayloan"
+	OpEditLoan      = "editloan"
+	OpDeleteLoan    = "deleteloan"
+	OpPartialRepay  = "partialrepay"
+	OpSearchLoan    = "searchloan"
+	OpEditRepay     = "editrepayment"
+	OpMergeLoans    = "mergeloans"
+	OpReassignLoan  = "reassignloan"
+	OpResetData     = "resetdata"
+	OpImportData    = "importdata"
+	OpSettleUp      = "settleup"
+	OpBorrowerPhone = "borrowerphone"
+	OpGroupLoan     = "grouploan"
+	OpDisputeLoan   = "disputeloan"
+	OpRemindEvery   = "remindevery"
+	OpPaymentLink   = "paymentlink"
+	OpMergeNames    = "mergenames"
+	OpInstallment   = "installment"
+	OpDisburse      = "disburse"
+	OpRecurring     = "recurring"
+	OpExtendDue     = "extenddue"
+	OpNudgeTemplate = "nudgetemplate"
+	OpMyShare       = "myshare"
+	OpNone          = ""
 
 	// Menu callback data
 	MenuAddLoan = "menu_addloan"
@@ -32,19 +69,225 @@ const (
 	MenuStats   = "menu_stats"
 	MenuManage  = "menu_manage"
 	MenuSearch  = "menu_search"
+	MenuChart   = "menu_chart"
 
 	// Sub-menu callback data
-	SubMenuEdit       = "menu_edit_loan"
-	SubMenuDelete     = "menu_delete_loan"
-	SubMenuPartial    = "menu_partial_repay"
-	SubMenuRepayments = "menu_repayment_history"
+	SubMenuEdit        = "menu_edit_loan"
+	SubMenuDelete      = "menu_delete_loan"
+	SubMenuPartial     = "menu_partial_repay"
+	SubMenuRepayments  = "menu_repayment_history"
+	SubMenuMerge       = "menu_merge_loans"
+	SubMenuSettle      = "menu_settle_up"
+	SubMenuGroup       = "menu_group_loan"
+	SubMenuInstallment = "menu_installment_loan"
+	SubMenuRecurring   = "menu_recurring_loans"
 
 	// Search sub-menu callback data
-	SearchByName   = "search_by_name"
-	SearchByStatus = "search_by_status"
-	SearchAll      = "search_all_loans"
+	SearchByName    = "search_by_name"
+	SearchByStatus  = "search_by_status"
+	SearchAll       = "search_all_loans"
+	SearchOverdue   = "search_overdue"
+	SearchByPurpose = "search_by_purpose"
+	SearchAllFields = "search_all_fields"
+	SearchByDueDate = "search_by_due_date"
+
+	// Settings callback data
+	MenuSettings         = "menu_settings"
+	SettingsTogglePrefix = "settings_toggle_"
+	SettingsCyclePrefix  = "settings_cycle_"
 )
 
+// Loan event types recorded in the activity log
+const (
+	EventCreated          = "created"
+	EventEdited           = "edited"
+	EventPartialRepayment = "partial_repayment"
+	EventRepaid           = "repaid"
+	EventRepaymentEdited  = "repayment_edited"
+	EventRepaymentDeleted = "repayment_deleted"
+	EventMerged           = "merged"
+	EventTransferred      = "transferred"
+	EventReassigned       = "reassigned"
+	EventOverpaid         = "overpaid"
+	EventDisputed         = "disputed"
+	EventDisputeResolved  = "dispute_resolved"
+	EventReopened         = "reopened"
+	EventDisbursed        = "disbursed"
+	EventForgiven         = "forgiven"
+	EventExtended         = "extended"
+)
+
+// User setting keys
+const (
+	SettingShowPurpose = "show_purpose"
+	SettingReminders   = "reminders"
+	SettingDigest      = "digest"
+	SettingKeypad      = "keypad"
+	SettingFirstName   = "first_name"
+	SettingTextMode    = "text_mode"
+	// SettingAccessibility extends text mode with wording that reads well in screen readers
+	SettingAccessibility = "accessibility"
+	// Amount formatting, see GetMoneyFormat
+	SettingCurrencyPosition = "currency_position"
+	SettingNumberFormat     = "number_format"
+	SettingDecimalSeparator = "decimal_separator"
+	// SettingDueReminderDays is how many days before a due date the user is notified
+	SettingDueReminderDays = "due_reminder_days"
+	// SettingTimezone is the IANA time zone dates are shown in, set with /tz
+	SettingTimezone = "timezone"
+	// SettingReplyKeyboard keeps the quick-action keyboard under the input field, see /keyboard
+	SettingReplyKeyboard = "reply_keyboard"
+	// SettingPinnedSummary holds the ID of the pinned summary message; empty when /pin is off
+	SettingPinnedSummary = "pinned_summary"
+	// SettingOnboarded is set once a new user has been shown the introduction
+	SettingOnboarded = "onboarded"
+	// SettingQuietHours is the "start-end" hour range in which reminders are held back, or "off"
+	SettingQuietHours = "quiet_hours"
+	// SettingNudgeTemplate is the user's text of the message forwarded to borrowers, see RenderNudge
+	SettingNudgeTemplate = "nudge_template"
+	// SettingMyShare shows only the user's share of co-lent loans in balance and stats totals
+	SettingMyShare = "my_share"
+)
+
+// Texts of the quick-action reply keyboard buttons
+const (
+	ReplyAddLoan = "💰 Займ"
+	ReplyRepay   = "✅ Возврат"
+	ReplyBalance = "📊 Баланс"
+	ReplyStats   = "📈 Статистика"
+)
+
+// settingChoices lists the values of multiple-choice settings with their labels, in the order
+// they are cycled through. The first value is the default.
+var settingChoices = map[string][]struct {
+	Value string
+	Label string
+}{
+	SettingCurrencyPosition: {{"after", "5 000 ₸"}, {"before", "₸5 000"}},
+	SettingNumberFormat:     {{"space", "1 000"}, {"comma", "1,000"}, {"dot", "1.000"}},
+	SettingDecimalSeparator: {{"none", "без копеек"}, {"comma", "0,00"}, {"period", "0.00"}},
+	SettingDueReminderDays:  {{"3", "за 3 дня"}, {"1", "за 1 день"}, {"7", "за 7 дней"}, {"off", "выкл"}},
+	SettingQuietHours:       {{"off", "выкл"}, {"22-8", "22:00–08:00"}, {"23-7", "23:00–07:00"}, {"21-9", "21:00–09:00"}},
+}
+
+// settingChoiceLabels names the multiple-choice settings in the settings menu
+var settingChoiceLabels = map[string]string{
+	SettingCurrencyPosition: "💱 Знак валюты",
+	SettingNumberFormat:     "🔢 Разряды",
+	SettingDecimalSeparator: "📍 Дробная часть",
+	SettingDueReminderDays:  "⏳ Напомнить о сроке",
+	SettingQuietHours:       "🌙 Тихие часы",
+}
+
+// Reminder scheduling
+const (
+	reminderInterval = 7 * 24 * time.Hour
+	// reminderSlack tolerates timer drift when comparing against the last reminder time
+	reminderSlack = time.Hour
+	// maxLoanReminderDays caps the per-loan reminder interval
+	maxLoanReminderDays = 365
+	// Reminders go out on Monday at 10:00 local time unless configured otherwise
+	defaultReminderWeekday = time.Monday
+	defaultReminderHour    = 10
+	// The due-date digest goes out on Sunday evening and covers the next week
+	digestWeekday = time.Sunday
+	digestHour    = 19
+	digestDays    = 7
+	// Due-date notifications are checked once a day
+	dueReminderHour = 9
+	// Reminders held back by quiet hours are checked for delivery this often
+	deferredCheckInterval = 5 * time.Minute
+	// Overdue loans are reminded more often the longer they stay unpaid: weekly
+	// from overdueWeeklyDays past the due date and daily from overdueDailyDays
+	overdueWeeklyDays = 7
+	overdueDailyDays  = 30
+)
+
+// topBorrowersLimit is how many borrowers /top lists
+const topBorrowersLimit = 5
+
+// chartMonths is how many months the lending chart covers
+const chartMonths = 6
+
+// maxBorrowerSuggestions limits how many known borrowers are offered as buttons
+const maxBorrowerSuggestions = 8
+
+// Telegram message limits
+const (
+	// maxMessageLength is the maximum length of a Telegram text message
+	maxMessageLength = 4096
+	// snoozeDays is how long "🔕 Отложить напоминания" keeps a loan out of reminders
+	snoozeDays = 30
+	// loansPerMessage is how many loans with action buttons are sent in one message
+	loansPerMessage = 10
+	// maxNoteLength is the longest loan purpose or repayment note a user can type
+	maxNoteLength = 280
+	// searchPageSize is how many search results are shown before "показать ещё"
+	searchPageSize = 5
+)
+
+// dbPath is the location of the SQLite database file
+const dbPath = "./lending.db"
+
+// dbBusyTimeoutMs is how long a statement waits for a lock held by another
+// connection, e.g. a write for the reads in progress, before failing with SQLITE_BUSY
+const dbBusyTimeoutMs = 5000
+
+// Database connection pool
+const (
+	// dbMaxOpenConns bounds the pool shared by the reads and the writer goroutine.
+	// It can't be 1: some handlers run a query while
+	// the rows of another are still open, and would wait on themselves until the
+	// timeout fails them (see TestNestedQueryNeedsSecondConnection).
+	dbMaxOpenConns = 4
+	dbMaxIdleConns = 2
+	// dbQueryTimeout fails a query, and rolls back a transaction, that runs longer
+	dbQueryTimeout = 30 * time.Second
+	// A statement that still finds the database busy after busy_timeout is retried a
+	// few more times, waiting a little longer before each attempt
+	dbBusyRetries    = 3
+	dbBusyRetryDelay = 200 * time.Millisecond
+)
+
+// dbBusyMessage is shown instead of the error when the database stays locked
+const dbBusyMessage = "⏳ База занята, попробуйте ещё раз"
+
+// defaultBackupInterval is used when BACKUP_INTERVAL_HOURS is not set
+const defaultBackupInterval = 7 * 24 * time.Hour
+
+// defaultOutstandingAlertThreshold is used when OUTSTANDING_ALERT_THRESHOLD is not set
+const defaultOutstandingAlertThreshold = 10000000
+
+// Database maintenance
+const (
+	maintenanceCheckInterval = time.Hour
+	// recurringCatchUpLimit caps how many missed loans one template creates at once,
+	// e.g. after the bot was down for a long time
+	recurringCatchUpLimit = 31
+	vacuumInterval        = 7 * 24 * time.Hour
+	// vacuumDeletionThreshold triggers an early VACUUM after this many deleted rows
+	vacuumDeletionThreshold = 500
+
+	metaDeletionsSinceVacuum = "deletions_since_vacuum"
+	metaLastVacuum           = "last_vacuum"
+)
+
+// Config holds settings read from the environment
+type Config struct {
+	AdminIDs        []int64
+	BackupInterval  time.Duration
+	ReminderWeekday time.Weekday
+	ReminderHour    int
+	// MaxLoansPerUser caps how many loans a user can keep; 0 means no limit
+	MaxLoansPerUser int
+	// RepaidTolerance is the largest remainder at which a loan still counts as repaid
+	RepaidTolerance int64
+	// OutstandingAlertThreshold is the outstanding total above which /highbalances lists a user
+	OutstandingAlertThreshold int64
+	// WelcomeMessage introduces the bot to first-time users
+	WelcomeMessage string
+}
+
 // UserState manages the state for a single user
 type UserState struct {
 	Operation   string
@@ -56,40 +299,286 @@ type UserState struct {
 // State manager for all users
 type BotManager struct {
 	bot             *tgbotapi.BotAPI
-	db              *sql.DB
+	db              *timeoutDB
+	config          Config
 	userStates      map[int64]*UserState
 	stateMutex      sync.RWMutex
 	lastProcessedID int
+	// staleSummaries holds the users whose pinned summary needs refreshing, see MarkSummaryStale
+	staleSummaries map[int64]bool
+	summaryMutex   sync.Mutex
 }
 
 // Initialize a new bot manager
-func NewBotManager(bot *tgbotapi.BotAPI, db *sql.DB) *BotManager {
+func NewBotManager(bot *tgbotapi.BotAPI, db *sql.DB, config Config) *BotManager {
 	return &BotManager{
 		bot:        bot,
-		db:         db,
+		db:         newTimeoutDB(db, dbQueryTimeout),
+		config:     config,
 		userStates: make(map[int64]*UserState),
 	}
 }
 
-// GetState returns the current state for a user, creating one if it doesn't exist
-func (m *BotManager) GetState(chatID int64) *UserState {
+// timeoutDB bounds every query with a timeout, so a query stuck on a lock fails
+// instead of wedging the handler that ran it. The *Context methods apply the timeout
+// on top of the caller's context; the others start from context.Background().
+//
+// Writes don't run on the caller's goroutine: Exec and Transact hand them to a single
+// writer goroutine through the writes channel and wait for the result, so two writes
+// never compete for SQLite's write lock. Reads run directly on the pool.
+type timeoutDB struct {
+	*sql.DB
+	timeout time.Duration
+	writes  chan writeRequest
+	// writerID is the goroutine ID of the writer, see write
+	writerID atomic.Uint64
+}
+
+// errNestedWrite is returned by a write issued from inside another write
+var errNestedWrite = errors.New("write issued from inside another write")
+
+// writeRequest is a write waiting for the writer goroutine, which sends its result to done
+type writeRequest struct {
+	write func() error
+	done  chan error
+}
+
+// newTimeoutDB wraps db and starts its writer goroutine
+func newTimeoutDB(db *sql.DB, timeout time.Duration) *timeoutDB {
+	wrapped := &timeoutDB{DB: db, timeout: timeout, writes: make(chan writeRequest)}
+	go wrapped.runWriter()
+	return wrapped
+}
+
+// runWriter performs the queued writes one at a time
+func (db *timeoutDB) runWriter() {
+	db.writerID.Store(goroutineID())
+	for request := range db.writes {
+		request.done <- request.write()
+	}
+}
+
+// write queues fn for the writer goroutine and waits for its result. fn must not
+// write through db itself: the writer would wait on itself forever, so such a write
+// fails with errNestedWrite instead.
+func (db *timeoutDB) write(ctx context.Context, fn func() error) error {
+	if goroutineID() == db.writerID.Load() {
+		return errNestedWrite
+	}
+
+	done := make(chan error, 1)
+	select {
+	case db.writes <- writeRequest{write: fn, done: done}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return <-done
+}
+
+// timeoutRows are query results whose timeout is released once they are closed
+// or fully read
+type timeoutRows struct {
+	*sql.Rows
+	cancel context.CancelFunc
+}
+
+// Next advances to the next row, releasing the timeout after the last one
+func (r *timeoutRows) Next() bool {
+	if r.Rows.Next() {
+		return true
+	}
+	r.cancel()
+	return false
+}
+
+// Close closes the rows and releases their timeout
+func (r *timeoutRows) Close() error {
+	defer r.cancel()
+	return r.Rows.Close()
+}
+
+// timeoutRow is a single-row result whose timeout is released once it is scanned
+type timeoutRow struct {
+	*sql.Row
+	cancel context.CancelFunc
+}
+
+// Scan copies the row into dest and releases the timeout
+func (r *timeoutRow) Scan(dest ...any) error {
+	defer r.cancel()
+	return r.Row.Scan(dest...)
+}
+
+// timeoutTx is a transaction whose timeout is released once it is committed or rolled back
+type timeoutTx struct {
+	*sql.Tx
+	cancel context.CancelFunc
+}
+
+// Commit commits the transaction and releases its timeout
+func (tx *timeoutTx) Commit() error {
+	defer tx.cancel()
+	return tx.Tx.Commit()
+}
+
+// Rollback rolls the transaction back and releases its timeout
+func (tx *timeoutTx) Rollback() error {
+	defer tx.cancel()
+	return tx.Tx.Rollback()
+}
+
+// goroutineID returns the ID of the calling goroutine, read from the "goroutine N"
+// header of its stack trace
+func goroutineID() uint64 {
+	var buf [64]byte
+	header := bytes.TrimPrefix(buf[:runtime.Stack(buf[:], false)], []byte("goroutine "))
+	id, _ := strconv.ParseUint(string(header[:bytes.IndexByte(header, ' ')]), 10, 64)
+	return id
+}
+
+// isDatabaseBusy reports whether err means SQLite could not get a lock in time
+func isDatabaseBusy(err error) bool {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	// Extended result codes keep the primary code in the low byte
+	code := sqliteErr.Code() & 0xff
+	return code == sqlite3.SQLITE_BUSY || code == sqlite3.SQLITE_LOCKED
+}
+
+// dbErrorMessage returns the message to show the user for a failed database call:
+// dbBusyMessage when the database was locked, otherwise the given message
+func dbErrorMessage(err error, message string) string {
+	if isDatabaseBusy(err) {
+		return dbBusyMessage
+	}
+	return message
+}
+
+// retryBusy runs op again while it fails because the database is locked
+func retryBusy(op func() error) error {
+	err := op()
+	for attempt := 1; attempt <= dbBusyRetries && isDatabaseBusy(err); attempt++ {
+		log.Printf("Database is busy, retrying (attempt %d of %d)", attempt, dbBusyRetries)
+		time.Sleep(time.Duration(attempt) * dbBusyRetryDelay)
+		err = op()
+	}
+	return err
+}
+
+// ExecContext runs a statement on the writer goroutine with the timeout, retrying
+// while the database is locked
+func (db *timeoutDB) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	var result sql.Result
+	err := db.write(ctx, func() error {
+		return retryBusy(func() error {
+			ctx, cancel := context.WithTimeout(ctx, db.timeout)
+			defer cancel()
+
+			var err error
+			result, err = db.DB.ExecContext(ctx, query, args...)
+			return err
+		})
+	})
+	return result, err
+}
+
+// Exec is ExecContext with a background context
+func (db *timeoutDB) Exec(query string, args ...any) (sql.Result, error) {
+	return db.ExecContext(context.Background(), query, args...)
+}
+
+// QueryContext runs a query with the timeout, retrying while the database is locked.
+// Rows still open when the timeout expires are closed.
+func (db *timeoutDB) QueryContext(ctx context.Context, query string, args ...any) (*timeoutRows, error) {
+	var rows *timeoutRows
+	err := retryBusy(func() error {
+		ctx, cancel := context.WithTimeout(ctx, db.timeout)
+		result, err := db.DB.QueryContext(ctx, query, args...)
+		if err != nil {
+			cancel()
+			return err
+		}
+		rows = &timeoutRows{Rows: result, cancel: cancel}
+		return nil
+	})
+	return rows, err
+}
+
+// Query is QueryContext with a background context
+func (db *timeoutDB) Query(query string, args ...any) (*timeoutRows, error) {
+	return db.QueryContext(context.Background(), query, args...)
+}
+
+// QueryRowContext runs a single-row query with the timeout
+func (db *timeoutDB) QueryRowContext(ctx context.Context, query string, args ...any) *timeoutRow {
+	ctx, cancel := context.WithTimeout(ctx, db.timeout)
+	return &timeoutRow{Row: db.DB.QueryRowContext(ctx, query, args...), cancel: cancel}
+}
+
+// QueryRow is QueryRowContext with a background context
+func (db *timeoutDB) QueryRow(query string, args ...any) *timeoutRow {
+	return db.QueryRowContext(context.Background(), query, args...)
+}
+
+// beginTx starts a transaction that is rolled back if it is still open when the
+// timeout expires. Transactions are only started on the writer goroutine.
+func (db *timeoutDB) beginTx(ctx context.Context) (*timeoutTx, error) {
+	ctx, cancel := context.WithTimeout(ctx, db.timeout)
+	tx, err := db.DB.BeginTx(ctx, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &timeoutTx{Tx: tx, cancel: cancel}, nil
+}
+
+// TransactContext runs fn in a transaction on the writer goroutine and commits it, or
+// rolls it back if fn fails. The whole transaction is run again while the database is
+// locked: a deferred transaction that has read gets SQLITE_BUSY at its first write
+// without waiting, and only starting over can get it the lock. fn must therefore leave
+// nothing but the transaction changed when it fails, and must not write through db.
+func (db *timeoutDB) TransactContext(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	return db.write(ctx, func() error {
+		return retryBusy(func() error {
+			tx, err := db.beginTx(ctx)
+			if err != nil {
+				return err
+			}
+			if err := fn(tx.Tx); err != nil {
+				tx.Rollback()
+				return err
+			}
+			return tx.Commit()
+		})
+	})
+}
+
+// Transact is TransactContext with a background context
+func (db *timeoutDB) Transact(fn func(tx *sql.Tx) error) error {
+	return db.TransactContext(context.Background(), fn)
+}
+
+// GetState returns a snapshot of the current state for a user. Reading never creates
+// a state: a user without one gets the zero value, whose Operation is OpNone.
+// States are only stored by SetState and SaveStateData.
+func (m *BotManager) GetState(chatID int64) UserState {
 	m.stateMutex.RLock()
-	state, exists := m.userStates[chatID]
-	m.stateMutex.RUnlock()
+	defer m.stateMutex.RUnlock()
 
+	state, exists := m.userStates[chatID]
 	if !exists {
-		state = &UserState{
-			Operation:   OpNone,
-			Step:        0,
-			Data:        make(map[string]string),
-			LastUpdated: time.Now(),
-		}
-		m.stateMutex.Lock()
-		m.userStates[chatID] = state
-		m.stateMutex.Unlock()
+		return UserState{}
 	}
 
-	return state
+	// Copy the data so callers can read it without holding the lock
+	snapshot := *state
+	snapshot.Data = make(map[string]string, len(state.Data))
+	for key, value := range state.Data {
+		snapshot.Data[key] = value
+	}
+	return snapshot
 }
 
 // SetState updates a user's state
@@ -138,1172 +627,9068 @@ func (m *BotManager) SaveStateData(chatID int64, key string, value string) {
 	}
 
 	state.Data[key] = value
+	state.LastUpdated = time.Now()
 }
 
 // SendMessage is a helper to send text messages
 func (m *BotManager) SendMessage(chatID int64, text string) {
 	msg := tgbotapi.NewMessage(chatID, text)
-	_, err := m.bot.Send(msg)
+	_, err := m.Send(msg)
 	if err != nil {
 		log.Printf("Error sending message: %v", err)
 	}
 }
 
-// ShowMainMenu displays the main menu keyboard
-func (m *BotManager) ShowMainMenu(chatID int64) {
-	menuButtons := tgbotapi.NewInlineKeyboardMarkup(
-		tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData("💰 Записать займ", MenuAddLoan),
-			tgbotapi.NewInlineKeyboardButtonData("✅ Записать возврат", MenuRepay),
-		),
-		tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData("📊 Баланс", MenuBalance),
-			tgbotapi.NewInlineKeyboardButtonData("📈 Статистика", MenuStats),
-		),
+// SendErrorWithBack sends an error with a button back to the main menu. Button presses
+// strip the keyboard they came from, so failures reached from a button use this to
+// leave the user a way forward.
+func (m *BotManager) SendErrorWithBack(chatID int64, text string) {
+	msg := tgbotapi.NewMessage(chatID, text)
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
 		tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData("✏️ Управление займами", MenuManage),
-			tgbotapi.NewInlineKeyboardButtonData("🔍 Поиск", MenuSearch),
+			tgbotapi.NewInlineKeyboardButtonData("🔙 Назад", "back_to_main"),
 		),
 	)
-
-	msg := tgbotapi.NewMessage(chatID, "🤖 Выберите действие:")
-	msg.ReplyMarkup = menuButtons
-	_, err := m.bot.Send(msg)
-	if err != nil {
-		log.Printf("Error showing main menu: %v", err)
+	if _, err := m.Send(msg); err != nil {
+		log.Printf("Error sending message: %v", err)
 	}
 }
 
-// StartAddLoanFlow begins the process of recording a new loan
-func (m *BotManager) StartAddLoanFlow(chatID int64) {
-	// First clear any existing state
-	m.ClearState(chatID)
+// Send renders a message for the user's display mode and sends it
+func (m *BotManager) Send(msg tgbotapi.MessageConfig) (tgbotapi.Message, error) {
+	m.FormatMessage(&msg)
+	return m.bot.Send(msg)
+}
 
-	// Send the initial prompt
-	m.SendMessage(chatID, "📝 Давайте запишем новый займ.\n👤 Введите имя заемщика:")
+// SendMarkdown sends a MarkdownV2 text message built with markdownf
+func (m *BotManager) SendMarkdown(chatID int64, text string) {
+	m.SendMarkdownMessage(tgbotapi.NewMessage(chatID, text))
+}
 
-	// Then set the new state
-	m.SetState(chatID, OpAddLoan, 0)
+// SendMarkdownMessage sends a message as MarkdownV2. If Telegram rejects the markup,
+// the message is sent again as plain text so the user still gets it.
+func (m *BotManager) SendMarkdownMessage(msg tgbotapi.MessageConfig) {
+	m.FormatMessage(&msg)
+	msg.ParseMode = tgbotapi.ModeMarkdownV2
+	_, err := m.bot.Send(msg)
+	if err == nil {
+		return
+	}
 
-	log.Printf("Started add loan flow for user %d", chatID)
+	log.Printf("Error sending markdown message, retrying as plain text: %v", err)
+	msg.ParseMode = ""
+	msg.Text = unescapeMarkdownV2(msg.Text)
+	if _, err := m.bot.Send(msg); err != nil {
+		log.Printf("Error sending message: %v", err)
+	}
 }
 
-// StartRepayLoanFlow begins the process of marking a loan as repaid
-func (m *BotManager) StartRepayLoanFlow(chatID int64) {
-	// First clear any existing state
-	m.ClearState(chatID)
-
-	// Get active loans
-	activeLoans, err := m.GetActiveLoansForUser(chatID)
-	if err != nil {
-		log.Printf("Error getting active loans: %v", err)
-		m.SendMessage(chatID, "❌ Не удалось получить список активных займов.")
-		m.ShowMainMenu(chatID)
+// FormatMessage adapts the text and inline button labels of a message to the user's
+// display mode. In text mode emoji are removed so screen readers don't read them out;
+// accessibility mode also replaces symbols with words.
+func (m *BotManager) FormatMessage(msg *tgbotapi.MessageConfig) {
+	render := m.TextRenderer(msg.ChatID)
+	if render == nil {
 		return
 	}
 
-	if len(activeLoans) == 0 {
-		m.SendMessage(chatID, "У вас нет активных займов для возврата.")
-		m.ShowMainMenu(chatID)
-		return
+	msg.Text = render(msg.Text)
+	if markup, ok := msg.ReplyMarkup.(tgbotapi.InlineKeyboardMarkup); ok {
+		for _, row := range markup.InlineKeyboard {
+			for i := range row {
+				row[i].Text = render(row[i].Text)
+			}
+		}
 	}
+}
 
-	// Display loans with inline keyboard for selection
-	var keyboard [][]tgbotapi.InlineKeyboardButton
-	for _, loan := range activeLoans {
-		button := tgbotapi.NewInlineKeyboardButtonData(
-			fmt.Sprintf("ID %d: %s - %d ₸", loan.ID, loan.Borrower, loan.Amount),
-			fmt.Sprintf("repay_%d", loan.ID),
-		)
-		keyboard = append(keyboard, tgbotapi.NewInlineKeyboardRow(button))
+// TextRenderer returns the function that converts message text to the user's display mode,
+// or nil when messages are shown as they are
+func (m *BotManager) TextRenderer(chatID int64) func(string) string {
+	if m.GetBoolSetting(chatID, SettingAccessibility, false) {
+		return accessibleText
+	}
+	if m.GetBoolSetting(chatID, SettingTextMode, false) {
+		return plainText
 	}
+	return nil
+}
 
-	// Add back button
-	keyboard = append(keyboard, tgbotapi.NewInlineKeyboardRow(
-		tgbotapi.NewInlineKeyboardButtonData("🔙 Назад", "back_to_main"),
-	))
+// plainTextReplacer keeps separator lines visible. The dash is not a MarkdownV2
+// special character, so it is safe in markdown messages too.
+var plainTextReplacer = strings.NewReplacer(
+	"➖", "—",
+	"〰️", "—",
+)
 
-	msg := tgbotapi.NewMessage(chatID, "Выберите займ для отметки как возвращенный:")
-	msg.ReplyMarkup = tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
-	m.bot.Send(msg)
+// plainText strips emoji from text, keeping the words and layout
+func plainText(text string) string {
+	text = plainTextReplacer.Replace(text)
 
-	// Set state for next step
-	m.SetState(chatID, OpRepayLoan, 0)
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		var plain strings.Builder
+		for _, r := range line {
+			// Emoji are "other symbols", joined by variation selectors and zero-width joiners
+			if (unicode.Is(unicode.So, r) && r != '№') || r == '\uFE0F' || r == '\u200D' || r == '\u20E3' {
+				continue
+			}
+			plain.WriteRune(r)
+		}
+
+		// Drop the spaces that surrounded a leading or trailing emoji
+		lines[i] = strings.Trim(plain.String(), " ")
+	}
+
+	return strings.Join(lines, "\n")
 }
 
-// HandleAddLoanStep processes each step of the add loan flow
-func (m *BotManager) HandleAddLoanStep(chatID int64, text string) {
-	state := m.GetState(chatID)
+// accessibleReplacer spells out symbols that screen readers skip or read awkwardly.
+// Escaped markdown forms come first so they are replaced as a whole.
+var accessibleReplacer = strings.NewReplacer(
+	"₸", "тенге",
+	"\\#", "номер ",
+	"#", "номер ",
+	"№", "номер ",
+	" → ", ", теперь ",
+)
 
-	log.Printf("Handling add loan step %d for user %d with input: %s", state.Step, chatID, text)
+// accessibleText strips emoji and decorative separators and spells out symbols
+func accessibleText(text string) string {
+	text = accessibleReplacer.Replace(plainText(text))
 
-	switch state.Step {
-	case 0: // Getting borrower name
-		if text == "" {
-			m.SendMessage(chatID, "❌ Имя заемщика не может быть пустым. Пожалуйста, введите корректное имя:")
-			return
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		// Separator lines carry no information when read aloud
+		if line != "" && strings.Trim(line, "—") == "" {
+			continue
 		}
+		lines = append(lines, line)
+	}
 
-		// Save borrower name and move to next step
-		m.SaveStateData(chatID, "borrower_name", text)
-		m.SetState(chatID, OpAddLoan, 1)
-		m.SendMessage(chatID, "💰 Введите сумму займа:")
+	return strings.Join(lines, "\n")
+}
 
-	case 1: // Getting loan amount
-		amount, err := strconv.ParseInt(text, 10, 64)
-		if err != nil {
-			m.SendMessage(chatID, "❌ Некорректная сумма. Пожалуйста, введите целое число:")
-			return
-		}
+// markdownV2Special lists the characters that must be escaped in MarkdownV2 text
+const markdownV2Special = "_*[]()~`>#+-=|{}.!\\"
 
-		// Save amount and move to next step
-		m.SaveStateData(chatID, "amount", fmt.Sprintf("%d", amount))
-		m.SetState(chatID, OpAddLoan, 2)
-		m.SendMessage(chatID, "📝 Введите цель займа:")
+// userMarkdown marks user-entered text (purposes, notes) whose basic formatting is kept
+type userMarkdown string
 
-	case 2: // Getting loan purpose
-		if text == "" {
-			m.SendMessage(chatID, "❌ Цель займа не может быть пустой. Пожалуйста, введите корректную цель:")
-			return
+// escapeMarkdownV2 escapes text so it is shown literally in a MarkdownV2 message
+func escapeMarkdownV2(text string) string {
+	var escaped strings.Builder
+	for _, r := range text {
+		if strings.ContainsRune(markdownV2Special, r) {
+			escaped.WriteByte('\\')
 		}
+		escaped.WriteRune(r)
+	}
+	return escaped.String()
+}
 
-		// Save purpose and complete the process
-		m.SaveStateData(chatID, "purpose", text)
-
-		// Generate a new loan ID
-		var newLoanID int
-		err := m.db.QueryRow("SELECT COALESCE(MAX(loan_id), 0) + 1 FROM loans WHERE user_id = ?", chatID).Scan(&newLoanID)
-		if err != nil {
-			log.Printf("Error generating loan ID: %v", err)
-			m.SendMessage(chatID, fmt.Sprintf("❌ Ошибка при создании ID займа: %v", err))
-			return
+// unescapeMarkdownV2 turns MarkdownV2 text produced by markdownf back into plain text
+func unescapeMarkdownV2(text string) string {
+	var plain strings.Builder
+	escaped := false
+	for _, r := range text {
+		if r == '\\' && !escaped {
+			escaped = true
+			continue
 		}
+		escaped = false
+		plain.WriteRune(r)
+	}
+	return plain.String()
+}
 
-		// Insert the new loan into the database
-		query := `INSERT INTO loans (user_id, loan_id, borrower_name, amount, purpose, repaid) 
-				  VALUES (?, ?, ?, ?, ?, 0)`
-		_, err = m.db.Exec(
-			query,
-			chatID,
-			newLoanID,
-			state.Data["borrower_name"],
-			state.Data["amount"],
-			state.Data["purpose"],
-		)
+// formatUserMarkdown escapes user-entered text but keeps *bold*, _italic_ and ~strikethrough~
+// markers when they are balanced
+func formatUserMarkdown(text string) string {
+	escaped := escapeMarkdownV2(text)
+	for _, marker := range []string{"*", "_", "~"} {
+		if strings.Count(text, marker)%2 == 0 && !strings.Contains(text, "\\") {
+			escaped = strings.ReplaceAll(escaped, "\\"+marker, marker)
+		}
+	}
+	return escaped
+}
 
-		if err != nil {
-			log.Printf("Error inserting loan: %v", err)
-			m.SendMessage(chatID, fmt.Sprintf("❌ Не удалось зарегистрировать займ: %v", err))
-			return
+// markdownf formats a MarkdownV2 message. The format and every argument are escaped;
+// userMarkdown arguments keep their basic formatting. All verbs are rendered as strings.
+func markdownf(format string, args ...interface{}) string {
+	escapedArgs := make([]interface{}, len(args))
+	for i, arg := range args {
+		switch value := arg.(type) {
+		case userMarkdown:
+			escapedArgs[i] = formatUserMarkdown(string(value))
+		default:
+			escapedArgs[i] = escapeMarkdownV2(fmt.Sprint(value))
 		}
+	}
 
-		// Send success message
-		successMsg := fmt.Sprintf(
-			"✅ Займ успешно зарегистрирован!\n\n"+
-				"👤 Заемщик: %s\n"+
-				"💰 Сумма: %s ₸\n"+
-				"🎯 Цель: %s\n"+
-				"🆔 ID займа: %d\n\n"+
-				"〰️〰️〰️〰️〰️〰️〰️〰️〰️〰️",
-			state.Data["borrower_name"],
-			state.Data["amount"],
-			state.Data["purpose"],
-			newLoanID,
-		)
-		m.SendMessage(chatID, successMsg)
+	format = strings.ReplaceAll(escapeMarkdownV2(format), "%d", "%s")
+	return fmt.Sprintf(format, escapedArgs...)
+}
 
-		// Clear state and show main menu
-		m.ClearState(chatID)
-		m.ShowMainMenu(chatID)
+// SendLongMessage sends text split into several messages if it exceeds the Telegram limit
+func (m *BotManager) SendLongMessage(chatID int64, text string) {
+	for _, part := range splitMessage(text, maxMessageLength) {
+		m.SendMessage(chatID, part)
 	}
 }
 
-// HandleRepayLoanStep processes steps in the repay loan flow
-func (m *BotManager) HandleRepayLoanStep(chatID int64, text string) {
-	state := m.GetState(chatID)
-
-	switch state.Step {
-	case 0: // Select loan to repay
-		// Try to parse loan ID
-		loanID, err := strconv.Atoi(text)
-		if err != nil {
-			m.SendMessage(chatID, "❌ Пожалуйста, введите корректный номер займа из списка.")
-			return
-		}
+// splitMessage splits text on line boundaries into chunks of at most limit characters
+func splitMessage(text string, limit int) []string {
+	var parts []string
+	var current strings.Builder
+	currentLen := 0
 
-		// Check if loan exists and is active
-		var exists bool
-		var borrower string
-		var amount int64
-		err = m.db.QueryRow(
-			"SELECT EXISTS(SELECT 1 FROM loans WHERE user_id = ? AND loan_id = ? AND repaid = 0), borrower_name, amount FROM loans WHERE user_id = ? AND loan_id = ?",
-			chatID, loanID, chatID, loanID,
-		).Scan(&exists, &borrower, &amount)
+	for _, line := range strings.SplitAfter(text, "\n") {
+		lineLen := len([]rune(line))
 
-		if err != nil {
-			log.Printf("Error checking loan existence: %v", err)
-			m.SendMessage(chatID, "❌ Произошла ошибка при проверке займа.")
-			m.ClearState(chatID)
-			m.ShowMainMenu(chatID)
-			return
+		// Flush the current chunk if the line doesn't fit
+		if currentLen > 0 && currentLen+lineLen > limit {
+			parts = append(parts, current.String())
+			current.Reset()
+			currentLen = 0
 		}
 
-		if !exists {
-			m.SendMessage(chatID, "❌ Указанный займ не найден или уже погашен.")
-			return
+		// Hard-split lines that are longer than the limit on their own
+		for lineLen > limit {
+			runes := []rune(line)
+			parts = append(parts, string(runes[:limit]))
+			line = string(runes[limit:])
+			lineLen -= limit
 		}
 
-		// Save loan ID and advance to next step
-		m.SaveStateData(chatID, "loan_id", text)
-		m.SaveStateData(chatID, "borrower", borrower)
-		m.SaveStateData(chatID, "amount", fmt.Sprintf("%d", amount))
-		m.SetState(chatID, OpRepayLoan, 1)
-
-		// Ask for confirmation
-		m.SendMessage(chatID, fmt.Sprintf(
-			"Вы собираетесь отметить займ #%d от %s на сумму %d ₸ как возвращенный.\n\nВведите \"да\" для подтверждения или \"нет\" для отмены.",
-			loanID, borrower, amount,
-		))
-
-	case 1: // Confirm repayment
-		confirmation := strings.ToLower(text)
-
-		if confirmation == "да" {
-			// Get loan details from state
-			loanIDStr, _ := m.GetStateData(chatID, "loan_id")
-			borrower, _ := m.GetStateData(chatID, "borrower")
-			amountStr, _ := m.GetStateData(chatID, "amount")
+		current.WriteString(line)
+		currentLen += lineLen
+	}
 
-			loanID, _ := strconv.Atoi(loanIDStr)
-			amount, _ := strconv.ParseInt(amountStr, 10, 64)
+	if currentLen > 0 {
+		parts = append(parts, current.String())
+	}
 
-			// Mark loan as repaid
-			_, err := m.db.Exec(
-				"UPDATE loans SET repaid = 1 WHERE user_id = ? AND loan_id = ?",
-				chatID, loanID,
-			)
+	return parts
+}
 
-			if err != nil {
-				log.Printf("Error marking loan as repaid: %v", err)
-				m.SendMessage(chatID, "❌ Произошла ошибка при отметке займа как возвращенного.")
-				m.ClearState(chatID)
-				m.ShowMainMenu(chatID)
-				return
-			}
+// ShowMainMenu displays the main menu keyboard
+func (m *BotManager) ShowMainMenu(chatID int64) {
+	menuButtons := tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("💰 Записать займ", MenuAddLoan),
+			tgbotapi.NewInlineKeyboardButtonData("✅ Записать возврат", MenuRepay),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("📊 Баланс", MenuBalance),
+			tgbotapi.NewInlineKeyboardButtonData("📈 Статистика", MenuStats),
+			tgbotapi.NewInlineKeyboardButtonData("📊 График", MenuChart),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("✏️ Управление займами", MenuManage),
+			tgbotapi.NewInlineKeyboardButtonData("🔍 Поиск", MenuSearch),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("⚙️ Настройки", MenuSettings),
+		),
+	)
 
-			// Insert into repayments table
-			date := time.Now().Format("2006-01-02")
-			_, err = m.db.Exec(
-				"INSERT INTO repayments (user_id, loan_id, amount, repayment_date, note) VALUES (?, ?, ?, ?, 'Полный возврат')",
-				chatID, loanID, amount, date,
-			)
+	// Include the outstanding total when there is one
+	prompt := "🤖 Выберите действие:"
+	if outstanding, err := m.GetOutstandingTotal(chatID); err == nil && outstanding > 0 {
+		prompt = fmt.Sprintf("🤖 Выберите действие (вам должны %s):", m.Money(chatID, outstanding))
+	}
 
-			if err != nil {
-				log.Printf("Error recording repayment: %v", err)
-				// Loan is already marked as repaid, so we proceed
-			}
+	msg := tgbotapi.NewMessage(chatID, prompt)
+	msg.ReplyMarkup = menuButtons
+	_, err := m.Send(msg)
+	if err != nil {
+		log.Printf("Error showing main menu: %v", err)
+	}
+}
 
-			// Send confirmation
-			m.SendMessage(chatID, fmt.Sprintf(
-				"✅ Займ #%d от %s на сумму %d ₸ отмечен как возвращенный!",
-				loanID, borrower, amount,
-			))
+// formatAmount formats an amount with a separator between digit groups, e.g. 45 000
+func formatAmount(amount int64, separator string) string {
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
 
-		} else if confirmation == "нет" {
-			m.SendMessage(chatID, "❌ Отметка займа как возвращенного отменена.")
-		} else {
-			m.SendMessage(chatID, "Пожалуйста, введите \"да\" для подтверждения или \"нет\" для отмены.")
-			return
+	digits := strconv.FormatInt(amount, 10)
+	var grouped strings.Builder
+	for i, digit := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			grouped.WriteString(separator)
 		}
-
-		// Clear state and show main menu
-		m.ClearState(chatID)
-		m.ShowMainMenu(chatID)
+		grouped.WriteRune(digit)
 	}
-}
 
-// ShowBalance displays the user's active loans
-func (m *BotManager) ShowBalance(chatID int64) {
-	// Query active loans
-	rows, err := m.db.Query(
-		"SELECT loan_id, borrower_name, amount FROM loans WHERE user_id = ? AND repaid = 0",
-		chatID,
-	)
+	return sign + grouped.String()
+}
 
-	if err != nil {
-		log.Printf("Error querying loans: %v", err)
-		m.SendMessage(chatID, fmt.Sprintf("❌ Ошибка при получении баланса: %v", err))
-		m.ShowMainMenu(chatID)
-		return
-	}
-	defer rows.Close()
+// currencySymbol is the symbol shown next to amounts
+const currencySymbol = "₸"
 
-	// Build response
-	var response strings.Builder
-	response.WriteString("📊 Активные займы:\n\n")
+// MoneyFormat describes how a user wants amounts written
+type MoneyFormat struct {
+	SymbolBefore     bool
+	GroupSeparator   string
+	DecimalSeparator string // empty when amounts are shown without decimals
+}
 
-	var totalAmount int64
-	loanCount := 0
+// defaultMoneyFormat is the Kazakhstani style, e.g. 5 000 ₸
+var defaultMoneyFormat = MoneyFormat{GroupSeparator: " "}
 
-	// Process each loan
-	for rows.Next() {
-		var id int
-		var borrower string
-		var amount int64
+// formatMoney formats an amount with the currency symbol, e.g. 5 000 ₸ or ₸5,000.00
+func formatMoney(amount int64, format MoneyFormat) string {
+	number := formatAmount(amount, format.GroupSeparator)
+	if format.DecimalSeparator != "" {
+		number += format.DecimalSeparator + "00"
+	}
 
-		if err := rows.Scan(&id, &borrower, &amount); err != nil {
-			log.Printf("Error scanning loan row: %v", err)
-			continue
+	if format.SymbolBefore {
+		if amount < 0 {
+			return "-" + currencySymbol + strings.TrimPrefix(number, "-")
 		}
+		return currencySymbol + number
+	}
+	return number + " " + currencySymbol
+}
 
-		totalAmount += amount
-		loanCount++
+// GetMoneyFormat returns the user's amount formatting preferences
+func (m *BotManager) GetMoneyFormat(chatID int64) MoneyFormat {
+	format := defaultMoneyFormat
+	format.SymbolBefore = m.GetSetting(chatID, SettingCurrencyPosition, "after") == "before"
 
-		response.WriteString(fmt.Sprintf(
-			"🆔 Займ #%d\n👤 Заемщик: %s\n💰 Сумма: %d ₸\n➖➖➖➖➖➖➖➖➖➖\n\n",
-			id, borrower, amount,
-		))
+	switch m.GetSetting(chatID, SettingNumberFormat, "space") {
+	case "comma":
+		format.GroupSeparator = ","
+	case "dot":
+		format.GroupSeparator = "."
 	}
 
-	// Add summary
-	if loanCount == 0 {
-		response.WriteString("У вас нет активных займов! 🎉")
-	} else {
-		response.WriteString(fmt.Sprintf("💼 Общая сумма активных займов: %d ₸", totalAmount))
+	switch m.GetSetting(chatID, SettingDecimalSeparator, "none") {
+	case "comma":
+		format.DecimalSeparator = ","
+	case "period":
+		format.DecimalSeparator = "."
 	}
 
-	// Send response
-	m.SendMessage(chatID, response.String())
-	m.ShowMainMenu(chatID)
+	// 1.000.00 would be unreadable, so the decimals take the other mark when both clash
+	if format.DecimalSeparator != "" && format.DecimalSeparator == format.GroupSeparator {
+		if format.GroupSeparator == "." {
+			format.DecimalSeparator = ","
+		} else {
+			format.DecimalSeparator = "."
+		}
+	}
+
+	return format
 }
 
-// ShowStats displays lending statistics
-func (m *BotManager) ShowStats(chatID int64) {
-	var totalLoans int
-	var totalLent int64
-	var totalRepaid int
+// Money formats an amount in the user's preferred style
+func (m *BotManager) Money(chatID int64, amount int64) string {
+	return formatMoney(amount, m.GetMoneyFormat(chatID))
+}
 
-	// Get total loans and amount
-	err := m.db.QueryRow(
-		"SELECT COUNT(*), COALESCE(SUM(amount), 0) FROM loans WHERE user_id = ?",
-		chatID,
-	).Scan(&totalLoans, &totalLent)
+// foreignCurrencies maps the currency codes and signs accepted after an amount, e.g.
+// "100 USD" or "$100", to the currency code
+var foreignCurrencies = []struct {
+	Marker string
+	Code   string
+}{
+	{"USD", "USD"}, {"$", "USD"},
+	{"EUR", "EUR"}, {"€", "EUR"},
+	{"RUB", "RUB"}, {"РУБ", "RUB"}, {"₽", "RUB"},
+	{"CNY", "CNY"}, {"¥", "CNY"},
+	{"GBP", "GBP"}, {"£", "GBP"},
+	{"KGS", "KGS"}, {"UZS", "UZS"}, {"TRY", "TRY"},
+}
 
-	if err != nil {
-		log.Printf("Error getting loan stats: %v", err)
-		m.SendMessage(chatID, fmt.Sprintf("❌ Ошибка при формировании статистики: %v", err))
-		m.ShowMainMenu(chatID)
-		return
+// knownCurrency reports whether code is one of the foreignCurrencies codes
+func knownCurrency(code string) bool {
+	for _, currency := range foreignCurrencies {
+		if currency.Code == code {
+			return true
+		}
 	}
+	return false
+}
 
-	// Get repaid count
-	err = m.db.QueryRow(
-		"SELECT COUNT(*) FROM loans WHERE user_id = ? AND repaid = 1",
-		chatID,
-	).Scan(&totalRepaid)
+// parseForeignAmount parses an amount typed with a foreign currency, e.g. "100 USD"
+// or "$100". The last result reports whether the text names a foreign currency at all.
+func parseForeignAmount(text string) (int64, string, bool) {
+	cleaned := strings.ToUpper(strings.TrimSpace(text))
+	for _, currency := range foreignCurrencies {
+		var number string
+		switch {
+		case strings.HasSuffix(cleaned, currency.Marker):
+			number = strings.TrimSuffix(cleaned, currency.Marker)
+		case strings.HasPrefix(cleaned, currency.Marker):
+			number = strings.TrimPrefix(cleaned, currency.Marker)
+		default:
+			continue
+		}
 
-	if err != nil {
-		log.Printf("Error getting repaid count: %v", err)
-		m.SendMessage(chatID, fmt.Sprintf("❌ Ошибка при формировании статистики: %v", err))
-		m.ShowMainMenu(chatID)
-		return
+		amount, err := parseAmount(number)
+		if err != nil {
+			amount = 0
+		}
+		return amount, currency.Code, true
 	}
-
-	// Format stats message
-	stats := fmt.Sprintf(
-		"📈 Статистика займов:\n\n"+
-			"🔢 Всего займов: %d\n"+
-			"💰 Всего выдано: %d ₸\n"+
-			"✅ Возвращено займов: %d\n"+
-			"⏳ Ожидают возврата: %d\n\n"+
-			"〰️〰️〰️〰️〰️〰️〰️〰️〰️〰️",
-		totalLoans,
-		totalLent,
-		totalRepaid,
-		totalLoans-totalRepaid,
-	)
-
-	// Send stats
-	m.SendMessage(chatID, stats)
-	m.ShowMainMenu(chatID)
+	return 0, "", false
 }
 
-// ShowLoanManagementMenu displays options for managing loans
-func (m *BotManager) ShowLoanManagementMenu(chatID int64) {
-	menuButtons := tgbotapi.NewInlineKeyboardMarkup(
-		tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData("✏️ Редактировать займ", SubMenuEdit),
-			tgbotapi.NewInlineKeyboardButtonData("🗑️ Удалить займ", SubMenuDelete),
-		),
-		tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData("💵 Частичный возврат", SubMenuPartial),
-			tgbotapi.NewInlineKeyboardButtonData("📋 История платежей", SubMenuRepayments),
-		),
-		tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData("🔙 Назад", "back_to_main"),
-		),
-	)
-
-	msg := tgbotapi.NewMessage(chatID, "✏️ Управление займами\nВыберите действие:")
-	msg.ReplyMarkup = menuButtons
-	_, err := m.bot.Send(msg)
+// parseRate parses an exchange rate typed as "470.5" or "470,5"
+func parseRate(text string) (float64, error) {
+	rate, err := strconv.ParseFloat(strings.ReplaceAll(strings.TrimSpace(text), ",", "."), 64)
 	if err != nil {
-		log.Printf("Error showing loan management menu: %v", err)
+		return 0, err
 	}
+	if rate <= 0 || math.IsInf(rate, 0) {
+		return 0, errors.New("rate must be positive")
+	}
+	return rate, nil
 }
 
-// ShowSearchMenu displays search options
-func (m *BotManager) ShowSearchMenu(chatID int64) {
-	menuButtons := tgbotapi.NewInlineKeyboardMarkup(
-		tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData("👤 Поиск по имени", SearchByName),
-			tgbotapi.NewInlineKeyboardButtonData("📊 По статусу", SearchByStatus),
-		),
-		tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData("📋 Все займы", SearchAll),
-			tgbotapi.NewInlineKeyboardButtonData("🔙 Назад", "back_to_main"),
-		),
-	)
+// formatRate writes an exchange rate without trailing zeros, e.g. 470.5
+func formatRate(rate float64) string {
+	return strconv.FormatFloat(rate, 'f', -1, 64)
+}
 
-	msg := tgbotapi.NewMessage(chatID, "🔍 Поиск займов\nВыберите критерий поиска:")
-	msg.ReplyMarkup = menuButtons
-	_, err := m.bot.Send(msg)
-	if err != nil {
-		log.Printf("Error showing search menu: %v", err)
+// formatForeignMoney formats an amount in a foreign currency with cents when it has
+// them, e.g. 1 250 USD or 78,75 USD
+func formatForeignMoney(amount float64, currency string, format MoneyFormat) string {
+	cents := int64(math.Round(amount * 100))
+	number := formatAmount(cents/100, format.GroupSeparator)
+	if rest := cents % 100; rest != 0 {
+		decimal := format.DecimalSeparator
+		if decimal == "" {
+			decimal = ","
+			if format.GroupSeparator == "," {
+				decimal = "."
+			}
+		}
+		if rest < 0 {
+			rest = -rest
+		}
+		number += fmt.Sprintf("%s%02d", decimal, rest)
 	}
+	return number + " " + currency
 }
 
-// HandleCallbackQuery processes button presses
-func (m *BotManager) HandleCallbackQuery(callback *tgbotapi.CallbackQuery) {
-	// Acknowledge the button press
-	callback_config := tgbotapi.NewCallback(callback.ID, "")
-	m.bot.Send(callback_config)
-
-	// Remove the keyboard to prevent multiple clicks
-	editMsg := tgbotapi.NewEditMessageReplyMarkup(
-		callback.Message.Chat.ID,
-		callback.Message.MessageID,
-		tgbotapi.InlineKeyboardMarkup{
-			InlineKeyboard: [][]tgbotapi.InlineKeyboardButton{},
-		},
+// LoanMoney formats a tenge amount of a loan. For a loan given in a foreign currency it
+// shows the amount in that currency at the lending-day rate together with the tenge
+// equivalent, e.g. 100 USD ≈ 47 050 ₸.
+func (m *BotManager) LoanMoney(chatID int64, loan Loan, amount int64) string {
+	if loan.Currency == "" || loan.FxRate <= 0 {
+		return m.Money(chatID, amount)
+	}
+
+	format := m.GetMoneyFormat(chatID)
+	return fmt.Sprintf(
+		"%s ≈ %s",
+		formatForeignMoney(float64(amount)/loan.FxRate, loan.Currency, format), formatMoney(amount, format),
 	)
-	m.bot.Send(editMsg)
+}
 
-	// Get the callback data
-	data := callback.Data
-	chatID := callback.Message.Chat.ID
+// StartAddLoanFlow begins the process of recording a new loan
+func (m *BotManager) StartAddLoanFlow(chatID int64) {
+	// First clear any existing state
+	m.ClearState(chatID)
 
-	// Log the callback data for debugging
-	log.Printf("Received callback: %s", data)
+	// Send the initial prompt
+	m.SendMessage(chatID, "📝 Давайте запишем новый займ.\n👤 Введите имя заемщика:")
 
-	// Switch based on the callback data
-	switch {
-	case data == MenuAddLoan:
-		m.StartAddLoanFlow(chatID)
-	case data == MenuRepay:
-		m.StartRepayLoanFlow(chatID)
-	case data == MenuBalance:
-		m.ShowBalance(chatID)
-	case data == MenuStats:
-		m.ShowStats(chatID)
-	case data == MenuManage:
-		m.ShowLoanManagementMenu(chatID)
-	case data == MenuSearch:
-		m.ShowSearchMenu(chatID)
-	case data == "back_to_manage":
-		m.ShowLoanManagementMenu(chatID)
-	case data == "back_to_search":
-		m.ShowSearchMenu(chatID)
-	case data == "back_to_main":
+	// Then set the new state
+	m.SetState(chatID, OpAddLoan, 0)
+
+	log.Printf("Started add loan flow for user %d", chatID)
+}
+
+// StartRepayLoanFlow begins the process of marking a loan as repaid
+func (m *BotManager) StartRepayLoanFlow(chatID int64) {
+	// First clear any existing state
+	m.ClearState(chatID)
+
+	// Get active loans
+	activeLoans, err := m.GetActiveLoansForUser(chatID)
+	if err != nil {
+		log.Printf("Error getting active loans: %v", err)
+		m.SendMessage(chatID, "❌ Не удалось получить список активных займов.")
 		m.ShowMainMenu(chatID)
-	case data == SubMenuEdit:
-		m.StartEditLoanFlow(chatID)
-	case data == SubMenuDelete:
-		m.StartDeleteLoanFlow(chatID)
-	case data == SubMenuPartial:
-		m.StartPartialRepaymentFlow(chatID)
-	case data == SubMenuRepayments:
-		m.ShowRepaymentHistory(chatID)
-	case data == SearchByName:
-		m.StartSearchByNameFlow(chatID)
-	case data == SearchByStatus:
-		m.StartSearchByStatusFlow(chatID)
-	case data == SearchAll:
-		m.ShowAllLoans(chatID)
-	case data == "status_active":
-		m.ShowLoansByStatus(chatID, false)
-	case data == "status_repaid":
-		m.ShowLoansByStatus(chatID, true)
-	case strings.HasPrefix(data, "edit_"):
-		// Extract loan ID from callback data (format: "edit_123")
-		loanIDStr := strings.TrimPrefix(data, "edit_")
-		loanID, err := strconv.Atoi(loanIDStr)
-		if err != nil {
-			log.Printf("Error converting loan ID: %v", err)
-			m.SendMessage(chatID, "❌ Произошла ошибка при выборе займа.")
-			m.ShowMainMenu(chatID)
-			return
-		}
+		return
+	}
 
-		// Get loan details
-		loan, err := m.GetLoanByID(chatID, loanID)
-		if err != nil {
-			log.Printf("Error getting loan details: %v", err)
-			m.SendMessage(chatID, "❌ Не удалось получить информацию о займе.")
-			m.ShowMainMenu(chatID)
-			return
-		}
+	if len(activeLoans) == 0 {
+		m.SendMessage(chatID, "У вас нет активных займов для возврата.")
+		m.ShowMainMenu(chatID)
+		return
+	}
 
-		// Display edit options
-		keyboard := tgbotapi.NewInlineKeyboardMarkup(
-			tgbotapi.NewInlineKeyboardRow(
-				tgbotapi.NewInlineKeyboardButtonData("👤 Изменить имя", fmt.Sprintf("name_%d", loanID)),
-			),
-			tgbotapi.NewInlineKeyboardRow(
-				tgbotapi.NewInlineKeyboardButtonData("💰 Изменить сумму", fmt.Sprintf("amount_%d", loanID)),
-			),
-			tgbotapi.NewInlineKeyboardRow(
-				tgbotapi.NewInlineKeyboardButtonData("📝 Изменить цель", fmt.Sprintf("purpose_%d", loanID)),
-			),
-			tgbotapi.NewInlineKeyboardRow(
-				tgbotapi.NewInlineKeyboardButtonData("🔙 Назад", "back_to_manage"),
-			),
+	// Display loans with inline keyboard for selection
+	var keyboard [][]tgbotapi.InlineKeyboardButton
+	for _, loan := range activeLoans {
+		button := tgbotapi.NewInlineKeyboardButtonData(
+			fmt.Sprintf("ID %d: %s - %s", loan.ID, loan.Borrower, m.Money(chatID, loan.Amount)),
+			fmt.Sprintf("repay_%d", loan.ID),
 		)
+		keyboard = append(keyboard, tgbotapi.NewInlineKeyboardRow(button))
+	}
 
-		msg := tgbotapi.NewMessage(chatID, fmt.Sprintf(
-			"🔍 Займ #%d\n👤 Заемщик: %s\n💰 Сумма: %d ₸\n📝 Цель: %s\n\nВыберите, что хотите изменить:",
-			loan.ID, loan.Borrower, loan.Amount, loan.Purpose,
-		))
-		msg.ReplyMarkup = keyboard
-		m.bot.Send(msg)
+	// Add back button
+	keyboard = append(keyboard, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("🔙 Назад", "back_to_main"),
+	))
 
-	case strings.HasPrefix(data, "name_"):
-		// Extract loan ID from callback data (format: "name_123")
-		loanIDStr := strings.TrimPrefix(data, "name_")
-		log.Printf("Editing name: original callback data=%s, extracted ID=%s", data, loanIDStr)
+	msg := tgbotapi.NewMessage(chatID, "Выберите займ для отметки как возвращенный:")
+	msg.ReplyMarkup = tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+	m.Send(msg)
 
-		// Validate the loan ID
-		loanID, err := strconv.Atoi(loanIDStr)
-		if err != nil {
-			log.Printf("Error converting loan ID: %v", err)
-			m.SendMessage(chatID, "❌ Произошла ошибка при выборе займа.")
-			m.ShowMainMenu(chatID)
-			return
-		}
+	// Set state for next step
+	m.SetState(chatID, OpRepayLoan, 0)
+}
 
-		// Verify the loan exists
-		_, err = m.GetLoanByID(chatID, loanID)
-		if err != nil {
-			log.Printf("Error verifying loan: %v", err)
-			m.SendMessage(chatID, "❌ Займ не найден.")
-			m.ShowMainMenu(chatID)
+// HandleAddLoanStep processes each step of the add loan flow
+func (m *BotManager) HandleAddLoanStep(chatID int64, text string) {
+	state := m.GetState(chatID)
+
+	log.Printf("Handling add loan step %d for user %d with input: %s", state.Step, chatID, text)
+
+	switch state.Step {
+	case 0: // Getting borrower name
+		if text == "" {
+			m.SendMessage(chatID, "❌ Имя заемщика не может быть пустым. Пожалуйста, введите корректное имя:")
 			return
 		}
 
-		// Save the pure numeric loan ID and set the operation state
-		m.SaveStateData(chatID, "loan_id", loanIDStr) // Store just the numeric ID
-		m.SaveStateData(chatID, "edit_field", "name")
-		m.SetState(chatID, OpEditLoan, 1)
-
-		// Prompt for new name
-		m.SendMessage(chatID, "Введите новое имя заемщика:")
+		// Save borrower name and move to next step
+		m.SaveStateData(chatID, "borrower_name", text)
+		m.SetState(chatID, OpAddLoan, 1)
+		m.SendAmountPrompt(chatID, "💰 Введите сумму займа (в другой валюте — например 100 USD):", m.FrequentLoanAmounts(chatID))
 
-	case strings.HasPrefix(data, "amount_"):
-		// Extract loan ID from callback data (format: "amount_123")
-		loanIDStr := strings.TrimPrefix(data, "amount_")
-		log.Printf("Editing amount: original callback data=%s, extracted ID=%s", data, loanIDStr)
+	case 1: // Getting loan amount
+		// A loan in a foreign currency needs the rate before it is converted to tenge
+		if foreignAmount, currency, ok := parseForeignAmount(text); ok {
+			if foreignAmount <= 0 {
+				m.SendMessage(chatID, "❌ Некорректная сумма. Введите целое положительное число, например 100 USD:")
+				return
+			}
 
-		// Validate the loan ID
-		loanID, err := strconv.Atoi(loanIDStr)
-		if err != nil {
-			log.Printf("Error converting loan ID: %v", err)
-			m.SendMessage(chatID, "❌ Произошла ошибка при выборе займа.")
-			m.ShowMainMenu(chatID)
+			m.SaveStateData(chatID, "foreign_amount", strconv.FormatInt(foreignAmount, 10))
+			m.SaveStateData(chatID, "currency", currency)
+			m.SetState(chatID, OpAddLoan, 5)
+			m.SendMessage(chatID, fmt.Sprintf("💱 Введите курс на сегодня: сколько тенге стоит 1 %s (например 470,5):", currency))
 			return
 		}
 
-		// Verify the loan exists
-		_, err = m.GetLoanByID(chatID, loanID)
-		if err != nil {
-			log.Printf("Error verifying loan: %v", err)
-			m.SendMessage(chatID, "❌ Займ не найден.")
-			m.ShowMainMenu(chatID)
+		amount, err := parseAmount(text)
+		if err != nil || amount <= 0 {
+			m.SendMessage(chatID, "❌ Некорректная сумма. Пожалуйста, введите целое положительное число:")
 			return
 		}
 
-		// Save the pure numeric loan ID and set the operation state
-		m.SaveStateData(chatID, "loan_id", loanIDStr) // Store just the numeric ID
-		m.SaveStateData(chatID, "edit_field", "amount")
-		m.SetState(chatID, OpEditLoan, 1)
-
-		// Prompt for new amount
-		m.SendMessage(chatID, "Введите новую сумму займа (целое число):")
-
-	case strings.HasPrefix(data, "purpose_"):
-		// Extract loan ID from callback data (format: "purpose_123")
-		loanIDStr := strings.TrimPrefix(data, "purpose_")
-		log.Printf("Editing purpose: original callback data=%s, extracted ID=%s", data, loanIDStr)
+		// Save amount and move to next step
+		m.SaveStateData(chatID, "amount", fmt.Sprintf("%d", amount))
+		m.SaveStateData(chatID, "currency", "")
+		m.AskLoanPurpose(chatID)
 
-		// Validate the loan ID
-		loanID, err := strconv.Atoi(loanIDStr)
-		if err != nil {
-			log.Printf("Error converting loan ID: %v", err)
-			m.SendMessage(chatID, "❌ Произошла ошибка при выборе займа.")
-			m.ShowMainMenu(chatID)
+	case 2: // Getting loan purpose
+		if text == "" {
+			m.SendMessage(chatID, "❌ Цель займа не может быть пустой. Пожалуйста, введите корректную цель:")
 			return
 		}
-
-		// Verify the loan exists
-		_, err = m.GetLoanByID(chatID, loanID)
-		if err != nil {
-			log.Printf("Error verifying loan: %v", err)
-			m.SendMessage(chatID, "❌ Займ не найден.")
-			m.ShowMainMenu(chatID)
+		if noteTooLong(text) {
+			m.SendMessage(chatID, noteTooLongMessage(text))
 			return
 		}
 
-		// Save the pure numeric loan ID and set the operation state
-		m.SaveStateData(chatID, "loan_id", loanIDStr) // Store just the numeric ID
-		m.SaveStateData(chatID, "edit_field", "purpose")
-		m.SetState(chatID, OpEditLoan, 1)
+		// Save purpose and move to next step
+		m.SaveStateData(chatID, "purpose", text)
+		m.SetState(chatID, OpAddLoan, 3)
+		m.SendMessage(chatID, "📅 Введите срок возврата (ДД.ММ.ГГГГ) или \"-\", если срока нет:")
 
-		// Prompt for new purpose
-		m.SendMessage(chatID, "Введите новую цель займа:")
+	case 3: // Getting optional due date
+		dueDate := ""
+		if text != "-" {
+			date, err := parseDate(text)
+			if err != nil {
+				m.SendMessage(chatID, "❌ Некорректная дата. Введите дату в формате ДД.ММ.ГГГГ или \"-\":")
+				return
+			}
 
-	case strings.HasPrefix(data, "delete_"):
-		// Extract loan ID from callback data (format: "delete_123")
-		loanIDStr := strings.TrimPrefix(data, "delete_")
-		loanID, err := strconv.Atoi(loanIDStr)
-		if err != nil {
-			log.Printf("Error converting loan ID: %v", err)
-			m.SendMessage(chatID, "❌ Произошла ошибка при выборе займа.")
-			m.ShowMainMenu(chatID)
-			return
+			today := m.UserToday(chatID)
+			if date.Format(dateLayout) < today {
+				m.SendMessage(chatID, "❌ Срок возврата не может быть в прошлом. Введите другую дату:")
+				return
+			}
+			dueDate = date.Format(dateLayout)
 		}
 
-		// Get loan details
-		loan, err := m.GetLoanByID(chatID, loanID)
-		if err != nil {
-			log.Printf("Error getting loan details: %v", err)
-			m.SendMessage(chatID, "❌ Не удалось получить информацию о займе.")
-			m.ShowMainMenu(chatID)
+		// Save due date and move to next step
+		m.SaveStateData(chatID, "due_date", dueDate)
+		m.SetState(chatID, OpAddLoan, 4)
+		m.SendMessage(chatID, "📍 Где вы дали деньги? Напишите место, отправьте геопозицию через 📎 или \"-\", чтобы пропустить:")
+
+	case 4: // Getting optional location as text
+		if text == "" {
+			m.SendMessage(chatID, "❌ Напишите место, отправьте геопозицию или \"-\":")
 			return
 		}
 
-		// Display confirmation
-		keyboard := tgbotapi.NewInlineKeyboardMarkup(
-			tgbotapi.NewInlineKeyboardRow(
-				tgbotapi.NewInlineKeyboardButtonData("✅ Да, удалить", fmt.Sprintf("confirm_delete_%d", loanID)),
-				tgbotapi.NewInlineKeyboardButtonData("❌ Нет, отмена", "back_to_manage"),
-			),
-		)
-
-		msg := tgbotapi.NewMessage(chatID, fmt.Sprintf(
-			"⚠️ ВНИМАНИЕ! Вы собираетесь удалить займ:\n\n🆔 Займ #%d\n👤 Заемщик: %s\n💰 Сумма: %d ₸\n📝 Цель: %s\n\nЭто действие нельзя будет отменить. Вы уверены?",
-			loan.ID, loan.Borrower, loan.Amount, loan.Purpose,
-		))
-		msg.ReplyMarkup = keyboard
-		m.bot.Send(msg)
+		location := text
+		if text == "-" {
+			location = ""
+		}
+		m.CreateLoan(chatID, location, nil)
 
-	case strings.HasPrefix(data, "confirm_delete_"):
-		// Extract loan ID from callback data (format: "confirm_delete_123")
-		loanIDStr := strings.TrimPrefix(data, "confirm_delete_")
-		loanID, err := strconv.Atoi(loanIDStr)
+	case 5: // Getting the exchange rate of a loan in a foreign currency
+		rate, err := parseRate(text)
 		if err != nil {
-			log.Printf("Error converting loan ID: %v", err)
-			m.SendMessage(chatID, "❌ Произошла ошибка при удалении займа.")
-			m.ShowMainMenu(chatID)
+			m.SendMessage(chatID, "❌ Некорректный курс. Введите положительное число, например 470,5:")
 			return
 		}
 
-		// Delete the loan
-		err = m.DeleteLoan(chatID, loanID)
-		if err != nil {
-			log.Printf("Error deleting loan: %v", err)
-			m.SendMessage(chatID, "❌ Произошла ошибка при удалении займа.")
-		} else {
-			m.SendMessage(chatID, "✅ Займ успешно удален!")
+		foreignAmount, _ := strconv.ParseInt(state.Data["foreign_amount"], 10, 64)
+		amount := int64(math.Round(float64(foreignAmount) * rate))
+		if amount <= 0 {
+			m.SendMessage(chatID, "❌ Сумма в тенге получается нулевой. Проверьте курс:")
+			return
 		}
 
-		m.ShowMainMenu(chatID)
+		m.SaveStateData(chatID, "amount", strconv.FormatInt(amount, 10))
+		m.SaveStateData(chatID, "fx_rate", formatRate(rate))
+		m.AskLoanPurpose(chatID)
+	}
+}
 
-	case strings.HasPrefix(data, "partial_"):
-		// Extract loan ID from callback data (format: "partial_123")
-		loanIDStr := strings.TrimPrefix(data, "partial_")
-		loanID, err := strconv.Atoi(loanIDStr)
-		if err != nil {
-			log.Printf("Error converting loan ID: %v", err)
-			m.SendMessage(chatID, "❌ Произошла ошибка при выборе займа.")
-			m.ShowMainMenu(chatID)
-			return
+// AskLoanPurpose moves the add loan flow on once the amount is known
+func (m *BotManager) AskLoanPurpose(chatID int64) {
+	// A repeated loan already has its borrower and purpose, so it is created right away
+	if repeatOf, _ := m.GetStateData(chatID, "repeat_of"); repeatOf != "" {
+		m.CreateLoan(chatID, "", nil)
+		return
+	}
+
+	m.SetState(chatID, OpAddLoan, 2)
+	m.SendMessage(chatID, "📝 Введите цель займа:")
+}
+
+// nextLoanID reserves count consecutive loan IDs for a user and returns the first one.
+// IDs come from the user's counter in loan_counters, so they are never handed out twice,
+// even after the loan with the highest ID is deleted. The counter of a user who has none
+// yet starts after their highest existing loan ID. It must be called inside the
+// transaction that inserts the loans, so that a failed insert gives the IDs back.
+func nextLoanID(tx *sql.Tx, userID int64, count int) (int, error) {
+	var lastID int
+	err := tx.QueryRow(
+		`INSERT INTO loan_counters (user_id, last_loan_id)
+		VALUES (?1, (SELECT COALESCE(MAX(loan_id), 0) FROM loans WHERE user_id = ?1) + ?2)
+		ON CONFLICT(user_id) DO UPDATE SET last_loan_id = MAX(
+			last_loan_id, (SELECT COALESCE(MAX(loan_id), 0) FROM loans WHERE user_id = ?1)
+		) + ?2
+		RETURNING last_loan_id`,
+		userID, count,
+	).Scan(&lastID)
+	if err != nil {
+		return 0, err
+	}
+	return lastID - count + 1, nil
+}
+
+// checkLoanLimit returns errLoanLimit when adding more loans would take the user
+// over MAX_LOANS_PER_USER. Active and repaid loans both count. It must run in the
+// transaction that adds the loans, so that concurrent adds can't both pass it.
+func (m *BotManager) checkLoanLimit(tx *sql.Tx, userID int64, adding int) error {
+	if m.config.MaxLoansPerUser <= 0 {
+		return nil
+	}
+
+	var loanCount int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM loans WHERE user_id = ? AND deleted = 0", userID).Scan(&loanCount); err != nil {
+		return err
+	}
+	if loanCount+adding > m.config.MaxLoansPerUser {
+		return errLoanLimit
+	}
+	return nil
+}
+
+// insertLoan checks the loan limit, reserves a loan ID and runs insert with it in one
+// transaction, which is retried as a whole while the database is locked. It returns
+// errLoanLimit when the user has no room for another loan.
+func (m *BotManager) insertLoan(chatID int64, insert func(tx *sql.Tx, loanID int) error) (int, error) {
+	var loanID int
+	err := m.db.Transact(func(tx *sql.Tx) error {
+		if err := m.checkLoanLimit(tx, chatID, 1); err != nil {
+			return err
 		}
 
-		// Get loan details
-		loan, err := m.GetLoanByID(chatID, loanID)
+		var err error
+		loanID, err = nextLoanID(tx, chatID, 1)
 		if err != nil {
-			log.Printf("Error getting loan details: %v", err)
-			m.SendMessage(chatID, "❌ Не удалось получить информацию о займе.")
-			m.ShowMainMenu(chatID)
-			return
+			return err
 		}
+		return insert(tx, loanID)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return loanID, nil
+}
 
-		// Calculate remaining amount
-		repaidAmount := m.GetTotalRepaidAmount(chatID, loanID)
-		remainingAmount := loan.Amount - repaidAmount
+// CreateLoan saves the loan collected by the add loan flow, together with the
+// place it was lent at, and shows the summary
+func (m *BotManager) CreateLoan(chatID int64, location string, coordinates *tgbotapi.Location) {
+	state := m.GetState(chatID)
+	amount, _ := strconv.ParseInt(state.Data["amount"], 10, 64)
+	dueDate := state.Data["due_date"]
+
+	// The rate is only kept for a loan given in a foreign currency
+	currency := state.Data["currency"]
+	var fxRate sql.NullFloat64
+	if currency != "" {
+		rate, _ := strconv.ParseFloat(state.Data["fx_rate"], 64)
+		fxRate = sql.NullFloat64{Float64: rate, Valid: true}
+	}
 
-		// Save the loan ID and set the operation state
-		m.SaveStateData(chatID, "loan_id", loanIDStr)
-		m.SaveStateData(chatID, "remaining_amount", fmt.Sprintf("%d", remainingAmount))
-		m.SetState(chatID, OpPartialRepay, 1)
+	var latitude, longitude sql.NullFloat64
+	if coordinates != nil {
+		latitude = sql.NullFloat64{Float64: coordinates.Latitude, Valid: true}
+		longitude = sql.NullFloat64{Float64: coordinates.Longitude, Valid: true}
+	}
 
-		// Prompt for repayment amount
+	// Insert the new loan into the database
+	query := `INSERT INTO loans (user_id, loan_id, borrower_name, amount, purpose, repaid, created_at, due_date, location, latitude, longitude, currency, fx_rate) 
+			  VALUES (?, ?, ?, ?, ?, 0, CURRENT_TIMESTAMP, NULLIF(?, ''), NULLIF(?, ''), ?, ?, NULLIF(?, ''), ?)`
+	newLoanID, err := m.insertLoan(chatID, func(tx *sql.Tx, loanID int) error {
+		_, err := tx.Exec(
+			query,
+			chatID,
+			loanID,
+			state.Data["borrower_name"],
+			state.Data["amount"],
+			state.Data["purpose"],
+			dueDate,
+			location,
+			latitude,
+			longitude,
+			currency,
+			fxRate,
+		)
+		return err
+	})
+
+	if errors.Is(err, errLoanLimit) {
 		m.SendMessage(chatID, fmt.Sprintf(
-			"Займ: #%d от %s\nОсталось выплатить: %d ₸\n\nВведите сумму частичного возврата (целое число):",
-			loan.ID, loan.Borrower, remainingAmount,
+			"❌ Достигнут лимит займов (%d). Закройте или удалите старые.",
+			m.config.MaxLoansPerUser,
 		))
+		m.ClearState(chatID)
+		m.ShowMainMenu(chatID)
+		return
+	}
+	if err != nil {
+		log.Printf("Error inserting loan: %v", err)
+		m.SendMessage(chatID, dbErrorMessage(err, "❌ Не удалось зарегистрировать займ. Попробуйте позже."))
+		return
+	}
 
-	case strings.HasPrefix(data, "history_"):
-		// Extract loan ID from callback data (format: "history_123")
-		loanIDStr := strings.TrimPrefix(data, "history_")
-		loanID, err := strconv.Atoi(loanIDStr)
-		if err != nil {
-			log.Printf("Error converting loan ID: %v", err)
-			m.SendMessage(chatID, "❌ Произошла ошибка при просмотре истории.")
-			m.ShowMainMenu(chatID)
+	loan := Loan{Location: location, Latitude: latitude, Longitude: longitude, Currency: currency, FxRate: fxRate.Float64}
+
+	createdNote := fmt.Sprintf("Займ создан на сумму %s", m.LoanMoney(chatID, loan, amount))
+	if repeatOf := state.Data["repeat_of"]; repeatOf != "" {
+		createdNote += fmt.Sprintf(" (повтор займа #%s)", repeatOf)
+	}
+	m.LogLoanEvent(chatID, newLoanID, EventCreated, createdNote)
+
+	// Send success message
+	successMsg := markdownf(
+		"✅ Займ успешно зарегистрирован!\n\n"+
+			"👤 Заемщик: %s\n"+
+			"💰 Сумма: %s\n"+
+			"🎯 Цель: %s\n"+
+			"📅 Срок возврата: %s\n"+
+			"📍 Место: %s\n"+
+			"🆔 ID займа: %d\n\n"+
+			"〰️〰️〰️〰️〰️〰️〰️〰️〰️〰️",
+		state.Data["borrower_name"],
+		m.LoanMoney(chatID, loan, amount),
+		userMarkdown(state.Data["purpose"]),
+		dueDateLabel(dueDate),
+		locationLabel(loan),
+		newLoanID,
+	)
+
+	// Offer to fix a typo right away, without going through the management menu
+	msg := tgbotapi.NewMessage(chatID, successMsg)
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("✏️ Изменить", fmt.Sprintf("edit_%d", newLoanID)),
+		),
+	)
+	m.SendMarkdownMessage(msg)
+
+	// Clear state and show main menu
+	m.ClearState(chatID)
+	m.ShowMainMenu(chatID)
+}
+
+// GroupShare is one borrower's part of a group loan
+type GroupShare struct {
+	Borrower string
+	Amount   int64
+}
+
+// errGroupLoanLimit is returned by CreateGroupLoan when the shares don't fit under MAX_LOANS_PER_USER
+var errGroupLoanLimit = errors.New("group loan exceeds the loan limit")
+
+// parseGroupShares parses one "Имя сумма" line per borrower, e.g. "Айгуль 5 000".
+// The amount starts at the first digit of the line.
+func parseGroupShares(text string) ([]GroupShare, error) {
+	var shares []GroupShare
+	for i, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		digit := strings.IndexFunc(line, unicode.IsDigit)
+		if digit <= 0 {
+			return nil, fmt.Errorf("строка %d: укажите имя и сумму", i+1)
+		}
+
+		name := strings.TrimSpace(strings.TrimRight(line[:digit], " :=-—"))
+		amount, err := parseAmount(line[digit:])
+		if name == "" || err != nil || amount <= 0 {
+			return nil, fmt.Errorf("строка %d: укажите имя и сумму", i+1)
+		}
+		for _, share := range shares {
+			if sameBorrower(share.Borrower, name) {
+				return nil, fmt.Errorf("%s указан дважды", name)
+			}
+		}
+
+		shares = append(shares, GroupShare{Borrower: name, Amount: amount})
+	}
+
+	if len(shares) < 2 {
+		return nil, errors.New("в групповом займе должно быть хотя бы два заемщика")
+	}
+	return shares, nil
+}
+
+// StartGroupLoanFlow begins recording one loan split between several borrowers
+func (m *BotManager) StartGroupLoanFlow(chatID int64) {
+	// First clear any existing state
+	m.ClearState(chatID)
+	m.SetState(chatID, OpGroupLoan, 0)
+
+	m.SendAmountPrompt(chatID, "👥 Групповой займ: сумма делится между несколькими заемщиками, каждый возвращает свою часть.\n💰 Введите общую сумму займа:", m.FrequentLoanAmounts(chatID))
+}
+
+// HandleGroupLoanStep processes each step of the group loan flow
+func (m *BotManager) HandleGroupLoanStep(chatID int64, text string) {
+	state := m.GetState(chatID)
+
+	switch state.Step {
+	case 0: // Total amount
+		amount, err := parseAmount(text)
+		if err != nil || amount <= 0 {
+			m.SendMessage(chatID, "❌ Некорректная сумма. Пожалуйста, введите целое положительное число:")
 			return
 		}
 
-		// Show repayment history for this loan
-		m.ShowLoanRepaymentHistory(chatID, loanID)
+		m.SaveStateData(chatID, "amount", strconv.FormatInt(amount, 10))
+		m.SetState(chatID, OpGroupLoan, 1)
+		m.SendMessage(chatID, "📝 Введите цель займа:")
 
-	case strings.HasPrefix(data, "repay_"):
-		// Extract loan ID from callback data (format: "repay_123")
-		loanIDStr := strings.TrimPrefix(data, "repay_")
-		loanID, err := strconv.Atoi(loanIDStr)
+	case 1: // Purpose
+		if text == "" {
+			m.SendMessage(chatID, "❌ Цель займа не может быть пустой. Пожалуйста, введите корректную цель:")
+			return
+		}
+		if noteTooLong(text) {
+			m.SendMessage(chatID, noteTooLongMessage(text))
+			return
+		}
+
+		m.SaveStateData(chatID, "purpose", text)
+		m.SetState(chatID, OpGroupLoan, 2)
+		m.SendMessage(chatID, "👥 Введите заемщиков и их доли, каждого с новой строки, например:\n\nАйгуль 5000\nБекзат 3000")
+
+	case 2: // Shares
+		total, _ := strconv.ParseInt(state.Data["amount"], 10, 64)
+		shares, err := parseGroupShares(text)
 		if err != nil {
-			log.Printf("Error converting loan ID: %v", err)
-			m.SendMessage(chatID, "❌ Произошла ошибка при выборе займа.")
-			m.ShowMainMenu(chatID)
+			m.SendMessage(chatID, fmt.Sprintf("❌ %v. Введите доли заново:", err))
 			return
 		}
 
-		// Get loan details
-		loan, err := m.GetLoanByID(chatID, loanID)
+		var sum int64
+		for _, share := range shares {
+			sum += share.Amount
+		}
+		if sum != total {
+			m.SendMessage(chatID, fmt.Sprintf(
+				"❌ Сумма долей (%s) не совпадает с общей суммой займа (%s). Введите доли заново:",
+				m.Money(chatID, sum), m.Money(chatID, total),
+			))
+			return
+		}
+
+		groupID, err := m.CreateGroupLoan(chatID, state.Data["purpose"], shares)
+		if errors.Is(err, errGroupLoanLimit) {
+			m.SendMessage(chatID, fmt.Sprintf(
+				"❌ Достигнут лимит займов (%d). Закройте или удалите старые.",
+				m.config.MaxLoansPerUser,
+			))
+			m.ClearState(chatID)
+			m.ShowMainMenu(chatID)
+			return
+		}
 		if err != nil {
-			log.Printf("Error getting loan details: %v", err)
-			m.SendMessage(chatID, "❌ Не удалось получить информацию о займе.")
+			log.Printf("Error creating group loan: %v", err)
+			m.SendMessage(chatID, "❌ Не удалось зарегистрировать групповой займ. Ничего не было добавлено.")
+			m.ClearState(chatID)
 			m.ShowMainMenu(chatID)
 			return
 		}
 
-		// Display confirmation
-		keyboard := tgbotapi.NewInlineKeyboardMarkup(
-			tgbotapi.NewInlineKeyboardRow(
-				tgbotapi.NewInlineKeyboardButtonData("✅ Да, подтверждаю", fmt.Sprintf("confirm_repay_%d", loanID)),
-				tgbotapi.NewInlineKeyboardButtonData("❌ Нет, отмена", "back_to_main"),
-			),
-		)
+		// Show the created loans
+		var response strings.Builder
+		response.WriteString(fmt.Sprintf("✅ Групповой займ #%d на %s зарегистрирован!\n\n", groupID, m.Money(chatID, total)))
+		for i, share := range shares {
+			response.WriteString(fmt.Sprintf("🆔 Займ #%d 👤 %s — %s\n", groupID+i, share.Borrower, m.Money(chatID, share.Amount)))
+		}
+		response.WriteString("\nКаждый заемщик возвращает свою часть отдельно.")
+		m.SendMessage(chatID, response.String())
 
-		msg := tgbotapi.NewMessage(chatID, fmt.Sprintf(
-			"Вы собираетесь отметить займ как возвращенный:\n\n🆔 Займ #%d\n👤 Заемщик: %s\n💰 Сумма: %d ₸\n📝 Цель: %s\n\nПодтверждаете?",
-			loan.ID, loan.Borrower, loan.Amount, loan.Purpose,
-		))
-		msg.ReplyMarkup = keyboard
-		m.bot.Send(msg)
+		m.ClearState(chatID)
+		m.ShowMainMenu(chatID)
+	}
+}
 
-	case strings.HasPrefix(data, "confirm_repay_"):
-		// Extract loan ID from callback data (format: "confirm_repay_123")
-		loanIDStr := strings.TrimPrefix(data, "confirm_repay_")
-		loanID, err := strconv.Atoi(loanIDStr)
+// CreateGroupLoan inserts one loan per share in a single transaction. The loans get
+// consecutive IDs and share a group_id equal to the first of them, which is returned.
+func (m *BotManager) CreateGroupLoan(chatID int64, purpose string, shares []GroupShare) (int, error) {
+	var groupID int
+	err := m.db.Transact(func(tx *sql.Tx) error {
+		// Every share counts towards the per-user limit
+		if m.config.MaxLoansPerUser > 0 {
+			var loanCount int
+			if err := tx.QueryRow("SELECT COUNT(*) FROM loans WHERE user_id = ? AND deleted = 0", chatID).Scan(&loanCount); err != nil {
+				return err
+			}
+			if loanCount+len(shares) > m.config.MaxLoansPerUser {
+				return errGroupLoanLimit
+			}
+		}
+
+		var err error
+		groupID, err = nextLoanID(tx, chatID, len(shares))
 		if err != nil {
-			log.Printf("Error converting loan ID: %v", err)
-			m.SendMessage(chatID, "❌ Произошла ошибка при подтверждении возврата.")
-			m.ShowMainMenu(chatID)
+			return err
+		}
+
+		for i, share := range shares {
+			_, err := tx.Exec(
+				`INSERT INTO loans (user_id, loan_id, borrower_name, amount, purpose, repaid, created_at, group_id)
+				VALUES (?, ?, ?, ?, ?, 0, CURRENT_TIMESTAMP, ?)`,
+				chatID, groupID+i, share.Borrower, share.Amount, purpose, groupID,
+			)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for i, share := range shares {
+		m.LogLoanEvent(chatID, groupID+i, EventCreated, fmt.Sprintf("Доля группового займа #%d на сумму %s", groupID, m.Money(chatID, share.Amount)))
+	}
+
+	return groupID, nil
+}
+
+// errLoanLimit is returned when a new loan would exceed MAX_LOANS_PER_USER
+var errLoanLimit = errors.New("loan limit reached")
+
+// StartInstallmentLoanFlow begins recording a loan that is given out in parts over time
+func (m *BotManager) StartInstallmentLoanFlow(chatID int64) {
+	// First clear any existing state
+	m.ClearState(chatID)
+	m.SetState(chatID, OpInstallment, 0)
+
+	m.SendMessage(chatID, "💸 Займ частями: сумма начинается с нуля и растет с каждой выдачей.\n👤 Введите имя заемщика:")
+}
+
+// HandleInstallmentLoanStep processes each step of the installment loan flow
+func (m *BotManager) HandleInstallmentLoanStep(chatID int64, text string) {
+	state := m.GetState(chatID)
+
+	switch state.Step {
+	case 0: // Borrower name
+		if text == "" {
+			m.SendMessage(chatID, "❌ Имя заемщика не может быть пустым. Пожалуйста, введите корректное имя:")
 			return
 		}
 
-		// Get loan details
-		loan, err := m.GetLoanByID(chatID, loanID)
-		if err != nil {
-			log.Printf("Error getting loan details: %v", err)
-			m.SendMessage(chatID, "❌ Не удалось получить информацию о займе.")
-			m.ShowMainMenu(chatID)
+		m.SaveStateData(chatID, "borrower_name", text)
+		m.SetState(chatID, OpInstallment, 1)
+		m.SendMessage(chatID, "📝 Введите цель займа:")
+
+	case 1: // Purpose
+		if text == "" {
+			m.SendMessage(chatID, "❌ Цель займа не может быть пустой. Пожалуйста, введите корректную цель:")
+			return
+		}
+		if noteTooLong(text) {
+			m.SendMessage(chatID, noteTooLongMessage(text))
 			return
 		}
 
-		// Mark loan as repaid
-		_, err = m.db.Exec(
-			"UPDATE loans SET repaid = 1 WHERE user_id = ? AND loan_id = ?",
-			chatID, loanID,
-		)
+		borrower := state.Data["borrower_name"]
+		loanID, err := m.CreateInstallmentLoan(chatID, borrower, text)
+		if errors.Is(err, errLoanLimit) {
+			m.SendMessage(chatID, fmt.Sprintf(
+				"❌ Достигнут лимит займов (%d). Закройте или удалите старые.",
+				m.config.MaxLoansPerUser,
+			))
+			m.ClearState(chatID)
+			m.ShowMainMenu(chatID)
+			return
+		}
 		if err != nil {
-			log.Printf("Error marking loan as repaid: %v", err)
-			m.SendMessage(chatID, "❌ Произошла ошибка при отметке займа как возвращенного.")
+			log.Printf("Error creating installment loan: %v", err)
+			m.SendMessage(chatID, "❌ Не удалось зарегистрировать займ.")
+			m.ClearState(chatID)
 			m.ShowMainMenu(chatID)
 			return
 		}
 
-		// Insert into repayments table
-		date := time.Now().Format("2006-01-02")
-		_, err = m.db.Exec(
-			"INSERT INTO repayments (user_id, loan_id, amount, repayment_date, note) VALUES (?, ?, ?, ?, 'Полный возврат')",
-			chatID, loanID, loan.Amount, date,
-		)
+		m.SendMessage(chatID, fmt.Sprintf("✅ Займ частями #%d для %s зарегистрирован.", loanID, borrower))
+		m.StartDisbursementFlow(chatID, loanID)
+	}
+}
+
+// CreateInstallmentLoan inserts a loan with a zero amount that grows with each disbursement
+func (m *BotManager) CreateInstallmentLoan(chatID int64, borrower string, purpose string) (int, error) {
+	var loanID int
+	err := m.db.Transact(func(tx *sql.Tx) error {
+		if m.config.MaxLoansPerUser > 0 {
+			var loanCount int
+			if err := tx.QueryRow("SELECT COUNT(*) FROM loans WHERE user_id = ? AND deleted = 0", chatID).Scan(&loanCount); err != nil {
+				return err
+			}
+			if loanCount >= m.config.MaxLoansPerUser {
+				return errLoanLimit
+			}
+		}
+
+		var err error
+		loanID, err = nextLoanID(tx, chatID, 1)
 		if err != nil {
-			log.Printf("Error recording repayment: %v", err)
-			// Loan is already marked as repaid, so we proceed
+			return err
 		}
 
-		// Send confirmation
-		m.SendMessage(chatID, fmt.Sprintf(
-			"✅ Займ #%d от %s на сумму %d ₸ отмечен как возвращенный!",
-			loan.ID, loan.Borrower, loan.Amount,
-		))
+		_, err = tx.Exec(
+			`INSERT INTO loans (user_id, loan_id, borrower_name, amount, purpose, repaid, created_at, installments)
+			VALUES (?, ?, ?, 0, ?, 0, CURRENT_TIMESTAMP, 1)`,
+			chatID, loanID, borrower, purpose,
+		)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
 
-		m.ShowMainMenu(chatID)
+	m.LogLoanEvent(chatID, loanID, EventCreated, "Займ частями создан")
+	return loanID, nil
+}
 
-	default:
-		log.Printf("Unknown callback data: %s", data)
-		m.SendMessage(chatID, "❓ Неизвестная команда")
-		m.ShowMainMenu(chatID)
-	}
+// StartDisbursementFlow asks for the next part given out on an installment loan
+func (m *BotManager) StartDisbursementFlow(chatID int64, loanID int) {
+	m.ClearState(chatID)
+	m.SaveStateData(chatID, "loan_id", strconv.Itoa(loanID))
+	m.SetState(chatID, OpDisburse, 0)
+
+	m.SendAmountPrompt(chatID, fmt.Sprintf("💸 Займ #%d: введите сумму, выданную сейчас:", loanID), m.FrequentLoanAmounts(chatID))
 }
 
-// ShowLoansByStatus displays loans filtered by repaid status
-func (m *BotManager) ShowLoansByStatus(chatID int64, repaidStatus bool) {
-	rows, err := m.db.Query(
-		"SELECT loan_id, borrower_name, amount, purpose FROM loans WHERE user_id = ? AND repaid = ?",
-		chatID, repaidStatus,
-	)
+// HandleDisbursementStep processes the amount and note of a disbursement
+func (m *BotManager) HandleDisbursementStep(chatID int64, text string) {
+	state := m.GetState(chatID)
+	loanID, err := strconv.Atoi(state.Data["loan_id"])
 	if err != nil {
-		log.Printf("Error getting loans by status: %v", err)
-		m.SendMessage(chatID, "❌ Не удалось получить список займов.")
+		log.Printf("Error converting loan ID: %v", err)
+		m.SendMessage(chatID, "❌ Произошла ошибка при записи выдачи.")
+		m.ClearState(chatID)
 		m.ShowMainMenu(chatID)
 		return
 	}
+
+	switch state.Step {
+	case 0: // Amount
+		amount, err := parseAmount(text)
+		if err != nil || amount <= 0 {
+			m.SendMessage(chatID, "❌ Некорректная сумма. Пожалуйста, введите целое положительное число:")
+			return
+		}
+
+		m.SaveStateData(chatID, "amount", strconv.FormatInt(amount, 10))
+		m.SetState(chatID, OpDisburse, 1)
+		m.SendMessage(chatID, "📝 Добавьте заметку к выдаче (или отправьте \"-\" чтобы пропустить):")
+
+	case 1: // Optional note
+		note := text
+		if note == "-" {
+			note = ""
+		}
+		if noteTooLong(note) {
+			m.SendMessage(chatID, noteTooLongMessage(note))
+			return
+		}
+
+		amount, _ := strconv.ParseInt(state.Data["amount"], 10, 64)
+		date := m.UserToday(chatID)
+		if err := m.AddDisbursement(chatID, loanID, amount, date, note); err != nil {
+			log.Printf("Error recording disbursement: %v", err)
+			m.SendMessage(chatID, "❌ Не удалось записать выдачу.")
+			m.ClearState(chatID)
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		m.ClearState(chatID)
+		m.SendMessage(chatID, fmt.Sprintf("✅ Выдача %s по займу #%d записана.", m.Money(chatID, amount), loanID))
+		m.ShowLoanDetails(chatID, loanID)
+	}
+}
+
+// AddDisbursement records a part given out on an installment loan and adds it to the
+// loan amount in the same transaction, so the outstanding stays disbursed minus repaid
+func (m *BotManager) AddDisbursement(chatID int64, loanID int, amount int64, date string, note string) error {
+	err := m.db.Transact(func(tx *sql.Tx) error {
+		result, err := tx.Exec(
+			"UPDATE loans SET amount = amount + ? WHERE user_id = ? AND loan_id = ? AND installments = 1 AND repaid = 0 AND deleted = 0",
+			amount, chatID, loanID,
+		)
+		if err != nil {
+			return err
+		}
+		if updated, _ := result.RowsAffected(); updated == 0 {
+			return fmt.Errorf("loan %d is not an active installment loan", loanID)
+		}
+
+		_, err = tx.Exec(
+			"INSERT INTO disbursements (user_id, loan_id, amount, disbursement_date, note) VALUES (?, ?, ?, ?, NULLIF(?, ''))",
+			chatID, loanID, amount, date, note,
+		)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	details := fmt.Sprintf("Выдано %s от %s", m.Money(chatID, amount), date)
+	if note != "" {
+		details += ": " + note
+	}
+	m.LogLoanEvent(chatID, loanID, EventDisbursed, details)
+	return nil
+}
+
+// FormatInstallmentHistory lists the disbursements and repayments of an installment loan
+// as MarkdownV2 for the loan view
+func (m *BotManager) FormatInstallmentHistory(chatID int64, loanID int) string {
+	histories := []struct {
+		Title string
+		Query string
+	}{
+		{"💸 Выдачи:", "SELECT amount, disbursement_date, COALESCE(note, '') FROM disbursements WHERE user_id = ? AND loan_id = ? ORDER BY disbursement_date, disbursement_id"},
+		{"💵 Возвраты:", "SELECT amount, COALESCE(substr(repayment_date, 1, 10), ''), COALESCE(note, '') FROM repayments WHERE user_id = ? AND loan_id = ? ORDER BY repayment_date, repayment_id"},
+	}
+
+	// Read the format once instead of querying settings while rows are open
+	format := m.GetMoneyFormat(chatID)
+
+	var history strings.Builder
+	for _, section := range histories {
+		history.WriteString(markdownf("\n%s\n", section.Title))
+
+		rows, err := m.db.Query(section.Query, chatID, loanID)
+		if err != nil {
+			log.Printf("Error getting installment history: %v", err)
+			history.WriteString(markdownf("не удалось загрузить\n"))
+			continue
+		}
+
+		count := 0
+		for rows.Next() {
+			var amount int64
+			var date, note string
+			if err := rows.Scan(&amount, &date, &note); err != nil {
+				log.Printf("Error scanning installment history: %v", err)
+				continue
+			}
+
+			count++
+			history.WriteString(markdownf("• %s — %s", date, formatMoney(amount, format)))
+			if note != "" {
+				history.WriteString(markdownf(" (%s)", userMarkdown(note)))
+			}
+			history.WriteString(markdownf("\n"))
+		}
+		rows.Close()
+
+		if count == 0 {
+			history.WriteString(markdownf("пока нет\n"))
+		}
+	}
+
+	return history.String()
+}
+
+// RecurringLoan is a template that creates the same loan every IntervalDays days
+type RecurringLoan struct {
+	ID           int64
+	UserID       int64
+	Borrower     string
+	Amount       int64
+	Purpose      string
+	IntervalDays int
+	NextDate     string
+	Paused       bool
+}
+
+// GetRecurringLoans returns a user's recurring loan templates, the next to run first
+func (m *BotManager) GetRecurringLoans(chatID int64) ([]RecurringLoan, error) {
+	rows, err := m.db.Query(
+		`SELECT recurring_id, borrower_name, amount, COALESCE(purpose, ''), interval_days, next_date, COALESCE(paused, 0)
+		FROM recurring_loans WHERE user_id = ? ORDER BY paused, next_date, recurring_id`,
+		chatID,
+	)
+	if err != nil {
+		return nil, err
+	}
 	defer rows.Close()
 
-	var loans []Loan
+	var templates []RecurringLoan
 	for rows.Next() {
-		var loan Loan
-		loan.UserID = chatID
-		loan.Repaid = repaidStatus
+		template := RecurringLoan{UserID: chatID}
+		if err := rows.Scan(&template.ID, &template.Borrower, &template.Amount, &template.Purpose, &template.IntervalDays, &template.NextDate, &template.Paused); err != nil {
+			return nil, err
+		}
+		templates = append(templates, template)
+	}
 
-		if err := rows.Scan(&loan.ID, &loan.Borrower, &loan.Amount, &loan.Purpose); err != nil {
-			log.Printf("Error scanning loan: %v", err)
-			continue
+	return templates, rows.Err()
+}
+
+// ShowRecurringLoans lists the recurring loan templates with their next scheduled
+// creation and buttons to pause, resume or delete them
+func (m *BotManager) ShowRecurringLoans(chatID int64) {
+	templates, err := m.GetRecurringLoans(chatID)
+	if err != nil {
+		log.Printf("Error getting recurring loans: %v", err)
+		m.SendErrorWithBack(chatID, "❌ Не удалось получить регулярные займы.")
+		return
+	}
+
+	var text strings.Builder
+	text.WriteString("🔁 Регулярные займы\n\n")
+	if len(templates) == 0 {
+		text.WriteString("Шаблонов пока нет. Бот сам создает займ по шаблону через заданное число дней, например для карманных денег.")
+	}
+
+	var keyboard [][]tgbotapi.InlineKeyboardButton
+	for _, template := range templates {
+		text.WriteString(fmt.Sprintf(
+			"#%d 👤 %s — %s каждые %d %s\n",
+			template.ID, template.Borrower, m.Money(chatID, template.Amount), template.IntervalDays, daysWord(template.IntervalDays),
+		))
+		if template.Purpose != "" {
+			text.WriteString(fmt.Sprintf("📝 %s\n", template.Purpose))
 		}
 
-		loans = append(loans, loan)
+		pauseButton := tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("⏸️ #%d", template.ID), fmt.Sprintf("recurring_pause_%d", template.ID))
+		if template.Paused {
+			text.WriteString("⏸️ Приостановлен\n\n")
+			pauseButton = tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("▶️ #%d", template.ID), fmt.Sprintf("recurring_resume_%d", template.ID))
+		} else {
+			text.WriteString(fmt.Sprintf("📅 Следующий займ: %s\n\n", template.NextDate))
+		}
+		keyboard = append(keyboard, tgbotapi.NewInlineKeyboardRow(
+			pauseButton,
+			tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("🗑️ #%d", template.ID), fmt.Sprintf("recurring_delete_%d", template.ID)),
+		))
+	}
+
+	keyboard = append(keyboard,
+		tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("➕ Новый шаблон", "recurring_new")),
+		tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("🔙 Назад", "back_to_main")),
+	)
+
+	msg := tgbotapi.NewMessage(chatID, text.String())
+	msg.ReplyMarkup = tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+	if _, err := m.Send(msg); err != nil {
+		log.Printf("Error showing recurring loans: %v", err)
+	}
+}
+
+// StartRecurringLoanFlow begins creating a recurring loan template
+func (m *BotManager) StartRecurringLoanFlow(chatID int64) {
+	// First clear any existing state
+	m.ClearState(chatID)
+	m.SetState(chatID, OpRecurring, 0)
+
+	m.SendMessage(chatID, "🔁 Новый регулярный займ.\n👤 Введите имя заемщика:")
+}
+
+// HandleRecurringLoanStep processes each step of creating a recurring loan template
+func (m *BotManager) HandleRecurringLoanStep(chatID int64, text string) {
+	state := m.GetState(chatID)
+
+	switch state.Step {
+	case 0: // Borrower name
+		if text == "" {
+			m.SendMessage(chatID, "❌ Имя заемщика не может быть пустым. Пожалуйста, введите корректное имя:")
+			return
+		}
+
+		m.SaveStateData(chatID, "borrower_name", text)
+		m.SetState(chatID, OpRecurring, 1)
+		m.SendAmountPrompt(chatID, "💰 Введите сумму каждого займа:", m.FrequentLoanAmounts(chatID))
+
+	case 1: // Amount
+		amount, err := parseAmount(text)
+		if err != nil || amount <= 0 {
+			m.SendMessage(chatID, "❌ Некорректная сумма. Пожалуйста, введите целое положительное число:")
+			return
+		}
+
+		m.SaveStateData(chatID, "amount", strconv.FormatInt(amount, 10))
+		m.SetState(chatID, OpRecurring, 2)
+		m.SendMessage(chatID, "📝 Введите цель займа:")
+
+	case 2: // Purpose
+		if text == "" {
+			m.SendMessage(chatID, "❌ Цель займа не может быть пустой. Пожалуйста, введите корректную цель:")
+			return
+		}
+		if noteTooLong(text) {
+			m.SendMessage(chatID, noteTooLongMessage(text))
+			return
+		}
+
+		m.SaveStateData(chatID, "purpose", text)
+		m.SetState(chatID, OpRecurring, 3)
+		m.SendMessage(chatID, fmt.Sprintf("🔁 Как часто создавать займ? Введите число дней (1-%d), например 7 или 30:", maxLoanReminderDays))
+
+	case 3: // Interval
+		days, err := strconv.Atoi(strings.TrimSpace(text))
+		if err != nil || days < 1 || days > maxLoanReminderDays {
+			m.SendMessage(chatID, fmt.Sprintf("❌ Введите число дней от 1 до %d:", maxLoanReminderDays))
+			return
+		}
+
+		m.SaveStateData(chatID, "interval_days", strconv.Itoa(days))
+		m.SetState(chatID, OpRecurring, 4)
+		m.SendMessage(chatID, "📅 Когда создать первый займ? Введите дату (ДД.ММ.ГГГГ) или \"-\", чтобы начать сегодня:")
+
+	case 4: // First date
+		firstDate := m.UserToday(chatID)
+		if text != "-" {
+			date, err := parseDate(text)
+			if err != nil {
+				m.SendMessage(chatID, "❌ Некорректная дата. Введите дату в формате ДД.ММ.ГГГГ или \"-\":")
+				return
+			}
+			if date.Format(dateLayout) < firstDate {
+				m.SendMessage(chatID, "❌ Дата первого займа не может быть в прошлом. Введите другую дату:")
+				return
+			}
+			firstDate = date.Format(dateLayout)
+		}
+
+		amount, _ := strconv.ParseInt(state.Data["amount"], 10, 64)
+		days, _ := strconv.Atoi(state.Data["interval_days"])
+		_, err := m.db.Exec(
+			`INSERT INTO recurring_loans (user_id, borrower_name, amount, purpose, interval_days, next_date)
+			VALUES (?, ?, ?, ?, ?, ?)`,
+			chatID, state.Data["borrower_name"], amount, state.Data["purpose"], days, firstDate,
+		)
+		m.ClearState(chatID)
+		if err != nil {
+			log.Printf("Error saving recurring loan: %v", err)
+			m.SendErrorWithBack(chatID, "❌ Не удалось сохранить регулярный займ.")
+			return
+		}
+
+		m.SendMessage(chatID, fmt.Sprintf(
+			"✅ Регулярный займ сохранен: %s — %s каждые %d %s, первый %s.",
+			state.Data["borrower_name"], m.Money(chatID, amount), days, daysWord(days), firstDate,
+		))
+
+		// A template starting today creates its first loan right away
+		if _, err := m.CreateRecurringLoans(); err != nil {
+			log.Printf("Error creating recurring loans: %v", err)
+		}
+		m.ShowRecurringLoans(chatID)
+	}
+}
+
+// SetRecurringLoanPaused pauses or resumes a recurring loan template. A resumed template
+// continues from today rather than creating the loans missed while it was paused.
+func (m *BotManager) SetRecurringLoanPaused(chatID int64, recurringID int64, paused bool) error {
+	result, err := m.db.Exec(
+		`UPDATE recurring_loans SET paused = ?, next_date = CASE WHEN ? THEN next_date ELSE max(next_date, ?) END
+		WHERE user_id = ? AND recurring_id = ?`,
+		paused, paused, m.UserToday(chatID), chatID, recurringID,
+	)
+	if err != nil {
+		return err
+	}
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteRecurringLoan removes a recurring loan template; loans it already created stay
+func (m *BotManager) DeleteRecurringLoan(chatID int64, recurringID int64) error {
+	result, err := m.db.Exec("DELETE FROM recurring_loans WHERE user_id = ? AND recurring_id = ?", chatID, recurringID)
+	if err != nil {
+		return err
+	}
+	if deleted, _ := result.RowsAffected(); deleted == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// CreateRecurringLoans creates the loans of every active template that is due in its
+// user's time zone. Each loan is inserted in the same transaction that moves the
+// template's next_date forward, so a restart never creates the same loan twice.
+// It returns how many loans were created.
+func (m *BotManager) CreateRecurringLoans() (int, error) {
+	rows, err := m.db.Query(
+		`SELECT recurring_id, user_id, borrower_name, amount, COALESCE(purpose, ''), interval_days, next_date
+		FROM recurring_loans WHERE paused = 0 ORDER BY user_id, next_date, recurring_id`,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	var templates []RecurringLoan
+	for rows.Next() {
+		var template RecurringLoan
+		if err := rows.Scan(&template.ID, &template.UserID, &template.Borrower, &template.Amount, &template.Purpose, &template.IntervalDays, &template.NextDate); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		templates = append(templates, template)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	created := 0
+	for _, template := range templates {
+		today := m.UserToday(template.UserID)
+		for i := 0; i < recurringCatchUpLimit && template.NextDate <= today; i++ {
+			loanID, err := m.createRecurringLoan(&template)
+			if errors.Is(err, errLoanLimit) {
+				if err := m.SetRecurringLoanPaused(template.UserID, template.ID, true); err != nil {
+					log.Printf("Error pausing recurring loan %d: %v", template.ID, err)
+				}
+				m.SendReminderMessage(template.UserID, fmt.Sprintf(
+					"⏸️ Регулярный займ #%d приостановлен: достигнут лимит займов (%d).",
+					template.ID, m.config.MaxLoansPerUser,
+				), nil)
+				break
+			}
+			if err != nil {
+				log.Printf("Error creating loan from recurring template %d: %v", template.ID, err)
+				break
+			}
+			if loanID == 0 {
+				// Another run already created this one
+				break
+			}
+
+			created++
+			// Templates come due at local midnight, so the notice respects quiet hours
+			m.SendReminderMessage(template.UserID, fmt.Sprintf(
+				"🔁 Создан регулярный займ #%d: %s — %s.",
+				loanID, template.Borrower, m.Money(template.UserID, template.Amount),
+			), nil)
+		}
+	}
+
+	return created, nil
+}
+
+// createRecurringLoan claims the template's next date, inserts the loan and advances
+// template.NextDate. It returns 0 when the date was already claimed.
+func (m *BotManager) createRecurringLoan(template *RecurringLoan) (int, error) {
+	scheduled, err := time.ParseInLocation(dateLayout, template.NextDate, time.Local)
+	if err != nil {
+		return 0, err
+	}
+	nextDate := scheduled.AddDate(0, 0, template.IntervalDays).Format(dateLayout)
+
+	var loanID int
+	err = m.db.Transact(func(tx *sql.Tx) error {
+		loanID = 0
+		result, err := tx.Exec(
+			"UPDATE recurring_loans SET next_date = ? WHERE recurring_id = ? AND next_date = ? AND paused = 0",
+			nextDate, template.ID, template.NextDate,
+		)
+		if err != nil {
+			return err
+		}
+		if claimed, _ := result.RowsAffected(); claimed == 0 {
+			return nil
+		}
+
+		if m.config.MaxLoansPerUser > 0 {
+			var loanCount int
+			if err := tx.QueryRow("SELECT COUNT(*) FROM loans WHERE user_id = ? AND deleted = 0", template.UserID).Scan(&loanCount); err != nil {
+				return err
+			}
+			if loanCount >= m.config.MaxLoansPerUser {
+				return errLoanLimit
+			}
+		}
+
+		loanID, err = nextLoanID(tx, template.UserID, 1)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(
+			`INSERT INTO loans (user_id, loan_id, borrower_name, amount, purpose, repaid, created_at)
+			VALUES (?, ?, ?, ?, ?, 0, CURRENT_TIMESTAMP)`,
+			template.UserID, loanID, template.Borrower, template.Amount, template.Purpose,
+		)
+		return err
+	})
+	if err != nil || loanID == 0 {
+		return 0, err
+	}
+
+	m.LogLoanEvent(template.UserID, loanID, EventCreated, fmt.Sprintf(
+		"Займ создан по регулярному шаблону #%d на %s (запланирован на %s)",
+		template.ID, m.Money(template.UserID, template.Amount), template.NextDate,
+	))
+	template.NextDate = nextDate
+	return loanID, nil
+}
+
+// StartRepeatLoanFlow starts the add loan flow with the borrower and purpose of an
+// earlier loan, so only the amount has to be entered
+func (m *BotManager) StartRepeatLoanFlow(chatID int64, loanID int) {
+	loan, err := m.GetLoanByID(chatID, loanID)
+	if err != nil {
+		log.Printf("Error getting loan details: %v", err)
+		m.SendErrorWithBack(chatID, "❌ Займ не найден.")
+		return
+	}
+
+	m.ClearState(chatID)
+	m.SaveStateData(chatID, "borrower_name", loan.Borrower)
+	m.SaveStateData(chatID, "purpose", loan.Purpose)
+	m.SaveStateData(chatID, "repeat_of", strconv.Itoa(loan.ID))
+	m.SetState(chatID, OpAddLoan, 1)
+
+	// Offer the previous amount first
+	quickAmounts := []int64{loan.Amount}
+	for _, amount := range m.FrequentLoanAmounts(chatID) {
+		if amount != loan.Amount && len(quickAmounts) < quickAmountsLimit {
+			quickAmounts = append(quickAmounts, amount)
+		}
+	}
+
+	m.SendAmountPrompt(chatID, fmt.Sprintf(
+		"🔁 Новый займ для %s\n🎯 Цель: %s\n\n💰 Введите сумму займа (в прошлый раз: %s):",
+		loan.Borrower, loan.Purpose, m.Money(chatID, loan.Amount),
+	), quickAmounts)
+}
+
+// HandleRepayLoanStep processes steps in the repay loan flow
+func (m *BotManager) HandleRepayLoanStep(chatID int64, text string) {
+	state := m.GetState(chatID)
+
+	switch state.Step {
+	case 0: // Select loan to repay
+		// Try to parse loan ID
+		loanID, err := strconv.Atoi(text)
+		if err != nil {
+			m.SendMessage(chatID, "❌ Пожалуйста, введите корректный номер займа из списка.")
+			return
+		}
+
+		// Check if loan exists and is active
+		var exists bool
+		var borrower string
+		var amount int64
+		err = m.db.QueryRow(
+			"SELECT EXISTS(SELECT 1 FROM loans WHERE user_id = ? AND loan_id = ? AND repaid = 0 AND deleted = 0), borrower_name, amount FROM loans WHERE user_id = ? AND loan_id = ? AND deleted = 0",
+			chatID, loanID, chatID, loanID,
+		).Scan(&exists, &borrower, &amount)
+
+		if err != nil {
+			log.Printf("Error checking loan existence: %v", err)
+			m.SendMessage(chatID, "❌ Произошла ошибка при проверке займа.")
+			m.ClearState(chatID)
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		if !exists {
+			m.SendMessage(chatID, "❌ Указанный займ не найден или уже погашен.")
+			return
+		}
+
+		// Save loan ID and advance to next step
+		m.SaveStateData(chatID, "loan_id", text)
+		m.SaveStateData(chatID, "borrower", borrower)
+		m.SaveStateData(chatID, "amount", fmt.Sprintf("%d", amount))
+		m.SetState(chatID, OpRepayLoan, 1)
+
+		// Ask for confirmation
+		m.SendMessage(chatID, fmt.Sprintf(
+			"Вы собираетесь отметить займ #%d от %s на сумму %s как возвращенный.\n\nВведите \"да\" для подтверждения или \"нет\" для отмены.",
+			loanID, borrower, m.Money(chatID, amount),
+		))
+
+	case 1: // Confirm repayment
+		confirmation := strings.ToLower(text)
+
+		if confirmation == "да" {
+			// Get loan details from state
+			loanIDStr, _ := m.GetStateData(chatID, "loan_id")
+			borrower, _ := m.GetStateData(chatID, "borrower")
+			amountStr, _ := m.GetStateData(chatID, "amount")
+
+			loanID, _ := strconv.Atoi(loanIDStr)
+			amount, _ := strconv.ParseInt(amountStr, 10, 64)
+
+			// Mark loan as repaid
+			_, err := m.db.Exec(
+				"UPDATE loans SET repaid = 1 WHERE user_id = ? AND loan_id = ?",
+				chatID, loanID,
+			)
+
+			if err != nil {
+				log.Printf("Error marking loan as repaid: %v", err)
+				m.SendMessage(chatID, "❌ Произошла ошибка при отметке займа как возвращенного.")
+				m.ClearState(chatID)
+				m.ShowMainMenu(chatID)
+				return
+			}
+
+			// Insert into repayments table
+			date := m.UserToday(chatID)
+			_, err = m.db.Exec(
+				"INSERT INTO repayments (user_id, loan_id, amount, repayment_date, note) VALUES (?, ?, ?, ?, 'Полный возврат')",
+				chatID, loanID, amount, date,
+			)
+
+			if err != nil {
+				log.Printf("Error recording repayment: %v", err)
+				// Loan is already marked as repaid, so we proceed
+			}
+
+			m.LogLoanEvent(chatID, loanID, EventRepaid, "Займ отмечен как возвращенный")
+
+			// Send confirmation
+			m.SendMessage(chatID, fmt.Sprintf(
+				"✅ Займ #%d от %s на сумму %s отмечен как возвращенный!",
+				loanID, borrower, m.Money(chatID, amount),
+			))
+
+		} else if confirmation == "нет" {
+			m.SendMessage(chatID, "❌ Отметка займа как возвращенного отменена.")
+		} else {
+			m.SendMessage(chatID, "Пожалуйста, введите \"да\" для подтверждения или \"нет\" для отмены.")
+			return
+		}
+
+		// Clear state and show main menu
+		m.ClearState(chatID)
+		m.ShowMainMenu(chatID)
+	}
+}
+
+// ShowBalance displays the user's active loans
+func (m *BotManager) ShowBalance(chatID int64) {
+	// Purposes can be hidden for privacy
+	showPurpose := m.GetBoolSetting(chatID, SettingShowPurpose, true)
+	myShare := m.GetBoolSetting(chatID, SettingMyShare, false)
+
+	// Query active loans
+	rows, err := m.db.Query(
+		"SELECT loan_id, borrower_name, amount, COALESCE(purpose, ''), COALESCE(my_share_percent, 100) FROM loans WHERE user_id = ? AND repaid = 0 AND deleted = 0",
+		chatID,
+	)
+
+	if err != nil {
+		log.Printf("Error querying loans: %v", err)
+		m.SendMessage(chatID, dbErrorMessage(err, "❌ Ошибка при получении баланса. Попробуйте позже."))
+		m.ShowMainMenu(chatID)
+		return
+	}
+	defer rows.Close()
+
+	var loans []Loan
+	var totalAmount int64
+	hasShared := false
+
+	// Process each loan
+	for rows.Next() {
+		var loan Loan
+		if err := rows.Scan(&loan.ID, &loan.Borrower, &loan.Amount, &loan.Purpose, &loan.SharePercent); err != nil {
+			log.Printf("Error scanning loan row: %v", err)
+			continue
+		}
+
+		if loan.SharePercent < 100 {
+			hasShared = true
+		}
+		if myShare {
+			totalAmount += shareOf(loan.Amount, loan.SharePercent)
+		} else {
+			totalAmount += loan.Amount
+		}
+		loans = append(loans, loan)
+	}
+
+	if len(loans) == 0 {
+		m.SendMarkdown(chatID, markdownf("📊 Активные займы:\n\nУ вас нет активных займов! 🎉"))
+		m.ShowMainMenu(chatID)
+		return
+	}
+
+	// Send the loans in batches, each loan with its own repay and edit buttons
+	for start := 0; start < len(loans); start += loansPerMessage {
+		end := start + loansPerMessage
+		if end > len(loans) {
+			end = len(loans)
+		}
+
+		var response strings.Builder
+		if start == 0 {
+			response.WriteString(markdownf("📊 Активные займы:\n\n"))
+		}
+
+		var keyboard [][]tgbotapi.InlineKeyboardButton
+		for _, loan := range loans[start:end] {
+			response.WriteString(markdownf(
+				"🆔 Займ #%d\n👤 Заемщик: %s\n💰 Сумма: %s\n",
+				loan.ID, loan.Borrower, m.Money(chatID, loan.Amount),
+			))
+			if loan.SharePercent < 100 {
+				response.WriteString(markdownf("👤 Моя доля: %d%% (%s)\n", loan.SharePercent, m.Money(chatID, shareOf(loan.Amount, loan.SharePercent))))
+			}
+			if showPurpose && loan.Purpose != "" {
+				response.WriteString(markdownf("📝 Цель: %s\n", userMarkdown(loan.Purpose)))
+			}
+			response.WriteString(markdownf("➖➖➖➖➖➖➖➖➖➖\n\n"))
+
+			keyboard = append(keyboard, tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("✅ Возврат #%d", loan.ID), fmt.Sprintf("repay_%d", loan.ID)),
+				tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("✏️ #%d", loan.ID), fmt.Sprintf("edit_%d", loan.ID)),
+			))
+		}
+
+		// Add summary after the last loan
+		if end == len(loans) {
+			if myShare && hasShared {
+				response.WriteString(markdownf("💼 Моя доля в активных займах: %s", m.Money(chatID, totalAmount)))
+			} else {
+				response.WriteString(markdownf("💼 Общая сумма активных займов: %s", m.Money(chatID, totalAmount)))
+			}
+			if hasShared {
+				keyboard = append(keyboard, tgbotapi.NewInlineKeyboardRow(m.shareModeButton(chatID, "sharemode_balance")))
+			}
+		}
+
+		msg := tgbotapi.NewMessage(chatID, response.String())
+		msg.ReplyMarkup = tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+		m.SendMarkdownMessage(msg)
+	}
+
+	m.ShowMainMenu(chatID)
+}
+
+// ShowBalanceText sends active loans as a tab-separated plain text block for copying into a spreadsheet
+func (m *BotManager) ShowBalanceText(chatID int64) {
+	activeLoans, err := m.GetActiveLoansForUser(chatID)
+	if err != nil {
+		log.Printf("Error getting active loans: %v", err)
+		m.SendMessage(chatID, "❌ Не удалось получить список активных займов.")
+		return
+	}
+
+	if len(activeLoans) == 0 {
+		m.SendMessage(chatID, "Нет активных займов.")
+		return
+	}
+
+	// Build one line per loan, keeping tabs and line breaks out of the values
+	clean := strings.NewReplacer("\t", " ", "\r", " ", "\n", " ")
+
+	var response strings.Builder
+	response.WriteString("Заемщик\tСумма\tОстаток\tЦель\n")
+
+	for _, loan := range activeLoans {
+		remainingAmount := loan.Amount - m.GetTotalRepaidAmount(chatID, loan.ID)
+		response.WriteString(fmt.Sprintf(
+			"%s\t%d\t%d\t%s\n",
+			clean.Replace(loan.Borrower), loan.Amount, remainingAmount, clean.Replace(loan.Purpose),
+		))
+	}
+
+	m.SendLongMessage(chatID, response.String())
+}
+
+// GetBorrowerLedger returns all loans and repayments of one borrower in chronological order
+func (m *BotManager) GetBorrowerLedger(chatID int64, borrower string) ([]LedgerEntry, error) {
+	rows, err := m.db.Query(
+		"SELECT loan_id, borrower_name, amount, COALESCE(purpose, ''), COALESCE(created_at, '') FROM loans WHERE user_id = ? AND deleted = 0 ORDER BY loan_id",
+		chatID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// Borrower names are compared in Go since SQLite only folds ASCII case
+	var entries []LedgerEntry
+	for rows.Next() {
+		var entry LedgerEntry
+		var name, purpose string
+
+		if err := rows.Scan(&entry.LoanID, &name, &entry.Amount, &purpose, &entry.Date); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if !sameBorrower(name, borrower) {
+			continue
+		}
+		entry.Date = m.LocalDate(chatID, entry.Date)
+
+		entry.Description = "Займ"
+		if purpose != "" {
+			entry.Description = fmt.Sprintf("Займ: %s", purpose)
+		}
+		entries = append(entries, entry)
+	}
+	rows.Close()
+
+	// Add the repayments of every matching loan
+	loanCount := len(entries)
+	for _, loanEntry := range entries[:loanCount] {
+		repaymentRows, err := m.db.Query(
+			"SELECT amount, COALESCE(substr(repayment_date, 1, 10), ''), COALESCE(note, '') FROM repayments WHERE user_id = ? AND loan_id = ?",
+			chatID, loanEntry.LoanID,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		for repaymentRows.Next() {
+			entry := LedgerEntry{LoanID: loanEntry.LoanID}
+			var note string
+
+			if err := repaymentRows.Scan(&entry.Amount, &entry.Date, &note); err != nil {
+				repaymentRows.Close()
+				return nil, err
+			}
+
+			entry.Amount = -entry.Amount
+			entry.Description = "Возврат"
+			if note != "" {
+				entry.Description = fmt.Sprintf("Возврат: %s", note)
+			}
+			entries = append(entries, entry)
+		}
+		repaymentRows.Close()
+	}
+
+	// Loans come before repayments made on the same day
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Date < entries[j].Date
+	})
+
+	return entries, nil
+}
+
+// buildCSV renders a header and rows as CSV
+func buildCSV(header []string, rows [][]string) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+
+	if err := writer.Write(header); err != nil {
+		return nil, err
+	}
+	if err := writer.WriteAll(rows); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// buildLedgerCSV renders ledger entries as CSV with a running balance column
+func buildLedgerCSV(entries []LedgerEntry) ([]byte, error) {
+	var balance int64
+	var rows [][]string
+	for _, entry := range entries {
+		balance += entry.Amount
+		rows = append(rows, []string{
+			entry.Date,
+			strconv.Itoa(entry.LoanID),
+			entry.Description,
+			strconv.FormatInt(entry.Amount, 10),
+			strconv.FormatInt(balance, 10),
+		})
+	}
+
+	return buildCSV([]string{"Дата", "Займ", "Операция", "Сумма", "Остаток"}, rows)
+}
+
+// SendBorrowerLedger sends a CSV file with all loans and repayments of one borrower
+func (m *BotManager) SendBorrowerLedger(chatID int64, borrower string) {
+	borrower = strings.TrimSpace(borrower)
+	if borrower == "" {
+		m.SendMessage(chatID, "❌ Укажите имя заемщика, например: /ledger Айдар")
+		return
+	}
+
+	entries, err := m.GetBorrowerLedger(chatID, borrower)
+	if err != nil {
+		log.Printf("Error building ledger: %v", err)
+		m.SendErrorWithBack(chatID, "❌ Не удалось сформировать выписку.")
+		return
+	}
+
+	if len(entries) == 0 {
+		m.SendErrorWithBack(chatID, fmt.Sprintf("🔍 Займы заемщика \"%s\" не найдены.", borrower))
+		return
+	}
+
+	data, err := buildLedgerCSV(entries)
+	if err != nil {
+		log.Printf("Error building ledger CSV: %v", err)
+		m.SendErrorWithBack(chatID, "❌ Не удалось сформировать выписку.")
+		return
+	}
+
+	var balance int64
+	for _, entry := range entries {
+		balance += entry.Amount
+	}
+
+	doc := tgbotapi.NewDocument(chatID, tgbotapi.FileBytes{
+		Name:  fmt.Sprintf("ledger-%s.csv", borrower),
+		Bytes: data,
+	})
+	doc.Caption = fmt.Sprintf("📒 Выписка по заемщику %s\n💵 Остаток долга: %s", borrower, m.Money(chatID, balance))
+	if _, err := m.bot.Send(doc); err != nil {
+		log.Printf("Error sending ledger: %v", err)
+		m.SendErrorWithBack(chatID, "❌ Не удалось отправить выписку.")
+	}
+}
+
+// RepaymentExport is a repayment as written to a JSON export
+type RepaymentExport struct {
+	ID     int64  `json:"id"`
+	Amount int64  `json:"amount"`
+	Date   string `json:"date"`
+	Note   string `json:"note,omitempty"`
+}
+
+// LoanExport is a loan with its repayments as written to a JSON export. Currency and
+// FxRate are only set for a loan given in a foreign currency; Amount is always in tenge.
+// SharePercent is only set for a co-lent loan, see Loan.SharePercent.
+type LoanExport struct {
+	ID           int               `json:"id"`
+	Borrower     string            `json:"borrower"`
+	Amount       int64             `json:"amount"`
+	Purpose      string            `json:"purpose"`
+	Repaid       bool              `json:"repaid"`
+	Forgiven     bool              `json:"forgiven,omitempty"`
+	CreatedDate  string            `json:"created_date"`
+	DueDate      string            `json:"due_date,omitempty"`
+	Location     string            `json:"location,omitempty"`
+	Latitude     *float64          `json:"latitude,omitempty"`
+	Longitude    *float64          `json:"longitude,omitempty"`
+	Currency     string            `json:"currency,omitempty"`
+	FxRate       float64           `json:"fx_rate,omitempty"`
+	SharePercent int               `json:"my_share_percent,omitempty"`
+	Repayments   []RepaymentExport `json:"repayments"`
+}
+
+// GetLoanExports returns all of the user's loans with their repayments, oldest first
+func (m *BotManager) GetLoanExports(chatID int64) ([]LoanExport, error) {
+	// Issue dates are exported as the user sees them
+	location := m.UserLocation(chatID)
+
+	rows, err := m.db.Query(
+		`SELECT loan_id, borrower_name, amount, COALESCE(purpose, ''), repaid, COALESCE(forgiven, 0), COALESCE(created_at, ''),
+		COALESCE(due_date, ''), COALESCE(location, ''), latitude, longitude, COALESCE(currency, ''), COALESCE(fx_rate, 0),
+		COALESCE(my_share_percent, 100)
+		FROM loans WHERE user_id = ? AND deleted = 0 ORDER BY loan_id`,
+		chatID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var loans []LoanExport
+	loanIndex := make(map[int]int)
+	for rows.Next() {
+		var loan LoanExport
+		var latitude, longitude sql.NullFloat64
+
+		if err := rows.Scan(
+			&loan.ID, &loan.Borrower, &loan.Amount, &loan.Purpose, &loan.Repaid, &loan.Forgiven, &loan.CreatedDate,
+			&loan.DueDate, &loan.Location, &latitude, &longitude, &loan.Currency, &loan.FxRate,
+			&loan.SharePercent,
+		); err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		loan.CreatedDate = localDate(loan.CreatedDate, location)
+		if loan.SharePercent == 100 {
+			loan.SharePercent = 0
+		}
+		if latitude.Valid && longitude.Valid {
+			loan.Latitude = &latitude.Float64
+			loan.Longitude = &longitude.Float64
+		}
+		loan.Repayments = []RepaymentExport{}
+
+		loanIndex[loan.ID] = len(loans)
+		loans = append(loans, loan)
+	}
+	rows.Close()
+
+	// Attach the repayments to their loans
+	repaymentRows, err := m.db.Query(
+		`SELECT repayment_id, loan_id, amount, COALESCE(substr(repayment_date, 1, 10), ''), COALESCE(note, '')
+		FROM repayments WHERE user_id = ? ORDER BY repayment_date, repayment_id`,
+		chatID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer repaymentRows.Close()
+
+	for repaymentRows.Next() {
+		var repayment RepaymentExport
+		var loanID int
+
+		if err := repaymentRows.Scan(&repayment.ID, &loanID, &repayment.Amount, &repayment.Date, &repayment.Note); err != nil {
+			return nil, err
+		}
+
+		if i, ok := loanIndex[loanID]; ok {
+			loans[i].Repayments = append(loans[i].Repayments, repayment)
+		}
+	}
+
+	return loans, repaymentRows.Err()
+}
+
+// buildExportCSV renders exported loans as CSV, one row per loan
+func buildExportCSV(loans []LoanExport) ([]byte, error) {
+	var rows [][]string
+	for _, loan := range loans {
+		var repaid int64
+		for _, repayment := range loan.Repayments {
+			repaid += repayment.Amount
+		}
+
+		status := "Активен"
+		switch {
+		case loan.Forgiven:
+			status = "Прощен"
+		case loan.Repaid:
+			status = "Возвращен"
+		}
+
+		rows = append(rows, []string{
+			strconv.Itoa(loan.ID),
+			loan.CreatedDate,
+			loan.Borrower,
+			strconv.FormatInt(loan.Amount, 10),
+			strconv.FormatInt(repaid, 10),
+			strconv.FormatInt(loan.Amount-repaid, 10),
+			loan.Purpose,
+			loan.DueDate,
+			status,
+		})
+	}
+
+	return buildCSV([]string{"Займ", "Дата", "Заемщик", "Сумма", "Выплачено", "Остаток", "Цель", "Срок", "Статус"}, rows)
+}
+
+// SendExport sends all of the user's loans as a CSV file, or as JSON for "/export json"
+func (m *BotManager) SendExport(chatID int64, format string) {
+	format = strings.ToLower(strings.TrimSpace(format))
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "json" {
+		m.SendMessage(chatID, "❌ Используйте /export или /export json.")
+		return
+	}
+
+	loans, err := m.GetLoanExports(chatID)
+	if err != nil {
+		log.Printf("Error exporting loans: %v", err)
+		m.SendMessage(chatID, "❌ Не удалось выгрузить данные.")
+		return
+	}
+
+	if len(loans) == 0 {
+		m.SendMessage(chatID, "У вас пока нет займов для выгрузки.")
+		return
+	}
+
+	var data []byte
+	if format == "json" {
+		data, err = json.MarshalIndent(loans, "", "  ")
+	} else {
+		data, err = buildExportCSV(loans)
+	}
+	if err != nil {
+		log.Printf("Error building %s export: %v", format, err)
+		m.SendMessage(chatID, "❌ Не удалось выгрузить данные.")
+		return
+	}
+
+	doc := tgbotapi.NewDocument(chatID, tgbotapi.FileBytes{
+		Name:  fmt.Sprintf("loans-%s.%s", time.Now().Format("20060102"), format),
+		Bytes: data,
+	})
+	doc.Caption = fmt.Sprintf("📤 Выгрузка займов: %d", len(loans))
+	if render := m.TextRenderer(chatID); render != nil {
+		doc.Caption = render(doc.Caption)
+	}
+	if _, err := m.bot.Send(doc); err != nil {
+		log.Printf("Error sending export: %v", err)
+		m.SendMessage(chatID, "❌ Не удалось отправить файл.")
+	}
+}
+
+// maxImportSize limits the size of an uploaded import file
+const maxImportSize = 1 << 20
+
+// importClient downloads import files. Updates are handled one at a time, so a
+// stalled download must not hold up the bot for long.
+var importClient = &http.Client{Timeout: 30 * time.Second}
+
+// StartImportFlow asks for a JSON file made by /export json
+func (m *BotManager) StartImportFlow(chatID int64) {
+	m.ClearState(chatID)
+	m.SetState(chatID, OpImportData, 0)
+	m.SendMessage(chatID, "📥 Отправьте JSON-файл, полученный командой /export json.\nЗаймы из файла будут добавлены к вашим текущим займам под новыми номерами.")
+}
+
+// ImportLoansFromDocument downloads an uploaded JSON export and adds its loans to the user's
+func (m *BotManager) ImportLoansFromDocument(chatID int64, document *tgbotapi.Document) {
+	if document.FileSize > maxImportSize {
+		m.SendMessage(chatID, "❌ Файл слишком большой. Максимальный размер — 1 МБ.")
+		return
+	}
+
+	url, err := m.bot.GetFileDirectURL(document.FileID)
+	if err != nil {
+		log.Printf("Error getting import file URL: %v", err)
+		m.SendMessage(chatID, "❌ Не удалось получить файл. Попробуйте отправить его еще раз.")
+		return
+	}
+
+	resp, err := importClient.Get(url)
+	if err != nil {
+		log.Printf("Error downloading import file: %v", err)
+		m.SendMessage(chatID, "❌ Не удалось получить файл. Попробуйте отправить его еще раз.")
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("Error downloading import file: %s", resp.Status)
+		m.SendMessage(chatID, "❌ Не удалось получить файл. Попробуйте отправить его еще раз.")
+		return
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxImportSize+1))
+	if err != nil || len(data) > maxImportSize {
+		log.Printf("Error reading import file: %v", err)
+		m.SendMessage(chatID, "❌ Не удалось прочитать файл.")
+		return
+	}
+
+	loans, err := parseLoanExports(data)
+	if err != nil {
+		m.SendMessage(chatID, fmt.Sprintf("❌ Файл не похож на выгрузку /export json: %v\nИсправьте файл и отправьте его еще раз.", err))
+		return
+	}
+
+	importedLoans, importedRepayments, err := m.ImportLoans(chatID, loans)
+	if errors.Is(err, errLoanLimit) {
+		m.SendMessage(chatID, fmt.Sprintf(
+			"❌ Достигнут лимит займов (%d). Закройте или удалите старые.",
+			m.config.MaxLoansPerUser,
+		))
+		return
+	}
+	if err != nil {
+		log.Printf("Error importing loans: %v", err)
+		m.SendMessage(chatID, dbErrorMessage(err, "❌ Не удалось импортировать займы. Ничего не было добавлено."))
+		return
+	}
+
+	m.ClearState(chatID)
+	m.SendMessage(chatID, fmt.Sprintf(
+		"✅ Импорт завершен.\n\n📋 Займов: %d\n💵 Платежей: %d",
+		importedLoans, importedRepayments,
+	))
+	m.ShowMainMenu(chatID)
+}
+
+// parseLoanExports decodes and checks a JSON export. The returned error is shown to the user.
+func parseLoanExports(data []byte) ([]LoanExport, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	var loans []LoanExport
+	if err := decoder.Decode(&loans); err != nil {
+		return nil, fmt.Errorf("ожидается список займов в формате JSON")
+	}
+	if decoder.More() {
+		return nil, fmt.Errorf("после списка займов есть лишние данные")
+	}
+	if len(loans) == 0 {
+		return nil, fmt.Errorf("в файле нет займов")
+	}
+
+	for i, loan := range loans {
+		if strings.TrimSpace(loan.Borrower) == "" {
+			return nil, fmt.Errorf("займ №%d: не указан заемщик", i+1)
+		}
+		if loan.Amount <= 0 {
+			return nil, fmt.Errorf("займ №%d: сумма должна быть больше нуля", i+1)
+		}
+		if _, err := time.Parse(dateLayout, loan.CreatedDate); err != nil {
+			return nil, fmt.Errorf("займ №%d: некорректная дата выдачи %q", i+1, loan.CreatedDate)
+		}
+		if loan.DueDate != "" {
+			if _, err := time.Parse(dateLayout, loan.DueDate); err != nil {
+				return nil, fmt.Errorf("займ №%d: некорректный срок возврата %q", i+1, loan.DueDate)
+			}
+		}
+		if (loan.Latitude == nil) != (loan.Longitude == nil) {
+			return nil, fmt.Errorf("займ №%d: нужны и широта, и долгота", i+1)
+		}
+		if loan.Currency != "" && !knownCurrency(loan.Currency) {
+			return nil, fmt.Errorf("займ №%d: неизвестная валюта %q", i+1, loan.Currency)
+		}
+		if (loan.Currency == "") != (loan.FxRate == 0) || loan.FxRate < 0 {
+			return nil, fmt.Errorf("займ №%d: для займа в валюте нужны и валюта, и курс", i+1)
+		}
+		if loan.SharePercent < 0 || loan.SharePercent > 100 {
+			return nil, fmt.Errorf("займ №%d: доля должна быть от 1 до 100%%", i+1)
+		}
+
+		var repaid int64
+		for j, repayment := range loan.Repayments {
+			if repayment.Amount <= 0 {
+				return nil, fmt.Errorf("займ №%d, платеж №%d: сумма должна быть больше нуля", i+1, j+1)
+			}
+			if _, err := time.Parse(dateLayout, repayment.Date); err != nil {
+				return nil, fmt.Errorf("займ №%d, платеж №%d: некорректная дата %q", i+1, j+1, repayment.Date)
+			}
+			repaid += repayment.Amount
+		}
+		if repaid > loan.Amount {
+			return nil, fmt.Errorf("займ №%d: платежи превышают сумму займа", i+1)
+		}
+	}
+
+	return loans, nil
+}
+
+// ImportLoans inserts exported loans and their repayments under new loan IDs in one
+// transaction. It returns errLoanLimit when they would exceed MAX_LOANS_PER_USER.
+func (m *BotManager) ImportLoans(chatID int64, loans []LoanExport) (int, int, error) {
+	// Issue dates are in the user's time zone
+	location := m.UserLocation(chatID)
+
+	repaymentCount := 0
+	err := m.db.Transact(func(tx *sql.Tx) error {
+		// Imported loans count towards the per-user limit
+		if m.config.MaxLoansPerUser > 0 {
+			var loanCount int
+			if err := tx.QueryRow("SELECT COUNT(*) FROM loans WHERE user_id = ? AND deleted = 0", chatID).Scan(&loanCount); err != nil {
+				return err
+			}
+			if loanCount+len(loans) > m.config.MaxLoansPerUser {
+				return errLoanLimit
+			}
+		}
+
+		// Imported loans are numbered after the user's existing ones
+		firstLoanID, err := nextLoanID(tx, chatID, len(loans))
+		if err != nil {
+			return err
+		}
+
+		// A retried transaction counts the repayments again
+		repaymentCount = 0
+		for i, loan := range loans {
+			loanID := firstLoanID + i
+
+			var latitude, longitude sql.NullFloat64
+			if loan.Latitude != nil && loan.Longitude != nil {
+				latitude = sql.NullFloat64{Float64: *loan.Latitude, Valid: true}
+				longitude = sql.NullFloat64{Float64: *loan.Longitude, Valid: true}
+			}
+
+			createdAt, err := storedMidnight(loan.CreatedDate, location)
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.Exec(
+				`INSERT INTO loans (user_id, loan_id, borrower_name, amount, purpose, repaid, forgiven, created_at, due_date, location, latitude, longitude, currency, fx_rate, my_share_percent)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, NULLIF(?, ''), NULLIF(?, ''), ?, ?, NULLIF(?, ''), NULLIF(?, 0), COALESCE(NULLIF(?, 0), 100))`,
+				chatID, loanID, strings.TrimSpace(loan.Borrower), loan.Amount, loan.Purpose, loan.Repaid, loan.Repaid && loan.Forgiven,
+				createdAt, loan.DueDate, loan.Location, latitude, longitude, loan.Currency, loan.FxRate, loan.SharePercent,
+			)
+			if err != nil {
+				return err
+			}
+
+			for _, repayment := range loan.Repayments {
+				_, err = tx.Exec(
+					"INSERT INTO repayments (user_id, loan_id, amount, repayment_date, note) VALUES (?, ?, ?, ?, ?)",
+					chatID, loanID, repayment.Amount, repayment.Date, repayment.Note,
+				)
+				if err != nil {
+					return err
+				}
+				repaymentCount++
+			}
+
+			_, err = tx.Exec(
+				"INSERT INTO loan_events (user_id, loan_id, event_type, details, created_at) VALUES (?, ?, ?, ?, ?)",
+				chatID, loanID, EventCreated, "Займ импортирован из файла", time.Now().UTC(),
+			)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return len(loans), repaymentCount, nil
+}
+
+// ShowStats displays lending statistics
+func (m *BotManager) ShowStats(chatID int64) {
+	var totalLoans int
+	var totalLent int64
+	var totalRepaid int
+
+	// With the toggle on, amounts of co-lent loans count at the user's share only
+	myShare := m.GetBoolSetting(chatID, SettingMyShare, false)
+
+	// Get total loans and amount
+	err := m.db.QueryRow(
+		`SELECT COUNT(*), COALESCE(SUM(amount * CASE WHEN ?2 THEN COALESCE(my_share_percent, 100) ELSE 100 END / 100), 0)
+		FROM loans WHERE user_id = ?1 AND deleted = 0`,
+		chatID, myShare,
+	).Scan(&totalLoans, &totalLent)
+
+	if err != nil {
+		log.Printf("Error getting loan stats: %v", err)
+		m.SendMessage(chatID, dbErrorMessage(err, "❌ Ошибка при формировании статистики. Попробуйте позже."))
+		m.ShowMainMenu(chatID)
+		return
+	}
+
+	// Get repaid count
+	err = m.db.QueryRow(
+		"SELECT COUNT(*) FROM loans WHERE user_id = ? AND repaid = 1 AND COALESCE(forgiven, 0) = 0 AND deleted = 0",
+		chatID,
+	).Scan(&totalRepaid)
+
+	if err != nil {
+		log.Printf("Error getting repaid count: %v", err)
+		m.SendMessage(chatID, dbErrorMessage(err, "❌ Ошибка при формировании статистики. Попробуйте позже."))
+		m.ShowMainMenu(chatID)
+		return
+	}
+
+	// Get forgiven loans and what was written off on them
+	var forgivenCount int
+	var forgivenAmount int64
+	err = m.db.QueryRow(
+		`SELECT COUNT(*), COALESCE(SUM((l.amount - COALESCE(
+			(SELECT SUM(r.amount) FROM repayments r WHERE r.user_id = l.user_id AND r.loan_id = l.loan_id), 0))
+			* CASE WHEN ?2 THEN COALESCE(l.my_share_percent, 100) ELSE 100 END / 100), 0)
+		FROM loans l WHERE l.user_id = ?1 AND COALESCE(l.forgiven, 0) = 1 AND l.deleted = 0`,
+		chatID, myShare,
+	).Scan(&forgivenCount, &forgivenAmount)
+
+	if err != nil {
+		log.Printf("Error getting forgiven loans: %v", err)
+		m.SendMessage(chatID, dbErrorMessage(err, "❌ Ошибка при формировании статистики. Попробуйте позже."))
+		m.ShowMainMenu(chatID)
+		return
+	}
+
+	// Get everything paid back so far, partial repayments included
+	var totalCollected int64
+	err = m.db.QueryRow(
+		`SELECT COALESCE(SUM(r.amount * CASE WHEN ?2 THEN COALESCE(l.my_share_percent, 100) ELSE 100 END / 100), 0) FROM repayments r
+		JOIN loans l ON l.user_id = r.user_id AND l.loan_id = r.loan_id
+		WHERE r.user_id = ?1 AND l.deleted = 0`,
+		chatID, myShare,
+	).Scan(&totalCollected)
+
+	if err != nil {
+		log.Printf("Error getting repaid amount: %v", err)
+		m.SendMessage(chatID, dbErrorMessage(err, "❌ Ошибка при формировании статистики. Попробуйте позже."))
+		m.ShowMainMenu(chatID)
+		return
+	}
+
+	// Format stats message
+	stats := fmt.Sprintf(
+		"📈 Статистика займов:\n\n"+
+			"🔢 Всего займов: %d\n"+
+			"💰 Всего выдано: %s\n"+
+			"✅ Возвращено займов: %d\n"+
+			"⏳ Ожидают возврата: %d\n",
+		totalLoans,
+		m.Money(chatID, totalLent),
+		totalRepaid,
+		totalLoans-totalRepaid-forgivenCount,
+	)
+	if forgivenCount > 0 {
+		stats += fmt.Sprintf("🙏 Прощено: %d %s, списано %s\n", forgivenCount, loansWord(forgivenCount), m.Money(chatID, forgivenAmount))
+	}
+	if totalLent > 0 {
+		stats += fmt.Sprintf(
+			"📊 Погашено: %s %d%% (%s из %s)\n",
+			progressBar(totalCollected, totalLent, 10), repaidPercent(totalCollected, totalLent),
+			m.Money(chatID, totalCollected), m.Money(chatID, totalLent),
+		)
+	}
+
+	// Compare the outstanding debt with the start of the week and of the month
+	today := m.UserNow(chatID)
+	weekStart := today.AddDate(0, 0, -((int(today.Weekday()) + 6) % 7))
+	monthStart := time.Date(today.Year(), today.Month(), 1, 0, 0, 0, 0, today.Location())
+	tomorrow := today.AddDate(0, 0, 1).Format(dateLayout)
+	outstandingNow, _, err := m.OutstandingAt(chatID, tomorrow, myShare)
+	if err != nil {
+		log.Printf("Error getting outstanding trend: %v", err)
+	} else if totalLoans > 0 {
+		stats += "\n"
+		for _, period := range []struct {
+			Label string
+			Start time.Time
+		}{
+			{"С начала недели", weekStart},
+			{"С начала месяца", monthStart},
+		} {
+			outstandingBefore, loansBefore, err := m.OutstandingAt(chatID, period.Start.Format(dateLayout), myShare)
+			if err != nil {
+				log.Printf("Error getting outstanding trend: %v", err)
+				break
+			}
+			stats += m.outstandingTrendLine(chatID, period.Label, outstandingBefore, outstandingNow, loansBefore)
+		}
+	}
+	// Co-lent loans can be counted at the user's share only
+	var hasShared bool
+	err = m.db.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM loans WHERE user_id = ? AND deleted = 0 AND COALESCE(my_share_percent, 100) < 100)",
+		chatID,
+	).Scan(&hasShared)
+	if err != nil {
+		log.Printf("Error checking shared loans: %v", err)
+	}
+	if hasShared && myShare {
+		stats += "👤 Суммы по общим займам — только ваша доля\n"
+	}
+	stats += "\n〰️〰️〰️〰️〰️〰️〰️〰️〰️〰️"
+
+	// Send stats
+	msg := tgbotapi.NewMessage(chatID, stats)
+	if hasShared {
+		msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+			tgbotapi.NewInlineKeyboardRow(m.shareModeButton(chatID, "sharemode_stats")),
+		)
+	}
+	if _, err := m.Send(msg); err != nil {
+		log.Printf("Error sending message: %v", err)
+	}
+	m.ShowMainMenu(chatID)
+}
+
+// OutstandingAt returns how much was owed at the start of the given date (YYYY-MM-DD),
+// rebuilt from loan creation, disbursement and repayment dates, together with how many
+// loans existed by then. Forgiven loans stop counting from the day they were forgiven.
+// With myShare only the user's share of co-lent loans is counted.
+func (m *BotManager) OutstandingAt(chatID int64, date string, myShare bool) (int64, int, error) {
+	var outstanding int64
+	var loanCount int
+	err := m.db.QueryRow(
+		`SELECT COALESCE(SUM(max(0,
+			CASE WHEN COALESCE(l.installments, 0) = 1
+				THEN COALESCE((SELECT SUM(d.amount) FROM disbursements d
+					WHERE d.user_id = l.user_id AND d.loan_id = l.loan_id AND d.disbursement_date < ?1), 0)
+				ELSE l.amount END
+			- COALESCE((SELECT SUM(r.amount) FROM repayments r
+				WHERE r.user_id = l.user_id AND r.loan_id = l.loan_id AND substr(r.repayment_date, 1, 10) < ?1), 0)
+		) * CASE WHEN ?4 THEN COALESCE(l.my_share_percent, 100) ELSE 100 END / 100), 0), COUNT(*)
+		FROM loans l
+		WHERE l.user_id = ?2 AND l.deleted = 0 AND substr(l.created_at, 1, 10) < ?1
+		AND NOT (COALESCE(l.forgiven, 0) = 1 AND EXISTS (SELECT 1 FROM loan_events e
+			WHERE e.user_id = l.user_id AND e.loan_id = l.loan_id AND e.event_type = ?3 AND substr(e.created_at, 1, 10) < ?1))`,
+		date, chatID, EventForgiven, myShare,
+	).Scan(&outstanding, &loanCount)
+	return outstanding, loanCount, err
+}
+
+// outstandingTrendLine describes how the outstanding debt changed since the start of
+// a period, with an arrow pointing the way it went
+func (m *BotManager) outstandingTrendLine(chatID int64, label string, before, now int64, loansBefore int) string {
+	if loansBefore == 0 {
+		return fmt.Sprintf("🆕 %s: займов раньше не было, сравнивать пока не с чем\n", label)
+	}
+
+	switch {
+	case now > before:
+		return fmt.Sprintf("📈 %s: %s → %s (↑ %s)\n", label, m.Money(chatID, before), m.Money(chatID, now), m.Money(chatID, now-before))
+	case now < before:
+		return fmt.Sprintf("📉 %s: %s → %s (↓ %s)\n", label, m.Money(chatID, before), m.Money(chatID, now), m.Money(chatID, before-now))
+	default:
+		return fmt.Sprintf("➡️ %s: без изменений, %s\n", label, m.Money(chatID, now))
+	}
+}
+
+// repaidPercent returns the share of total that is done, from 0 to 100
+func repaidPercent(done, total int64) int {
+	if total <= 0 || done <= 0 {
+		return 0
+	}
+	if done >= total {
+		return 100
+	}
+	return int(done * 100 / total)
+}
+
+// progressBar draws the share of total that is done as a bar of width cells
+func progressBar(done, total int64, width int) string {
+	filled := repaidPercent(done, total) * width / 100
+	return strings.Repeat("▓", filled) + strings.Repeat("░", width-filled)
+}
+
+// ShowLifetimeStats displays all-time lending totals
+func (m *BotManager) ShowLifetimeStats(chatID int64) {
+	var loanCount, borrowerCount int
+	var totalLent, totalCollected int64
+
+	// Get principal issued and unique borrowers
+	err := m.db.QueryRow(
+		"SELECT COUNT(*), COALESCE(SUM(amount), 0), COUNT(DISTINCT borrower_name) FROM loans WHERE user_id = ? AND deleted = 0",
+		chatID,
+	).Scan(&loanCount, &totalLent, &borrowerCount)
+	if err != nil {
+		log.Printf("Error getting lifetime stats: %v", err)
+		m.SendMessage(chatID, "❌ Не удалось получить статистику.")
+		return
+	}
+
+	if loanCount == 0 {
+		m.SendMessage(chatID, "У вас пока нет займов — статистика появится после первого.")
+		return
+	}
+
+	// Get everything collected on those loans
+	err = m.db.QueryRow(
+		`SELECT COALESCE(SUM(r.amount), 0) FROM repayments r
+		JOIN loans l ON l.user_id = r.user_id AND l.loan_id = r.loan_id
+		WHERE r.user_id = ? AND l.deleted = 0`,
+		chatID,
+	).Scan(&totalCollected)
+	if err != nil {
+		log.Printf("Error getting lifetime repayments: %v", err)
+		m.SendMessage(chatID, "❌ Не удалось получить статистику.")
+		return
+	}
+
+	stats := fmt.Sprintf(
+		"🏅 За все время:\n\n"+
+			"💰 Выдано: %s\n"+
+			"✅ Собрано: %s\n"+
+			"🔢 Займов: %d\n"+
+			"👥 Заемщиков: %d\n"+
+			"📏 Средний займ: %s\n\n"+
+			"〰️〰️〰️〰️〰️〰️〰️〰️〰️〰️",
+		m.Money(chatID, totalLent),
+		m.Money(chatID, totalCollected),
+		loanCount,
+		borrowerCount,
+		m.Money(chatID, totalLent/int64(loanCount)),
+	)
+	m.SendMessage(chatID, stats)
+}
+
+// GetMonthlyLending returns the amounts lent in each of the last few months, oldest first.
+// Months without loans are returned as zero.
+func (m *BotManager) GetMonthlyLending(chatID int64, months int, now time.Time) ([]string, []int64, error) {
+	firstMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC).AddDate(0, -(months - 1), 0)
+
+	rows, err := m.db.Query(
+		"SELECT substr(created_at, 1, 7), SUM(amount) FROM loans WHERE user_id = ? AND deleted = 0 AND substr(created_at, 1, 7) >= ? GROUP BY substr(created_at, 1, 7)",
+		chatID, firstMonth.Format("2006-01"),
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	totals := make(map[string]int64)
+	for rows.Next() {
+		var month string
+		var total int64
+		if err := rows.Scan(&month, &total); err != nil {
+			return nil, nil, err
+		}
+		totals[month] = total
+	}
+
+	// Fill in every month so gaps show up as empty bars
+	labels := make([]string, months)
+	amounts := make([]int64, months)
+	for i := 0; i < months; i++ {
+		month := firstMonth.AddDate(0, i, 0)
+		labels[i] = month.Format("01.2006")
+		amounts[i] = totals[month.Format("2006-01")]
+	}
+
+	return labels, amounts, nil
+}
+
+// renderBarChart draws amounts as a PNG bar chart, grouping axis digits with the given separator
+func renderBarChart(labels []string, amounts []int64, separator string) ([]byte, error) {
+	var maxAmount int64
+	bars := make([]chart.Value, len(labels))
+	for i, label := range labels {
+		bars[i] = chart.Value{Label: label, Value: float64(amounts[i])}
+		if amounts[i] > maxAmount {
+			maxAmount = amounts[i]
+		}
+	}
+
+	graph := chart.BarChart{
+		Width:    800,
+		Height:   400,
+		BarWidth: 80,
+		Background: chart.Style{
+			Padding: chart.Box{Top: 40, Left: 20, Right: 20, Bottom: 20},
+		},
+		YAxis: chart.YAxis{
+			// A fixed range keeps equal bars from collapsing the axis
+			Range: &chart.ContinuousRange{Min: 0, Max: float64(maxAmount)},
+			ValueFormatter: func(v interface{}) string {
+				if value, ok := v.(float64); ok {
+					return formatAmount(int64(value), separator)
+				}
+				return ""
+			},
+		},
+		Bars: bars,
+	}
+
+	var buf bytes.Buffer
+	if err := graph.Render(chart.PNG, &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// SendLendingChart sends a bar chart of the amounts lent per month over the last half year
+func (m *BotManager) SendLendingChart(chatID int64) {
+	labels, amounts, err := m.GetMonthlyLending(chatID, chartMonths, time.Now())
+	if err != nil {
+		log.Printf("Error getting monthly lending: %v", err)
+		m.SendMessage(chatID, "❌ Не удалось построить график.")
+		m.ShowMainMenu(chatID)
+		return
+	}
+
+	var total int64
+	for _, amount := range amounts {
+		total += amount
+	}
+	if total == 0 {
+		m.SendMessage(chatID, fmt.Sprintf("📊 За последние %d месяцев займов не было.", chartMonths))
+		m.ShowMainMenu(chatID)
+		return
+	}
+
+	image, err := renderBarChart(labels, amounts, m.GetMoneyFormat(chatID).GroupSeparator)
+	if err != nil {
+		log.Printf("Error rendering chart: %v", err)
+		m.SendMessage(chatID, "❌ Не удалось построить график.")
+		m.ShowMainMenu(chatID)
+		return
+	}
+
+	photo := tgbotapi.NewPhoto(chatID, tgbotapi.FileBytes{Name: "chart.png", Bytes: image})
+	photo.Caption = fmt.Sprintf("📊 Выдано займов по месяцам: %s за %d месяцев", m.Money(chatID, total), chartMonths)
+	if render := m.TextRenderer(chatID); render != nil {
+		photo.Caption = render(photo.Caption)
+	}
+	if _, err := m.bot.Send(photo); err != nil {
+		log.Printf("Error sending chart: %v", err)
+		m.SendMessage(chatID, "❌ Не удалось отправить график.")
+	}
+
+	m.ShowMainMenu(chatID)
+}
+
+// ShowTopBorrowers lists the borrowers who owe the most across their active loans
+func (m *BotManager) ShowTopBorrowers(chatID int64) {
+	rows, err := m.db.Query(
+		`SELECT l.borrower_name, COUNT(*), SUM(l.amount - COALESCE(
+			(SELECT SUM(r.amount) FROM repayments r WHERE r.user_id = l.user_id AND r.loan_id = l.loan_id), 0)) AS outstanding
+		FROM loans l WHERE l.user_id = ? AND l.repaid = 0 AND l.deleted = 0
+		GROUP BY l.borrower_name ORDER BY outstanding DESC LIMIT ?`,
+		chatID, topBorrowersLimit,
+	)
+	if err != nil {
+		log.Printf("Error getting top borrowers: %v", err)
+		m.SendMessage(chatID, "❌ Не удалось получить список должников.")
+		return
+	}
+	defer rows.Close()
+
+	// Build response
+	var response strings.Builder
+	response.WriteString("🏆 Больше всего должны:\n\n")
+
+	place := 0
+	for rows.Next() {
+		var borrower string
+		var loanCount int
+		var outstanding int64
+
+		if err := rows.Scan(&borrower, &loanCount, &outstanding); err != nil {
+			log.Printf("Error scanning top borrower: %v", err)
+			continue
+		}
+
+		place++
+		response.WriteString(fmt.Sprintf(
+			"%d. 👤 %s — %s (займов: %d)\n",
+			place, borrower, m.Money(chatID, outstanding), loanCount,
+		))
+	}
+
+	if place == 0 {
+		m.SendMessage(chatID, "У вас нет активных займов — никто ничего не должен! 🎉")
+		return
+	}
+
+	m.SendMessage(chatID, response.String())
+}
+
+// ShowUntouchedLoans lists active loans without a single repayment, oldest first
+func (m *BotManager) ShowUntouchedLoans(chatID int64) {
+	rows, err := m.db.Query(
+		`SELECT l.loan_id, l.borrower_name, l.amount, COALESCE(l.created_at, '')
+		FROM loans l LEFT JOIN repayments r ON r.user_id = l.user_id AND r.loan_id = l.loan_id
+		WHERE l.user_id = ? AND l.repaid = 0 AND l.deleted = 0 AND r.repayment_id IS NULL
+		ORDER BY l.created_at, l.loan_id`,
+		chatID,
+	)
+	if err != nil {
+		log.Printf("Error getting untouched loans: %v", err)
+		m.SendMessage(chatID, "❌ Не удалось получить список займов.")
+		return
+	}
+	defer rows.Close()
+
+	// Build response
+	var response strings.Builder
+	response.WriteString("🪨 Займы без единого возврата:\n\n")
+
+	now := m.UserNow(chatID)
+	loanCount := 0
+	var total int64
+	for rows.Next() {
+		var loanID int
+		var borrower, createdAt string
+		var amount int64
+
+		if err := rows.Scan(&loanID, &borrower, &amount, &createdAt); err != nil {
+			log.Printf("Error scanning untouched loan: %v", err)
+			continue
+		}
+
+		outstanding := "дата выдачи неизвестна"
+		if created, err := time.ParseInLocation(dateLayout, m.LocalDate(chatID, createdAt), time.Local); err == nil {
+			days := ageInDays(created, now)
+			outstanding = fmt.Sprintf("%d %s", days, daysWord(days))
+		}
+
+		loanCount++
+		total += amount
+		response.WriteString(fmt.Sprintf(
+			"🆔 #%d 👤 %s — %s (%s)\n",
+			loanID, borrower, m.Money(chatID, amount), outstanding,
+		))
+	}
+
+	if loanCount == 0 {
+		m.SendMessage(chatID, "👍 По всем активным займам уже были возвраты.")
+		return
+	}
+
+	response.WriteString(fmt.Sprintf("\n💼 Всего: %s", m.Money(chatID, total)))
+	m.SendLongMessage(chatID, response.String())
+}
+
+// dueInLabel describes how much time is left until a due date, e.g. "через 3 дня"
+func dueInLabel(dueDate string, now time.Time) string {
+	if dueDate == "" {
+		return "без срока"
+	}
+
+	due, err := time.ParseInLocation(dateLayout, dueDate, time.Local)
+	if err != nil {
+		return "срок: " + dueDate
+	}
+
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	days := int(due.Sub(today).Hours() / 24)
+	switch {
+	case days == 0:
+		return "срок сегодня"
+	case days < 0:
+		return fmt.Sprintf("просрочен на %d %s", -days, daysWord(-days))
+	default:
+		return fmt.Sprintf("через %d %s", days, daysWord(days))
+	}
+}
+
+// ShowLoansByDueDate lists active loans by due date, the most urgent first and loans
+// without a due date last
+func (m *BotManager) ShowLoansByDueDate(chatID int64) {
+	rows, err := m.db.Query(
+		`SELECT l.loan_id, l.borrower_name, l.amount - COALESCE(
+			(SELECT SUM(r.amount) FROM repayments r WHERE r.user_id = l.user_id AND r.loan_id = l.loan_id), 0),
+			COALESCE(l.due_date, '')
+		FROM loans l
+		WHERE l.user_id = ? AND l.repaid = 0 AND l.deleted = 0
+		ORDER BY COALESCE(l.due_date, '') = '', l.due_date, l.loan_id`,
+		chatID,
+	)
+	if err != nil {
+		log.Printf("Error getting loans by due date: %v", err)
+		m.SendMessage(chatID, "❌ Не удалось получить список займов.")
+		return
+	}
+	defer rows.Close()
+
+	// Build response
+	var response strings.Builder
+	response.WriteString("📅 Активные займы по сроку возврата:\n\n")
+
+	now := m.UserNow(chatID)
+	loanCount := 0
+	for rows.Next() {
+		var loanID int
+		var borrower, dueDate string
+		var remaining int64
+
+		if err := rows.Scan(&loanID, &borrower, &remaining, &dueDate); err != nil {
+			log.Printf("Error scanning loan by due date: %v", err)
+			continue
+		}
+
+		loanCount++
+		line := fmt.Sprintf("🆔 #%d 👤 %s — %s", loanID, borrower, m.Money(chatID, remaining))
+		if dueDate != "" {
+			line += fmt.Sprintf(" 📅 %s", dueDate)
+		}
+		response.WriteString(fmt.Sprintf("%s (%s)\n", line, dueInLabel(dueDate, now)))
+	}
+
+	if loanCount == 0 {
+		m.SendMessage(chatID, "📭 У вас нет активных займов.")
+		return
+	}
+
+	m.SendLongMessage(chatID, response.String())
+}
+
+// YearSummary holds the totals of the loans issued in one calendar year
+type YearSummary struct {
+	Year      string
+	LoanCount int
+	Lent      int64
+	Repaid    int64
+}
+
+// GetYearlySummaries returns per-year loan totals, newest year first
+func (m *BotManager) GetYearlySummaries(chatID int64) ([]YearSummary, error) {
+	// created_at may hold either SQLite or Go timestamps, so the year is cut from the text
+	rows, err := m.db.Query(
+		`SELECT substr(l.created_at, 1, 4) AS year, COUNT(*), SUM(l.amount), SUM(COALESCE(
+			(SELECT SUM(r.amount) FROM repayments r WHERE r.user_id = l.user_id AND r.loan_id = l.loan_id), 0))
+		FROM loans l WHERE l.user_id = ? AND l.deleted = 0 AND l.created_at IS NOT NULL
+		GROUP BY year ORDER BY year DESC`,
+		chatID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var summaries []YearSummary
+	for rows.Next() {
+		var summary YearSummary
+		if err := rows.Scan(&summary.Year, &summary.LoanCount, &summary.Lent, &summary.Repaid); err != nil {
+			return nil, err
+		}
+		summaries = append(summaries, summary)
+	}
+	return summaries, rows.Err()
+}
+
+// ShowYearlySummary shows how much was lent and repaid per year, current year first
+func (m *BotManager) ShowYearlySummary(chatID int64) {
+	summaries, err := m.GetYearlySummaries(chatID)
+	if err != nil {
+		log.Printf("Error getting yearly summary: %v", err)
+		m.SendMessage(chatID, "❌ Не удалось получить итоги по годам.")
+		return
+	}
+
+	// The current year is always shown, even before its first loan
+	currentYear := strconv.Itoa(time.Now().Year())
+	current := YearSummary{Year: currentYear}
+	var pastYears []YearSummary
+	for _, summary := range summaries {
+		if summary.Year == currentYear {
+			current = summary
+		} else {
+			pastYears = append(pastYears, summary)
+		}
+	}
+
+	// Build response
+	var response strings.Builder
+	response.WriteString("📆 Итоги по годам\n\n")
+	response.WriteString(fmt.Sprintf(
+		"⭐ %s год (на сегодня)\n📋 Займов: %d\n💰 Выдано: %s\n✅ Возвращено: %s\n💵 Остаток: %s\n",
+		current.Year, current.LoanCount,
+		m.Money(chatID, current.Lent), m.Money(chatID, current.Repaid), m.Money(chatID, current.Lent-current.Repaid),
+	))
+
+	for _, summary := range pastYears {
+		response.WriteString(fmt.Sprintf(
+			"\n〰️〰️〰️〰️〰️〰️〰️〰️〰️〰️\n\n📅 %s год\n📋 Займов: %d\n💰 Выдано: %s\n✅ Возвращено: %s\n",
+			summary.Year, summary.LoanCount, m.Money(chatID, summary.Lent), m.Money(chatID, summary.Repaid),
+		))
+	}
+
+	m.SendMessage(chatID, response.String())
+}
+
+// ShowLoanManagementMenu displays options for managing loans
+func (m *BotManager) ShowLoanManagementMenu(chatID int64) {
+	menuButtons := tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("✏️ Редактировать займ", SubMenuEdit),
+			tgbotapi.NewInlineKeyboardButtonData("🗑️ Удалить займ", SubMenuDelete),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("💵 Частичный возврат", SubMenuPartial),
+			tgbotapi.NewInlineKeyboardButtonData("📋 История платежей", SubMenuRepayments),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🔗 Объединить займы", SubMenuMerge),
+			tgbotapi.NewInlineKeyboardButtonData("🤝 Общее погашение", SubMenuSettle),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("👥 Групповой займ", SubMenuGroup),
+			tgbotapi.NewInlineKeyboardButtonData("💸 Займ частями", SubMenuInstallment),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🔁 Регулярные займы", SubMenuRecurring),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🔙 Назад", "back_to_main"),
+		),
+	)
+
+	msg := tgbotapi.NewMessage(chatID, "✏️ Управление займами\nВыберите действие:")
+	msg.ReplyMarkup = menuButtons
+	_, err := m.Send(msg)
+	if err != nil {
+		log.Printf("Error showing loan management menu: %v", err)
+	}
+}
+
+// ShowSettingsMenu displays the user's current settings with buttons to change them
+func (m *BotManager) ShowSettingsMenu(chatID int64) {
+	showPurpose := m.GetBoolSetting(chatID, SettingShowPurpose, true)
+	reminders := m.GetBoolSetting(chatID, SettingReminders, true)
+	digest := m.GetBoolSetting(chatID, SettingDigest, true)
+	textMode := m.GetBoolSetting(chatID, SettingTextMode, false)
+	accessibility := m.GetBoolSetting(chatID, SettingAccessibility, false)
+	keypad := m.GetBoolSetting(chatID, SettingKeypad, false)
+	plainMarks := textMode || accessibility
+
+	menuButtons := tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(
+				fmt.Sprintf("%s Показывать цель в балансе", settingMark(showPurpose, plainMarks)),
+				SettingsTogglePrefix+SettingShowPurpose,
+			),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(
+				fmt.Sprintf("%s Еженедельные напоминания", settingMark(reminders, plainMarks)),
+				SettingsTogglePrefix+SettingReminders,
+			),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(
+				fmt.Sprintf("%s Сводка сроков по воскресеньям", settingMark(digest, plainMarks)),
+				SettingsTogglePrefix+SettingDigest,
+			),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(
+				fmt.Sprintf("%s Кнопки для ввода сумм", settingMark(keypad, plainMarks)),
+				SettingsTogglePrefix+SettingKeypad,
+			),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(
+				fmt.Sprintf("%s Текстовый режим (без эмодзи)", settingMark(textMode, plainMarks)),
+				SettingsTogglePrefix+SettingTextMode,
+			),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(
+				fmt.Sprintf("%s Режим для экранного диктора", settingMark(accessibility, plainMarks)),
+				SettingsTogglePrefix+SettingAccessibility,
+			),
+		),
+	)
+
+	// Multiple-choice settings switch to the next option on each press
+	for _, key := range []string{SettingCurrencyPosition, SettingNumberFormat, SettingDecimalSeparator, SettingDueReminderDays, SettingQuietHours} {
+		menuButtons.InlineKeyboard = append(menuButtons.InlineKeyboard, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(
+				fmt.Sprintf("%s: %s", settingChoiceLabels[key], m.settingChoiceLabel(chatID, key)),
+				SettingsCyclePrefix+key,
+			),
+		))
+	}
+
+	menuButtons.InlineKeyboard = append(menuButtons.InlineKeyboard, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("🔙 Назад", "back_to_main"),
+	))
+
+	msg := tgbotapi.NewMessage(chatID, "⚙️ Настройки\nНажмите на настройку, чтобы изменить её:")
+	msg.ReplyMarkup = menuButtons
+	_, err := m.Send(msg)
+	if err != nil {
+		log.Printf("Error showing settings menu: %v", err)
+	}
+}
+
+// settingChoiceLabel returns the label of the current value of a multiple-choice setting
+func (m *BotManager) settingChoiceLabel(chatID int64, key string) string {
+	choices := settingChoices[key]
+	value := m.GetSetting(chatID, key, choices[0].Value)
+	for _, choice := range choices {
+		if choice.Value == value {
+			return choice.Label
+		}
+	}
+	return choices[0].Label
+}
+
+// CycleSetting switches a multiple-choice setting to its next value
+func (m *BotManager) CycleSetting(chatID int64, key string) {
+	choices := settingChoices[key]
+	value := m.GetSetting(chatID, key, choices[0].Value)
+
+	next := choices[0].Value
+	for i, choice := range choices {
+		if choice.Value == value {
+			next = choices[(i+1)%len(choices)].Value
+			break
+		}
+	}
+
+	if err := m.SetSetting(chatID, key, next); err != nil {
+		log.Printf("Error saving setting %s for user %d: %v", key, chatID, err)
+	}
+}
+
+// settingMark returns the marker shown next to a boolean setting
+func settingMark(enabled bool, textMode bool) string {
+	if textMode {
+		if enabled {
+			return "[вкл]"
+		}
+		return "[выкл]"
+	}
+	if enabled {
+		return "✅"
+	}
+	return "❌"
+}
+
+// ShowSearchMenu displays search options
+func (m *BotManager) ShowSearchMenu(chatID int64) {
+	menuButtons := tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🔎 Поиск по всем полям", SearchAllFields),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("👤 Поиск по имени", SearchByName),
+			tgbotapi.NewInlineKeyboardButtonData("📊 По статусу", SearchByStatus),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("📋 Все займы", SearchAll),
+			tgbotapi.NewInlineKeyboardButtonData("🔴 Просроченные", SearchOverdue),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("📝 По цели", SearchByPurpose),
+			tgbotapi.NewInlineKeyboardButtonData("📅 По сроку", SearchByDueDate),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🔙 Назад", "back_to_main"),
+		),
+	)
+
+	msg := tgbotapi.NewMessage(chatID, "🔍 Поиск займов\nВыберите критерий поиска:")
+	msg.ReplyMarkup = menuButtons
+	_, err := m.Send(msg)
+	if err != nil {
+		log.Printf("Error showing search menu: %v", err)
+	}
+}
+
+// loanCallbackPrefixes are the callback prefixes followed by a loan ID. Active marks
+// buttons that only make sense while the loan is not repaid.
+var loanCallbackPrefixes = []struct {
+	Prefix string
+	Active bool
+}{
+	{"merge_toggle_", true},
+	{"edit_", true},
+	{"name_", true},
+	{"amount_", true},
+	{"purpose_", true},
+	{"delete_", false},
+	{"confirm_delete_", false},
+	{"partial_", true},
+	{"loan_", false},
+	{"events_", false},
+	{"ledger_", false},
+	{"location_", false},
+	{"repeat_", false},
+	{"reopen_", false},
+	{"confirm_reopen_", false},
+	{"keep_reopen_", false},
+	{"phone_", false},
+	{"paylink_", false},
+	{"dispute_", true},
+	{"disburse_", true},
+	{"undispute_", false},
+	{"remindevery_", true},
+	{"snooze_", true},
+	{"unsnooze_", true},
+	{"reassign_", false},
+	{"history_", false},
+	{"repay_", true},
+	{"confirm_repay_", true},
+	{"forgive_", true},
+	{"confirm_forgive_", true},
+	{"extend_", true},
+	{"nudge_", true},
+	{"myshare_", true},
+}
+
+// repaymentCallbackPrefixes are the callback prefixes followed by a repayment ID
+var repaymentCallbackPrefixes = []string{"repayment_amount_", "repayment_delete_", "confirm_repayment_delete_"}
+
+// IsStaleCallback reports whether a button refers to a loan, repayment or flow that no longer exists
+func (m *BotManager) IsStaleCallback(chatID int64, data string) bool {
+	// Buttons that only work inside a running flow
+	switch {
+	case strings.HasPrefix(data, "reassign_pick_"):
+		return m.GetState(chatID).Operation != OpReassignLoan
+	case strings.HasPrefix(data, "dupmerge_"), strings.HasPrefix(data, "dupskip_"):
+		state := m.GetState(chatID)
+		group, _, _ := strings.Cut(strings.TrimPrefix(strings.TrimPrefix(data, "dupmerge_"), "dupskip_"), "_")
+		return state.Operation != OpMergeNames || state.Data["dup_"+group+"_0"] == "" || state.Data["dup_"+group+"_done"] != ""
+	case strings.HasPrefix(data, "settle_pick_"):
+		state := m.GetState(chatID)
+		return state.Operation != OpSettleUp || state.Step != 0
+	case strings.HasPrefix(data, "merge_toggle_"), data == "merge_review", data == "merge_execute":
+		if m.GetState(chatID).Operation != OpMergeLoans {
+			return true
+		}
+	case data == "restart_confirm", data == "restart_cancel":
+		return m.GetState(chatID).Operation == OpNone
+	case strings.HasPrefix(data, KeypadPrefix), strings.HasPrefix(data, QuickAmountPrefix):
+		return !m.AmountPromptActive(chatID)
+	case data == "reset_confirm", data == "reset_cancel":
+		state := m.GetState(chatID)
+		return state.Operation != OpResetData || state.Step != 1
+	case data == "search_more":
+		query, _ := m.GetStateData(chatID, "search_query")
+		return query == ""
+	case data == "percent_confirm", data == "percent_change":
+		state := m.GetState(chatID)
+		return state.Operation != OpPartialRepay || state.Step != 1 || state.Data["percent_amount"] == ""
+	}
+
+	for _, prefix := range repaymentCallbackPrefixes {
+		if strings.HasPrefix(data, prefix) {
+			repaymentID, err := strconv.ParseInt(strings.TrimPrefix(data, prefix), 10, 64)
+			if err != nil {
+				return true
+			}
+			_, err = m.GetRepaymentByID(chatID, repaymentID)
+			return err != nil
+		}
+	}
+
+	for _, callback := range loanCallbackPrefixes {
+		if strings.HasPrefix(data, callback.Prefix) {
+			loanID, err := strconv.Atoi(strings.TrimPrefix(data, callback.Prefix))
+			if err != nil {
+				return true
+			}
+			loan, err := m.GetLoanByID(chatID, loanID)
+			return err != nil || (callback.Active && loan.Repaid)
+		}
+	}
+
+	return false
+}
+
+// toastPrefixes are the callbacks of quick database actions that confirm their
+// success with a toast
+var toastPrefixes = []string{
+	"confirm_delete_", "confirm_repay_", "confirm_repayment_delete_", "merge_execute",
+	SettingsCyclePrefix, SettingsTogglePrefix, "confirm_forgive_", "confirm_reopen_", "keep_reopen_",
+}
+
+// hasToast reports whether the button press is answered with a toast once handled
+func hasToast(data string) bool {
+	for _, prefix := range toastPrefixes {
+		if strings.HasPrefix(data, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// HandleCallbackQuery processes button presses
+func (m *BotManager) HandleCallbackQuery(callback *tgbotapi.CallbackQuery) {
+	// Get the callback data
+	data := callback.Data
+	chatID := callback.Message.Chat.ID
+
+	// Log the callback data for debugging
+	log.Printf("Received callback: %s", data)
+
+	// Buttons on old messages may refer to loans or flows that are gone
+	stale := m.IsStaleCallback(chatID, data)
+
+	// Quick database actions are acknowledged once handled, with a toast when they
+	// succeed. Other presses are acknowledged right away, so the spinner doesn't hang
+	// while slow actions such as charts or exports run.
+	var toast string
+	if stale {
+		m.bot.Send(tgbotapi.NewCallbackWithAlert(callback.ID, "⚠️ Кнопка устарела"))
+	} else if hasToast(data) {
+		defer func() {
+			m.bot.Send(tgbotapi.NewCallback(callback.ID, toast))
+		}()
+	} else {
+		m.bot.Send(tgbotapi.NewCallback(callback.ID, ""))
+	}
+
+	// Remove the keyboard to prevent multiple clicks. Every failure path below
+	// ends with a menu or a "🔙 Назад" button so the user is never left stuck.
+	// The amount keypad stays, it redraws itself on every press.
+	if stale || !strings.HasPrefix(data, KeypadPrefix) {
+		editMsg := tgbotapi.NewEditMessageReplyMarkup(
+			callback.Message.Chat.ID,
+			callback.Message.MessageID,
+			tgbotapi.InlineKeyboardMarkup{
+				InlineKeyboard: [][]tgbotapi.InlineKeyboardButton{},
+			},
+		)
+		m.bot.Send(editMsg)
+	}
+
+	if stale {
+		log.Printf("Ignoring stale callback: %s", data)
+		return
+	}
+
+	// Switch based on the callback data
+	switch {
+	case strings.HasPrefix(data, KeypadPrefix):
+		m.HandleKeypadPress(chatID, callback.Message.MessageID, strings.TrimPrefix(data, KeypadPrefix))
+	case strings.HasPrefix(data, QuickAmountPrefix):
+		m.HandleQuickAmount(chatID, callback.Message.MessageID, strings.TrimPrefix(data, QuickAmountPrefix))
+	case data == MenuAddLoan:
+		m.StartAddLoanFlow(chatID)
+	case data == MenuRepay:
+		m.StartRepayLoanFlow(chatID)
+	case data == MenuBalance:
+		m.ShowBalance(chatID)
+	case data == MenuStats:
+		m.ShowStats(chatID)
+	case data == MenuChart:
+		m.SendLendingChart(chatID)
+	case data == MenuManage:
+		m.ShowLoanManagementMenu(chatID)
+	case data == MenuSearch:
+		m.ShowSearchMenu(chatID)
+	case data == "back_to_manage":
+		m.ShowLoanManagementMenu(chatID)
+	case data == "back_to_search":
+		m.ShowSearchMenu(chatID)
+	case data == "back_to_main":
+		m.ShowMainMenu(chatID)
+	case data == "restart_confirm":
+		payload, _ := m.GetStateData(chatID, "start_payload")
+		m.Restart(chatID, payload)
+	case data == "restart_cancel":
+		m.SendMessage(chatID, "👍 Продолжаем. Введите данные, которые запрашивались ранее.")
+	case data == "reset_confirm":
+		withSettings, _ := m.GetStateData(chatID, "delete_settings")
+		m.ClearState(chatID)
+		m.ResetAllData(chatID, withSettings == "1")
+	case data == "reset_cancel":
+		m.ClearState(chatID)
+		m.SendMessage(chatID, "👍 Сброс отменен, ваши данные сохранены.")
+		m.ShowMainMenu(chatID)
+	case data == "percent_confirm":
+		amountStr, _ := m.GetStateData(chatID, "percent_amount")
+		amount, _ := strconv.ParseInt(amountStr, 10, 64)
+		m.SaveStateData(chatID, "percent_amount", "")
+		m.AskPartialRepaymentNote(chatID, amount)
+	case data == "percent_change":
+		m.SaveStateData(chatID, "percent_amount", "")
+		m.SendMessage(chatID, "Введите сумму частичного возврата или процент от остатка (например, 50%):")
+	case data == SubMenuEdit:
+		m.StartEditLoanFlow(chatID)
+	case data == SubMenuDelete:
+		m.StartDeleteLoanFlow(chatID)
+	case data == SubMenuPartial:
+		m.StartPartialRepaymentFlow(chatID)
+	case data == SubMenuRepayments:
+		m.ShowRepaymentHistory(chatID)
+	case data == SubMenuMerge:
+		m.StartMergeLoansFlow(chatID)
+	case data == SubMenuSettle:
+		m.StartSettleUpFlow(chatID, "")
+	case data == SubMenuGroup:
+		m.StartGroupLoanFlow(chatID)
+	case data == SubMenuInstallment:
+		m.StartInstallmentLoanFlow(chatID)
+	case data == SubMenuRecurring:
+		m.ShowRecurringLoans(chatID)
+	case data == "recurring_new":
+		m.StartRecurringLoanFlow(chatID)
+	case strings.HasPrefix(data, "recurring_pause_"), strings.HasPrefix(data, "recurring_resume_"), strings.HasPrefix(data, "recurring_delete_"):
+		// Extract template ID from callback data (format: "recurring_pause_12")
+		action, idStr, _ := strings.Cut(strings.TrimPrefix(data, "recurring_"), "_")
+		recurringID, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			log.Printf("Error converting recurring loan ID: %v", err)
+			m.SendErrorWithBack(chatID, "❌ Произошла ошибка при выборе шаблона.")
+			return
+		}
+
+		if action == "delete" {
+			err = m.DeleteRecurringLoan(chatID, recurringID)
+		} else {
+			err = m.SetRecurringLoanPaused(chatID, recurringID, action == "pause")
+		}
+		if err != nil {
+			log.Printf("Error updating recurring loan: %v", err)
+			m.SendErrorWithBack(chatID, "❌ Шаблон не найден.")
+			return
+		}
+
+		switch action {
+		case "pause":
+			m.SendMessage(chatID, fmt.Sprintf("⏸️ Шаблон #%d приостановлен.", recurringID))
+		case "resume":
+			m.SendMessage(chatID, fmt.Sprintf("▶️ Шаблон #%d возобновлен.", recurringID))
+		default:
+			m.SendMessage(chatID, fmt.Sprintf("🗑️ Шаблон #%d удален.", recurringID))
+		}
+		m.ShowRecurringLoans(chatID)
+	case strings.HasPrefix(data, "merge_toggle_"):
+		// Extract loan ID from callback data (format: "merge_toggle_123")
+		loanID, err := strconv.Atoi(strings.TrimPrefix(data, "merge_toggle_"))
+		if err != nil {
+			log.Printf("Error converting loan ID: %v", err)
+			m.SendMessage(chatID, "❌ Произошла ошибка при выборе займа.")
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		m.ToggleMergeSelection(chatID, loanID)
+		m.ShowMergeSelection(chatID)
+	case data == "merge_review":
+		m.ShowMergeConfirmation(chatID)
+	case data == "merge_execute":
+		loanIDs := m.GetMergeSelection(chatID)
+		newLoanID, err := m.MergeLoans(chatID, loanIDs)
+		m.ClearState(chatID)
+
+		if errors.Is(err, errMergeBorrowerMismatch) {
+			m.SendMessage(chatID, "❌ Можно объединять только займы одного заемщика.")
+		} else if errors.Is(err, errMergeCurrencyMismatch) {
+			m.SendMessage(chatID, "❌ Можно объединять только займы в одной валюте.")
+		} else if errors.Is(err, errMergeShareMismatch) {
+			m.SendMessage(chatID, "❌ Можно объединять только займы с одинаковой долей.")
+		} else if errors.Is(err, errMergeInstallments) {
+			m.SendMessage(chatID, "❌ Займы, выдаваемые частями, нельзя объединять.")
+		} else if err != nil {
+			log.Printf("Error merging loans: %v", err)
+			m.SendMessage(chatID, "❌ Не удалось объединить займы.")
+		} else {
+			var mergedIDs []string
+			for _, loanID := range loanIDs {
+				mergedIDs = append(mergedIDs, fmt.Sprintf("#%d", loanID))
+			}
+			m.LogLoanEvent(chatID, newLoanID, EventMerged, fmt.Sprintf("Объединены займы %s", strings.Join(mergedIDs, ", ")))
+			m.SendMessage(chatID, fmt.Sprintf("✅ Займы объединены в займ #%d!", newLoanID))
+			toast = "🔗 Займы объединены"
+		}
+
+		m.ShowMainMenu(chatID)
+	case data == SearchByName:
+		m.StartSearchByNameFlow(chatID)
+	case data == SearchByStatus:
+		m.StartSearchByStatusFlow(chatID)
+	case data == SearchAll:
+		m.ShowAllLoans(chatID)
+	case data == SearchOverdue:
+		m.ShowOverdueLoans(chatID)
+	case data == "search_more":
+		m.ShowMoreSearchResults(chatID)
+		m.ShowMainMenu(chatID)
+	case data == SearchByPurpose:
+		m.StartSearchByTextFlow(chatID, "by_purpose", "Введите текст для поиска по цели займа:")
+	case data == SearchAllFields:
+		m.StartSearchByTextFlow(chatID, "all_fields", "Введите имя, цель, заметку, место или номер займа:")
+	case data == SearchByDueDate:
+		m.ShowLoansByDueDate(chatID)
+		m.ShowMainMenu(chatID)
+	case strings.HasPrefix(data, "transfer_accept_"), strings.HasPrefix(data, "transfer_decline_"):
+		// Extract transfer ID from callback data (format: "transfer_accept_123")
+		accept := strings.HasPrefix(data, "transfer_accept_")
+		transferIDStr := strings.TrimPrefix(strings.TrimPrefix(data, "transfer_accept_"), "transfer_decline_")
+		transferID, err := strconv.ParseInt(transferIDStr, 10, 64)
+		if err != nil {
+			log.Printf("Error converting transfer ID: %v", err)
+			m.SendMessage(chatID, "❌ Произошла ошибка при обработке передачи займа.")
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		m.CompleteTransfer(chatID, transferID, accept)
+	case data == MenuSettings:
+		m.ShowSettingsMenu(chatID)
+	case strings.HasPrefix(data, SettingsCyclePrefix):
+		// Switch a multiple-choice setting (format: "settings_cycle_<key>")
+		key := strings.TrimPrefix(data, SettingsCyclePrefix)
+		if _, ok := settingChoices[key]; ok {
+			m.CycleSetting(chatID, key)
+			toast = "⚙️ Настройка сохранена"
+		} else {
+			log.Printf("Unknown setting: %s", key)
+		}
+		m.ShowSettingsMenu(chatID)
+	case strings.HasPrefix(data, SettingsTogglePrefix):
+		// Flip a boolean setting (format: "settings_toggle_<key>")
+		key := strings.TrimPrefix(data, SettingsTogglePrefix)
+		switch key {
+		case SettingShowPurpose, SettingReminders, SettingDigest:
+			enabled := m.GetBoolSetting(chatID, key, true)
+			m.SetBoolSetting(chatID, key, !enabled)
+			toast = "⚙️ Настройка сохранена"
+		case SettingTextMode, SettingAccessibility, SettingKeypad:
+			enabled := m.GetBoolSetting(chatID, key, false)
+			m.SetBoolSetting(chatID, key, !enabled)
+			toast = "⚙️ Настройка сохранена"
+		default:
+			log.Printf("Unknown setting: %s", key)
+		}
+		m.ShowSettingsMenu(chatID)
+	case data == "status_active":
+		m.ShowLoansByStatus(chatID, false)
+	case data == "status_repaid":
+		m.ShowLoansByStatus(chatID, true)
+	case strings.HasPrefix(data, "edit_"):
+		// Extract loan ID from callback data (format: "edit_123")
+		loanIDStr := strings.TrimPrefix(data, "edit_")
+		loanID, err := strconv.Atoi(loanIDStr)
+		if err != nil {
+			log.Printf("Error converting loan ID: %v", err)
+			m.SendMessage(chatID, "❌ Произошла ошибка при выборе займа.")
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		// Get loan details
+		loan, err := m.GetLoanByID(chatID, loanID)
+		if err != nil {
+			log.Printf("Error getting loan details: %v", err)
+			m.SendMessage(chatID, "❌ Не удалось получить информацию о займе.")
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		// Display edit options
+		keyboard := tgbotapi.NewInlineKeyboardMarkup(
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("👤 Изменить имя", fmt.Sprintf("name_%d", loanID)),
+			),
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("💰 Изменить сумму", fmt.Sprintf("amount_%d", loanID)),
+			),
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("📝 Изменить цель", fmt.Sprintf("purpose_%d", loanID)),
+			),
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("🔙 Назад", "back_to_manage"),
+			),
+		)
+
+		msg := tgbotapi.NewMessage(chatID, markdownf(
+			"🔍 Займ #%d\n👤 Заемщик: %s\n💰 Сумма: %s\n📝 Цель: %s\n\nВыберите, что хотите изменить:",
+			loan.ID, loan.Borrower, m.Money(chatID, loan.Amount), userMarkdown(loan.Purpose),
+		))
+		msg.ReplyMarkup = keyboard
+		m.SendMarkdownMessage(msg)
+
+	case strings.HasPrefix(data, "name_"):
+		// Extract loan ID from callback data (format: "name_123")
+		loanIDStr := strings.TrimPrefix(data, "name_")
+		log.Printf("Editing name: original callback data=%s, extracted ID=%s", data, loanIDStr)
+
+		// Validate the loan ID
+		loanID, err := strconv.Atoi(loanIDStr)
+		if err != nil {
+			log.Printf("Error converting loan ID: %v", err)
+			m.SendMessage(chatID, "❌ Произошла ошибка при выборе займа.")
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		// Verify the loan exists
+		_, err = m.GetLoanByID(chatID, loanID)
+		if err != nil {
+			log.Printf("Error verifying loan: %v", err)
+			m.SendMessage(chatID, "❌ Займ не найден.")
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		// Save the pure numeric loan ID and set the operation state
+		m.SaveStateData(chatID, "loan_id", loanIDStr) // Store just the numeric ID
+		m.SaveStateData(chatID, "edit_field", "name")
+		m.SetState(chatID, OpEditLoan, 1)
+
+		// Prompt for new name
+		m.SendMessage(chatID, "Введите новое имя заемщика:")
+
+	case strings.HasPrefix(data, "amount_"):
+		// Extract loan ID from callback data (format: "amount_123")
+		loanIDStr := strings.TrimPrefix(data, "amount_")
+		log.Printf("Editing amount: original callback data=%s, extracted ID=%s", data, loanIDStr)
+
+		// Validate the loan ID
+		loanID, err := strconv.Atoi(loanIDStr)
+		if err != nil {
+			log.Printf("Error converting loan ID: %v", err)
+			m.SendMessage(chatID, "❌ Произошла ошибка при выборе займа.")
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		// Verify the loan exists
+		loan, err := m.GetLoanByID(chatID, loanID)
+		if err != nil {
+			log.Printf("Error verifying loan: %v", err)
+			m.SendMessage(chatID, "❌ Займ не найден.")
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		// The amount of a loan given in installments is the sum of its disbursements
+		if loan.Installments {
+			m.SendErrorWithBack(chatID, "❌ Сумма займа частями складывается из выдач. Используйте кнопку «💸 Выдать еще».")
+			return
+		}
+
+		// Save the pure numeric loan ID and set the operation state
+		m.SaveStateData(chatID, "loan_id", loanIDStr) // Store just the numeric ID
+		m.SaveStateData(chatID, "edit_field", "amount")
+		m.SetState(chatID, OpEditLoan, 1)
+
+		// Prompt for new amount
+		m.SendMessage(chatID, "Введите новую сумму займа (целое число):")
+
+	case strings.HasPrefix(data, "purpose_"):
+		// Extract loan ID from callback data (format: "purpose_123")
+		loanIDStr := strings.TrimPrefix(data, "purpose_")
+		log.Printf("Editing purpose: original callback data=%s, extracted ID=%s", data, loanIDStr)
+
+		// Validate the loan ID
+		loanID, err := strconv.Atoi(loanIDStr)
+		if err != nil {
+			log.Printf("Error converting loan ID: %v", err)
+			m.SendMessage(chatID, "❌ Произошла ошибка при выборе займа.")
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		// Verify the loan exists
+		_, err = m.GetLoanByID(chatID, loanID)
+		if err != nil {
+			log.Printf("Error verifying loan: %v", err)
+			m.SendMessage(chatID, "❌ Займ не найден.")
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		// Save the pure numeric loan ID and set the operation state
+		m.SaveStateData(chatID, "loan_id", loanIDStr) // Store just the numeric ID
+		m.SaveStateData(chatID, "edit_field", "purpose")
+		m.SetState(chatID, OpEditLoan, 1)
+
+		// Prompt for new purpose
+		m.SendMessage(chatID, "Введите новую цель займа:")
+
+	case strings.HasPrefix(data, "delete_"):
+		// Extract loan ID from callback data (format: "delete_123")
+		loanIDStr := strings.TrimPrefix(data, "delete_")
+		loanID, err := strconv.Atoi(loanIDStr)
+		if err != nil {
+			log.Printf("Error converting loan ID: %v", err)
+			m.SendMessage(chatID, "❌ Произошла ошибка при выборе займа.")
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		// Get loan details
+		loan, err := m.GetLoanByID(chatID, loanID)
+		if err != nil {
+			log.Printf("Error getting loan details: %v", err)
+			m.SendMessage(chatID, "❌ Не удалось получить информацию о займе.")
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		// Display confirmation
+		keyboard := tgbotapi.NewInlineKeyboardMarkup(
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("✅ Да, удалить", fmt.Sprintf("confirm_delete_%d", loanID)),
+				tgbotapi.NewInlineKeyboardButtonData("❌ Нет, отмена", "back_to_manage"),
+			),
+		)
+
+		msg := tgbotapi.NewMessage(chatID, markdownf(
+			"⚠️ ВНИМАНИЕ! Вы собираетесь удалить займ:\n\n🆔 Займ #%d\n👤 Заемщик: %s\n💰 Сумма: %s\n📝 Цель: %s\n\nЭто действие нельзя будет отменить. Вы уверены?",
+			loan.ID, loan.Borrower, m.Money(chatID, loan.Amount), userMarkdown(loan.Purpose),
+		))
+		msg.ReplyMarkup = keyboard
+		m.SendMarkdownMessage(msg)
+
+	case strings.HasPrefix(data, "confirm_delete_"):
+		// Extract loan ID from callback data (format: "confirm_delete_123")
+		loanIDStr := strings.TrimPrefix(data, "confirm_delete_")
+		loanID, err := strconv.Atoi(loanIDStr)
+		if err != nil {
+			log.Printf("Error converting loan ID: %v", err)
+			m.SendMessage(chatID, "❌ Произошла ошибка при удалении займа.")
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		// Delete the loan
+		err = m.DeleteLoan(chatID, loanID)
+		if err != nil {
+			log.Printf("Error deleting loan: %v", err)
+			m.SendMessage(chatID, "❌ Произошла ошибка при удалении займа.")
+		} else {
+			m.SendMessage(chatID, "✅ Займ успешно удален!")
+			m.MarkSummaryStale(chatID)
+			toast = "🗑️ Займ удален"
+		}
+
+		m.ShowMainMenu(chatID)
+
+	case strings.HasPrefix(data, "partial_"):
+		// Extract loan ID from callback data (format: "partial_123")
+		loanIDStr := strings.TrimPrefix(data, "partial_")
+		loanID, err := strconv.Atoi(loanIDStr)
+		if err != nil {
+			log.Printf("Error converting loan ID: %v", err)
+			m.SendMessage(chatID, "❌ Произошла ошибка при выборе займа.")
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		// Get loan details
+		loan, err := m.GetLoanByID(chatID, loanID)
+		if err != nil {
+			log.Printf("Error getting loan details: %v", err)
+			m.SendMessage(chatID, "❌ Не удалось получить информацию о займе.")
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		// Calculate remaining amount
+		repaidAmount := m.GetTotalRepaidAmount(chatID, loanID)
+		remainingAmount := loan.Amount - repaidAmount
+
+		// Start from a clean state so nothing is left over from an aborted attempt
+		m.ClearState(chatID)
+
+		// Save the loan ID and set the operation state
+		m.SaveStateData(chatID, "loan_id", loanIDStr)
+		m.SaveStateData(chatID, "remaining_amount", fmt.Sprintf("%d", remainingAmount))
+		m.SetState(chatID, OpPartialRepay, 1)
+
+		// Prompt for repayment amount
+		m.SendAmountPrompt(chatID, fmt.Sprintf(
+			"Займ: #%d от %s\nОсталось выплатить: %s\n\nВведите сумму частичного возврата (целое число) или процент от остатка (например, 50%%):",
+			loan.ID, loan.Borrower, m.Money(chatID, remainingAmount),
+		), m.FrequentRepaymentAmounts(chatID, remainingAmount))
+
+	case strings.HasPrefix(data, "loan_"):
+		// Extract loan ID from callback data (format: "loan_123")
+		loanID, err := strconv.Atoi(strings.TrimPrefix(data, "loan_"))
+		if err != nil {
+			log.Printf("Error converting loan ID: %v", err)
+			m.SendMessage(chatID, "❌ Произошла ошибка при выборе займа.")
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		m.ShowLoanDetails(chatID, loanID)
+
+	case strings.HasPrefix(data, "events_"):
+		// Extract loan ID from callback data (format: "events_123")
+		loanID, err := strconv.Atoi(strings.TrimPrefix(data, "events_"))
+		if err != nil {
+			log.Printf("Error converting loan ID: %v", err)
+			m.SendMessage(chatID, "❌ Произошла ошибка при просмотре истории изменений.")
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		m.ShowLoanEvents(chatID, loanID)
+
+	case strings.HasPrefix(data, "snooze_"), strings.HasPrefix(data, "unsnooze_"):
+		// Extract loan ID from callback data (format: "snooze_123" or "unsnooze_123")
+		snooze := strings.HasPrefix(data, "snooze_")
+		loanID, err := strconv.Atoi(data[strings.Index(data, "_")+1:])
+		if err != nil {
+			log.Printf("Error converting loan ID: %v", err)
+			m.SendMessage(chatID, "❌ Произошла ошибка при изменении напоминаний.")
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		m.SnoozeLoanReminders(chatID, loanID, snooze)
+
+	case strings.HasPrefix(data, "location_"):
+		// Extract loan ID from callback data (format: "location_123")
+		loanID, err := strconv.Atoi(strings.TrimPrefix(data, "location_"))
+		if err != nil {
+			log.Printf("Error converting loan ID: %v", err)
+			m.SendMessage(chatID, "❌ Произошла ошибка при получении места займа.")
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		m.SendLoanLocation(chatID, loanID)
+
+	case strings.HasPrefix(data, "disburse_"):
+		// Extract loan ID from callback data (format: "disburse_123")
+		loanID, err := strconv.Atoi(strings.TrimPrefix(data, "disburse_"))
+		if err != nil {
+			log.Printf("Error converting loan ID: %v", err)
+			m.SendMessage(chatID, "❌ Произошла ошибка при выборе займа.")
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		m.StartDisbursementFlow(chatID, loanID)
+
+	case strings.HasPrefix(data, "dispute_"):
+		// Extract loan ID from callback data (format: "dispute_123")
+		loanID, err := strconv.Atoi(strings.TrimPrefix(data, "dispute_"))
+		if err != nil {
+			log.Printf("Error converting loan ID: %v", err)
+			m.SendMessage(chatID, "❌ Произошла ошибка при выборе займа.")
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		m.ClearState(chatID)
+		m.SaveStateData(chatID, "loan_id", strconv.Itoa(loanID))
+		m.SetState(chatID, OpDisputeLoan, 1)
+		m.SendMessage(chatID, "❗ Опишите, с чем не согласен заемщик (или отправьте \"-\" чтобы пропустить):")
+
+	case strings.HasPrefix(data, "remindevery_"):
+		// Extract loan ID from callback data (format: "remindevery_123")
+		loanID, err := strconv.Atoi(strings.TrimPrefix(data, "remindevery_"))
+		if err != nil {
+			log.Printf("Error converting loan ID: %v", err)
+			m.SendMessage(chatID, "❌ Произошла ошибка при выборе займа.")
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		m.ClearState(chatID)
+		m.SaveStateData(chatID, "loan_id", strconv.Itoa(loanID))
+		m.SetState(chatID, OpRemindEvery, 1)
+		m.SendMessage(chatID, fmt.Sprintf(
+			"⏰ Как часто напоминать об этом займе? Введите число дней (1-%d) или 0, чтобы вернуть еженедельное напоминание:",
+			maxLoanReminderDays,
+		))
+
+	case strings.HasPrefix(data, "extend_"):
+		// Extract loan ID from callback data (format: "extend_123")
+		loanID, err := strconv.Atoi(strings.TrimPrefix(data, "extend_"))
+		if err != nil {
+			log.Printf("Error converting loan ID: %v", err)
+			m.SendMessage(chatID, "❌ Произошла ошибка при выборе займа.")
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		loan, err := m.GetLoanByID(chatID, loanID)
+		if err != nil {
+			log.Printf("Error getting loan details: %v", err)
+			m.SendErrorWithBack(chatID, "❌ Займ не найден.")
+			return
+		}
+
+		m.ClearState(chatID)
+		m.SaveStateData(chatID, "loan_id", strconv.Itoa(loanID))
+		m.SetState(chatID, OpExtendDue, 1)
+		m.SendMessage(chatID, fmt.Sprintf(
+			"📆 Текущий срок: %s.\nВведите новый срок возврата (ДД.ММ.ГГГГ):",
+			dueDateLabel(loan.DueDate),
+		))
+
+	case strings.HasPrefix(data, "nudge_"):
+		// Extract loan ID from callback data (format: "nudge_123")
+		loanID, err := strconv.Atoi(strings.TrimPrefix(data, "nudge_"))
+		if err != nil {
+			log.Printf("Error converting loan ID: %v", err)
+			m.SendMessage(chatID, "❌ Произошла ошибка при выборе займа.")
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		m.SendBorrowerNudge(chatID, loanID)
+
+	case data == "template_nudge":
+		m.StartNudgeTemplateFlow(chatID)
+
+	case strings.HasPrefix(data, "myshare_"):
+		// Extract loan ID from callback data (format: "myshare_123")
+		loanID, err := strconv.Atoi(strings.TrimPrefix(data, "myshare_"))
+		if err != nil {
+			log.Printf("Error converting loan ID: %v", err)
+			m.SendMessage(chatID, "❌ Произошла ошибка при выборе займа.")
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		m.ClearState(chatID)
+		m.SaveStateData(chatID, "loan_id", strconv.Itoa(loanID))
+		m.SetState(chatID, OpMyShare, 1)
+		m.SendMessage(chatID, "👤 Какая часть этого займа — ваши деньги? Введите процент от 1 до 100, например 50, если давали пополам с кем-то:")
+
+	case data == "sharemode_balance", data == "sharemode_stats":
+		myShare := !m.GetBoolSetting(chatID, SettingMyShare, false)
+		m.SetBoolSetting(chatID, SettingMyShare, myShare)
+		if data == "sharemode_balance" {
+			m.ShowBalance(chatID)
+		} else {
+			m.ShowStats(chatID)
+		}
+
+	case strings.HasPrefix(data, "undispute_"):
+		// Extract loan ID from callback data (format: "undispute_123")
+		loanID, err := strconv.Atoi(strings.TrimPrefix(data, "undispute_"))
+		if err != nil {
+			log.Printf("Error converting loan ID: %v", err)
+			m.SendMessage(chatID, "❌ Произошла ошибка при выборе займа.")
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		m.SetLoanDisputed(chatID, loanID, false, "")
+
+	case strings.HasPrefix(data, "phone_"):
+		// Extract loan ID from callback data (format: "phone_123")
+		loanID, err := strconv.Atoi(strings.TrimPrefix(data, "phone_"))
+		if err != nil {
+			log.Printf("Error converting loan ID: %v", err)
+			m.SendMessage(chatID, "❌ Произошла ошибка при выборе займа.")
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		m.StartBorrowerPhoneFlow(chatID, loanID)
+
+	case strings.HasPrefix(data, "paylink_"):
+		// Extract loan ID from callback data (format: "paylink_123")
+		loanID, err := strconv.Atoi(strings.TrimPrefix(data, "paylink_"))
+		if err != nil {
+			log.Printf("Error converting loan ID: %v", err)
+			m.SendMessage(chatID, "❌ Произошла ошибка при выборе займа.")
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		m.StartPaymentLinkFlow(chatID, loanID)
+
+	case strings.HasPrefix(data, "forgive_"):
+		// Extract loan ID from callback data (format: "forgive_123")
+		loanID, err := strconv.Atoi(strings.TrimPrefix(data, "forgive_"))
+		if err != nil {
+			log.Printf("Error converting loan ID: %v", err)
+			m.SendMessage(chatID, "❌ Произошла ошибка при выборе займа.")
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		m.ConfirmForgiveLoan(chatID, loanID)
+
+	case strings.HasPrefix(data, "confirm_forgive_"):
+		// Extract loan ID from callback data (format: "confirm_forgive_123")
+		loanID, err := strconv.Atoi(strings.TrimPrefix(data, "confirm_forgive_"))
+		if err != nil {
+			log.Printf("Error converting loan ID: %v", err)
+			m.SendMessage(chatID, "❌ Произошла ошибка при выборе займа.")
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		if err := m.ForgiveLoan(chatID, loanID); err != nil {
+			log.Printf("Error forgiving loan: %v", err)
+			m.SendErrorWithBack(chatID, "❌ Не удалось простить долг.")
+			return
+		}
+
+		toast = "🙏 Долг прощен"
+		m.SendMessage(chatID, fmt.Sprintf("🙏 Долг по займу #%d прощен, займ закрыт.", loanID))
+		m.ShowLoanDetails(chatID, loanID)
+
+	case strings.HasPrefix(data, "reopen_"):
+		// Extract loan ID from callback data (format: "reopen_123")
+		loanID, err := strconv.Atoi(strings.TrimPrefix(data, "reopen_"))
+		if err != nil {
+			log.Printf("Error converting loan ID: %v", err)
+			m.SendMessage(chatID, "❌ Произошла ошибка при выборе займа.")
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		m.ConfirmReopenLoan(chatID, loanID)
+
+	case strings.HasPrefix(data, "confirm_reopen_"), strings.HasPrefix(data, "keep_reopen_"):
+		// Extract loan ID from callback data (format: "confirm_reopen_123" or "keep_reopen_123")
+		dropFullRepayment := strings.HasPrefix(data, "confirm_reopen_")
+		loanID, err := strconv.Atoi(strings.TrimPrefix(strings.TrimPrefix(data, "confirm_reopen_"), "keep_reopen_"))
+		if err != nil {
+			log.Printf("Error converting loan ID: %v", err)
+			m.SendMessage(chatID, "❌ Произошла ошибка при выборе займа.")
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		if err := m.ReopenLoan(chatID, loanID, dropFullRepayment); err != nil {
+			log.Printf("Error reopening loan: %v", err)
+			m.SendErrorWithBack(chatID, "❌ Не удалось вернуть займ в активные.")
+			return
+		}
+
+		toast = "↩️ Займ снова активен"
+		m.SendMessage(chatID, fmt.Sprintf("↩️ Займ #%d снова активен.", loanID))
+		m.ShowLoanDetails(chatID, loanID)
+
+	case strings.HasPrefix(data, "repeat_"):
+		// Extract loan ID from callback data (format: "repeat_123")
+		loanID, err := strconv.Atoi(strings.TrimPrefix(data, "repeat_"))
+		if err != nil {
+			log.Printf("Error converting loan ID: %v", err)
+			m.SendMessage(chatID, "❌ Произошла ошибка при выборе займа.")
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		m.StartRepeatLoanFlow(chatID, loanID)
+
+	case strings.HasPrefix(data, "ledger_"):
+		// Extract loan ID from callback data (format: "ledger_123")
+		loanID, err := strconv.Atoi(strings.TrimPrefix(data, "ledger_"))
+		if err != nil {
+			log.Printf("Error converting loan ID: %v", err)
+			m.SendMessage(chatID, "❌ Произошла ошибка при формировании выписки.")
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		loan, err := m.GetLoanByID(chatID, loanID)
+		if err != nil {
+			log.Printf("Error getting loan details: %v", err)
+			m.SendMessage(chatID, "❌ Займ не найден.")
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		m.SendBorrowerLedger(chatID, loan.Borrower)
+
+	case strings.HasPrefix(data, "dupmerge_"):
+		// Merge a group of spellings into the chosen one (format: "dupmerge_<group>_<spelling>")
+		group, _, _ := strings.Cut(strings.TrimPrefix(data, "dupmerge_"), "_")
+		canonical, ok := m.GetStateData(chatID, "dup_"+strings.TrimPrefix(data, "dupmerge_"))
+		if !ok {
+			m.SendMessage(chatID, "❌ Выбор устарел. Запустите /duplicates заново.")
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		var spellings []string
+		for i := 0; ; i++ {
+			spelling, ok := m.GetStateData(chatID, fmt.Sprintf("dup_%s_%d", group, i))
+			if !ok {
+				break
+			}
+			spellings = append(spellings, spelling)
+		}
+
+		merged, err := m.MergeBorrowerSpellings(chatID, canonical, spellings)
+		if err != nil {
+			log.Printf("Error merging borrower names: %v", err)
+			m.SendErrorWithBack(chatID, "❌ Не удалось объединить имена.")
+			return
+		}
+
+		m.SendMessage(chatID, fmt.Sprintf("🔗 Имена объединены: %d %s теперь за «%s».", merged, loansWord(merged), strings.TrimSpace(canonical)))
+		m.FinishDuplicateGroup(chatID, group)
+
+	case strings.HasPrefix(data, "dupskip_"):
+		m.FinishDuplicateGroup(chatID, strings.TrimPrefix(data, "dupskip_"))
+
+	case strings.HasPrefix(data, "settle_pick_"):
+		// Use a suggested borrower name (format: "settle_pick_2")
+		name, ok := m.GetStateData(chatID, "suggestion_"+strings.TrimPrefix(data, "settle_pick_"))
+		if !ok {
+			m.SendMessage(chatID, "❌ Выбор устарел. Начните погашение заново.")
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		m.HandleSettleUpStep(chatID, name)
+
+	case strings.HasPrefix(data, "reassign_pick_"):
+		// Use a suggested borrower name (format: "reassign_pick_2")
+		name, ok := m.GetStateData(chatID, "suggestion_"+strings.TrimPrefix(data, "reassign_pick_"))
+		state := m.GetState(chatID)
+		if !ok || state.Operation != OpReassignLoan || state.Step != 1 {
+			m.SendMessage(chatID, "❌ Выбор устарел. Начните смену заёмщика заново.")
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		m.HandleReassignLoanStep(chatID, name)
+
+	case strings.HasPrefix(data, "reassign_"):
+		// Extract loan ID from callback data (format: "reassign_123")
+		loanID, err := strconv.Atoi(strings.TrimPrefix(data, "reassign_"))
+		if err != nil {
+			log.Printf("Error converting loan ID: %v", err)
+			m.SendMessage(chatID, "❌ Произошла ошибка при выборе займа.")
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		m.StartReassignLoanFlow(chatID, loanID)
+
+	case strings.HasPrefix(data, "history_"):
+		// Extract loan ID from callback data (format: "history_123")
+		loanIDStr := strings.TrimPrefix(data, "history_")
+		loanID, err := strconv.Atoi(loanIDStr)
+		if err != nil {
+			log.Printf("Error converting loan ID: %v", err)
+			m.SendMessage(chatID, "❌ Произошла ошибка при просмотре истории.")
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		// Show repayment history for this loan
+		m.ShowLoanRepaymentHistory(chatID, loanID)
+
+	case strings.HasPrefix(data, "repayment_amount_"):
+		// Extract repayment ID from callback data (format: "repayment_amount_123")
+		repaymentIDStr := strings.TrimPrefix(data, "repayment_amount_")
+		repaymentID, err := strconv.ParseInt(repaymentIDStr, 10, 64)
+		if err != nil {
+			log.Printf("Error converting repayment ID: %v", err)
+			m.SendMessage(chatID, "❌ Произошла ошибка при выборе платежа.")
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		// Get repayment details
+		repayment, err := m.GetRepaymentByID(chatID, repaymentID)
+		if err != nil {
+			log.Printf("Error getting repayment details: %v", err)
+			m.SendMessage(chatID, "❌ Платеж не найден.")
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		// Save the repayment ID and set the operation state
+		m.ClearState(chatID)
+		m.SaveStateData(chatID, "repayment_id", repaymentIDStr)
+		m.SetState(chatID, OpEditRepay, 1)
+
+		// Prompt for new amount
+		m.SendMessage(chatID, fmt.Sprintf(
+			"Платеж от %s по займу #%d\n💵 Текущая сумма: %s\n\nВведите новую сумму платежа (целое число):",
+			repayment.Date, repayment.LoanID, m.Money(chatID, repayment.Amount),
+		))
+
+	case strings.HasPrefix(data, "repayment_delete_"):
+		// Extract repayment ID from callback data (format: "repayment_delete_123")
+		repaymentIDStr := strings.TrimPrefix(data, "repayment_delete_")
+		repaymentID, err := strconv.ParseInt(repaymentIDStr, 10, 64)
+		if err != nil {
+			log.Printf("Error converting repayment ID: %v", err)
+			m.SendMessage(chatID, "❌ Произошла ошибка при выборе платежа.")
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		// Get repayment details
+		repayment, err := m.GetRepaymentByID(chatID, repaymentID)
+		if err != nil {
+			log.Printf("Error getting repayment details: %v", err)
+			m.SendMessage(chatID, "❌ Платеж не найден.")
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		// Display confirmation
+		keyboard := tgbotapi.NewInlineKeyboardMarkup(
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("✅ Да, удалить", fmt.Sprintf("confirm_repayment_delete_%d", repaymentID)),
+				tgbotapi.NewInlineKeyboardButtonData("❌ Нет, отмена", fmt.Sprintf("history_%d", repayment.LoanID)),
+			),
+		)
+
+		msg := tgbotapi.NewMessage(chatID, fmt.Sprintf(
+			"⚠️ Вы собираетесь удалить платеж по займу #%d:\n\n📅 %s\n💵 Сумма: %s\n\nЭто действие нельзя будет отменить. Вы уверены?",
+			repayment.LoanID, repayment.Date, m.Money(chatID, repayment.Amount),
+		))
+		msg.ReplyMarkup = keyboard
+		m.Send(msg)
+
+	case strings.HasPrefix(data, "confirm_repayment_delete_"):
+		// Extract repayment ID from callback data (format: "confirm_repayment_delete_123")
+		repaymentIDStr := strings.TrimPrefix(data, "confirm_repayment_delete_")
+		repaymentID, err := strconv.ParseInt(repaymentIDStr, 10, 64)
+		if err != nil {
+			log.Printf("Error converting repayment ID: %v", err)
+			m.SendMessage(chatID, "❌ Произошла ошибка при удалении платежа.")
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		// Keep the deleted payment for the activity log
+		repayment, err := m.GetRepaymentByID(chatID, repaymentID)
+		if err != nil {
+			log.Printf("Error getting repayment details: %v", err)
+			m.SendMessage(chatID, "❌ Платеж не найден.")
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		// Delete the repayment
+		loanID, err := m.DeleteRepayment(chatID, repaymentID)
+		if err != nil {
+			log.Printf("Error deleting repayment: %v", err)
+			m.SendMessage(chatID, "❌ Произошла ошибка при удалении платежа.")
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		m.LogLoanEvent(chatID, loanID, EventRepaymentDeleted, fmt.Sprintf("Удален платеж от %s на %s", repayment.Date, m.Money(chatID, repayment.Amount)))
+
+		m.SendMessage(chatID, "✅ Платеж успешно удален!")
+		toast = "🗑️ Платеж удален"
+		m.ShowLoanRepaymentHistory(chatID, loanID)
+
+	case strings.HasPrefix(data, "repay_"):
+		// Extract loan ID from callback data (format: "repay_123")
+		loanIDStr := strings.TrimPrefix(data, "repay_")
+		loanID, err := strconv.Atoi(loanIDStr)
+		if err != nil {
+			log.Printf("Error converting loan ID: %v", err)
+			m.SendMessage(chatID, "❌ Произошла ошибка при выборе займа.")
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		// Get loan details
+		loan, err := m.GetLoanByID(chatID, loanID)
+		if err != nil {
+			log.Printf("Error getting loan details: %v", err)
+			m.SendMessage(chatID, "❌ Не удалось получить информацию о займе.")
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		// Display confirmation
+		keyboard := tgbotapi.NewInlineKeyboardMarkup(
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("✅ Да, подтверждаю", fmt.Sprintf("confirm_repay_%d", loanID)),
+				tgbotapi.NewInlineKeyboardButtonData("❌ Нет, отмена", "back_to_main"),
+			),
+		)
+
+		msg := tgbotapi.NewMessage(chatID, markdownf(
+			"Вы собираетесь отметить займ как возвращенный:\n\n🆔 Займ #%d\n👤 Заемщик: %s\n💰 Сумма: %s\n📝 Цель: %s\n\nПодтверждаете?",
+			loan.ID, loan.Borrower, m.Money(chatID, loan.Amount), userMarkdown(loan.Purpose),
+		))
+		msg.ReplyMarkup = keyboard
+		m.SendMarkdownMessage(msg)
+
+	case strings.HasPrefix(data, "confirm_repay_"):
+		// Extract loan ID from callback data (format: "confirm_repay_123")
+		loanIDStr := strings.TrimPrefix(data, "confirm_repay_")
+		loanID, err := strconv.Atoi(loanIDStr)
+		if err != nil {
+			log.Printf("Error converting loan ID: %v", err)
+			m.SendMessage(chatID, "❌ Произошла ошибка при подтверждении возврата.")
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		// Get loan details
+		loan, err := m.GetLoanByID(chatID, loanID)
+		if err != nil {
+			log.Printf("Error getting loan details: %v", err)
+			m.SendMessage(chatID, "❌ Не удалось получить информацию о займе.")
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		// Mark loan as repaid
+		_, err = m.db.Exec(
+			"UPDATE loans SET repaid = 1 WHERE user_id = ? AND loan_id = ?",
+			chatID, loanID,
+		)
+		if err != nil {
+			log.Printf("Error marking loan as repaid: %v", err)
+			m.SendMessage(chatID, "❌ Произошла ошибка при отметке займа как возвращенного.")
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		// Insert into repayments table
+		date := m.UserToday(chatID)
+		_, err = m.db.Exec(
+			"INSERT INTO repayments (user_id, loan_id, amount, repayment_date, note) VALUES (?, ?, ?, ?, 'Полный возврат')",
+			chatID, loanID, loan.Amount, date,
+		)
+		if err != nil {
+			log.Printf("Error recording repayment: %v", err)
+			// Loan is already marked as repaid, so we proceed
+		}
+
+		m.LogLoanEvent(chatID, loanID, EventRepaid, "Займ отмечен как возвращенный")
+
+		// Send confirmation
+		m.SendMessage(chatID, fmt.Sprintf(
+			"✅ Займ #%d от %s на сумму %s отмечен как возвращенный!",
+			loan.ID, loan.Borrower, m.Money(chatID, loan.Amount),
+		))
+		toast = "✅ Возврат отмечен"
+
+		m.ShowMainMenu(chatID)
+
+	default:
+		log.Printf("Unknown callback data: %s", data)
+		m.SendMessage(chatID, "❓ Неизвестная команда")
+		m.ShowMainMenu(chatID)
+	}
+}
+
+// ShowLoansByStatus displays loans filtered by repaid status
+func (m *BotManager) ShowLoansByStatus(chatID int64, repaidStatus bool) {
+	rows, err := m.db.Query(
+		"SELECT loan_id, borrower_name, amount, purpose, COALESCE(due_date, ''), COALESCE(disputed, 0), COALESCE(dispute_note, ''), COALESCE(currency, ''), COALESCE(fx_rate, 0), COALESCE(forgiven, 0) FROM loans WHERE user_id = ? AND repaid = ? AND deleted = 0",
+		chatID, repaidStatus,
+	)
+	if err != nil {
+		log.Printf("Error getting loans by status: %v", err)
+		m.SendMessage(chatID, "❌ Не удалось получить список займов.")
+		m.ShowMainMenu(chatID)
+		return
+	}
+	defer rows.Close()
+
+	var loans []Loan
+	for rows.Next() {
+		var loan Loan
+		loan.UserID = chatID
+		loan.Repaid = repaidStatus
+
+		if err := rows.Scan(&loan.ID, &loan.Borrower, &loan.Amount, &loan.Purpose, &loan.DueDate, &loan.Disputed, &loan.DisputeNote, &loan.Currency, &loan.FxRate, &loan.Forgiven); err != nil {
+			log.Printf("Error scanning loan: %v", err)
+			continue
+		}
+
+		loans = append(loans, loan)
+	}
+
+	if len(loans) == 0 {
+		status := "возвращенных"
+		if !repaidStatus {
+			status = "активных"
+		}
+		m.SendMessage(chatID, fmt.Sprintf("У вас нет %s займов.", status))
+		m.ShowMainMenu(chatID)
+		return
+	}
+
+	// Build response
+	var response strings.Builder
+	status := "✅ Возвращенные"
+	if !repaidStatus {
+		status = "⏳ Активные"
+	}
+	response.WriteString(markdownf("📋 %s займы:\n\n", status))
+
+	for _, loan := range loans {
+		if !loan.Repaid {
+			// Calculate remaining amount for active loans
+			repaidAmount := m.GetTotalRepaidAmount(chatID, loan.ID)
+			remainingAmount := loan.Amount - repaidAmount
+
+			response.WriteString(markdownf(
+				"🆔 Займ #%d\n👤 Заемщик: %s\n💰 Сумма: %s\n💵 Остаток: %s\n📝 Цель: %s\n➖➖➖➖➖➖➖➖➖➖\n\n",
+				loan.ID, loan.Borrower, m.Money(chatID, loan.Amount), m.Money(chatID, remainingAmount), userMarkdown(loan.Purpose),
+			))
+		} else {
+			response.WriteString(markdownf(
+				"🆔 Займ #%d\n👤 Заемщик: %s\n💰 Сумма: %s\n📝 Цель: %s\n➖➖➖➖➖➖➖➖➖➖\n\n",
+				loan.ID, loan.Borrower, m.Money(chatID, loan.Amount), userMarkdown(loan.Purpose),
+			))
+		}
+	}
+
+	// Send response
+	m.SendMarkdown(chatID, response.String())
+	m.ShowMainMenu(chatID)
+}
+
+// GetLoanByID retrieves a loan by its ID
+func (m *BotManager) GetLoanByID(chatID int64, loanID int) (Loan, error) {
+	var loan Loan
+	loan.UserID = chatID
+	loan.ID = loanID
+
+	err := m.db.QueryRow(
+		`SELECT borrower_name, amount, purpose, repaid, COALESCE(due_date, ''), COALESCE(snooze_until, ''),
+		COALESCE(created_at, ''), COALESCE(location, ''), latitude, longitude, group_id,
+		COALESCE(disputed, 0), COALESCE(dispute_note, ''), COALESCE(reminder_interval_days, 0), COALESCE(installments, 0),
+		COALESCE(currency, ''), COALESCE(fx_rate, 0), COALESCE(forgiven, 0), COALESCE(my_share_percent, 100),
+		(SELECT COUNT(*) FROM extensions e WHERE e.user_id = loans.user_id AND e.loan_id = loans.loan_id)
+		FROM loans WHERE user_id = ? AND loan_id = ? AND deleted = 0`,
+		chatID, loanID,
+	).Scan(
+		&loan.Borrower, &loan.Amount, &loan.Purpose, &loan.Repaid, &loan.DueDate, &loan.SnoozeUntil,
+		&loan.CreatedDate, &loan.Location, &loan.Latitude, &loan.Longitude, &loan.GroupID,
+		&loan.Disputed, &loan.DisputeNote, &loan.ReminderDays, &loan.Installments,
+		&loan.Currency, &loan.FxRate, &loan.Forgiven, &loan.SharePercent,
+		&loan.Extensions,
+	)
+
+	if err != nil {
+		return Loan{}, err
+	}
+	loan.CreatedDate = m.LocalDate(chatID, loan.CreatedDate)
+
+	return loan, nil
+}
+
+// DeleteLoan removes a loan and its repayments from the database
+func (m *BotManager) DeleteLoan(chatID int64, loanID int) error {
+	var deletedRepayments int64
+	err := m.db.Transact(func(tx *sql.Tx) error {
+		// Delete repayments first (due to foreign key constraints)
+		result, err := tx.Exec("DELETE FROM repayments WHERE user_id = ? AND loan_id = ?", chatID, loanID)
+		if err != nil {
+			return err
+		}
+		deletedRepayments, _ = result.RowsAffected()
+
+		// Delete the activity log
+		_, err = tx.Exec("DELETE FROM loan_events WHERE user_id = ? AND loan_id = ?", chatID, loanID)
+		if err != nil {
+			return err
+		}
+
+		// Remove the sent due-date notifications as cleanup; loan IDs are never reused
+		_, err = tx.Exec("DELETE FROM due_notifications WHERE user_id = ? AND loan_id = ?", chatID, loanID)
+		if err != nil {
+			return err
+		}
+
+		// Delete the disbursements of a loan given in installments
+		_, err = tx.Exec("DELETE FROM disbursements WHERE user_id = ? AND loan_id = ?", chatID, loanID)
+		if err != nil {
+			return err
+		}
+
+		// Delete the amount change history
+		_, err = tx.Exec("DELETE FROM loan_amount_history WHERE user_id = ? AND loan_id = ?", chatID, loanID)
+		if err != nil {
+			return err
+		}
+
+		// Delete the due date extensions
+		_, err = tx.Exec("DELETE FROM extensions WHERE user_id = ? AND loan_id = ?", chatID, loanID)
+		if err != nil {
+			return err
+		}
+
+		// Delete the loan
+		_, err = tx.Exec("DELETE FROM loans WHERE user_id = ? AND loan_id = ?", chatID, loanID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	m.RecordDeletions(deletedRepayments + 1)
+	return nil
+}
+
+// ShowLoanRepaymentHistory displays the repayment history for a specific loan
+func (m *BotManager) ShowLoanRepaymentHistory(chatID int64, loanID int) {
+	// Get loan details
+	loan, err := m.GetLoanByID(chatID, loanID)
+	if err != nil {
+		log.Printf("Error getting loan details: %v", err)
+		m.SendMessage(chatID, "❌ Не удалось получить информацию о займе.")
+		m.ShowMainMenu(chatID)
+		return
+	}
+
+	// Get repayment history
+	rows, err := m.db.Query(
+		"SELECT repayment_id, amount, repayment_date, COALESCE(note, '') FROM repayments WHERE user_id = ? AND loan_id = ? ORDER BY repayment_date",
+		chatID, loanID,
+	)
+	if err != nil {
+		log.Printf("Error getting repayment history: %v", err)
+		m.SendMessage(chatID, "❌ Не удалось получить историю платежей.")
+		m.ShowMainMenu(chatID)
+		return
+	}
+	defer rows.Close()
+
+	// Build response
+	var response strings.Builder
+	response.WriteString(markdownf("📋 История платежей по займу #%d:\n\n", loanID))
+	response.WriteString(markdownf("👤 Заемщик: %s\n", loan.Borrower))
+	response.WriteString(markdownf("💰 Общая сумма: %s\n", m.LoanMoney(chatID, loan, loan.Amount)))
+	response.WriteString(loanRateLine(loan) + "\n")
+
+	// Calculate total repaid
+	var totalRepaid int64
+	var repayments []struct {
+		ID     int64
+		Amount int64
+		Date   string
+		Note   string
+	}
+
+	for rows.Next() {
+		var id int64
+		var amount int64
+		var date string
+		var note string
+
+		if err := rows.Scan(&id, &amount, &date, &note); err != nil {
+			log.Printf("Error scanning repayment: %v", err)
+			continue
+		}
+
+		totalRepaid += amount
+		repayments = append(repayments, struct {
+			ID     int64
+			Amount int64
+			Date   string
+			Note   string
+		}{
+			ID:     id,
+			Amount: amount,
+			Date:   date,
+			Note:   note,
+		})
+	}
+
+	// Display individual repayments
+	if len(repayments) == 0 {
+		response.WriteString(markdownf("Нет записей о платежах по этому займу.\n"))
+	} else {
+		for i, repayment := range repayments {
+			response.WriteString(markdownf(
+				"%d. 📅 %s\n💵 Сумма: %s",
+				i+1, repayment.Date, m.LoanMoney(chatID, loan, repayment.Amount),
+			))
+			if repayment.Note != "" {
+				response.WriteString(markdownf("\n📝 Примечание: %s", userMarkdown(repayment.Note)))
+			}
+			response.WriteString("\n\n")
+		}
+	}
+
+	// Add summary
+	remainingAmount := loan.Amount - totalRepaid
+	status := "✅ Возвращен полностью"
+	if !loan.Repaid {
+		status = fmt.Sprintf("⏳ Остаток: %s", m.LoanMoney(chatID, loan, remainingAmount))
+	}
+
+	response.WriteString(markdownf(
+		"💵 Итого выплачено: %s\n📊 Статус: %s",
+		m.LoanMoney(chatID, loan, totalRepaid), status,
+	))
+
+	// Send response and show back button
+	m.SendMarkdown(chatID, response.String())
+
+	// Provide buttons to correct individual repayments
+	var keyboard [][]tgbotapi.InlineKeyboardButton
+	for i, repayment := range repayments {
+		keyboard = append(keyboard, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(
+				fmt.Sprintf("✏️ Сумма №%d", i+1),
+				fmt.Sprintf("repayment_amount_%d", repayment.ID),
+			),
+			tgbotapi.NewInlineKeyboardButtonData(
+				fmt.Sprintf("🗑️ №%d", i+1),
+				fmt.Sprintf("repayment_delete_%d", repayment.ID),
+			),
+		))
+	}
+
+	// Provide a button to go back
+	keyboard = append(keyboard, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("🔙 Назад", "back_to_manage"),
+	))
+
+	msg := tgbotapi.NewMessage(chatID, "Выберите действие:")
+	msg.ReplyMarkup = tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+	m.Send(msg)
+}
+
+// StartSearchByNameFlow begins the process of searching for loans by borrower name
+func (m *BotManager) StartSearchByNameFlow(chatID int64) {
+	// First clear any existing state
+	m.ClearState(chatID)
+
+	// Set state for search by name
+	m.SetState(chatID, OpSearchLoan, 0)
+	m.SaveStateData(chatID, "search_type", "by_name")
+
+	// Send prompt for borrower name
+	m.SendMessage(chatID, "Введите имя заемщика для поиска:")
+}
+
+// StartSearchByTextFlow begins a text search of the given type ("by_purpose" or "all_fields")
+func (m *BotManager) StartSearchByTextFlow(chatID int64, searchType, prompt string) {
+	m.ClearState(chatID)
+	m.SetState(chatID, OpSearchLoan, 0)
+	m.SaveStateData(chatID, "search_type", searchType)
+
+	m.SendMessage(chatID, prompt)
+}
+
+// StartSearchByStatusFlow begins the process of searching for loans by status
+func (m *BotManager) StartSearchByStatusFlow(chatID int64) {
+	// Create inline keyboard for status selection
+	keyboard := tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("⏳ Активные", "status_active"),
+			tgbotapi.NewInlineKeyboardButtonData("✅ Возвращенные", "status_repaid"),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🔙 Назад", "back_to_search"),
+		),
+	)
+
+	msg := tgbotapi.NewMessage(chatID, "Выберите статус займов для поиска:")
+	msg.ReplyMarkup = keyboard
+	m.Send(msg)
+}
+
+// ShowAllLoans displays all loans for a user
+func (m *BotManager) ShowAllLoans(chatID int64) {
+	allLoans, err := m.GetAllLoansForUser(chatID)
+	if err != nil {
+		log.Printf("Error getting loans: %v", err)
+		m.SendMessage(chatID, "❌ Не удалось получить список займов.")
+		m.ShowMainMenu(chatID)
+		return
+	}
+
+	if len(allLoans) == 0 {
+		m.SendMessage(chatID, "У вас нет займов.")
+		m.ShowMainMenu(chatID)
+		return
+	}
+
+	// Build response
+	var response strings.Builder
+	response.WriteString(markdownf("📋 Все займы:\n\n"))
+
+	for _, loan := range allLoans {
+		response.WriteString(m.FormatLoanEntry(chatID, loan))
+	}
+
+	// Send response
+	m.SendMarkdown(chatID, response.String())
+	m.ShowMainMenu(chatID)
+}
+
+// loanRateLine shows the lending-day rate of a loan given in a foreign currency
+func loanRateLine(loan Loan) string {
+	if loan.Currency == "" || loan.FxRate <= 0 {
+		return ""
+	}
+	return markdownf("💱 Курс на день займа: 1 %s = %s ₸\n", loan.Currency, formatRate(loan.FxRate))
+}
+
+// FormatLoanEntry renders a loan as a MarkdownV2 list entry including its status and remaining amount
+func (m *BotManager) FormatLoanEntry(chatID int64, loan Loan) string {
+	disputeMark := ""
+	if loan.Disputed {
+		disputeMark = "❗ "
+	}
+	searchMatch := ""
+	if loan.SearchMatch != "" {
+		searchMatch = markdownf("🎯 Совпадение: %s\n", loan.SearchMatch)
+	}
+
+	if loan.Repaid {
+		entry := markdownf(
+			"%s🆔 Займ #%d\n👤 Заемщик: %s\n💰 Сумма: %s\n📝 Цель: %s\n",
+			disputeMark, loan.ID, loan.Borrower, m.LoanMoney(chatID, loan, loan.Amount), userMarkdown(loan.Purpose),
+		) + searchMatch + loanRateLine(loan)
+		if loan.Location != "" || loan.Latitude.Valid {
+			entry += markdownf("📍 Место: %s\n", locationLabel(loan))
+		}
+		if loan.Phone != "" {
+			entry += markdownf("📞 Телефон: %s\n", userMarkdown(loan.Phone))
+		}
+		if loan.GroupID.Valid {
+			entry += markdownf("👥 Доля группового займа #%d\n", loan.GroupID.Int64)
+		}
+		if loan.Forgiven {
+			return entry + markdownf("📊 Статус: %s\n➖➖➖➖➖➖➖➖➖➖\n\n", "🙏 Долг прощен")
+		}
+		return entry + markdownf("📊 Статус: %s\n➖➖➖➖➖➖➖➖➖➖\n\n", "✅ Возвращен")
+	}
+
+	// Calculate remaining amount for active loans
+	repaidAmount := m.GetTotalRepaidAmount(chatID, loan.ID)
+	remainingAmount := loan.Amount - repaidAmount
+
+	entry := markdownf(
+		"%s🆔 Займ #%d\n👤 Заемщик: %s\n💰 Сумма: %s\n💵 Остаток: %s\n📝 Цель: %s\n",
+		disputeMark, loan.ID, loan.Borrower, m.LoanMoney(chatID, loan, loan.Amount), m.LoanMoney(chatID, loan, remainingAmount), userMarkdown(loan.Purpose),
+	) + searchMatch + loanRateLine(loan)
+	if loan.CreatedDate != "" {
+		entry += markdownf("📆 %s\n", loanAgeLabel(loan.CreatedDate, m.UserNow(chatID)))
+	}
+	if loan.DueDate != "" {
+		entry += markdownf("📅 Срок возврата: %s\n", loan.DueDate)
+	}
+	if loan.Extensions > 0 {
+		entry += markdownf("📆 Срок продлевался %d %s\n", loan.Extensions, timesWord(loan.Extensions))
+	}
+	if loan.SharePercent > 0 && loan.SharePercent < 100 {
+		entry += markdownf("👤 Моя доля: %d%% (%s из остатка)\n", loan.SharePercent, m.LoanMoney(chatID, loan, shareOf(remainingAmount, loan.SharePercent)))
+	}
+	if loan.Location != "" || loan.Latitude.Valid {
+		entry += markdownf("📍 Место: %s\n", locationLabel(loan))
+	}
+	if loan.Phone != "" {
+		entry += markdownf("📞 Телефон: %s\n", userMarkdown(loan.Phone))
+	}
+	if loan.GroupID.Valid {
+		entry += markdownf("👥 Доля группового займа #%d\n", loan.GroupID.Int64)
+	}
+	now := m.UserNow(chatID)
+	if days := loanDaysOverdue(loan, now); days > 0 {
+		entry += markdownf("🔴 Просрочен на %d дн.\n", days)
+	}
+	if isSnoozed(loan, now) {
+		entry += markdownf("🔕 Напоминания отложены до %s\n", loan.SnoozeUntil)
+	}
+	if loan.Installments {
+		entry += markdownf("💸 Выдается частями\n")
+	}
+	if loan.ReminderDays > 0 {
+		entry += markdownf("⏰ Напоминания: каждые %d %s\n", loan.ReminderDays, daysWord(loan.ReminderDays))
+	}
+	if loan.Disputed {
+		if loan.DisputeNote != "" {
+			entry += markdownf("❗ Оспаривается: %s\n", userMarkdown(loan.DisputeNote))
+		} else {
+			entry += markdownf("❗ Оспаривается, напоминания не отправляются\n")
+		}
+	}
+
+	return entry + markdownf("📊 Статус: %s\n➖➖➖➖➖➖➖➖➖➖\n\n", "⏳ Активен")
+}
+
+// ageInDays returns how many whole days before now a loan was issued. Back-dated loans
+// with a creation date in the future count as issued today.
+func ageInDays(created time.Time, now time.Time) int {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	createdDay := time.Date(created.Year(), created.Month(), created.Day(), 0, 0, 0, 0, time.Local)
+
+	days := int(today.Sub(createdDay).Hours() / 24)
+	if days < 0 {
+		return 0
+	}
+	return days
+}
+
+// daysWord returns the Russian word for "days" agreeing with n, e.g. 1 день, 2 дня, 5 дней
+func daysWord(n int) string {
+	switch {
+	case n%100 >= 11 && n%100 <= 14:
+		return "дней"
+	case n%10 == 1:
+		return "день"
+	case n%10 >= 2 && n%10 <= 4:
+		return "дня"
+	default:
+		return "дней"
+	}
+}
+
+// loanAgeLabel describes when a loan was issued, e.g. "Выдан 45 дней назад"
+func loanAgeLabel(createdDate string, now time.Time) string {
+	created, err := time.ParseInLocation(dateLayout, createdDate, time.Local)
+	if err != nil {
+		return "Выдан: " + createdDate
+	}
+
+	days := ageInDays(created, now)
+	if days == 0 {
+		return "Выдан сегодня"
+	}
+	return fmt.Sprintf("Выдан %d %s назад", days, daysWord(days))
+}
+
+// isSnoozed reports whether a loan is still left out of reminders
+func isSnoozed(loan Loan, now time.Time) bool {
+	return loan.SnoozeUntil != "" && loan.SnoozeUntil > now.Format(dateLayout)
+}
+
+// loanDaysOverdue returns how many days an active loan is past its due date, or 0
+func loanDaysOverdue(loan Loan, now time.Time) int {
+	if loan.Repaid || loan.DueDate == "" {
+		return 0
+	}
+
+	dueDate, err := time.ParseInLocation(dateLayout, loan.DueDate, time.Local)
+	if err != nil {
+		return 0
+	}
+
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	days := int(today.Sub(dueDate).Hours() / 24)
+	if days < 0 {
+		return 0
+	}
+	return days
+}
+
+// ShowOverdueLoans lists active loans past their due date, most overdue first
+func (m *BotManager) ShowOverdueLoans(chatID int64) {
+	activeLoans, err := m.GetActiveLoansForUser(chatID)
+	if err != nil {
+		log.Printf("Error getting active loans: %v", err)
+		m.SendMessage(chatID, "❌ Не удалось получить список займов.")
+		m.ShowMainMenu(chatID)
+		return
+	}
+
+	now := m.UserNow(chatID)
+	var overdueLoans []Loan
+	for _, loan := range activeLoans {
+		if loanDaysOverdue(loan, now) > 0 {
+			overdueLoans = append(overdueLoans, loan)
+		}
+	}
+
+	if len(overdueLoans) == 0 {
+		m.SendMessage(chatID, "✅ Нет просроченных займов.")
+		m.ShowMainMenu(chatID)
+		return
+	}
+
+	sort.SliceStable(overdueLoans, func(i, j int) bool {
+		return loanDaysOverdue(overdueLoans[i], now) > loanDaysOverdue(overdueLoans[j], now)
+	})
+
+	m.SendLoansWithActions(chatID, fmt.Sprintf("🔴 Просроченные займы (%d):\n\n", len(overdueLoans)), overdueLoans)
+
+	// What is still owed on the overdue loans
+	var totalOverdue int64
+	for _, loan := range overdueLoans {
+		totalOverdue += loan.Amount - m.GetTotalRepaidAmount(chatID, loan.ID)
+	}
+	m.SendMessage(chatID, fmt.Sprintf("💼 Всего просрочено: %s", m.Money(chatID, totalOverdue)))
+	m.ShowMainMenu(chatID)
+}
+
+// LoanActionButtons returns the inline buttons for acting on a loan
+func LoanActionButtons(loan Loan) []tgbotapi.InlineKeyboardButton {
+	if loan.Repaid {
+		return tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("🔍 #%d", loan.ID), fmt.Sprintf("loan_%d", loan.ID)),
+			tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("📋 #%d", loan.ID), fmt.Sprintf("history_%d", loan.ID)),
+		)
+	}
+
+	return tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("🔍 #%d", loan.ID), fmt.Sprintf("loan_%d", loan.ID)),
+		tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("✏️ #%d", loan.ID), fmt.Sprintf("edit_%d", loan.ID)),
+		tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("💵 #%d", loan.ID), fmt.Sprintf("partial_%d", loan.ID)),
+		tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("📋 #%d", loan.ID), fmt.Sprintf("history_%d", loan.ID)),
+		tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("✅ #%d", loan.ID), fmt.Sprintf("repay_%d", loan.ID)),
+	)
+}
+
+// ShowLoanDetails displays a single loan with buttons for every action on it
+func (m *BotManager) ShowLoanDetails(chatID int64, loanID int) {
+	loan, err := m.GetLoanByID(chatID, loanID)
+	if err != nil {
+		log.Printf("Error getting loan details: %v", err)
+		m.SendMessage(chatID, "❌ Займ не найден.")
+		m.ShowMainMenu(chatID)
+		return
+	}
+	loan.Phone = m.GetBorrowerPhone(chatID, loan.Borrower)
+
+	var keyboard [][]tgbotapi.InlineKeyboardButton
+	if !loan.Repaid {
+		keyboard = append(keyboard,
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("✏️ Редактировать", fmt.Sprintf("edit_%d", loan.ID)),
+				tgbotapi.NewInlineKeyboardButtonData("💵 Частичный возврат", fmt.Sprintf("partial_%d", loan.ID)),
+			),
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("✅ Отметить возврат", fmt.Sprintf("repay_%d", loan.ID)),
+			),
+		)
+
+		snoozeButton := tgbotapi.NewInlineKeyboardButtonData("🔕 Отложить напоминания", fmt.Sprintf("snooze_%d", loan.ID))
+		if isSnoozed(loan, m.UserNow(chatID)) {
+			snoozeButton = tgbotapi.NewInlineKeyboardButtonData("🔔 Возобновить напоминания", fmt.Sprintf("unsnooze_%d", loan.ID))
+		}
+		disputeButton := tgbotapi.NewInlineKeyboardButtonData("❗ Отметить спор", fmt.Sprintf("dispute_%d", loan.ID))
+		if loan.Disputed {
+			disputeButton = tgbotapi.NewInlineKeyboardButtonData("🤝 Спор решен", fmt.Sprintf("undispute_%d", loan.ID))
+		}
+		keyboard = append(keyboard,
+			tgbotapi.NewInlineKeyboardRow(snoozeButton, disputeButton),
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("⏰ Частота напоминаний", fmt.Sprintf("remindevery_%d", loan.ID)),
+				tgbotapi.NewInlineKeyboardButtonData("🙏 Простить долг", fmt.Sprintf("forgive_%d", loan.ID)),
+			),
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("📆 Продлить срок", fmt.Sprintf("extend_%d", loan.ID)),
+				tgbotapi.NewInlineKeyboardButtonData("📤 Напомнить заёмщику", fmt.Sprintf("nudge_%d", loan.ID)),
+			),
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("👤 Моя доля", fmt.Sprintf("myshare_%d", loan.ID)),
+			),
+		)
+	}
+	keyboard = append(keyboard,
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("📋 История платежей", fmt.Sprintf("history_%d", loan.ID)),
+			tgbotapi.NewInlineKeyboardButtonData("🕓 История изменений", fmt.Sprintf("events_%d", loan.ID)),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("📒 Выписка по заемщику", fmt.Sprintf("ledger_%d", loan.ID)),
+			tgbotapi.NewInlineKeyboardButtonData("🔄 Сменить заёмщика", fmt.Sprintf("reassign_%d", loan.ID)),
+		),
+	)
+	if loan.Latitude.Valid && loan.Longitude.Valid {
+		keyboard = append(keyboard, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🗺️ Показать на карте", fmt.Sprintf("location_%d", loan.ID)),
+		))
+	}
+	phoneLabel := "📞 Добавить телефон"
+	if loan.Phone != "" {
+		phoneLabel = "📞 Изменить телефон"
+	}
+	keyboard = append(keyboard, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData(phoneLabel, fmt.Sprintf("phone_%d", loan.ID)),
+		tgbotapi.NewInlineKeyboardButtonData("💳 Ссылка на оплату", fmt.Sprintf("paylink_%d", loan.ID)),
+	))
+	if loan.Installments && !loan.Repaid {
+		keyboard = append(keyboard, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("💸 Выдать еще", fmt.Sprintf("disburse_%d", loan.ID)),
+		))
+	}
+	if loan.Repaid {
+		keyboard = append(keyboard, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🔁 Повторить займ", fmt.Sprintf("repeat_%d", loan.ID)),
+			tgbotapi.NewInlineKeyboardButtonData("↩️ Вернуть в активные", fmt.Sprintf("reopen_%d", loan.ID)),
+		))
+	}
+	keyboard = append(keyboard, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("🔙 Назад", "back_to_main"),
+	))
+
+	text := m.FormatLoanEntry(chatID, loan)
+	if loan.Installments {
+		text += m.FormatInstallmentHistory(chatID, loan.ID)
+	}
+
+	msg := tgbotapi.NewMessage(chatID, text)
+	msg.ReplyMarkup = tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+	m.SendMarkdownMessage(msg)
+}
+
+// SnoozeLoanReminders leaves a loan out of reminders for snoozeDays, or brings it back
+func (m *BotManager) SnoozeLoanReminders(chatID int64, loanID int, snooze bool) {
+	snoozeUntil := ""
+	if snooze {
+		snoozeUntil = m.UserNow(chatID).AddDate(0, 0, snoozeDays).Format(dateLayout)
+	}
+
+	_, err := m.db.Exec(
+		"UPDATE loans SET snooze_until = NULLIF(?, '') WHERE user_id = ? AND loan_id = ? AND deleted = 0",
+		snoozeUntil, chatID, loanID,
+	)
+	if err != nil {
+		log.Printf("Error updating loan snooze: %v", err)
+		m.SendErrorWithBack(chatID, "❌ Не удалось изменить напоминания по займу.")
+		return
+	}
+
+	if snooze {
+		m.SendMessage(chatID, fmt.Sprintf("🔕 Напоминания по займу #%d отложены до %s.", loanID, snoozeUntil))
+	} else {
+		m.SendMessage(chatID, fmt.Sprintf("🔔 Напоминания по займу #%d возобновлены.", loanID))
+	}
+	m.ShowLoanDetails(chatID, loanID)
+}
+
+// borrowerKey identifies a borrower in the borrowers table the way sameBorrower compares names
+func borrowerKey(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// GetBorrowerPhone returns the phone saved for a borrower, or ""
+func (m *BotManager) GetBorrowerPhone(chatID int64, borrower string) string {
+	var phone string
+	err := m.db.QueryRow(
+		"SELECT COALESCE(phone, '') FROM borrowers WHERE user_id = ? AND name_key = ?",
+		chatID, borrowerKey(borrower),
+	).Scan(&phone)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Error getting phone of %s: %v", borrower, err)
+		}
+		return ""
+	}
+	return phone
+}
+
+// SetBorrowerPhone saves the phone of a borrower for all their loans; "" removes it
+func (m *BotManager) SetBorrowerPhone(chatID int64, borrower string, phone string) error {
+	_, err := m.db.Exec(
+		`INSERT INTO borrowers (user_id, name_key, name, phone) VALUES (?, ?, ?, NULLIF(?, ''))
+		ON CONFLICT(user_id, name_key) DO UPDATE SET name = excluded.name, phone = excluded.phone`,
+		chatID, borrowerKey(borrower), strings.TrimSpace(borrower), phone,
+	)
+	return err
+}
+
+// normalizePhone checks a typed phone number and strips separators such as
+// spaces, dashes and brackets, keeping a leading "+"
+func normalizePhone(text string) (string, error) {
+	text = strings.TrimSpace(text)
+	var digits strings.Builder
+	for i, r := range text {
+		switch {
+		case r >= '0' && r <= '9':
+			digits.WriteRune(r)
+		case r == '+' && i == 0:
+		case r == ' ' || r == '-' || r == '(' || r == ')' || r == '.':
+		default:
+			return "", fmt.Errorf("invalid character %q in phone number", r)
+		}
+	}
+
+	// E.164 numbers have at most 15 digits
+	if digits.Len() < 5 || digits.Len() > 15 {
+		return "", fmt.Errorf("phone number has %d digits", digits.Len())
+	}
+	if strings.HasPrefix(text, "+") {
+		return "+" + digits.String(), nil
+	}
+	return digits.String(), nil
+}
+
+// StartBorrowerPhoneFlow asks for the phone of the borrower of a loan
+func (m *BotManager) StartBorrowerPhoneFlow(chatID int64, loanID int) {
+	loan, err := m.GetLoanByID(chatID, loanID)
+	if err != nil {
+		log.Printf("Error getting loan details: %v", err)
+		m.SendErrorWithBack(chatID, "❌ Займ не найден.")
+		return
+	}
+
+	m.ClearState(chatID)
+	m.SaveStateData(chatID, "loan_id", strconv.Itoa(loanID))
+	m.SaveStateData(chatID, "borrower_name", loan.Borrower)
+	m.SetState(chatID, OpBorrowerPhone, 1)
+
+	prompt := fmt.Sprintf("📞 Введите телефон заемщика %s или отправьте его контакт.", loan.Borrower)
+	if phone := m.GetBorrowerPhone(chatID, loan.Borrower); phone != "" {
+		prompt += fmt.Sprintf("\nСейчас сохранен: %s. Отправьте \"-\", чтобы удалить его.", phone)
+	}
+	m.SendMessage(chatID, prompt)
+}
+
+// HandleBorrowerPhoneStep saves the phone typed or shared for a borrower
+func (m *BotManager) HandleBorrowerPhoneStep(chatID int64, text string) {
+	borrower, _ := m.GetStateData(chatID, "borrower_name")
+	loanIDStr, _ := m.GetStateData(chatID, "loan_id")
+	loanID, err := strconv.Atoi(loanIDStr)
+	if err != nil {
+		log.Printf("Error converting loan ID: %v", err)
+		m.SendMessage(chatID, "❌ Произошла ошибка при сохранении телефона.")
+		m.ClearState(chatID)
+		m.ShowMainMenu(chatID)
+		return
+	}
+
+	phone := ""
+	if text != "-" {
+		phone, err = normalizePhone(text)
+		if err != nil {
+			m.SendMessage(chatID, "❌ Некорректный номер. Введите телефон, например +7 701 123 45 67, или \"-\":")
+			return
+		}
+	}
+
+	if err := m.SetBorrowerPhone(chatID, borrower, phone); err != nil {
+		log.Printf("Error saving phone of %s: %v", borrower, err)
+		m.SendMessage(chatID, "❌ Не удалось сохранить телефон.")
+		m.ClearState(chatID)
+		m.ShowMainMenu(chatID)
+		return
+	}
+
+	if phone == "" {
+		m.SendMessage(chatID, fmt.Sprintf("🗑️ Телефон заемщика %s удален.", borrower))
+	} else {
+		m.SendMessage(chatID, fmt.Sprintf("✅ Телефон заемщика %s сохранен: %s", borrower, phone))
+	}
+	m.ClearState(chatID)
+	m.ShowLoanDetails(chatID, loanID)
+}
+
+// paymentLinkAmount is the placeholder replaced with the amount owed in a payment link template
+const paymentLinkAmount = "{amount}"
+
+// GetBorrowerPaymentLink returns the payment link template saved for a borrower, or ""
+func (m *BotManager) GetBorrowerPaymentLink(chatID int64, borrower string) string {
+	var link string
+	err := m.db.QueryRow(
+		"SELECT COALESCE(payment_link, '') FROM borrowers WHERE user_id = ? AND name_key = ?",
+		chatID, borrowerKey(borrower),
+	).Scan(&link)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Error getting payment link of %s: %v", borrower, err)
+		}
+		return ""
+	}
+	return link
+}
+
+// SetBorrowerPaymentLink saves the payment link template of a borrower; "" removes it
+func (m *BotManager) SetBorrowerPaymentLink(chatID int64, borrower string, link string) error {
+	_, err := m.db.Exec(
+		`INSERT INTO borrowers (user_id, name_key, name, payment_link) VALUES (?, ?, ?, NULLIF(?, ''))
+		ON CONFLICT(user_id, name_key) DO UPDATE SET name = excluded.name, payment_link = excluded.payment_link`,
+		chatID, borrowerKey(borrower), strings.TrimSpace(borrower), link,
+	)
+	return err
+}
+
+// paymentLinkURL fills the amount into a payment link template
+func paymentLinkURL(template string, amount int64) string {
+	return strings.ReplaceAll(template, paymentLinkAmount, strconv.FormatInt(amount, 10))
+}
+
+// validPaymentLink reports whether a template gives a link Telegram accepts on a URL button
+func validPaymentLink(template string) bool {
+	link, err := url.Parse(paymentLinkURL(template, 1))
+	return err == nil && (link.Scheme == "https" || link.Scheme == "http") && link.Host != ""
+}
+
+// PaymentRequestButtons returns a URL button opening the borrower's payment link with the
+// amount filled in, or nil when no link is configured
+func (m *BotManager) PaymentRequestButtons(chatID int64, loan Loan, remaining int64, label string) []tgbotapi.InlineKeyboardButton {
+	template := m.GetBorrowerPaymentLink(chatID, loan.Borrower)
+	if template == "" {
+		return nil
+	}
+	return tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonURL(label, paymentLinkURL(template, remaining)))
+}
+
+// SendReminderMessage sends a reminder with optional payment request buttons
+func (m *BotManager) SendReminderMessage(chatID int64, text string, keyboard [][]tgbotapi.InlineKeyboardButton) {
+	// During the user's quiet hours the reminder waits until the window ends
+	if until, quiet := quietHoursEnd(m.GetSetting(chatID, SettingQuietHours, "off"), m.UserNow(chatID)); quiet {
+		err := m.DeferReminderMessage(chatID, text, keyboard, until)
+		if err == nil {
+			return
+		}
+		log.Printf("Error deferring reminder to %d, sending now: %v", chatID, err)
+	}
+
+	m.deliverReminderMessage(chatID, text, keyboard)
+}
+
+// deliverReminderMessage sends a reminder right away
+func (m *BotManager) deliverReminderMessage(chatID int64, text string, keyboard [][]tgbotapi.InlineKeyboardButton) {
+	if len(keyboard) == 0 {
+		m.SendMessage(chatID, text)
+		return
+	}
+
+	msg := tgbotapi.NewMessage(chatID, text)
+	msg.ReplyMarkup = tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+	if _, err := m.Send(msg); err != nil {
+		log.Printf("Error sending reminder to %d: %v", chatID, err)
+	}
+}
+
+// quietHoursEnd reports whether now falls inside the quiet hours setting, e.g. "22-8",
+// and when they end. The range may wrap past midnight.
+func quietHoursEnd(setting string, now time.Time) (time.Time, bool) {
+	startText, endText, ok := strings.Cut(setting, "-")
+	if !ok {
+		return time.Time{}, false
+	}
+	start, err := strconv.Atoi(startText)
+	if err != nil {
+		return time.Time{}, false
+	}
+	end, err := strconv.Atoi(endText)
+	if err != nil || start == end {
+		return time.Time{}, false
+	}
+
+	hour := now.Hour()
+	quiet := hour >= start && hour < end
+	if start > end {
+		quiet = hour >= start || hour < end
+	}
+	if !quiet {
+		return time.Time{}, false
+	}
+
+	until := time.Date(now.Year(), now.Month(), now.Day(), end, 0, 0, 0, now.Location())
+	if !until.After(now) {
+		until = until.AddDate(0, 0, 1)
+	}
+	return until, true
+}
+
+// DeferReminderMessage stores a reminder to be sent at the given time
+func (m *BotManager) DeferReminderMessage(chatID int64, text string, keyboard [][]tgbotapi.InlineKeyboardButton, sendAt time.Time) error {
+	keyboardJSON, err := json.Marshal(keyboard)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.db.Exec(
+		"INSERT INTO deferred_messages (user_id, text, keyboard, send_after) VALUES (?, ?, ?, ?)",
+		chatID, text, string(keyboardJSON), sendAt.Unix(),
+	)
+	return err
+}
+
+// StartDeferredMessageScheduler delivers reminders held back by quiet hours once they end
+func (m *BotManager) StartDeferredMessageScheduler() {
+	go func() {
+		ticker := time.NewTicker(deferredCheckInterval)
+		for {
+			<-ticker.C
+			m.SendDeferredMessages()
+		}
+	}()
+}
+
+// SendDeferredMessages sends the reminders whose quiet hours are over. Each message is
+// deleted before it is sent, so a restart never delivers it twice.
+func (m *BotManager) SendDeferredMessages() {
+	rows, err := m.db.Query(
+		"SELECT message_id, user_id, text, COALESCE(keyboard, '') FROM deferred_messages WHERE send_after <= ? ORDER BY send_after, message_id",
+		time.Now().Unix(),
+	)
+	if err != nil {
+		log.Printf("Error querying deferred messages: %v", err)
+		return
+	}
+
+	type deferredMessage struct {
+		ID       int64
+		UserID   int64
+		Text     string
+		Keyboard string
+	}
+	var messages []deferredMessage
+	for rows.Next() {
+		var message deferredMessage
+		if err := rows.Scan(&message.ID, &message.UserID, &message.Text, &message.Keyboard); err != nil {
+			log.Printf("Error scanning deferred message: %v", err)
+			continue
+		}
+		messages = append(messages, message)
+	}
+	rows.Close()
+
+	for _, message := range messages {
+		result, err := m.db.Exec("DELETE FROM deferred_messages WHERE message_id = ?", message.ID)
+		if err != nil {
+			log.Printf("Error claiming deferred message %d: %v", message.ID, err)
+			continue
+		}
+		if deleted, _ := result.RowsAffected(); deleted == 0 {
+			continue
+		}
+
+		var keyboard [][]tgbotapi.InlineKeyboardButton
+		if message.Keyboard != "" {
+			if err := json.Unmarshal([]byte(message.Keyboard), &keyboard); err != nil {
+				log.Printf("Error decoding keyboard of deferred message %d: %v", message.ID, err)
+			}
+		}
+		m.deliverReminderMessage(message.UserID, message.Text, keyboard)
+	}
+}
+
+// StartPaymentLinkFlow asks for the payment link template of the borrower of a loan
+func (m *BotManager) StartPaymentLinkFlow(chatID int64, loanID int) {
+	loan, err := m.GetLoanByID(chatID, loanID)
+	if err != nil {
+		log.Printf("Error getting loan details: %v", err)
+		m.SendErrorWithBack(chatID, "❌ Займ не найден.")
+		return
+	}
+
+	m.ClearState(chatID)
+	m.SaveStateData(chatID, "loan_id", strconv.Itoa(loanID))
+	m.SaveStateData(chatID, "borrower_name", loan.Borrower)
+	m.SetState(chatID, OpPaymentLink, 1)
+
+	prompt := fmt.Sprintf(
+		"💳 Введите ссылку для запроса денег у заемщика %s. Вместо суммы напишите %s, например:\nhttps://pay.kaspi.kz/pay/ваш_номер?amount=%s\n\nКнопка с этой ссылкой появится в напоминаниях.",
+		loan.Borrower, paymentLinkAmount, paymentLinkAmount,
+	)
+	if link := m.GetBorrowerPaymentLink(chatID, loan.Borrower); link != "" {
+		prompt += fmt.Sprintf("\nСейчас сохранена: %s. Отправьте \"-\", чтобы удалить ее.", link)
+	}
+	m.SendMessage(chatID, prompt)
+}
+
+// HandlePaymentLinkStep saves the payment link template typed for a borrower
+func (m *BotManager) HandlePaymentLinkStep(chatID int64, text string) {
+	borrower, _ := m.GetStateData(chatID, "borrower_name")
+	loanIDStr, _ := m.GetStateData(chatID, "loan_id")
+	loanID, err := strconv.Atoi(loanIDStr)
+	if err != nil {
+		log.Printf("Error converting loan ID: %v", err)
+		m.SendMessage(chatID, "❌ Произошла ошибка при сохранении ссылки.")
+		m.ClearState(chatID)
+		m.ShowMainMenu(chatID)
+		return
+	}
+
+	link := strings.TrimSpace(text)
+	if link == "-" {
+		link = ""
+	} else if !validPaymentLink(link) {
+		m.SendMessage(chatID, "❌ Некорректная ссылка. Введите ссылку, начинающуюся с https://, или \"-\":")
+		return
+	}
+
+	if err := m.SetBorrowerPaymentLink(chatID, borrower, link); err != nil {
+		log.Printf("Error saving payment link of %s: %v", borrower, err)
+		m.SendMessage(chatID, "❌ Не удалось сохранить ссылку.")
+		m.ClearState(chatID)
+		m.ShowMainMenu(chatID)
+		return
+	}
+
+	if link == "" {
+		m.SendMessage(chatID, fmt.Sprintf("🗑️ Ссылка на оплату для %s удалена.", borrower))
+	} else if !strings.Contains(link, paymentLinkAmount) {
+		m.SendMessage(chatID, fmt.Sprintf("✅ Ссылка на оплату для %s сохранена. В ней нет %s, поэтому сумма не будет подставляться.", borrower, paymentLinkAmount))
+	} else {
+		m.SendMessage(chatID, fmt.Sprintf("✅ Ссылка на оплату для %s сохранена.", borrower))
+	}
+	m.ClearState(chatID)
+	m.ShowLoanDetails(chatID, loanID)
+}
+
+// defaultNudgeTemplate is the borrower reminder used until the user saves their own
+const defaultNudgeTemplate = "Привет, {name}! Напоминаю о займе {amount} от {date}. Осталось вернуть {remaining}. Спасибо!"
+
+// nudgePlaceholders describes the placeholders a nudge template may use
+const nudgePlaceholders = "{name} — имя заемщика\n{amount} — сумма займа\n{date} — дата займа\n{remaining} — остаток долга\n{due} — срок возврата"
+
+// RenderNudge fills the user's nudge template with the details of a loan
+func (m *BotManager) RenderNudge(chatID int64, loan Loan, remaining int64) string {
+	template := m.GetSetting(chatID, SettingNudgeTemplate, defaultNudgeTemplate)
+	return strings.NewReplacer(
+		"{name}", loan.Borrower,
+		"{amount}", m.LoanMoney(chatID, loan, loan.Amount),
+		"{date}", loan.CreatedDate,
+		"{remaining}", m.LoanMoney(chatID, loan, remaining),
+		"{due}", dueDateLabel(loan.DueDate),
+	).Replace(template)
+}
+
+// SendBorrowerNudge sends a ready-made reminder for the borrower of a loan on its own,
+// so it can be forwarded or copied as is
+func (m *BotManager) SendBorrowerNudge(chatID int64, loanID int) {
+	loan, err := m.GetLoanByID(chatID, loanID)
+	if err != nil {
+		log.Printf("Error getting loan details: %v", err)
+		m.SendErrorWithBack(chatID, "❌ Займ не найден.")
+		return
+	}
+
+	remaining := loan.Amount - m.GetTotalRepaidAmount(chatID, loanID)
+	m.SendMessage(chatID, m.RenderNudge(chatID, loan, remaining))
+
+	m.ClearState(chatID)
+	m.SaveStateData(chatID, "loan_id", strconv.Itoa(loanID))
+	msg := tgbotapi.NewMessage(chatID, "☝️ Перешлите это сообщение заемщику или скопируйте текст.")
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("✏️ Изменить шаблон", "template_nudge"),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🔙 К займу", fmt.Sprintf("loan_%d", loanID)),
+		),
+	)
+	if _, err := m.Send(msg); err != nil {
+		log.Printf("Error sending message: %v", err)
+	}
+}
+
+// StartNudgeTemplateFlow asks for a new text of the borrower reminder
+func (m *BotManager) StartNudgeTemplateFlow(chatID int64) {
+	// Keep the loan the template was opened from, so we can return to it
+	loanID, _ := m.GetStateData(chatID, "loan_id")
+	m.ClearState(chatID)
+	m.SaveStateData(chatID, "loan_id", loanID)
+	m.SetState(chatID, OpNudgeTemplate, 1)
+
+	m.SendMessage(chatID, fmt.Sprintf(
+		"📤 Сейчас напоминание заемщику выглядит так:\n\n%s\n\nВведите новый текст. Можно использовать:\n%s\n\nОтправьте \"-\", чтобы вернуть текст по умолчанию.",
+		m.GetSetting(chatID, SettingNudgeTemplate, defaultNudgeTemplate), nudgePlaceholders,
+	))
+}
+
+// HandleNudgeTemplateStep saves the borrower reminder text typed by the user
+func (m *BotManager) HandleNudgeTemplateStep(chatID int64, text string) {
+	template := strings.TrimSpace(text)
+	if template == "" {
+		m.SendMessage(chatID, "❌ Текст не может быть пустым. Введите текст напоминания или \"-\":")
+		return
+	}
+	if noteTooLong(template) {
+		m.SendMessage(chatID, noteTooLongMessage(template))
+		return
+	}
+	if template == "-" {
+		template = defaultNudgeTemplate
+	}
+
+	loanIDStr, _ := m.GetStateData(chatID, "loan_id")
+	m.ClearState(chatID)
+	if err := m.SetSetting(chatID, SettingNudgeTemplate, template); err != nil {
+		log.Printf("Error saving nudge template: %v", err)
+		m.SendErrorWithBack(chatID, dbErrorMessage(err, "❌ Не удалось сохранить шаблон."))
+		return
+	}
+
+	m.SendMessage(chatID, "✅ Шаблон напоминания сохранен.")
+	if loanID, err := strconv.Atoi(loanIDStr); err == nil {
+		m.SendBorrowerNudge(chatID, loanID)
+		return
+	}
+	m.ShowMainMenu(chatID)
+}
+
+// HandleDisputeStep saves the optional dispute note and flags the loan
+func (m *BotManager) HandleDisputeStep(chatID int64, text string) {
+	loanID, err := strconv.Atoi(m.GetState(chatID).Data["loan_id"])
+	if err != nil {
+		log.Printf("Error converting loan ID: %v", err)
+		m.SendMessage(chatID, "❌ Произошла ошибка при отметке спора.")
+		m.ClearState(chatID)
+		m.ShowMainMenu(chatID)
+		return
+	}
+
+	note := text
+	if note == "-" {
+		note = ""
+	}
+	if noteTooLong(note) {
+		m.SendMessage(chatID, noteTooLongMessage(note))
+		return
+	}
+
+	m.ClearState(chatID)
+	m.SetLoanDisputed(chatID, loanID, true, note)
+}
+
+// HandleRemindEveryStep saves how often a single loan should be reminded about
+func (m *BotManager) HandleRemindEveryStep(chatID int64, text string) {
+	loanID, err := strconv.Atoi(m.GetState(chatID).Data["loan_id"])
+	if err != nil {
+		log.Printf("Error converting loan ID: %v", err)
+		m.SendMessage(chatID, "❌ Произошла ошибка при настройке напоминаний.")
+		m.ClearState(chatID)
+		m.ShowMainMenu(chatID)
+		return
+	}
+
+	days, err := strconv.Atoi(strings.TrimSpace(text))
+	if err != nil || days < 0 || days > maxLoanReminderDays {
+		m.SendMessage(chatID, fmt.Sprintf("❌ Введите число дней от 1 до %d или 0:", maxLoanReminderDays))
+		return
+	}
+
+	// 0 falls back to the weekly reminder
+	_, err = m.db.Exec(
+		"UPDATE loans SET reminder_interval_days = NULLIF(?, 0) WHERE user_id = ? AND loan_id = ? AND deleted = 0",
+		days, chatID, loanID,
+	)
+	m.ClearState(chatID)
+	if err != nil {
+		log.Printf("Error updating loan reminder interval: %v", err)
+		m.SendErrorWithBack(chatID, "❌ Не удалось сохранить частоту напоминаний.")
+		return
+	}
+
+	if days == 0 {
+		m.SendMessage(chatID, fmt.Sprintf("⏰ Займ #%d снова попадает в еженедельное напоминание.", loanID))
+	} else {
+		m.SendMessage(chatID, fmt.Sprintf("⏰ Напоминания по займу #%d будут приходить каждые %d %s.", loanID, days, daysWord(days)))
+	}
+	m.ShowLoanDetails(chatID, loanID)
+}
+
+// HandleMyShareStep saves the user's share of a loan lent together with someone else
+func (m *BotManager) HandleMyShareStep(chatID int64, text string) {
+	loanID, err := strconv.Atoi(m.GetState(chatID).Data["loan_id"])
+	if err != nil {
+		log.Printf("Error converting loan ID: %v", err)
+		m.SendMessage(chatID, "❌ Произошла ошибка при изменении доли.")
+		m.ClearState(chatID)
+		m.ShowMainMenu(chatID)
+		return
+	}
+
+	percent, err := strconv.Atoi(strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(text), "%")))
+	if err != nil || percent < 1 || percent > 100 {
+		m.SendMessage(chatID, "❌ Введите процент от 1 до 100:")
+		return
+	}
+
+	var oldPercent int
+	err = m.db.QueryRow(
+		"SELECT COALESCE(my_share_percent, 100) FROM loans WHERE user_id = ? AND loan_id = ? AND deleted = 0",
+		chatID, loanID,
+	).Scan(&oldPercent)
+	if err == nil {
+		_, err = m.db.Exec(
+			"UPDATE loans SET my_share_percent = ? WHERE user_id = ? AND loan_id = ? AND deleted = 0",
+			percent, chatID, loanID,
+		)
+	}
+	m.ClearState(chatID)
+	if err != nil {
+		log.Printf("Error updating loan share: %v", err)
+		m.SendErrorWithBack(chatID, dbErrorMessage(err, "❌ Не удалось сохранить долю."))
+		return
+	}
+
+	if oldPercent != percent {
+		m.LogLoanEvent(chatID, loanID, EventEdited, fmt.Sprintf("Моя доля: %d%% → %d%%", oldPercent, percent))
+	}
+	if percent == 100 {
+		m.SendMessage(chatID, fmt.Sprintf("👤 Займ #%d целиком ваш.", loanID))
+	} else {
+		m.SendMessage(chatID, fmt.Sprintf("👤 Ваша доля в займе #%d: %d%%.", loanID, percent))
+	}
+	m.ShowLoanDetails(chatID, loanID)
+}
+
+// shareOf returns percent percent of amount, rounded down
+func shareOf(amount int64, percent int) int64 {
+	return amount * int64(percent) / 100
+}
+
+// shareModeButton switches balance or stats totals between the user's share and full amounts
+func (m *BotManager) shareModeButton(chatID int64, callback string) tgbotapi.InlineKeyboardButton {
+	if m.GetBoolSetting(chatID, SettingMyShare, false) {
+		return tgbotapi.NewInlineKeyboardButtonData("💯 Показать полные суммы", callback)
+	}
+	return tgbotapi.NewInlineKeyboardButtonData("👤 Показать мою долю", callback)
+}
+
+// HandleExtendDueStep moves a loan's due date to the date typed by the user
+func (m *BotManager) HandleExtendDueStep(chatID int64, text string) {
+	loanID, err := strconv.Atoi(m.GetState(chatID).Data["loan_id"])
+	if err != nil {
+		log.Printf("Error converting loan ID: %v", err)
+		m.SendMessage(chatID, "❌ Произошла ошибка при продлении срока.")
+		m.ClearState(chatID)
+		m.ShowMainMenu(chatID)
+		return
+	}
+
+	date, err := parseDate(text)
+	if err != nil {
+		m.SendMessage(chatID, "❌ Некорректная дата. Введите дату в формате ДД.ММ.ГГГГ:")
+		return
+	}
+	newDueDate := date.Format(dateLayout)
+	if newDueDate < m.UserToday(chatID) {
+		m.SendMessage(chatID, "❌ Срок возврата не может быть в прошлом. Введите другую дату:")
+		return
+	}
+
+	oldDueDate, err := m.ExtendLoanDueDate(chatID, loanID, newDueDate)
+	if errors.Is(err, errSameDueDate) {
+		m.SendMessage(chatID, "❌ Это текущий срок займа. Введите другую дату:")
+		return
+	}
+	m.ClearState(chatID)
+	if err != nil {
+		log.Printf("Error extending loan due date: %v", err)
+		m.SendErrorWithBack(chatID, dbErrorMessage(err, "❌ Не удалось изменить срок возврата."))
+		return
+	}
+
+	m.LogLoanEvent(chatID, loanID, EventExtended, fmt.Sprintf("Срок возврата: %s → %s", dueDateLabel(oldDueDate), newDueDate))
+	m.SendMessage(chatID, fmt.Sprintf("📆 Срок возврата займа #%d перенесен на %s.", loanID, newDueDate))
+	m.ShowLoanDetails(chatID, loanID)
+}
+
+// errSameDueDate is returned when an extension would keep the current due date
+var errSameDueDate = errors.New("due date is unchanged")
+
+// ExtendLoanDueDate sets a new due date on an active loan and records the change in
+// the extensions log. It returns the previous due date, empty when there was none.
+func (m *BotManager) ExtendLoanDueDate(chatID int64, loanID int, newDueDate string) (string, error) {
+	var oldDueDate string
+	err := m.db.Transact(func(tx *sql.Tx) error {
+		err := tx.QueryRow(
+			"SELECT COALESCE(due_date, '') FROM loans WHERE user_id = ? AND loan_id = ? AND repaid = 0 AND deleted = 0",
+			chatID, loanID,
+		).Scan(&oldDueDate)
+		if err != nil {
+			return err
+		}
+		if oldDueDate == newDueDate {
+			return errSameDueDate
+		}
+
+		_, err = tx.Exec("UPDATE loans SET due_date = ? WHERE user_id = ? AND loan_id = ?", newDueDate, chatID, loanID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(
+			"INSERT INTO extensions (user_id, loan_id, old_due_date, new_due_date, extended_at) VALUES (?, ?, NULLIF(?, ''), ?, CURRENT_TIMESTAMP)",
+			chatID, loanID, oldDueDate, newDueDate,
+		)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return oldDueDate, nil
+}
+
+// timesWord returns the form of "раз" that goes with n, e.g. 2 раза
+func timesWord(n int) string {
+	switch {
+	case n%100 >= 11 && n%100 <= 14:
+		return "раз"
+	case n%10 >= 2 && n%10 <= 4:
+		return "раза"
+	default:
+		return "раз"
+	}
+}
+
+// SetLoanDisputed flags a loan as disputed with an optional note, or clears the flag.
+// Disputed loans still count in the balance but are left out of reminders.
+func (m *BotManager) SetLoanDisputed(chatID int64, loanID int, disputed bool, note string) {
+	_, err := m.db.Exec(
+		"UPDATE loans SET disputed = ?, dispute_note = NULLIF(?, '') WHERE user_id = ? AND loan_id = ? AND deleted = 0",
+		disputed, note, chatID, loanID,
+	)
+	if err != nil {
+		log.Printf("Error updating loan dispute: %v", err)
+		m.SendErrorWithBack(chatID, "❌ Не удалось изменить отметку о споре.")
+		return
+	}
+
+	if disputed {
+		details := "Займ отмечен как спорный"
+		if note != "" {
+			details += ": " + note
+		}
+		m.LogLoanEvent(chatID, loanID, EventDisputed, details)
+		m.SendMessage(chatID, fmt.Sprintf("❗ Займ #%d отмечен как спорный. Напоминания по нему не отправляются, пока спор не решен.", loanID))
+	} else {
+		m.LogLoanEvent(chatID, loanID, EventDisputeResolved, "Спор по займу решен")
+		m.SendMessage(chatID, fmt.Sprintf("🤝 Спор по займу #%d решен.", loanID))
+	}
+	m.ShowLoanDetails(chatID, loanID)
+}
+
+// GetFullRepayment returns the latest "Полный возврат" repayment recorded when a loan
+// was marked repaid in one go
+func (m *BotManager) GetFullRepayment(chatID int64, loanID int) (Repayment, error) {
+	var repayment Repayment
+	repayment.LoanID = loanID
+
+	err := m.db.QueryRow(
+		`SELECT repayment_id, amount, COALESCE(substr(repayment_date, 1, 10), '') FROM repayments
+		WHERE user_id = ? AND loan_id = ? AND note = 'Полный возврат'
+		ORDER BY repayment_id DESC LIMIT 1`,
+		chatID, loanID,
+	).Scan(&repayment.ID, &repayment.Amount, &repayment.Date)
+	if err != nil {
+		return Repayment{}, err
+	}
+
+	repayment.Note = "Полный возврат"
+	return repayment, nil
+}
+
+// ConfirmForgiveLoan asks before the rest of a loan is written off
+func (m *BotManager) ConfirmForgiveLoan(chatID int64, loanID int) {
+	loan, err := m.GetLoanByID(chatID, loanID)
+	if err != nil || loan.Repaid {
+		m.SendErrorWithBack(chatID, "❌ Займ не найден среди активных.")
+		return
+	}
+
+	remainingAmount := loan.Amount - m.GetTotalRepaidAmount(chatID, loanID)
+	msg := tgbotapi.NewMessage(chatID, fmt.Sprintf(
+		"🙏 Простить долг %s по займу #%d?\n\nОстаток %s не будет взыскиваться и не попадет в собранные суммы. Займ закроется, но его можно будет вернуть в активные.",
+		loan.Borrower, loan.ID, m.LoanMoney(chatID, loan, remainingAmount),
+	))
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🙏 Да, простить", fmt.Sprintf("confirm_forgive_%d", loan.ID)),
+			tgbotapi.NewInlineKeyboardButtonData("❌ Отмена", fmt.Sprintf("loan_%d", loan.ID)),
+		),
+	)
+	if _, err := m.Send(msg); err != nil {
+		log.Printf("Error sending forgive confirmation: %v", err)
+	}
+}
+
+// ForgiveLoan closes an active loan without recording a repayment for the rest
+func (m *BotManager) ForgiveLoan(chatID int64, loanID int) error {
+	result, err := m.db.Exec(
+		"UPDATE loans SET repaid = 1, forgiven = 1 WHERE user_id = ? AND loan_id = ? AND repaid = 0 AND deleted = 0",
+		chatID, loanID,
+	)
+	if err != nil {
+		return err
+	}
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		return fmt.Errorf("loan %d is not active", loanID)
+	}
+
+	loan, err := m.GetLoanByID(chatID, loanID)
+	if err != nil {
+		return err
+	}
+	remainingAmount := loan.Amount - m.GetTotalRepaidAmount(chatID, loanID)
+	m.LogLoanEvent(chatID, loanID, EventForgiven, fmt.Sprintf("Долг прощен, списано %s", m.LoanMoney(chatID, loan, remainingAmount)))
+	return nil
+}
+
+// ConfirmReopenLoan asks before a repaid loan is made active again, offering to remove
+// the automatic full repayment so the remaining amount is recalculated
+func (m *BotManager) ConfirmReopenLoan(chatID int64, loanID int) {
+	loan, err := m.GetLoanByID(chatID, loanID)
+	if err != nil || !loan.Repaid {
+		m.SendErrorWithBack(chatID, "❌ Займ не найден среди возвращенных.")
+		return
+	}
+
+	repaid := m.GetTotalRepaidAmount(chatID, loanID)
+	fullRepayment, err := m.GetFullRepayment(chatID, loanID)
+	hasFullRepayment := err == nil
+
+	// A loan whose repayments cover it would be closed again by maintenance
+	canKeep := loan.Amount-repaid > m.config.RepaidTolerance
+	canDrop := hasFullRepayment && loan.Amount-(repaid-fullRepayment.Amount) > m.config.RepaidTolerance
+	if !canKeep && !canDrop {
+		m.SendErrorWithBack(chatID, "❌ Возвраты покрывают всю сумму займа. Удалите или измените платежи в истории возвратов, чтобы вернуть его в активные.")
+		return
+	}
+
+	text := fmt.Sprintf("↩️ Вернуть займ #%d от %s на сумму %s в активные?", loan.ID, loan.Borrower, m.Money(chatID, loan.Amount))
+	var keyboard [][]tgbotapi.InlineKeyboardButton
+	if canDrop {
+		text += fmt.Sprintf(
+			"\n\nПри отметке возврата был записан платеж «Полный возврат» на %s от %s. Его можно удалить, чтобы остаток пересчитался.",
+			m.Money(chatID, fullRepayment.Amount), fullRepayment.Date,
+		)
+		keyboard = append(keyboard, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("✅ Вернуть и удалить платеж", fmt.Sprintf("confirm_reopen_%d", loan.ID)),
+		))
+	}
+	if canKeep {
+		label := "✅ Да, вернуть"
+		if canDrop {
+			label = "↩️ Вернуть, платеж оставить"
+		}
+		keyboard = append(keyboard, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(label, fmt.Sprintf("keep_reopen_%d", loan.ID)),
+		))
+	}
+	keyboard = append(keyboard, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("❌ Отмена", fmt.Sprintf("loan_%d", loan.ID)),
+	))
+
+	msg := tgbotapi.NewMessage(chatID, text)
+	msg.ReplyMarkup = tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+	if _, err := m.Send(msg); err != nil {
+		log.Printf("Error sending reopen confirmation: %v", err)
+	}
+}
+
+// ReopenLoan marks a repaid loan as active again, optionally deleting the automatic
+// "Полный возврат" repayment in the same transaction
+func (m *BotManager) ReopenLoan(chatID int64, loanID int, dropFullRepayment bool) error {
+	var fullRepayment Repayment
+	if dropFullRepayment {
+		var err error
+		fullRepayment, err = m.GetFullRepayment(chatID, loanID)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := m.db.Transact(func(tx *sql.Tx) error {
+		result, err := tx.Exec(
+			"UPDATE loans SET repaid = 0, forgiven = 0 WHERE user_id = ? AND loan_id = ? AND repaid = 1 AND deleted = 0",
+			chatID, loanID,
+		)
+		if err != nil {
+			return err
+		}
+		if updated, _ := result.RowsAffected(); updated == 0 {
+			return fmt.Errorf("loan %d is not repaid", loanID)
+		}
+
+		if dropFullRepayment {
+			_, err = tx.Exec("DELETE FROM repayments WHERE user_id = ? AND repayment_id = ?", chatID, fullRepayment.ID)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	details := "Займ возвращен в активные"
+	if dropFullRepayment {
+		details += fmt.Sprintf(", удален платеж «Полный возврат» на %s от %s", m.Money(chatID, fullRepayment.Amount), fullRepayment.Date)
+	}
+	m.LogLoanEvent(chatID, loanID, EventReopened, details)
+	return nil
+}
+
+// SendLoanLocation sends the map point where a loan was given
+func (m *BotManager) SendLoanLocation(chatID int64, loanID int) {
+	loan, err := m.GetLoanByID(chatID, loanID)
+	if err != nil {
+		log.Printf("Error getting loan details: %v", err)
+		m.SendMessage(chatID, "❌ Займ не найден.")
+		m.ShowMainMenu(chatID)
+		return
+	}
+
+	if !loan.Latitude.Valid || !loan.Longitude.Valid {
+		m.SendErrorWithBack(chatID, "📍 Для этого займа геопозиция не сохранена.")
+		return
+	}
+
+	location := tgbotapi.NewLocation(chatID, loan.Latitude.Float64, loan.Longitude.Float64)
+	if _, err := m.bot.Send(location); err != nil {
+		log.Printf("Error sending loan location: %v", err)
+		m.SendErrorWithBack(chatID, "❌ Не удалось отправить геопозицию.")
+	}
+}
+
+// HandleLoanCommand shows a loan and its repayments for "/loan <id>"
+func (m *BotManager) HandleLoanCommand(chatID int64, args string) {
+	loanID, err := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(args), "#"))
+	if err != nil || loanID <= 0 {
+		m.SendMessage(chatID, "❌ Укажите номер займа, например: /loan 5")
+		return
+	}
+
+	// Only the user's own loans are found
+	if _, err := m.GetLoanByID(chatID, loanID); err != nil {
+		m.SendMessage(chatID, fmt.Sprintf("❌ Займ #%d не найден.", loanID))
+		return
+	}
+
+	m.ShowLoanDetails(chatID, loanID)
+	m.ShowLoanRepaymentHistory(chatID, loanID)
+}
+
+// UpdateLoanAmount changes a loan's amount and records the old and new values
+// in loan_amount_history within the same transaction
+func (m *BotManager) UpdateLoanAmount(chatID int64, loanID int, oldAmount, newAmount int64, repaid bool) error {
+	return m.db.Transact(func(tx *sql.Tx) error {
+		// A loan that is active again is no longer forgiven
+		_, err := tx.Exec(
+			"UPDATE loans SET amount = ?, repaid = ?, forgiven = COALESCE(forgiven, 0) AND ? WHERE user_id = ? AND loan_id = ?",
+			newAmount, repaid, repaid, chatID, loanID,
+		)
+		if err != nil || oldAmount == newAmount {
+			return err
+		}
+
+		_, err = tx.Exec(
+			"INSERT INTO loan_amount_history (user_id, loan_id, old_amount, new_amount, changed_at) VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)",
+			chatID, loanID, oldAmount, newAmount,
+		)
+		return err
+	})
+}
+
+// FormatAmountHistory lists the amount edits of a loan, or returns "" when there were none
+func (m *BotManager) FormatAmountHistory(chatID int64, loanID int) string {
+	// Read the settings first, the rows keep the connection busy
+	format := m.GetMoneyFormat(chatID)
+	location := m.UserLocation(chatID)
+
+	rows, err := m.db.Query(
+		"SELECT old_amount, new_amount, changed_at FROM loan_amount_history WHERE user_id = ? AND loan_id = ? ORDER BY changed_at, history_id",
+		chatID, loanID,
+	)
+	if err != nil {
+		log.Printf("Error getting loan amount history: %v", err)
+		return ""
+	}
+	defer rows.Close()
+
+	var history strings.Builder
+	for rows.Next() {
+		var oldAmount, newAmount int64
+		var changedAt time.Time
+		if err := rows.Scan(&oldAmount, &newAmount, &changedAt); err != nil {
+			log.Printf("Error scanning loan amount change: %v", err)
+			continue
+		}
+
+		sign := "+"
+		if newAmount < oldAmount {
+			sign = "-"
+		}
+		diff := newAmount - oldAmount
+		if diff < 0 {
+			diff = -diff
+		}
+		history.WriteString(fmt.Sprintf(
+			"📅 %s: %s → %s (%s%s)\n",
+			changedAt.In(location).Format("2006-01-02 15:04"),
+			formatMoney(oldAmount, format), formatMoney(newAmount, format), sign, formatMoney(diff, format),
+		))
+	}
+
+	if history.Len() == 0 {
+		return ""
+	}
+	return "💰 Изменения суммы:\n" + history.String()
+}
+
+// ShowLoanEvents displays the chronological activity log of a loan
+func (m *BotManager) ShowLoanEvents(chatID int64, loanID int) {
+	if _, err := m.GetLoanByID(chatID, loanID); err != nil {
+		log.Printf("Error getting loan details: %v", err)
+		m.SendMessage(chatID, "❌ Займ не найден.")
+		m.ShowMainMenu(chatID)
+		return
+	}
+
+	rows, err := m.db.Query(
+		"SELECT event_type, details, created_at FROM loan_events WHERE user_id = ? AND loan_id = ? ORDER BY created_at, event_id",
+		chatID, loanID,
+	)
+	if err != nil {
+		log.Printf("Error getting loan events: %v", err)
+		m.SendMessage(chatID, "❌ Не удалось получить историю изменений.")
+		m.ShowMainMenu(chatID)
+		return
+	}
+	defer rows.Close()
+
+	// Build response
+	var response strings.Builder
+	response.WriteString(fmt.Sprintf("🕓 История изменений займа #%d:\n\n", loanID))
+
+	location := m.UserLocation(chatID)
+	eventCount := 0
+	for rows.Next() {
+		var eventType, details string
+		var createdAt time.Time
+
+		if err := rows.Scan(&eventType, &details, &createdAt); err != nil {
+			log.Printf("Error scanning loan event: %v", err)
+			continue
+		}
+
+		eventCount++
+		response.WriteString(fmt.Sprintf(
+			"📅 %s\n%s %s\n\n",
+			createdAt.In(location).Format("2006-01-02 15:04"), loanEventIcon(eventType), details,
+		))
+	}
+
+	if eventCount == 0 {
+		response.WriteString("Нет записей об изменениях этого займа.\n\n")
+	}
+	rows.Close()
+
+	if amountHistory := m.FormatAmountHistory(chatID, loanID); amountHistory != "" {
+		response.WriteString(amountHistory)
+	}
+
+	keyboard := tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🔙 Назад", fmt.Sprintf("loan_%d", loanID)),
+		),
+	)
+
+	msg := tgbotapi.NewMessage(chatID, response.String())
+	msg.ReplyMarkup = keyboard
+	m.Send(msg)
+}
+
+// loanEventIcon returns the emoji shown for an event type in the activity log
+func loanEventIcon(eventType string) string {
+	switch eventType {
+	case EventCreated:
+		return "🆕"
+	case EventEdited:
+		return "✏️"
+	case EventPartialRepayment:
+		return "💵"
+	case EventRepaid:
+		return "✅"
+	case EventRepaymentEdited:
+		return "🔧"
+	case EventRepaymentDeleted:
+		return "🗑️"
+	case EventMerged:
+		return "🔗"
+	case EventTransferred:
+		return "📨"
+	case EventReassigned:
+		return "🔄"
+	case EventOverpaid:
+		return "⚠️"
+	case EventDisputed:
+		return "❗"
+	case EventDisputeResolved:
+		return "🤝"
+	case EventReopened:
+		return "↩️"
+	case EventDisbursed:
+		return "💸"
+	case EventForgiven:
+		return "🙏"
+	case EventExtended:
+		return "📆"
+	default:
+		return "•"
+	}
+}
+
+// SendLoansWithActions sends a list of loans with a row of action buttons per loan,
+// splitting it over several messages to stay within message and keyboard limits
+func (m *BotManager) SendLoansWithActions(chatID int64, header string, loans []Loan) {
+	for start := 0; start < len(loans); start += loansPerMessage {
+		end := start + loansPerMessage
+		if end > len(loans) {
+			end = len(loans)
+		}
+
+		var response strings.Builder
+		if start == 0 {
+			response.WriteString(escapeMarkdownV2(header))
+		}
+
+		var keyboard [][]tgbotapi.InlineKeyboardButton
+		for _, loan := range loans[start:end] {
+			response.WriteString(m.FormatLoanEntry(chatID, loan))
+			keyboard = append(keyboard, LoanActionButtons(loan))
+		}
+
+		msg := tgbotapi.NewMessage(chatID, response.String())
+		msg.ReplyMarkup = tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+		m.SendMarkdownMessage(msg)
+	}
+}
+
+// dateLayout is the format dates are stored and shown in
+const dateLayout = "2006-01-02"
+
+// storedTimestampLayout is how SQLite's CURRENT_TIMESTAMP stores times, always in UTC
+const storedTimestampLayout = "2006-01-02 15:04:05"
+
+// UserLocation returns the time zone chosen with /tz, or the server's time zone
+func (m *BotManager) UserLocation(chatID int64) *time.Location {
+	name := m.GetSetting(chatID, SettingTimezone, "")
+	if name == "" {
+		return time.Local
+	}
+
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		log.Printf("Error loading time zone %s for user %d: %v", name, chatID, err)
+		return time.Local
+	}
+	return location
+}
+
+// UserNow returns the current time in the user's time zone
+func (m *BotManager) UserNow(chatID int64) time.Time {
+	return time.Now().In(m.UserLocation(chatID))
+}
+
+// UserToday returns the current date in the user's time zone
+func (m *BotManager) UserToday(chatID int64) string {
+	return m.UserNow(chatID).Format(dateLayout)
+}
+
+// LocalDate converts a stored created_at value to a date in the user's time zone.
+// Values without a time of day are already dates.
+func (m *BotManager) LocalDate(chatID int64, stored string) string {
+	return localDate(stored, m.UserLocation(chatID))
+}
+
+// localDate is LocalDate for a time zone that was already looked up
+func localDate(stored string, location *time.Location) string {
+	if created, err := time.Parse(storedTimestampLayout, stored); err == nil {
+		return created.In(location).Format(dateLayout)
+	}
+	if len(stored) > len(dateLayout) {
+		return stored[:len(dateLayout)]
+	}
+	return stored
+}
+
+// storedMidnight returns the stored created_at value for the start of a date
+// (YYYY-MM-DD) in the given time zone, so that LocalDate gives the date back
+func storedMidnight(date string, location *time.Location) (string, error) {
+	midnight, err := time.ParseInLocation(dateLayout, date, location)
+	if err != nil {
+		return "", err
+	}
+	return midnight.UTC().Format(storedTimestampLayout), nil
+}
+
+// HandleTimezoneCommand shows or changes the user's time zone (/tz Asia/Almaty)
+func (m *BotManager) HandleTimezoneCommand(chatID int64, args string) {
+	name := strings.TrimSpace(args)
+	if name == "" {
+		current := m.GetSetting(chatID, SettingTimezone, "")
+		if current == "" {
+			current = "время сервера"
+		}
+		m.SendMessage(chatID, fmt.Sprintf(
+			"🕰 Часовой пояс: %s\nСейчас: %s\n\nЧтобы изменить его, отправьте, например, /tz Asia/Almaty",
+			current, m.UserNow(chatID).Format("2006-01-02 15:04"),
+		))
+		return
+	}
+
+	location, err := time.LoadLocation(name)
+	if err != nil || name == "Local" {
+		m.SendMessage(chatID, "❌ Неизвестный часовой пояс. Укажите его в формате Asia/Almaty или Europe/Moscow.")
+		return
+	}
+
+	if err := m.SetSetting(chatID, SettingTimezone, location.String()); err != nil {
+		log.Printf("Error saving time zone for user %d: %v", chatID, err)
+		m.SendMessage(chatID, "❌ Не удалось сохранить часовой пояс.")
+		return
+	}
+
+	m.SendMessage(chatID, fmt.Sprintf(
+		"✅ Часовой пояс изменен на %s.\nСейчас: %s",
+		location.String(), time.Now().In(location).Format("2006-01-02 15:04"),
+	))
+}
+
+// Loan represents a loan record
+type Loan struct {
+	ID       int
+	UserID   int64
+	Borrower string
+	Amount   int64
+	Purpose  string
+	Repaid   bool
+	DueDate  string
+	// SnoozeUntil is the date (YYYY-MM-DD) until which the loan is left out of reminders
+	SnoozeUntil string
+	// CreatedDate is the issue date (YYYY-MM-DD); only loaded for single-loan views
+	CreatedDate string
+	// Location is where the money was lent; coordinates are set when it was shared from the map
+	Location  string
+	Latitude  sql.NullFloat64
+	Longitude sql.NullFloat64
+	// Phone is the borrower's phone number; only loaded for the loan details view
+	Phone string
+	// GroupID is the ID of the first loan of a group loan; only loaded for single-loan views
+	GroupID sql.NullInt64
+	// Disputed marks a loan whose amount the borrower disagrees with; it is left out of reminders
+	Disputed    bool
+	DisputeNote string
+	// ReminderDays overrides the weekly reminder with a reminder every N days; 0 uses the default
+	ReminderDays int
+	// Installments marks a loan given out in parts; Amount is the total disbursed so far
+	Installments bool
+	// SearchMatch names the fields that matched an all-fields search
+	SearchMatch string
+	// Currency is the code of the currency the loan was given in, empty for tenge.
+	// Amount is still in tenge, converted at FxRate tenge per unit on the lending day.
+	Currency string
+	FxRate   float64
+	// Forgiven marks a closed loan that was written off instead of repaid
+	Forgiven bool
+	// Extensions is how many times the due date was moved; only loaded for single-loan views
+	Extensions int
+	// SharePercent is the user's part of a loan lent together with someone else, 100 when
+	// all the money is theirs; only loaded for single-loan views and the balance
+	SharePercent int
+}
+
+// locationLabel describes where a loan was given, or "не указано"
+func locationLabel(loan Loan) string {
+	switch {
+	case loan.Location != "":
+		return loan.Location
+	case loan.Latitude.Valid && loan.Longitude.Valid:
+		return fmt.Sprintf("%.5f, %.5f", loan.Latitude.Float64, loan.Longitude.Float64)
+	default:
+		return "не указано"
+	}
+}
+
+// Repayment represents a single recorded repayment
+type Repayment struct {
+	ID     int64
+	LoanID int
+	Amount int64
+	Date   string
+	Note   string
+}
+
+// LedgerEntry is one line of a borrower's ledger: a loan (positive amount)
+// or a repayment (negative amount)
+type LedgerEntry struct {
+	Date        string
+	LoanID      int
+	Description string
+	Amount      int64
+}
+
+// errRepaymentExceedsLoan is returned when repayments would exceed the loan amount
+var errRepaymentExceedsLoan = errors.New("repayments exceed loan amount")
+
+// errMergeBorrowerMismatch is returned when loans of different borrowers are merged
+var errMergeBorrowerMismatch = errors.New("loans belong to different borrowers")
+
+// errMergeCurrencyMismatch is returned when loans given in different currencies are merged
+var errMergeCurrencyMismatch = errors.New("loans are in different currencies")
+
+// errMergeShareMismatch is returned when loans with different shares of the user are merged
+var errMergeShareMismatch = errors.New("loans have different shares")
+
+// errMergeInstallments is returned when a loan given out in parts is merged; its amount
+// comes from the disbursements, which a fixed-amount loan doesn't have
+var errMergeInstallments = errors.New("installment loans cannot be merged")
+
+// GetRepaymentByID retrieves a repayment by its ID
+func (m *BotManager) GetRepaymentByID(chatID int64, repaymentID int64) (Repayment, error) {
+	var repayment Repayment
+	repayment.ID = repaymentID
+
+	err := m.db.QueryRow(
+		"SELECT loan_id, amount, repayment_date, COALESCE(note, '') FROM repayments WHERE user_id = ? AND repayment_id = ?",
+		chatID, repaymentID,
+	).Scan(&repayment.LoanID, &repayment.Amount, &repayment.Date, &repayment.Note)
+
+	if err != nil {
+		return Repayment{}, err
+	}
+
+	return repayment, nil
+}
+
+// UpdateRepaymentAmount changes a repayment's amount and re-evaluates the loan status.
+// It returns the loan's remaining amount after the change.
+func (m *BotManager) UpdateRepaymentAmount(chatID int64, repaymentID int64, amount int64) (int64, error) {
+	var remaining int64
+	err := m.db.Transact(func(tx *sql.Tx) error {
+		// Find the loan the repayment belongs to
+		var loanID int
+		var loanAmount int64
+		var forgiven bool
+		err := tx.QueryRow(
+			"SELECT l.loan_id, l.amount, COALESCE(l.forgiven, 0) FROM repayments r JOIN loans l ON l.user_id = r.user_id AND l.loan_id = r.loan_id WHERE r.user_id = ? AND r.repayment_id = ?",
+			chatID, repaymentID,
+		).Scan(&loanID, &loanAmount, &forgiven)
+		if err != nil {
+			return err
+		}
+
+		// Sum the other repayments of this loan
+		var otherRepaid int64
+		err = tx.QueryRow(
+			"SELECT COALESCE(SUM(amount), 0) FROM repayments WHERE user_id = ? AND loan_id = ? AND repayment_id != ?",
+			chatID, loanID, repaymentID,
+		).Scan(&otherRepaid)
+		if err != nil {
+			return err
+		}
+
+		if otherRepaid+amount > loanAmount {
+			return errRepaymentExceedsLoan
+		}
+
+		// Update the repayment
+		_, err = tx.Exec(
+			"UPDATE repayments SET amount = ? WHERE user_id = ? AND repayment_id = ?",
+			amount, chatID, repaymentID,
+		)
+		if err != nil {
+			return err
+		}
+
+		// Mark the loan repaid or reopen it depending on the new total. A forgiven loan
+		// stays closed: it is only reopened through ReopenLoan and its confirmation.
+		remaining = loanAmount - otherRepaid - amount
+		if forgiven {
+			return nil
+		}
+		query := "UPDATE loans SET repaid = 0 WHERE user_id = ? AND loan_id = ?"
+		if remaining <= m.config.RepaidTolerance {
+			query = "UPDATE loans SET repaid = 1 WHERE user_id = ? AND loan_id = ?"
+		}
+		_, err = tx.Exec(query, chatID, loanID)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return remaining, nil
+}
+
+// DeleteRepayment removes a repayment and reopens the loan if it is no longer fully repaid.
+// It returns the ID of the loan the repayment belonged to.
+func (m *BotManager) DeleteRepayment(chatID int64, repaymentID int64) (int, error) {
+	var loanID int
+	err := m.db.Transact(func(tx *sql.Tx) error {
+		// Find the loan the repayment belongs to
+		var loanAmount int64
+		var forgiven bool
+		err := tx.QueryRow(
+			"SELECT l.loan_id, l.amount, COALESCE(l.forgiven, 0) FROM repayments r JOIN loans l ON l.user_id = r.user_id AND l.loan_id = r.loan_id WHERE r.user_id = ? AND r.repayment_id = ?",
+			chatID, repaymentID,
+		).Scan(&loanID, &loanAmount, &forgiven)
+		if err != nil {
+			return err
+		}
+
+		// Delete the repayment
+		_, err = tx.Exec("DELETE FROM repayments WHERE user_id = ? AND repayment_id = ?", chatID, repaymentID)
+		if err != nil {
+			return err
+		}
+
+		// A forgiven loan stays closed, see UpdateRepaymentAmount
+		if forgiven {
+			return nil
+		}
+
+		// Reopen the loan if more than RepaidTolerance remains
+		var totalRepaid int64
+		err = tx.QueryRow(
+			"SELECT COALESCE(SUM(amount), 0) FROM repayments WHERE user_id = ? AND loan_id = ?",
+			chatID, loanID,
+		).Scan(&totalRepaid)
+		if err != nil {
+			return err
+		}
+
+		if loanAmount-totalRepaid > m.config.RepaidTolerance {
+			_, err = tx.Exec("UPDATE loans SET repaid = 0 WHERE user_id = ? AND loan_id = ?", chatID, loanID)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	m.RecordDeletions(1)
+	return loanID, nil
+}
+
+// GetSetting returns a user's setting, or the default if it was never set
+func (m *BotManager) GetSetting(chatID int64, key string, defaultValue string) string {
+	var value string
+	err := m.db.QueryRow(
+		"SELECT value FROM user_settings WHERE user_id = ? AND key = ?",
+		chatID, key,
+	).Scan(&value)
+
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Error getting setting %s for user %d: %v", key, chatID, err)
+		}
+		return defaultValue
+	}
+
+	return value
+}
+
+// SetSetting stores a user's setting
+func (m *BotManager) SetSetting(chatID int64, key string, value string) error {
+	_, err := m.db.Exec(
+		"INSERT INTO user_settings (user_id, key, value) VALUES (?, ?, ?) ON CONFLICT(user_id, key) DO UPDATE SET value = excluded.value",
+		chatID, key, value,
+	)
+	return err
+}
+
+// GetBoolSetting returns a user's boolean setting, or the default if it was never set
+func (m *BotManager) GetBoolSetting(chatID int64, key string, defaultValue bool) bool {
+	value, err := strconv.ParseBool(m.GetSetting(chatID, key, strconv.FormatBool(defaultValue)))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+// SetBoolSetting stores a user's boolean setting
+func (m *BotManager) SetBoolSetting(chatID int64, key string, value bool) {
+	if err := m.SetSetting(chatID, key, strconv.FormatBool(value)); err != nil {
+		log.Printf("Error saving setting %s for user %d: %v", key, chatID, err)
+	}
+}
+
+// MergeLoans combines several active loans of one borrower into a new loan.
+// Repayments are moved to the new loan and the originals are soft-deleted. The merged
+// loan keeps the oldest creation date and the earliest due date of the originals.
+// Loans given out in parts, in different currencies or with different shares of the
+// user cannot be merged.
+func (m *BotManager) MergeLoans(chatID int64, loanIDs []int) (int, error) {
+	if len(loanIDs) < 2 {
+		return 0, fmt.Errorf("at least two loans are required, got %d", len(loanIDs))
+	}
+
+	var newLoanID int
+	err := m.db.Transact(func(tx *sql.Tx) error {
+		// Load and validate the selected loans
+		var borrower, currency string
+		var sharePercent int
+		var totalAmount int64
+		var foreignTotal float64
+		var purposes []string
+		for i, loanID := range loanIDs {
+			var loanBorrower, purpose, loanCurrency string
+			var amount int64
+			var fxRate float64
+			var installments bool
+			var loanShare int
+			err := tx.QueryRow(
+				`SELECT borrower_name, amount, COALESCE(purpose, ''), COALESCE(installments, 0), COALESCE(currency, ''), COALESCE(fx_rate, 0),
+				COALESCE(my_share_percent, 100)
+				FROM loans WHERE user_id = ? AND loan_id = ? AND repaid = 0 AND deleted = 0`,
+				chatID, loanID,
+			).Scan(&loanBorrower, &amount, &purpose, &installments, &loanCurrency, &fxRate, &loanShare)
+			if err != nil {
+				return fmt.Errorf("loan %d: %w", loanID, err)
+			}
+			if installments {
+				return errMergeInstallments
+			}
+
+			if i == 0 {
+				borrower = loanBorrower
+				currency = loanCurrency
+				sharePercent = loanShare
+			} else if !sameBorrower(loanBorrower, borrower) {
+				return errMergeBorrowerMismatch
+			} else if loanCurrency != currency {
+				return errMergeCurrencyMismatch
+			} else if loanShare != sharePercent {
+				return errMergeShareMismatch
+			}
+
+			totalAmount += amount
+			if fxRate > 0 {
+				foreignTotal += float64(amount) / fxRate
+			}
+			if purpose != "" {
+				purposes = append(purposes, purpose)
+			}
+		}
+
+		// Generate a new loan ID
+		var err error
+		newLoanID, err = nextLoanID(tx, chatID, 1)
+		if err != nil {
+			return err
+		}
+
+		// A merged foreign currency loan gets the average rate of the originals
+		var fxRate sql.NullFloat64
+		if currency != "" && foreignTotal > 0 {
+			fxRate = sql.NullFloat64{Float64: float64(totalAmount) / foreignTotal, Valid: true}
+		}
+
+		// Insert the merged loan
+		_, err = tx.Exec(
+			`INSERT INTO loans (user_id, loan_id, borrower_name, amount, purpose, repaid, created_at, currency, fx_rate, my_share_percent)
+			VALUES (?, ?, ?, ?, ?, 0, CURRENT_TIMESTAMP, NULLIF(?, ''), ?, ?)`,
+			chatID, newLoanID, borrower, totalAmount, strings.Join(purposes, "; "), currency, fxRate, sharePercent,
+		)
+		if err != nil {
+			return err
+		}
+
+		for _, loanID := range loanIDs {
+			// Move the repayment history to the merged loan
+			_, err = tx.Exec(
+				"UPDATE repayments SET loan_id = ? WHERE user_id = ? AND loan_id = ?",
+				newLoanID, chatID, loanID,
+			)
+			if err != nil {
+				return err
+			}
+
+			// Soft-delete the original loan
+			_, err = tx.Exec(
+				"UPDATE loans SET deleted = 1, merged_into = ? WHERE user_id = ? AND loan_id = ?",
+				newLoanID, chatID, loanID,
+			)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Date the merged loan from the oldest original, so charts and trends keep the
+		// principal in the month it was lent, and keep the earliest due date
+		_, err = tx.Exec(
+			`UPDATE loans SET
+				created_at = COALESCE((SELECT MIN(o.created_at) FROM loans o
+					WHERE o.user_id = loans.user_id AND o.merged_into = loans.loan_id), created_at),
+				due_date = (SELECT MIN(o.due_date) FROM loans o
+					WHERE o.user_id = loans.user_id AND o.merged_into = loans.loan_id AND COALESCE(o.due_date, '') != '')
+			WHERE user_id = ? AND loan_id = ?`,
+			chatID, newLoanID,
+		)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return newLoanID, nil
+}
+
+// TransferLoan moves a loan with its repayments, history and disbursements to another
+// user under a new loan ID
+func (m *BotManager) TransferLoan(transferID int64, fromUserID int64, loanID int, toUserID int64) (int, error) {
+	var newLoanID int
+	err := m.db.Transact(func(tx *sql.Tx) error {
+		// Make sure the loan still exists
+		var exists bool
+		err := tx.QueryRow(
+			"SELECT EXISTS(SELECT 1 FROM loans WHERE user_id = ? AND loan_id = ? AND deleted = 0)",
+			fromUserID, loanID,
+		).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return sql.ErrNoRows
+		}
+
+		// The loan counts towards the recipient's limit
+		if err := m.checkLoanLimit(tx, toUserID, 1); err != nil {
+			return err
+		}
+
+		// Generate a new loan ID in the recipient's namespace
+		newLoanID, err = nextLoanID(tx, toUserID, 1)
+		if err != nil {
+			return err
+		}
+
+		// Move the loan and its repayments
+		_, err = tx.Exec(
+			"UPDATE loans SET user_id = ?, loan_id = ? WHERE user_id = ? AND loan_id = ?",
+			toUserID, newLoanID, fromUserID, loanID,
+		)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(
+			"UPDATE repayments SET user_id = ?, loan_id = ? WHERE user_id = ? AND loan_id = ?",
+			toUserID, newLoanID, fromUserID, loanID,
+		)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(
+			"UPDATE loan_events SET user_id = ?, loan_id = ? WHERE user_id = ? AND loan_id = ?",
+			toUserID, newLoanID, fromUserID, loanID,
+		)
+		if err != nil {
+			return err
+		}
+
+		// The amount of a loan given out in parts is the sum of its disbursements
+		_, err = tx.Exec(
+			"UPDATE disbursements SET user_id = ?, loan_id = ? WHERE user_id = ? AND loan_id = ?",
+			toUserID, newLoanID, fromUserID, loanID,
+		)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(
+			"UPDATE loan_amount_history SET user_id = ?, loan_id = ? WHERE user_id = ? AND loan_id = ?",
+			toUserID, newLoanID, fromUserID, loanID,
+		)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(
+			"UPDATE extensions SET user_id = ?, loan_id = ? WHERE user_id = ? AND loan_id = ?",
+			toUserID, newLoanID, fromUserID, loanID,
+		)
+		if err != nil {
+			return err
+		}
+
+		// Mark the transfer as done
+		_, err = tx.Exec("UPDATE transfers SET status = 'accepted' WHERE transfer_id = ?", transferID)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return newLoanID, nil
+}
+
+// LogLoanEvent appends an entry to a loan's activity log
+func (m *BotManager) LogLoanEvent(chatID int64, loanID int, eventType string, details string) {
+	_, err := m.db.Exec(
+		"INSERT INTO loan_events (user_id, loan_id, event_type, details, created_at) VALUES (?, ?, ?, ?, ?)",
+		chatID, loanID, eventType, details, time.Now().UTC(),
+	)
+	if err != nil {
+		log.Printf("Error logging %s event for loan %d: %v", eventType, loanID, err)
+	}
+
+	// Every change to a loan is logged, so this keeps the pinned summary current
+	m.MarkSummaryStale(chatID)
+}
+
+// GetLoanCreatedDate returns the date a loan was created, or "" if it is unknown
+func (m *BotManager) GetLoanCreatedDate(chatID int64, loanID int) string {
+	var createdDate string
+	err := m.db.QueryRow(
+		"SELECT COALESCE(created_at, '') FROM loans WHERE user_id = ? AND loan_id = ? AND deleted = 0",
+		chatID, loanID,
+	).Scan(&createdDate)
+	if err != nil {
+		log.Printf("Error getting loan creation date: %v", err)
+		return ""
+	}
+	return m.LocalDate(chatID, createdDate)
+}
+
+// GetActiveLoansForUser retrieves all active loans for a user
+func (m *BotManager) GetActiveLoansForUser(chatID int64) ([]Loan, error) {
+	rows, err := m.db.Query(
+		"SELECT loan_id, borrower_name, amount, purpose, COALESCE(due_date, ''), COALESCE(snooze_until, ''), COALESCE(disputed, 0), COALESCE(dispute_note, ''), COALESCE(reminder_interval_days, 0), COALESCE(currency, ''), COALESCE(fx_rate, 0), COALESCE(forgiven, 0) FROM loans WHERE user_id = ? AND repaid = 0 AND deleted = 0",
+		chatID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var loans []Loan
+	for rows.Next() {
+		var loan Loan
+		loan.UserID = chatID
+		loan.Repaid = false
+
+		if err := rows.Scan(&loan.ID, &loan.Borrower, &loan.Amount, &loan.Purpose, &loan.DueDate, &loan.SnoozeUntil, &loan.Disputed, &loan.DisputeNote, &loan.ReminderDays, &loan.Currency, &loan.FxRate, &loan.Forgiven); err != nil {
+			return nil, err
+		}
+
+		loans = append(loans, loan)
+	}
+
+	return loans, nil
+}
+
+// GetAllLoansForUser retrieves all loans for a user
+func (m *BotManager) GetAllLoansForUser(chatID int64) ([]Loan, error) {
+	rows, err := m.db.Query(
+		"SELECT loan_id, borrower_name, amount, purpose, repaid, COALESCE(due_date, ''), COALESCE(disputed, 0), COALESCE(dispute_note, ''), COALESCE(currency, ''), COALESCE(fx_rate, 0), COALESCE(forgiven, 0) FROM loans WHERE user_id = ? AND deleted = 0",
+		chatID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var loans []Loan
+	for rows.Next() {
+		var loan Loan
+		loan.UserID = chatID
+
+		if err := rows.Scan(&loan.ID, &loan.Borrower, &loan.Amount, &loan.Purpose, &loan.Repaid, &loan.DueDate, &loan.Disputed, &loan.DisputeNote, &loan.Currency, &loan.FxRate, &loan.Forgiven); err != nil {
+			return nil, err
+		}
+
+		loans = append(loans, loan)
+	}
+
+	return loans, nil
+}
+
+// GetOutstandingTotal calculates how much is still owed to the user across all active loans
+func (m *BotManager) GetOutstandingTotal(chatID int64) (int64, error) {
+	var outstanding int64
+	err := m.db.QueryRow(
+		`SELECT COALESCE(SUM(l.amount - COALESCE(
+			(SELECT SUM(r.amount) FROM repayments r WHERE r.user_id = l.user_id AND r.loan_id = l.loan_id), 0)), 0)
+		FROM loans l WHERE l.user_id = ? AND l.repaid = 0 AND l.deleted = 0`,
+		chatID,
+	).Scan(&outstanding)
+
+	return outstanding, err
+}
+
+// GetTotalRepaidAmount calculates the total amount repaid for a loan
+func (m *BotManager) GetTotalRepaidAmount(chatID int64, loanID int) int64 {
+	var totalRepaid int64
+	err := m.db.QueryRow(
+		"SELECT COALESCE(SUM(amount), 0) FROM repayments WHERE user_id = ? AND loan_id = ?",
+		chatID, loanID,
+	).Scan(&totalRepaid)
+
+	if err != nil {
+		log.Printf("Error calculating repaid amount: %v", err)
+		return 0
+	}
+
+	return totalRepaid
+}
+
+// Start runs the bot and begins processing updates
+func (m *BotManager) Start() {
+	log.Println("Starting bot...")
+
+	// Configure update channel
+	u := tgbotapi.NewUpdate(0)
+	u.Timeout = 60
+	updates := m.bot.GetUpdatesChan(u)
+
+	// Start reminder scheduler
+	m.StartReminderScheduler()
+
+	// Start weekly due-date digest scheduler
+	m.StartDigestScheduler()
+
+	// Start daily due-date notification scheduler
+	m.StartDueReminderScheduler()
+
+	// Start database backup scheduler
+	m.StartBackupScheduler()
+
+	// Start database maintenance scheduler
+	m.StartMaintenanceScheduler()
+
+	// Start delivery of reminders held back by quiet hours
+	m.StartDeferredMessageScheduler()
+
+	// Process updates
+	for update := range updates {
+		// Skip already processed updates
+		if update.UpdateID <= m.lastProcessedID {
+			continue
+		}
+		m.lastProcessedID = update.UpdateID
+
+		// Process callback queries (button presses)
+		if update.CallbackQuery != nil {
+			m.HandleCallbackQuery(update.CallbackQuery)
+			m.RefreshPinnedSummaries()
+			continue
+		}
+
+		// Process messages. Shared locations, contacts and files answer some flow steps;
+		// stickers, voice messages and photos can't, so a running flow asks for text instead.
+		if message := update.Message; message != nil {
+			switch {
+			case message.Text != "", message.Location != nil, message.Contact != nil, message.Document != nil:
+				m.HandleMessage(message)
+			case m.GetState(message.Chat.ID).Operation != OpNone:
+				m.SendMessage(message.Chat.ID, textExpectedMessage)
+			}
+		}
+
+		// Refresh the summaries once the whole action is done
+		m.RefreshPinnedSummaries()
+	}
+}
+
+// StartReminderScheduler sends weekly reminders about outstanding loans at the configured day and hour
+func (m *BotManager) StartReminderScheduler() {
+	go func() {
+		for {
+			// Wait for the configured wall-clock time rather than a fixed interval,
+			// so reminders don't depend on when the bot was started
+			next := nextReminderTime(time.Now(), m.config.ReminderWeekday, m.config.ReminderHour)
+			log.Printf("Next reminders scheduled for %s", next.Format("2006-01-02 15:04"))
+
+			timer := time.NewTimer(time.Until(next))
+			<-timer.C
+			m.SendReminders()
+		}
+	}()
+}
+
+// StartDueReminderScheduler checks every day for loans whose due date is getting close
+func (m *BotManager) StartDueReminderScheduler() {
+	go func() {
+		for {
+			now := time.Now()
+			next := time.Date(now.Year(), now.Month(), now.Day(), dueReminderHour, 0, 0, 0, now.Location())
+			if !next.After(now) {
+				next = next.AddDate(0, 0, 1)
+			}
+			log.Printf("Next due-date check scheduled for %s", next.Format("2006-01-02 15:04"))
+
+			timer := time.NewTimer(time.Until(next))
+			<-timer.C
+			m.SendDueReminders()
+			m.SendLoanReminders()
+			m.SendOverdueReminders()
+		}
+	}()
+}
+
+// SendDueReminders notifies users about loans due within their chosen number of days.
+// Each loan is notified once per due date and threshold.
+func (m *BotManager) SendDueReminders() {
+	// Users west of the server may still be a day behind
+	now := time.Now()
+	yesterday := time.Date(now.Year(), now.Month(), now.Day()-1, 0, 0, 0, 0, time.Local)
+
+	rows, err := m.db.Query(
+		`SELECT user_id, loan_id, borrower_name, amount, due_date, COALESCE(snooze_until, '') FROM loans
+		WHERE repaid = 0 AND deleted = 0 AND COALESCE(disputed, 0) = 0 AND due_date >= ?
+		ORDER BY user_id, due_date, loan_id`,
+		yesterday.Format(dateLayout),
+	)
+	if err != nil {
+		log.Printf("Error querying due dates for notifications: %v", err)
+		return
+	}
+
+	var loans []Loan
+	for rows.Next() {
+		var loan Loan
+		if err := rows.Scan(&loan.UserID, &loan.ID, &loan.Borrower, &loan.Amount, &loan.DueDate, &loan.SnoozeUntil); err != nil {
+			log.Printf("Error scanning loan for due notification: %v", err)
+			continue
+		}
+		loans = append(loans, loan)
+	}
+	rows.Close()
+
+	for _, loan := range loans {
+		userNow := m.UserNow(loan.UserID)
+		if isSnoozed(loan, userNow) {
+			continue
+		}
+
+		threshold, err := strconv.Atoi(m.GetSetting(loan.UserID, SettingDueReminderDays, "3"))
+		if err != nil {
+			// Notifications are turned off
+			continue
+		}
+
+		dueDate, err := time.ParseInLocation(dateLayout, loan.DueDate, time.Local)
+		if err != nil {
+			continue
+		}
+		today := time.Date(userNow.Year(), userNow.Month(), userNow.Day(), 0, 0, 0, 0, time.Local)
+		daysLeft := int(dueDate.Sub(today).Hours() / 24)
+		if daysLeft < 0 || daysLeft > threshold {
+			continue
+		}
+
+		// Claim the notification first so a loan is never notified twice
+		result, err := m.db.Exec(
+			"INSERT OR IGNORE INTO due_notifications (user_id, loan_id, due_date, days_before) VALUES (?, ?, ?, ?)",
+			loan.UserID, loan.ID, loan.DueDate, threshold,
+		)
+		if err != nil {
+			log.Printf("Error recording due notification: %v", err)
+			continue
+		}
+		if inserted, _ := result.RowsAffected(); inserted == 0 {
+			continue
+		}
+
+		when := "сегодня"
+		if daysLeft > 0 {
+			when = fmt.Sprintf("через %d %s", daysLeft, daysWord(daysLeft))
+		}
+		remainingAmount := loan.Amount - m.GetTotalRepaidAmount(loan.UserID, loan.ID)
+		var keyboard [][]tgbotapi.InlineKeyboardButton
+		if row := m.PaymentRequestButtons(loan.UserID, loan, remainingAmount, "💳 Запросить оплату"); row != nil {
+			keyboard = append(keyboard, row)
+		}
+		m.SendReminderMessage(loan.UserID, fmt.Sprintf(
+			"⏳ Срок возврата займа #%d %s (%s).\n👤 Заемщик: %s\n💵 Остаток: %s",
+			loan.ID, when, loan.DueDate, loan.Borrower, m.Money(loan.UserID, remainingAmount),
+		), keyboard)
+	}
+}
+
+// nextReminderTime returns the first time after now that falls on the given weekday and hour
+func nextReminderTime(now time.Time, weekday time.Weekday, hour int) time.Time {
+	next := time.Date(now.Year(), now.Month(), now.Day(), hour, 0, 0, 0, now.Location())
+	next = next.AddDate(0, 0, (int(weekday)-int(now.Weekday())+7)%7)
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 7)
+	}
+	return next
+}
+
+// WasRecentlyReminded reports whether a user already received a reminder within the current interval
+func (m *BotManager) WasRecentlyReminded(userID int64) bool {
+	var lastReminded time.Time
+	err := m.db.QueryRow(
+		"SELECT last_reminded FROM reminders WHERE user_id = ?",
+		userID,
+	).Scan(&lastReminded)
+
+	if err == sql.ErrNoRows {
+		return false
+	}
+	if err != nil {
+		log.Printf("Error getting last reminder time for user %d: %v", userID, err)
+		return false
+	}
+
+	return time.Since(lastReminded) < reminderInterval-reminderSlack
+}
+
+// MarkReminded records the time a user was last sent a reminder
+func (m *BotManager) MarkReminded(userID int64) {
+	_, err := m.db.Exec(
+		"INSERT INTO reminders (user_id, last_reminded) VALUES (?, ?) ON CONFLICT(user_id) DO UPDATE SET last_reminded = excluded.last_reminded",
+		userID, time.Now().UTC(),
+	)
+	if err != nil {
+		log.Printf("Error saving reminder time for user %d: %v", userID, err)
+	}
+}
+
+// SendReminders sends reminder messages to users with outstanding loans
+func (m *BotManager) SendReminders() {
+	// Get distinct users with active loans
+	rows, err := m.db.Query("SELECT DISTINCT user_id FROM loans WHERE repaid = 0 AND deleted = 0")
+	if err != nil {
+		log.Printf("Error querying users for reminders: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	// Build list of users
+	var userIDs []int64
+	for rows.Next() {
+		var userID int64
+		if err := rows.Scan(&userID); err != nil {
+			log.Printf("Error scanning user ID: %v", err)
+			continue
+		}
+		userIDs = append(userIDs, userID)
+	}
+
+	// Send reminders to each user
+	for _, userID := range userIDs {
+		// Skip users who turned reminders off
+		if !m.GetBoolSetting(userID, SettingReminders, true) {
+			continue
+		}
+
+		// Skip users who were already reminded recently (e.g. before a restart)
+		if m.WasRecentlyReminded(userID) {
+			continue
+		}
+
+		// Get active loans for this user
+		loans, err := m.GetActiveLoansForUser(userID)
+		if err != nil {
+			log.Printf("Error querying loans for user %d: %v", userID, err)
+			continue
+		}
+
+		// Build reminder message with what is actually still owed
+		reminderMsg := "⏰ Еженедельное напоминание: У вас есть активные займы:\n\n"
+		if firstName := m.GetSetting(userID, SettingFirstName, ""); firstName != "" {
+			reminderMsg = fmt.Sprintf("⏰ %s, еженедельное напоминание: У вас есть активные займы:\n\n", firstName)
+		}
+
+		var totalRemaining int64
+		var remindedIDs []int
+		var keyboard [][]tgbotapi.InlineKeyboardButton
+		for _, loan := range loans {
+			// Leave out loans whose reminders are snoozed or that have their own interval
+			if isSnoozed(loan, m.UserNow(userID)) || loan.Disputed || loan.ReminderDays > 0 {
+				continue
+			}
+
+			remainingAmount := loan.Amount - m.GetTotalRepaidAmount(userID, loan.ID)
+			if remainingAmount <= 0 {
+				continue
+			}
+
+			totalRemaining += remainingAmount
+			remindedIDs = append(remindedIDs, loan.ID)
+			reminderMsg += fmt.Sprintf("🆔 Займ #%d - %s: %s\n", loan.ID, loan.Borrower, m.Money(userID, remainingAmount))
+			label := fmt.Sprintf("💳 Запросить у %s (#%d)", loan.Borrower, loan.ID)
+			if row := m.PaymentRequestButtons(userID, loan, remainingAmount, label); row != nil {
+				keyboard = append(keyboard, row)
+			}
+		}
+
+		if totalRemaining == 0 {
+			continue
+		}
+
+		reminderMsg += fmt.Sprintf("\n💼 Всего к возврату: %s", m.Money(userID, totalRemaining))
+
+		// Send the reminder
+		m.SendReminderMessage(userID, reminderMsg, keyboard)
+		m.MarkReminded(userID)
+		for _, loanID := range remindedIDs {
+			m.MarkLoanReminded(userID, loanID)
+		}
+	}
+}
+
+// MarkLoanReminded records the time a loan was last included in a reminder
+func (m *BotManager) MarkLoanReminded(userID int64, loanID int) {
+	_, err := m.db.Exec(
+		"UPDATE loans SET last_reminded = ? WHERE user_id = ? AND loan_id = ?",
+		time.Now().UTC(), userID, loanID,
+	)
+	if err != nil {
+		log.Printf("Error saving reminder time for loan %d of user %d: %v", loanID, userID, err)
+	}
+}
+
+// SendLoanReminders reminds about loans that have their own reminder interval once
+// that many days have passed since their last reminder
+func (m *BotManager) SendLoanReminders() {
+	rows, err := m.db.Query(
+		`SELECT user_id, loan_id, borrower_name, amount, COALESCE(snooze_until, ''), reminder_interval_days, last_reminded FROM loans
+		WHERE repaid = 0 AND deleted = 0 AND COALESCE(disputed, 0) = 0 AND reminder_interval_days > 0
+		ORDER BY user_id, loan_id`,
+	)
+	if err != nil {
+		log.Printf("Error querying loans with their own reminder interval: %v", err)
+		return
+	}
+
+	type dueLoan struct {
+		Loan
+		LastReminded sql.NullTime
+	}
+	var loans []dueLoan
+	for rows.Next() {
+		var loan dueLoan
+		if err := rows.Scan(&loan.UserID, &loan.ID, &loan.Borrower, &loan.Amount, &loan.SnoozeUntil, &loan.ReminderDays, &loan.LastReminded); err != nil {
+			log.Printf("Error scanning loan for reminder: %v", err)
+			continue
+		}
+		loans = append(loans, loan)
+	}
+	rows.Close()
+
+	for _, loan := range loans {
+		if !m.GetBoolSetting(loan.UserID, SettingReminders, true) || isSnoozed(loan.Loan, m.UserNow(loan.UserID)) {
+			continue
+		}
+
+		interval := time.Duration(loan.ReminderDays) * 24 * time.Hour
+		if loan.LastReminded.Valid && time.Since(loan.LastReminded.Time) < interval-reminderSlack {
+			continue
+		}
+
+		remainingAmount := loan.Amount - m.GetTotalRepaidAmount(loan.UserID, loan.ID)
+		if remainingAmount <= 0 {
+			continue
+		}
+
+		var keyboard [][]tgbotapi.InlineKeyboardButton
+		if row := m.PaymentRequestButtons(loan.UserID, loan.Loan, remainingAmount, "💳 Запросить оплату"); row != nil {
+			keyboard = append(keyboard, row)
+		}
+		m.SendReminderMessage(loan.UserID, fmt.Sprintf(
+			"⏰ Напоминание по займу #%d (каждые %d %s).\n👤 Заемщик: %s\n💵 Остаток: %s",
+			loan.ID, loan.ReminderDays, daysWord(loan.ReminderDays), loan.Borrower, m.Money(loan.UserID, remainingAmount),
+		), keyboard)
+		m.MarkLoanReminded(loan.UserID, loan.ID)
+	}
+}
+
+// overdueReminderInterval returns how often a loan overdue by the given number of days
+// is reminded about, or 0 when it is not overdue long enough to escalate
+func overdueReminderInterval(daysOverdue int) time.Duration {
+	switch {
+	case daysOverdue > overdueDailyDays:
+		return 24 * time.Hour
+	case daysOverdue >= overdueWeeklyDays:
+		return 7 * 24 * time.Hour
+	default:
+		return 0
+	}
+}
+
+// SendOverdueReminders reminds about long-overdue loans more often than the weekly
+// reminder does. The cadence is tracked per loan in loans.last_reminded, which the
+// other reminders update too, so a loan is never reminded twice within its interval.
+func (m *BotManager) SendOverdueReminders() {
+	// Users west of the server may still be a day behind
+	now := time.Now()
+	cutoff := time.Date(now.Year(), now.Month(), now.Day()-overdueWeeklyDays+1, 0, 0, 0, 0, time.Local)
+
+	rows, err := m.db.Query(
+		`SELECT user_id, loan_id, borrower_name, amount, due_date, COALESCE(snooze_until, ''), last_reminded FROM loans
+		WHERE repaid = 0 AND deleted = 0 AND COALESCE(disputed, 0) = 0 AND due_date != '' AND due_date <= ?
+		ORDER BY user_id, due_date, loan_id`,
+		cutoff.Format(dateLayout),
+	)
+	if err != nil {
+		log.Printf("Error querying overdue loans for reminders: %v", err)
+		return
+	}
+
+	type overdueLoan struct {
+		Loan
+		LastReminded sql.NullTime
+	}
+	var loans []overdueLoan
+	for rows.Next() {
+		var loan overdueLoan
+		if err := rows.Scan(&loan.UserID, &loan.ID, &loan.Borrower, &loan.Amount, &loan.DueDate, &loan.SnoozeUntil, &loan.LastReminded); err != nil {
+			log.Printf("Error scanning overdue loan for reminder: %v", err)
+			continue
+		}
+		loans = append(loans, loan)
+	}
+	rows.Close()
+
+	for _, loan := range loans {
+		userNow := m.UserNow(loan.UserID)
+		if !m.GetBoolSetting(loan.UserID, SettingReminders, true) || isSnoozed(loan.Loan, userNow) {
+			continue
+		}
+
+		dueDate, err := time.ParseInLocation(dateLayout, loan.DueDate, time.Local)
+		if err != nil {
+			continue
+		}
+		today := time.Date(userNow.Year(), userNow.Month(), userNow.Day(), 0, 0, 0, 0, time.Local)
+		daysOverdue := int(today.Sub(dueDate).Hours() / 24)
+
+		interval := overdueReminderInterval(daysOverdue)
+		if interval == 0 {
+			continue
+		}
+		if loan.LastReminded.Valid && time.Since(loan.LastReminded.Time) < interval-reminderSlack {
+			continue
+		}
+
+		remainingAmount := loan.Amount - m.GetTotalRepaidAmount(loan.UserID, loan.ID)
+		if remainingAmount <= 0 {
+			continue
+		}
+
+		var keyboard [][]tgbotapi.InlineKeyboardButton
+		if row := m.PaymentRequestButtons(loan.UserID, loan.Loan, remainingAmount, "💳 Запросить оплату"); row != nil {
+			keyboard = append(keyboard, row)
+		}
+		m.SendReminderMessage(loan.UserID, fmt.Sprintf(
+			"🚨 Займ #%d просрочен на %d %s (срок был %s).\n👤 Заемщик: %s\n💵 Остаток: %s",
+			loan.ID, daysOverdue, daysWord(daysOverdue), loan.DueDate, loan.Borrower, m.Money(loan.UserID, remainingAmount),
+		), keyboard)
+		m.MarkLoanReminded(loan.UserID, loan.ID)
+	}
+}
+
+// StartDigestScheduler sends the weekly digest of upcoming due dates every Sunday evening
+func (m *BotManager) StartDigestScheduler() {
+	go func() {
+		for {
+			next := nextReminderTime(time.Now(), digestWeekday, digestHour)
+			log.Printf("Next due-date digest scheduled for %s", next.Format("2006-01-02 15:04"))
+
+			timer := time.NewTimer(time.Until(next))
+			<-timer.C
+			m.SendDueDigests()
+		}
+	}()
+}
+
+// russianWeekdays are short weekday names indexed by time.Weekday
+var russianWeekdays = []string{"Вс", "Пн", "Вт", "Ср", "Чт", "Пт", "Сб"}
+
+// SendDueDigests sends each user a calendar of the loans due within the coming week
+func (m *BotManager) SendDueDigests() {
+	today := time.Now()
+	rows, err := m.db.Query(
+		`SELECT user_id, loan_id, borrower_name, amount, due_date FROM loans
+		WHERE repaid = 0 AND deleted = 0 AND COALESCE(disputed, 0) = 0 AND due_date > ? AND due_date <= ?
+		ORDER BY user_id, due_date, loan_id`,
+		today.Format(dateLayout), today.AddDate(0, 0, digestDays).Format(dateLayout),
+	)
+	if err != nil {
+		log.Printf("Error querying due dates for digest: %v", err)
+		return
+	}
+
+	// Group the loans by user, keeping them sorted by due date
+	dueLoans := make(map[int64][]Loan)
+	var userIDs []int64
+	for rows.Next() {
+		var loan Loan
+		if err := rows.Scan(&loan.UserID, &loan.ID, &loan.Borrower, &loan.Amount, &loan.DueDate); err != nil {
+			log.Printf("Error scanning loan for digest: %v", err)
+			continue
+		}
+		if _, seen := dueLoans[loan.UserID]; !seen {
+			userIDs = append(userIDs, loan.UserID)
+		}
+		dueLoans[loan.UserID] = append(dueLoans[loan.UserID], loan)
+	}
+	rows.Close()
+
+	for _, userID := range userIDs {
+		// Skip users who turned the digest off
+		if !m.GetBoolSetting(userID, SettingDigest, true) {
+			continue
+		}
+
+		var digest strings.Builder
+		digest.WriteString("🗓️ Сроки возврата на неделю:\n")
+
+		lastDate := ""
+		for _, loan := range dueLoans[userID] {
+			// Start a new day heading whenever the date changes
+			if loan.DueDate != lastDate {
+				lastDate = loan.DueDate
+				heading := loan.DueDate
+				if date, err := time.Parse(dateLayout, loan.DueDate); err == nil {
+					heading = fmt.Sprintf("%s, %s", russianWeekdays[date.Weekday()], date.Format("02.01"))
+				}
+				digest.WriteString(fmt.Sprintf("\n📅 %s\n", heading))
+			}
+
+			remainingAmount := loan.Amount - m.GetTotalRepaidAmount(userID, loan.ID)
+			digest.WriteString(fmt.Sprintf("• #%d %s — %s\n", loan.ID, loan.Borrower, m.Money(userID, remainingAmount)))
+		}
+
+		m.SendReminderMessage(userID, digest.String(), nil)
+	}
+}
+
+// StartBackupScheduler periodically sends a snapshot of the database to the admins
+func (m *BotManager) StartBackupScheduler() {
+	if len(m.config.AdminIDs) == 0 || m.config.BackupInterval <= 0 {
+		log.Println("Database backups disabled")
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(m.config.BackupInterval)
+		for {
+			<-ticker.C
+			m.SendBackup()
+		}
+	}()
+}
+
+// SendBackup creates a consistent snapshot of the database and sends it to every admin
+func (m *BotManager) SendBackup() {
+	// VACUUM INTO requires the target file not to exist
+	backupPath := filepath.Join(os.TempDir(), fmt.Sprintf("lending-%s.db", time.Now().Format("20060102-150405")))
+	defer os.Remove(backupPath)
+
+	// A backup of a large database can take longer than the query timeout
+	if _, err := m.db.DB.Exec("VACUUM INTO ?", backupPath); err != nil {
+		log.Printf("Error creating database backup: %v", err)
+		return
+	}
+
+	for _, adminID := range m.config.AdminIDs {
+		doc := tgbotapi.NewDocument(adminID, tgbotapi.FilePath(backupPath))
+		doc.Caption = fmt.Sprintf("💾 Резервная копия базы данных от %s", time.Now().Format("2006-01-02 15:04"))
+		if _, err := m.bot.Send(doc); err != nil {
+			log.Printf("Error sending backup to admin %d: %v", adminID, err)
+		}
+	}
+
+	log.Println("Database backup sent")
+}
+
+// StartMaintenanceScheduler periodically closes paid-off loans and checks whether the
+// database should be vacuumed
+func (m *BotManager) StartMaintenanceScheduler() {
+	go func() {
+		ticker := time.NewTicker(maintenanceCheckInterval)
+		for {
+			<-ticker.C
+			if closed, err := m.CloseSettledLoans(); err != nil {
+				log.Printf("Error closing settled loans: %v", err)
+			} else if closed > 0 {
+				log.Printf("Closed %d loans paid off by repayments", closed)
+			}
+			if created, err := m.CreateRecurringLoans(); err != nil {
+				log.Printf("Error creating recurring loans: %v", err)
+			} else if created > 0 {
+				log.Printf("Created %d recurring loans", created)
+			}
+			m.RefreshPinnedSummaries()
+			if m.VacuumDue() {
+				m.RunVacuum()
+			}
+		}
+	}()
+}
+
+// CloseSettledLoans marks active loans as repaid when their repayments already cover
+// the amount, which can be left over from amount edits or older versions of the bot.
+// It returns how many loans were closed.
+func (m *BotManager) CloseSettledLoans() (int, error) {
+	rows, err := m.db.Query(
+		`SELECT user_id, loan_id FROM loans
+		WHERE repaid = 0 AND deleted = 0 AND amount > 0
+		AND amount - COALESCE((SELECT SUM(r.amount) FROM repayments r WHERE r.user_id = loans.user_id AND r.loan_id = loans.loan_id), 0) <= ?`,
+		m.config.RepaidTolerance,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	type loanKey struct {
+		UserID int64
+		LoanID int
+	}
+	var settled []loanKey
+	for rows.Next() {
+		var key loanKey
+		if err := rows.Scan(&key.UserID, &key.LoanID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		settled = append(settled, key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	closed := 0
+	for _, key := range settled {
+		result, err := m.db.Exec(
+			"UPDATE loans SET repaid = 1 WHERE user_id = ? AND loan_id = ? AND repaid = 0",
+			key.UserID, key.LoanID,
+		)
+		if err != nil {
+			return closed, err
+		}
+		if affected, _ := result.RowsAffected(); affected == 0 {
+			continue
+		}
+
+		closed++
+		m.LogLoanEvent(key.UserID, key.LoanID, EventRepaid, "Займ закрыт автоматически: возвраты покрывают сумму займа")
+	}
+
+	return closed, nil
+}
+
+// VacuumDue reports whether enough time has passed or enough rows were deleted since the last VACUUM
+func (m *BotManager) VacuumDue() bool {
+	deletions, _ := strconv.ParseInt(m.GetMeta(metaDeletionsSinceVacuum, "0"), 10, 64)
+	if deletions >= vacuumDeletionThreshold {
+		return true
+	}
+
+	lastVacuum, err := time.Parse(time.RFC3339, m.GetMeta(metaLastVacuum, ""))
+	if err != nil {
+		// Never vacuumed: start counting from now instead of vacuuming right after startup
+		m.SetMeta(metaLastVacuum, time.Now().UTC().Format(time.RFC3339))
+		return false
+	}
+
+	return time.Since(lastVacuum) >= vacuumInterval
+}
+
+// RunVacuum rebuilds the database file to reclaim space freed by deletions
+func (m *BotManager) RunVacuum() {
+	sizeBefore := databaseFileSize()
+
+	// VACUUM runs on the writer goroutine, so no write runs alongside it. Rewriting a
+	// large database can take longer than the query timeout.
+	err := m.db.write(context.Background(), func() error {
+		_, err := m.db.DB.Exec("VACUUM")
+		return err
+	})
+	if err != nil {
+		log.Printf("Error running VACUUM: %v", err)
+		return
+	}
+
+	m.SetMeta(metaDeletionsSinceVacuum, "0")
+	m.SetMeta(metaLastVacuum, time.Now().UTC().Format(time.RFC3339))
+
+	log.Printf("VACUUM finished: database size %d -> %d bytes", sizeBefore, databaseFileSize())
+}
+
+// databaseFileSize returns the size of the database file in bytes, or -1 if it can't be read
+func databaseFileSize() int64 {
+	info, err := os.Stat(dbPath)
+	if err != nil {
+		return -1
+	}
+	return info.Size()
+}
+
+// RecordDeletions adds to the number of rows deleted since the last VACUUM
+func (m *BotManager) RecordDeletions(count int64) {
+	_, err := m.db.Exec(
+		"INSERT INTO bot_meta (key, value) VALUES (?, ?) ON CONFLICT(key) DO UPDATE SET value = CAST(value AS INTEGER) + excluded.value",
+		metaDeletionsSinceVacuum, count,
+	)
+	if err != nil {
+		log.Printf("Error recording deletions: %v", err)
+	}
+}
+
+// GetMeta returns a bot-wide value stored in bot_meta, or the default if it is missing
+func (m *BotManager) GetMeta(key string, defaultValue string) string {
+	var value string
+	err := m.db.QueryRow("SELECT value FROM bot_meta WHERE key = ?", key).Scan(&value)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Error getting meta %s: %v", key, err)
+		}
+		return defaultValue
+	}
+	return value
+}
+
+// SetMeta stores a bot-wide value in bot_meta
+func (m *BotManager) SetMeta(key string, value string) {
+	_, err := m.db.Exec(
+		"INSERT INTO bot_meta (key, value) VALUES (?, ?) ON CONFLICT(key) DO UPDATE SET value = excluded.value",
+		key, value,
+	)
+	if err != nil {
+		log.Printf("Error saving meta %s: %v", key, err)
+	}
+}
+
+// HandleMessage processes text messages
+func (m *BotManager) HandleMessage(message *tgbotapi.Message) {
+	chatID := message.Chat.ID
+	text := strings.TrimSpace(message.Text)
+
+	log.Printf("Message from user %d: %s", chatID, text)
+
+	// Handle commands
+	if message.IsCommand() {
+		switch message.Command() {
+		case "start":
+			// Checked before the first name is saved, which counts as a setting
+			onboard := m.NeedsOnboarding(chatID)
+			m.SaveFirstName(chatID, message.From)
+
+			// Don't throw away a half-finished operation without asking
+			if m.GetState(chatID).Operation != OpNone {
+				m.SaveStateData(chatID, "start_payload", message.CommandArguments())
+				m.ConfirmRestart(chatID)
+				return
+			}
+
+			if onboard && message.CommandArguments() == "" {
+				m.ShowOnboarding(chatID)
+				return
+			}
+			m.Restart(chatID, message.CommandArguments())
+		case "balancetext":
+			m.ShowBalanceText(chatID)
+		case "tz":
+			m.HandleTimezoneCommand(chatID, message.CommandArguments())
+		case "settings":
+			m.ClearState(chatID)
+			m.ShowSettingsMenu(chatID)
+		case "reminders":
+			m.HandleRemindersCommand(chatID, message.CommandArguments())
+		case "pin":
+			m.HandlePinCommand(chatID, message.CommandArguments())
+		case "keyboard":
+			m.HandleKeyboardCommand(chatID, message.CommandArguments())
+		case "transfer":
+			m.HandleTransferCommand(chatID, message.CommandArguments())
+		case "ledger":
+			m.SendBorrowerLedger(chatID, message.CommandArguments())
+		case "top":
+			m.ShowTopBorrowers(chatID)
+		case "overdue":
+			m.ShowOverdueLoans(chatID)
+		case "untouched":
+			m.ShowUntouchedLoans(chatID)
+		case "duplicates":
+			m.ShowDuplicateBorrowers(chatID)
+		case "yearly":
+			m.ShowYearlySummary(chatID)
+		case "loan":
+			m.HandleLoanCommand(chatID, message.CommandArguments())
+		case "export":
+			m.SendExport(chatID, message.CommandArguments())
+		case "import":
+			m.StartImportFlow(chatID)
+		case "whoami":
+			m.ShowWhoAmI(message)
+		case "lifetime":
+			m.ShowLifetimeStats(chatID)
+		case "installment":
+			m.StartInstallmentLoanFlow(chatID)
+		case "recurring":
+			m.ClearState(chatID)
+			m.ShowRecurringLoans(chatID)
+		case "group":
+			m.StartGroupLoanFlow(chatID)
+		case "settle":
+			m.StartSettleUpFlow(chatID, strings.TrimSpace(message.CommandArguments()))
+		case "reset":
+			m.StartResetFlow(chatID, false)
+		case "deletealldata":
+			m.StartResetFlow(chatID, true)
+		case "find":
+			// Search right away when a name is given, otherwise ask for one
+			query := strings.TrimSpace(message.CommandArguments())
+			if query == "" {
+				m.StartSearchByNameFlow(chatID)
+				return
+			}
+			m.SearchLoansByName(chatID, query)
+		case "dbstats":
+			if !m.IsAdmin(message) {
+				m.SendMessage(chatID, "⛔ Команда доступна только администратору.")
+				return
+			}
+			m.ShowDatabaseStats(chatID)
+		case "highbalances":
+			if !m.IsAdmin(message) {
+				m.SendMessage(chatID, "⛔ Команда доступна только администратору.")
+				return
+			}
+			m.ShowHighBalances(chatID, message.CommandArguments())
+		case "closesettled":
+			if !m.IsAdmin(message) {
+				m.SendMessage(chatID, "⛔ Команда доступна только администратору.")
+				return
+			}
+			closed, err := m.CloseSettledLoans()
+			if err != nil {
+				log.Printf("Error closing settled loans: %v", err)
+				m.SendMessage(chatID, "❌ Не удалось закрыть погашенные займы.")
+				return
+			}
+			m.SendMessage(chatID, fmt.Sprintf("🧹 Закрыто погашенных займов: %d", closed))
+		default:
+			m.SendMessage(chatID, "🤔 Неизвестная команда. Используйте /start для начала работы.")
+		}
+		return
+	}
+
+	// Buttons of the quick-action keyboard work like the main menu and cancel a running flow
+	switch text {
+	case ReplyAddLoan:
+		m.StartAddLoanFlow(chatID)
+		return
+	case ReplyRepay:
+		m.StartRepayLoanFlow(chatID)
+		return
+	case ReplyBalance:
+		m.ClearState(chatID)
+		m.ShowBalance(chatID)
+		return
+	case ReplyStats:
+		m.ClearState(chatID)
+		m.ShowStats(chatID)
+		return
+	}
+
+	// Handle conversation state
+	state := m.GetState(chatID)
+
+	// A shared location answers the place question of the add loan flow
+	if message.Location != nil && state.Operation == OpAddLoan && state.Step == 4 {
+		m.CreateLoan(chatID, "", message.Location)
+		return
+	}
+
+	// A shared contact answers the phone question
+	if message.Contact != nil && state.Operation == OpBorrowerPhone {
+		m.HandleBorrowerPhoneStep(chatID, message.Contact.PhoneNumber)
+		return
+	}
+
+	// Files are only expected by /import
+	if message.Document != nil {
+		if state.Operation == OpImportData {
+			m.ImportLoansFromDocument(chatID, message.Document)
+		} else {
+			m.SendMessage(chatID, "📎 Чтобы загрузить займы из файла, используйте команду /import.")
+		}
+		return
+	}
+
+	// A location or contact outside the step that expects it is not an answer either
+	if text == "" {
+		if state.Operation != OpNone {
+			m.SendMessage(chatID, textExpectedMessage)
+		}
+		return
+	}
+
+	m.HandleStateInput(chatID, text)
+}
+
+// textExpectedMessage answers a message without text sent while a flow waits for input
+const textExpectedMessage = "✍️ Пожалуйста, отправьте текст, чтобы продолжить."
+
+// HandleStateInput passes text typed by the user, or entered on the keypad, to the running flow
+func (m *BotManager) HandleStateInput(chatID int64, text string) {
+	state := m.GetState(chatID)
+
+	switch state.Operation {
+	case OpAddLoan:
+		m.HandleAddLoanStep(chatID, text)
+	case OpRepayLoan:
+		m.HandleRepayLoanStep(chatID, text)
+	case OpEditLoan:
+		m.HandleEditLoanStep(chatID, text)
+	case OpPartialRepay:
+		m.HandlePartialRepaymentStep(chatID, text)
+	case OpSearchLoan:
+		m.HandleSearchStep(chatID, text)
+	case OpEditRepay:
+		m.HandleEditRepaymentStep(chatID, text)
+	case OpMergeLoans:
+		m.SendMessage(chatID, "Выберите займы для объединения с помощью кнопок выше.")
+	case OpMergeNames:
+		m.SendMessage(chatID, "Выберите правильное написание имени с помощью кнопок выше.")
+	case OpReassignLoan:
+		m.HandleReassignLoanStep(chatID, text)
+	case OpSettleUp:
+		m.HandleSettleUpStep(chatID, text)
+	case OpBorrowerPhone:
+		m.HandleBorrowerPhoneStep(chatID, text)
+	case OpPaymentLink:
+		m.HandlePaymentLinkStep(chatID, text)
+	case OpGroupLoan:
+		m.HandleGroupLoanStep(chatID, text)
+	case OpInstallment:
+		m.HandleInstallmentLoanStep(chatID, text)
+	case OpDisburse:
+		m.HandleDisbursementStep(chatID, text)
+	case OpRecurring:
+		m.HandleRecurringLoanStep(chatID, text)
+	case OpDisputeLoan:
+		m.HandleDisputeStep(chatID, text)
+	case OpRemindEvery:
+		m.HandleRemindEveryStep(chatID, text)
+	case OpExtendDue:
+		m.HandleExtendDueStep(chatID, text)
+	case OpNudgeTemplate:
+		m.HandleNudgeTemplateStep(chatID, text)
+	case OpMyShare:
+		m.HandleMyShareStep(chatID, text)
+	case OpResetData:
+		m.HandleResetStep(chatID, text)
+	case OpImportData:
+		m.SendMessage(chatID, "📎 Отправьте JSON-файл выгрузки как документ.")
+	case OpNone: // No active conversation
+		m.ShowMainMenu(chatID)
+	default:
+		log.Printf("Unknown operation: %s", state.Operation)
+		m.ShowMainMenu(chatID)
+	}
+}
+
+// resetConfirmationWord must be typed before /reset offers the final button
+const resetConfirmationWord = "УДАЛИТЬ"
+
+// StartResetFlow begins the two-step confirmation for wiping the user's data. /reset
+// keeps the settings and asks for a fixed word; /deletealldata also removes the
+// settings and asks for a random code.
+func (m *BotManager) StartResetFlow(chatID int64, withSettings bool) {
+	m.ClearState(chatID)
+	m.SetState(chatID, OpResetData, 0)
+
+	if !withSettings {
+		m.SaveStateData(chatID, "confirm_code", resetConfirmationWord)
+		m.SendMessage(chatID, fmt.Sprintf(
+			"⚠️ Все ваши займы, платежи и история изменений будут удалены без возможности восстановления.\n\n"+
+				"Чтобы продолжить, введите слово %s.\nЛюбой другой ответ отменит сброс.",
+			resetConfirmationWord,
+		))
+		return
+	}
+
+	code := fmt.Sprintf("%06d", rand.Intn(1000000))
+	m.SaveStateData(chatID, "confirm_code", code)
+	m.SaveStateData(chatID, "delete_settings", "1")
+	m.SendMessage(chatID, fmt.Sprintf(
+		"⚠️ Все ваши данные будут удалены без возможности восстановления: займы, платежи, история изменений и настройки.\n\n"+
+			"Чтобы продолжить, введите код %s.\nЛюбой другой ответ отменит удаление.",
+		code,
+	))
+}
+
+// HandleResetStep checks the typed confirmation code and asks for the final confirmation
+func (m *BotManager) HandleResetStep(chatID int64, text string) {
+	state := m.GetState(chatID)
+
+	switch state.Step {
+	case 0: // Typed confirmation code
+		if !strings.EqualFold(text, state.Data["confirm_code"]) {
+			m.ClearState(chatID)
+			m.SendMessage(chatID, "👍 Сброс отменен, ваши данные сохранены.")
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		m.SetState(chatID, OpResetData, 1)
+		keyboard := tgbotapi.NewInlineKeyboardMarkup(
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("🗑️ Да, удалить всё", "reset_confirm"),
+				tgbotapi.NewInlineKeyboardButtonData("❌ Отмена", "reset_cancel"),
+			),
+		)
+
+		msg := tgbotapi.NewMessage(chatID, "⚠️ Последнее подтверждение. Удалить все ваши данные?")
+		msg.ReplyMarkup = keyboard
+		if _, err := m.Send(msg); err != nil {
+			log.Printf("Error sending reset confirmation: %v", err)
+		}
+
+	case 1: // Waiting for the button
+		m.SendMessage(chatID, "Подтвердите или отмените сброс с помощью кнопок выше.")
+	}
+}
+
+// ResetAllData deletes the user's data and reports how much was removed
+func (m *BotManager) ResetAllData(chatID int64, withSettings bool) {
+	deleted, err := m.DeleteUserData(chatID, withSettings)
+	if err != nil {
+		log.Printf("Error resetting data for user %d: %v", chatID, err)
+		m.SendMessage(chatID, "❌ Не удалось удалить данные. Попробуйте позже.")
+		m.ShowMainMenu(chatID)
+		return
+	}
+
+	report := fmt.Sprintf(
+		"✅ Данные удалены.\n\n📋 Займов: %d\n💵 Платежей: %d",
+		deleted.Loans, deleted.Repayments,
+	)
+	if withSettings {
+		report += fmt.Sprintf("\n⚙️ Настроек: %d", deleted.Settings)
+	}
+	m.SendMessage(chatID, report)
+	m.ShowMainMenu(chatID)
+}
+
+// DeletedData counts what DeleteUserData removed
+type DeletedData struct {
+	Loans      int64
+	Repayments int64
+	Settings   int64
+}
+
+// DeleteUserData removes all loans, repayments and loan events of a single user,
+// and optionally their settings, in one transaction
+func (m *BotManager) DeleteUserData(chatID int64, withSettings bool) (DeletedData, error) {
+	var deleted DeletedData
+	var deletedEvents, deletedLoans int64
+	err := m.db.Transact(func(tx *sql.Tx) error {
+		deleted = DeletedData{}
+
+		// Count the loans the user can see; merged and deleted ones are removed as well
+		err := tx.QueryRow("SELECT COUNT(*) FROM loans WHERE user_id = ? AND deleted = 0", chatID).Scan(&deleted.Loans)
+		if err != nil {
+			return err
+		}
+
+		// Delete repayments first (due to foreign key constraints)
+		result, err := tx.Exec("DELETE FROM repayments WHERE user_id = ?", chatID)
+		if err != nil {
+			return err
+		}
+		deleted.Repayments, _ = result.RowsAffected()
+
+		// Delete the activity log
+		result, err = tx.Exec("DELETE FROM loan_events WHERE user_id = ?", chatID)
+		if err != nil {
+			return err
+		}
+		deletedEvents, _ = result.RowsAffected()
+
+		// Forget sent due-date notifications
+		_, err = tx.Exec("DELETE FROM due_notifications WHERE user_id = ?", chatID)
+		if err != nil {
+			return err
+		}
+
+		// Delete the borrowers' contacts
+		_, err = tx.Exec("DELETE FROM borrowers WHERE user_id = ?", chatID)
+		if err != nil {
+			return err
+		}
+
+		// Delete the disbursements of loans given in installments
+		_, err = tx.Exec("DELETE FROM disbursements WHERE user_id = ?", chatID)
+		if err != nil {
+			return err
+		}
+
+		// Delete the amount change history
+		_, err = tx.Exec("DELETE FROM loan_amount_history WHERE user_id = ?", chatID)
+		if err != nil {
+			return err
+		}
+
+		// Delete the due date extensions
+		_, err = tx.Exec("DELETE FROM extensions WHERE user_id = ?", chatID)
+		if err != nil {
+			return err
+		}
+
+		// Delete reminders waiting for the end of quiet hours
+		_, err = tx.Exec("DELETE FROM deferred_messages WHERE user_id = ?", chatID)
+		if err != nil {
+			return err
+		}
+
+		// Delete the recurring loan templates
+		_, err = tx.Exec("DELETE FROM recurring_loans WHERE user_id = ?", chatID)
+		if err != nil {
+			return err
+		}
+
+		// Delete the loans
+		result, err = tx.Exec("DELETE FROM loans WHERE user_id = ?", chatID)
+		if err != nil {
+			return err
+		}
+		deletedLoans, _ = result.RowsAffected()
+		// loan_counters is kept, so buttons left in the chat never point at a new loan
+
+		// Delete the settings and the reminder bookkeeping
+		if withSettings {
+			result, err = tx.Exec("DELETE FROM user_settings WHERE user_id = ?", chatID)
+			if err != nil {
+				return err
+			}
+			deleted.Settings, _ = result.RowsAffected()
+
+			_, err = tx.Exec("DELETE FROM reminders WHERE user_id = ?", chatID)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return DeletedData{}, err
+	}
+
+	m.RecordDeletions(deleted.Repayments + deletedEvents + deletedLoans + deleted.Settings)
+	return deleted, nil
+}
+
+// Callback prefixes of amount prompts: the keypad sends kp_0 … kp_9, kp_back and kp_ok,
+// quick picks send qa_<amount>
+const (
+	KeypadPrefix      = "kp_"
+	QuickAmountPrefix = "qa_"
+)
+
+// maxKeypadDigits keeps keypad amounts well inside int64
+const maxKeypadDigits = 12
+
+// quickAmountsLimit is how many frequently used amounts are offered as buttons
+const quickAmountsLimit = 4
+
+// SendAmountPrompt asks for an amount, offering the given frequently used amounts as
+// buttons and a numeric keypad when the user enabled it. Typing the amount works either way.
+func (m *BotManager) SendAmountPrompt(chatID int64, prompt string, quickAmounts []int64) {
+	keypad := m.GetBoolSetting(chatID, SettingKeypad, false)
+	if !keypad && len(quickAmounts) == 0 {
+		m.SendMessage(chatID, prompt)
+		return
+	}
+
+	// Tie the buttons to the current step so they can't answer a later question
+	state := m.GetState(chatID)
+	var amounts []string
+	for _, amount := range quickAmounts {
+		amounts = append(amounts, strconv.FormatInt(amount, 10))
+	}
+	m.SaveStateData(chatID, "amount_step", fmt.Sprintf("%s:%d", state.Operation, state.Step))
+	m.SaveStateData(chatID, "amount_prompt", prompt)
+	m.SaveStateData(chatID, "quick_amounts", strings.Join(amounts, ","))
+	m.SaveStateData(chatID, "keypad_value", "")
+
+	text := prompt
+	if keypad {
+		text = m.keypadText(chatID, prompt, "")
+	}
+
+	msg := tgbotapi.NewMessage(chatID, text)
+	msg.ReplyMarkup = m.amountMarkup(chatID)
+	if _, err := m.Send(msg); err != nil {
+		log.Printf("Error sending amount prompt: %v", err)
+	}
+}
+
+// AmountPromptActive reports whether the amount buttons belong to the step the user is on
+func (m *BotManager) AmountPromptActive(chatID int64) bool {
+	state := m.GetState(chatID)
+	amountStep, ok := state.Data["amount_step"]
+	return ok && amountStep == fmt.Sprintf("%s:%d", state.Operation, state.Step)
+}
+
+// FrequentLoanAmounts returns the amounts the user lends most often
+func (m *BotManager) FrequentLoanAmounts(chatID int64) []int64 {
+	return m.frequentAmounts(
+		"SELECT amount FROM loans WHERE user_id = ? AND deleted = 0 GROUP BY amount ORDER BY COUNT(*) DESC, amount LIMIT ?",
+		chatID, quickAmountsLimit,
+	)
+}
+
+// FrequentRepaymentAmounts returns the repayment amounts the user records most often, up to max
+func (m *BotManager) FrequentRepaymentAmounts(chatID int64, max int64) []int64 {
+	return m.frequentAmounts(
+		"SELECT amount FROM repayments WHERE user_id = ? AND amount <= ? GROUP BY amount ORDER BY COUNT(*) DESC, amount LIMIT ?",
+		chatID, max, quickAmountsLimit,
+	)
+}
+
+// frequentAmounts runs a top-amounts query and returns the amounts in ascending order
+func (m *BotManager) frequentAmounts(query string, args ...interface{}) []int64 {
+	rows, err := m.db.Query(query, args...)
+	if err != nil {
+		log.Printf("Error getting frequent amounts: %v", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var amounts []int64
+	for rows.Next() {
+		var amount int64
+		if err := rows.Scan(&amount); err != nil {
+			log.Printf("Error scanning frequent amount: %v", err)
+			continue
+		}
+		if amount > 0 {
+			amounts = append(amounts, amount)
+		}
+	}
+
+	sort.Slice(amounts, func(i, j int) bool { return amounts[i] < amounts[j] })
+	return amounts
+}
+
+// HandleQuickAmount submits a frequently used amount picked from the buttons
+func (m *BotManager) HandleQuickAmount(chatID int64, messageID int, value string) {
+	if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+		log.Printf("Invalid quick amount: %s", value)
+		return
+	}
+
+	// Leave the chosen amount in the message and pass it on like typed text
+	prompt, _ := m.GetStateData(chatID, "amount_prompt")
+	m.SaveStateData(chatID, "amount_step", "")
+	m.editAmountPrompt(chatID, messageID, m.keypadText(chatID, prompt, value), nil)
+	m.HandleStateInput(chatID, value)
+}
+
+// HandleKeypadPress adds a digit, removes the last one, or submits the amount
+func (m *BotManager) HandleKeypadPress(chatID int64, messageID int, key string) {
+	value, _ := m.GetStateData(chatID, "keypad_value")
+	prompt, _ := m.GetStateData(chatID, "amount_prompt")
+
+	switch key {
+	case "back":
+		if value == "" {
+			return
+		}
+		value = value[:len(value)-1]
+	case "ok":
+		if value == "" {
+			return
+		}
+
+		// Leave the entered amount in the message and pass it on like typed text
+		m.SaveStateData(chatID, "amount_step", "")
+		m.editAmountPrompt(chatID, messageID, m.keypadText(chatID, prompt, value), nil)
+		m.HandleStateInput(chatID, value)
+		return
+	default:
+		// Digits only, no leading zeros
+		if len(key) != 1 || key[0] < '0' || key[0] > '9' || (value == "" && key == "0") || len(value) >= maxKeypadDigits {
+			return
+		}
+		value += key
+	}
+
+	m.SaveStateData(chatID, "keypad_value", value)
+	markup := m.amountMarkup(chatID)
+	m.editAmountPrompt(chatID, messageID, m.keypadText(chatID, prompt, value), &markup)
+}
+
+// keypadText renders the prompt with the amount entered so far
+func (m *BotManager) keypadText(chatID int64, prompt string, value string) string {
+	entered := "…"
+	if amount, err := strconv.ParseInt(value, 10, 64); err == nil {
+		entered = m.Money(chatID, amount)
+	}
+
+	return fmt.Sprintf("%s\n\n🔢 %s", prompt, entered)
+}
+
+// editAmountPrompt updates the amount prompt, which Send does not format for edits
+func (m *BotManager) editAmountPrompt(chatID int64, messageID int, text string, markup *tgbotapi.InlineKeyboardMarkup) {
+	if render := m.TextRenderer(chatID); render != nil {
+		text = render(text)
+	}
+
+	edit := tgbotapi.NewEditMessageText(chatID, messageID, text)
+	edit.ReplyMarkup = markup
+	if _, err := m.bot.Send(edit); err != nil {
+		log.Printf("Error updating amount prompt: %v", err)
+	}
+}
+
+// amountMarkup builds the quick-pick row followed by the 3×4 numeric keypad, if enabled
+func (m *BotManager) amountMarkup(chatID int64) tgbotapi.InlineKeyboardMarkup {
+	var keyboard [][]tgbotapi.InlineKeyboardButton
+
+	if amounts, _ := m.GetStateData(chatID, "quick_amounts"); amounts != "" {
+		var row []tgbotapi.InlineKeyboardButton
+		for _, value := range strings.Split(amounts, ",") {
+			amount, _ := strconv.ParseInt(value, 10, 64)
+			row = append(row, tgbotapi.NewInlineKeyboardButtonData(m.Money(chatID, amount), QuickAmountPrefix+value))
+		}
+		keyboard = append(keyboard, row)
+	}
+
+	if m.GetBoolSetting(chatID, SettingKeypad, false) {
+		key := func(label string, value string) tgbotapi.InlineKeyboardButton {
+			return tgbotapi.NewInlineKeyboardButtonData(label, KeypadPrefix+value)
+		}
+
+		keyboard = append(keyboard,
+			tgbotapi.NewInlineKeyboardRow(key("1", "1"), key("2", "2"), key("3", "3")),
+			tgbotapi.NewInlineKeyboardRow(key("4", "4"), key("5", "5"), key("6", "6")),
+			tgbotapi.NewInlineKeyboardRow(key("7", "7"), key("8", "8"), key("9", "9")),
+			tgbotapi.NewInlineKeyboardRow(key("⌫", "back"), key("0", "0"), key("✅", "ok")),
+		)
+	}
+
+	return tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+}
+
+// ShowWhoAmI replies with the chat and user IDs, e.g. for filling in ADMIN_IDS
+func (m *BotManager) ShowWhoAmI(message *tgbotapi.Message) {
+	chatType := "личный чат"
+	if !message.Chat.IsPrivate() {
+		chatType = fmt.Sprintf("группа (%s)", message.Chat.Type)
+	}
+
+	text := fmt.Sprintf("🪪 Тип чата: %s\n💬 ID чата: %d", chatType, message.Chat.ID)
+	if message.From != nil {
+		text += fmt.Sprintf("\n👤 Ваш ID: %d", message.From.ID)
+	}
+	m.SendMessage(message.Chat.ID, text)
+}
+
+// ConfirmRestart asks whether the current operation should be abandoned for /start
+func (m *BotManager) ConfirmRestart(chatID int64) {
+	keyboard := tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("✅ Да, прервать", "restart_confirm"),
+			tgbotapi.NewInlineKeyboardButtonData("❌ Нет, продолжить", "restart_cancel"),
+		),
+	)
+
+	msg := tgbotapi.NewMessage(chatID, "⚠️ Прервать текущую операцию?\nВведенные данные будут потеряны.")
+	msg.ReplyMarkup = keyboard
+	if _, err := m.Send(msg); err != nil {
+		log.Printf("Error sending restart confirmation: %v", err)
+	}
+}
+
+// Restart clears the conversation state and shows the greeting, or the view
+// requested by the /start payload
+func (m *BotManager) Restart(chatID int64, payload string) {
+	m.ClearState(chatID)
+
+	// Links like t.me/<bot>?start=loan_42 open a view directly
+	if m.HandleStartPayload(chatID, payload) {
+		return
+	}
+
+	m.SendMessage(chatID, greeting(m.GetSetting(chatID, SettingFirstName, "")))
+	m.ShowMainMenu(chatID)
+}
+
+// defaultWelcomeMessage explains the bot to first-time users unless WELCOME_MESSAGE is set
+const defaultWelcomeMessage = "📒 Я помогаю вести учет денег, которые вы даете в долг.\n\n" +
+	"💰 Добавьте займ: кому и сколько вы дали, можно указать цель и срок возврата.\n" +
+	"✅ Отмечайте возвраты полностью или по частям.\n" +
+	"📊 Смотрите баланс, статистику и ищите займы.\n" +
+	"⏰ Раз в неделю я напомню, кто вам еще должен.\n\n" +
+	"⚙️ Настройки: /settings, клавиатура быстрых действий: /keyboard."
+
+// NeedsOnboarding reports whether a user is new: never introduced, with no loans and no settings
+func (m *BotManager) NeedsOnboarding(chatID int64) bool {
+	if m.GetBoolSetting(chatID, SettingOnboarded, false) {
+		return false
+	}
+
+	var known bool
+	err := m.db.QueryRow(
+		`SELECT EXISTS(SELECT 1 FROM loans WHERE user_id = ?) OR EXISTS(SELECT 1 FROM user_settings WHERE user_id = ?)`,
+		chatID, chatID,
+	).Scan(&known)
+	if err != nil {
+		log.Printf("Error checking whether user %d is new: %v", chatID, err)
+		return false
+	}
+	return !known
+}
+
+// ShowOnboarding greets a first-time user with a short introduction before the menu
+func (m *BotManager) ShowOnboarding(chatID int64) {
+	m.ClearState(chatID)
+	m.SendMessage(chatID, greeting(m.GetSetting(chatID, SettingFirstName, ""))+"\n\n"+m.config.WelcomeMessage)
+	m.SetBoolSetting(chatID, SettingOnboarded, true)
+	m.ShowMainMenu(chatID)
+}
+
+// HandleStartPayload opens the view requested by a /start deep-link parameter.
+// It returns false for an empty or unknown payload so the normal menu is shown.
+func (m *BotManager) HandleStartPayload(chatID int64, payload string) bool {
+	switch {
+	case payload == "":
+		return false
+	case payload == "balance":
+		m.ShowBalance(chatID)
+	case payload == "stats":
+		m.ShowStats(chatID)
+	case payload == "add":
+		m.StartAddLoanFlow(chatID)
+	case payload == "settings":
+		m.ShowSettingsMenu(chatID)
+	case strings.HasPrefix(payload, "loan_"):
+		loanID, err := strconv.Atoi(strings.TrimPrefix(payload, "loan_"))
+		if err != nil {
+			log.Printf("Invalid start payload: %s", payload)
+			return false
+		}
+		m.ShowLoanDetails(chatID, loanID)
+	case strings.HasPrefix(payload, "history_"):
+		loanID, err := strconv.Atoi(strings.TrimPrefix(payload, "history_"))
+		if err != nil {
+			log.Printf("Invalid start payload: %s", payload)
+			return false
+		}
+		m.ShowLoanRepaymentHistory(chatID, loanID)
+	default:
+		log.Printf("Unknown start payload: %s", payload)
+		return false
+	}
+
+	return true
+}
+
+// SaveFirstName remembers the user's Telegram first name so later messages can be personalized
+func (m *BotManager) SaveFirstName(chatID int64, user *tgbotapi.User) {
+	if user == nil {
+		return
+	}
+
+	firstName := strings.TrimSpace(user.FirstName)
+	if firstName == "" {
+		return
+	}
+
+	if err := m.SetSetting(chatID, SettingFirstName, firstName); err != nil {
+		log.Printf("Error saving first name for user %d: %v", chatID, err)
+	}
+}
+
+// greeting returns a welcome line addressed to the user by name when it is known
+func greeting(firstName string) string {
+	if firstName == "" {
+		return "👋 Привет!"
+	}
+	return fmt.Sprintf("👋 Привет, %s!", firstName)
+}
+
+// HandleTransferCommand asks another user to take over a loan ("/transfer <loan_id> <user_id>")
+func (m *BotManager) HandleTransferCommand(chatID int64, args string) {
+	fields := strings.Fields(args)
+	if len(fields) != 2 {
+		m.SendMessage(chatID, "Использование: /transfer <номер займа> <ID пользователя>\nID пользователя можно узнать у получателя.")
+		return
+	}
+
+	loanID, err := strconv.Atoi(fields[0])
+	if err != nil {
+		m.SendMessage(chatID, "❌ Некорректный номер займа.")
+		return
+	}
+
+	targetID, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || targetID == chatID {
+		m.SendMessage(chatID, "❌ Некорректный ID получателя.")
+		return
+	}
+
+	loan, err := m.GetLoanByID(chatID, loanID)
+	if err != nil {
+		m.SendMessage(chatID, "❌ Займ не найден.")
+		return
+	}
+
+	// Record the pending transfer
+	result, err := m.db.Exec(
+		"INSERT INTO transfers (from_user_id, loan_id, to_user_id, status) VALUES (?, ?, ?, 'pending')",
+		chatID, loanID, targetID,
+	)
+	if err != nil {
+		log.Printf("Error creating transfer: %v", err)
+		m.SendMessage(chatID, "❌ Не удалось создать запрос на передачу займа.")
+		return
+	}
+	transferID, _ := result.LastInsertId()
+
+	// Ask the recipient to accept
+	sender := m.GetSetting(chatID, SettingFirstName, "")
+	if sender == "" {
+		sender = fmt.Sprintf("ID %d", chatID)
+	}
+
+	remainingAmount := loan.Amount - m.GetTotalRepaidAmount(chatID, loanID)
+	keyboard := tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("✅ Принять", fmt.Sprintf("transfer_accept_%d", transferID)),
+			tgbotapi.NewInlineKeyboardButtonData("❌ Отклонить", fmt.Sprintf("transfer_decline_%d", transferID)),
+		),
+	)
+
+	msg := tgbotapi.NewMessage(targetID, fmt.Sprintf(
+		"📨 Пользователь %s хочет передать вам учет займа:\n\n👤 Заемщик: %s\n💰 Сумма: %s\n💵 Остаток: %s\n📝 Цель: %s\n\nПринять займ?",
+		sender, loan.Borrower, m.Money(targetID, loan.Amount), m.Money(targetID, remainingAmount), loan.Purpose,
+	))
+	msg.ReplyMarkup = keyboard
+	if _, err := m.Send(msg); err != nil {
+		log.Printf("Error sending transfer request to %d: %v", targetID, err)
+		m.db.Exec("UPDATE transfers SET status = 'failed' WHERE transfer_id = ?", transferID)
+		m.SendMessage(chatID, "❌ Не удалось отправить запрос. Получатель должен сначала запустить бота командой /start.")
+		return
+	}
+
+	m.SendMessage(chatID, fmt.Sprintf("📨 Запрос на передачу займа #%d отправлен. Займ будет передан после подтверждения получателем.", loanID))
+}
+
+// CompleteTransfer accepts or declines a pending loan transfer addressed to the user
+func (m *BotManager) CompleteTransfer(chatID int64, transferID int64, accept bool) {
+	var fromUserID int64
+	var loanID int
+	err := m.db.QueryRow(
+		"SELECT from_user_id, loan_id FROM transfers WHERE transfer_id = ? AND to_user_id = ? AND status = 'pending'",
+		transferID, chatID,
+	).Scan(&fromUserID, &loanID)
+	if err != nil {
+		m.SendMessage(chatID, "❌ Запрос на передачу не найден или уже обработан.")
+		m.ShowMainMenu(chatID)
+		return
+	}
+
+	if !accept {
+		m.db.Exec("UPDATE transfers SET status = 'declined' WHERE transfer_id = ?", transferID)
+		m.SendMessage(chatID, "Передача займа отклонена.")
+		m.SendMessage(fromUserID, fmt.Sprintf("❌ Получатель отклонил передачу займа #%d.", loanID))
+		m.ShowMainMenu(chatID)
+		return
+	}
+
+	newLoanID, err := m.TransferLoan(transferID, fromUserID, loanID, chatID)
+	if errors.Is(err, errLoanLimit) {
+		m.SendMessage(chatID, fmt.Sprintf(
+			"❌ Достигнут лимит займов (%d). Закройте или удалите старые, чтобы принять займ.",
+			m.config.MaxLoansPerUser,
+		))
+		m.ShowMainMenu(chatID)
+		return
+	}
+	if err != nil {
+		log.Printf("Error transferring loan: %v", err)
+		m.SendMessage(chatID, "❌ Не удалось принять займ. Возможно, он уже удален.")
+		m.ShowMainMenu(chatID)
+		return
+	}
+
+	m.LogLoanEvent(chatID, newLoanID, EventTransferred, fmt.Sprintf("Займ получен от пользователя %d (был #%d)", fromUserID, loanID))
+	m.SendMessage(chatID, fmt.Sprintf("✅ Займ принят и сохранен под номером #%d.", newLoanID))
+	m.SendMessage(fromUserID, fmt.Sprintf("✅ Займ #%d передан получателю.", loanID))
+	m.ShowMainMenu(chatID)
+}
+
+// IsAdmin reports whether a message was sent by one of the configured admins
+func (m *BotManager) IsAdmin(message *tgbotapi.Message) bool {
+	userID := message.Chat.ID
+	if message.From != nil {
+		userID = message.From.ID
+	}
+
+	for _, adminID := range m.config.AdminIDs {
+		if adminID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// ShowDatabaseStats reports record counts and the size of the database file
+func (m *BotManager) ShowDatabaseStats(chatID int64) {
+	var totalLoans, deletedLoans, totalRepayments, totalUsers int
+	var oldest, newest sql.NullString
+
+	err := m.db.QueryRow(
+		"SELECT COUNT(*), COALESCE(SUM(deleted), 0), COUNT(DISTINCT user_id), MIN(created_at), MAX(created_at) FROM loans",
+	).Scan(&totalLoans, &deletedLoans, &totalUsers, &oldest, &newest)
+	if err != nil {
+		log.Printf("Error getting loan counts: %v", err)
+		m.SendMessage(chatID, "❌ Не удалось получить статистику базы данных.")
+		return
+	}
+
+	err = m.db.QueryRow("SELECT COUNT(*) FROM repayments").Scan(&totalRepayments)
+	if err != nil {
+		log.Printf("Error getting repayment count: %v", err)
+		m.SendMessage(chatID, "❌ Не удалось получить статистику базы данных.")
+		return
+	}
+
+	fileSize := "неизвестно"
+	if info, err := os.Stat(dbPath); err != nil {
+		log.Printf("Error getting database file size: %v", err)
+	} else {
+		fileSize = fmt.Sprintf("%.1f КБ", float64(info.Size())/1024)
+	}
+
+	if !oldest.Valid {
+		oldest.String = "—"
+	}
+	if !newest.Valid {
+		newest.String = "—"
+	}
+
+	m.SendMessage(chatID, fmt.Sprintf(
+		"🗄️ Статистика базы данных:\n\n"+
+			"📄 Займов: %d (удалено: %d)\n"+
+			"💵 Платежей: %d\n"+
+			"👥 Пользователей: %d\n"+
+			"💾 Размер файла: %s\n"+
+			"📅 Самый старый займ: %s\n"+
+			"📅 Самый новый займ: %s",
+		totalLoans, deletedLoans, totalRepayments, totalUsers, fileSize, oldest.String, newest.String,
+	))
+}
+
+// ShowHighBalances lists the users whose outstanding total is above the alert threshold,
+// so admins can spot misuse of a shared bot. The threshold can be given as an argument.
+func (m *BotManager) ShowHighBalances(chatID int64, args string) {
+	threshold := m.config.OutstandingAlertThreshold
+	if args = strings.TrimSpace(args); args != "" {
+		value, err := parseAmount(args)
+		if err != nil || value <= 0 {
+			m.SendMessage(chatID, "❌ Укажите порог целым положительным числом, например /highbalances 5000000")
+			return
+		}
+		threshold = value
+	}
+
+	rows, err := m.db.Query(
+		`SELECT l.user_id, COUNT(*), SUM(l.amount - COALESCE(
+			(SELECT SUM(r.amount) FROM repayments r WHERE r.user_id = l.user_id AND r.loan_id = l.loan_id), 0)) AS outstanding
+		FROM loans l WHERE l.repaid = 0 AND l.deleted = 0
+		GROUP BY l.user_id HAVING outstanding > ? ORDER BY outstanding DESC`,
+		threshold,
+	)
+	if err != nil {
+		log.Printf("Error getting high balances: %v", err)
+		m.SendMessage(chatID, "❌ Не удалось получить суммы пользователей.")
+		return
+	}
+
+	type userBalance struct {
+		UserID      int64
+		LoanCount   int
+		Outstanding int64
+	}
+	var balances []userBalance
+	for rows.Next() {
+		var balance userBalance
+		if err := rows.Scan(&balance.UserID, &balance.LoanCount, &balance.Outstanding); err != nil {
+			log.Printf("Error scanning high balance: %v", err)
+			continue
+		}
+		balances = append(balances, balance)
+	}
+	rows.Close()
+
+	if len(balances) == 0 {
+		m.SendMessage(chatID, fmt.Sprintf("👍 Ни у одного пользователя остаток не превышает %s.", m.Money(chatID, threshold)))
+		return
+	}
+
+	// Build response
+	var response strings.Builder
+	response.WriteString(fmt.Sprintf("🚩 Пользователи с остатком больше %s:\n\n", m.Money(chatID, threshold)))
+	for _, balance := range balances {
+		name := m.GetSetting(balance.UserID, SettingFirstName, "")
+		if name != "" {
+			name = " (" + name + ")"
+		}
+		response.WriteString(fmt.Sprintf(
+			"👤 %d%s — %s (займов: %d)\n",
+			balance.UserID, name, m.Money(chatID, balance.Outstanding), balance.LoanCount,
+		))
+	}
+
+	m.SendLongMessage(chatID, response.String())
+}
+
+// HandleRemindersCommand turns weekly reminders on or off ("/reminders on", "/reminders off")
+func (m *BotManager) HandleRemindersCommand(chatID int64, args string) {
+	switch strings.ToLower(strings.TrimSpace(args)) {
+	case "on":
+		m.SetBoolSetting(chatID, SettingReminders, true)
+	case "off":
+		m.SetBoolSetting(chatID, SettingReminders, false)
+	case "":
+		// Just report the current state below
+	default:
+		m.SendMessage(chatID, "❌ Используйте /reminders on или /reminders off.")
+		return
+	}
+
+	if m.GetBoolSetting(chatID, SettingReminders, true) {
+		m.SendMessage(chatID, "🔔 Еженедельные напоминания включены.\nЧтобы отключить их, отправьте /reminders off")
+	} else {
+		m.SendMessage(chatID, "🔕 Еженедельные напоминания отключены.\nЧтобы включить их, отправьте /reminders on")
+	}
+}
+
+// HandleKeyboardCommand shows or hides the quick-action keyboard. Without arguments it
+// is toggled; "/keyboard on" and "/keyboard off" set it explicitly.
+func (m *BotManager) HandleKeyboardCommand(chatID int64, args string) {
+	enabled := m.GetBoolSetting(chatID, SettingReplyKeyboard, false)
+	switch strings.ToLower(strings.TrimSpace(args)) {
+	case "on":
+		enabled = true
+	case "off":
+		enabled = false
+	case "":
+		enabled = !enabled
+	default:
+		m.SendMessage(chatID, "❌ Используйте /keyboard, /keyboard on или /keyboard off.")
+		return
+	}
+	m.SetBoolSetting(chatID, SettingReplyKeyboard, enabled)
+
+	var msg tgbotapi.MessageConfig
+	if enabled {
+		msg = tgbotapi.NewMessage(chatID, "⌨️ Клавиатура быстрых действий включена.\nЧтобы скрыть ее, отправьте /keyboard")
+		keyboard := tgbotapi.NewReplyKeyboard(
+			tgbotapi.NewKeyboardButtonRow(
+				tgbotapi.NewKeyboardButton(ReplyAddLoan),
+				tgbotapi.NewKeyboardButton(ReplyRepay),
+			),
+			tgbotapi.NewKeyboardButtonRow(
+				tgbotapi.NewKeyboardButton(ReplyBalance),
+				tgbotapi.NewKeyboardButton(ReplyStats),
+			),
+		)
+		keyboard.ResizeKeyboard = true
+		msg.ReplyMarkup = keyboard
+	} else {
+		msg = tgbotapi.NewMessage(chatID, "⌨️ Клавиатура быстрых действий скрыта.\nЧтобы вернуть ее, отправьте /keyboard")
+		msg.ReplyMarkup = tgbotapi.NewRemoveKeyboard(true)
+	}
+
+	if _, err := m.Send(msg); err != nil {
+		log.Printf("Error updating reply keyboard: %v", err)
+	}
+}
+
+// HandlePinCommand turns the pinned summary message on or off
+func (m *BotManager) HandlePinCommand(chatID int64, args string) {
+	current := m.GetSetting(chatID, SettingPinnedSummary, "")
+	enabled := current != ""
+	switch strings.ToLower(strings.TrimSpace(args)) {
+	case "on":
+		enabled = true
+	case "off":
+		enabled = false
+	case "":
+		enabled = !enabled
+	default:
+		m.SendMessage(chatID, "❌ Используйте /pin, /pin on или /pin off.")
+		return
 	}
 
-	if len(loans) == 0 {
-		status := "возвращенных"
-		if !repaidStatus {
-			status = "активных"
+	if enabled {
+		if current != "" {
+			m.UpdatePinnedSummary(chatID)
+			m.SendMessage(chatID, "📌 Закрепленная сводка уже включена и обновлена.")
+			return
+		}
+		if err := m.SendPinnedSummary(chatID); err != nil {
+			log.Printf("Error sending pinned summary: %v", err)
+			m.SendMessage(chatID, "❌ Не удалось отправить сводку.")
 		}
-		m.SendMessage(chatID, fmt.Sprintf("У вас нет %s займов.", status))
-		m.ShowMainMenu(chatID)
 		return
 	}
 
-	// Build response
-	var response strings.Builder
-	status := "✅ Возвращенные"
-	if !repaidStatus {
-		status = "⏳ Активные"
+	if messageID, err := strconv.Atoi(current); err == nil {
+		if _, err := m.bot.Request(tgbotapi.UnpinChatMessageConfig{ChatID: chatID, MessageID: messageID}); err != nil {
+			log.Printf("Error unpinning summary for user %d: %v", chatID, err)
+		}
 	}
-	response.WriteString(fmt.Sprintf("📋 %s займы:\n\n", status))
+	if err := m.SetSetting(chatID, SettingPinnedSummary, ""); err != nil {
+		log.Printf("Error saving pinned summary for user %d: %v", chatID, err)
+	}
+	m.SendMessage(chatID, "📌 Закрепленная сводка отключена.\nЧтобы вернуть ее, отправьте /pin")
+}
 
-	for _, loan := range loans {
-		if !loan.Repaid {
-			// Calculate remaining amount for active loans
-			repaidAmount := m.GetTotalRepaidAmount(chatID, loan.ID)
-			remainingAmount := loan.Amount - repaidAmount
+// SummaryText builds the text of the pinned summary
+func (m *BotManager) SummaryText(chatID int64) (string, error) {
+	activeLoans, err := m.GetActiveLoansForUser(chatID)
+	if err != nil {
+		return "", err
+	}
+	outstanding, err := m.GetOutstandingTotal(chatID)
+	if err != nil {
+		return "", err
+	}
 
-			response.WriteString(fmt.Sprintf(
-				"🆔 Займ #%d\n👤 Заемщик: %s\n💰 Сумма: %d ₸\n💵 Остаток: %d ₸\n📝 Цель: %s\n➖➖➖➖➖➖➖➖➖➖\n\n",
-				loan.ID, loan.Borrower, loan.Amount, remainingAmount, loan.Purpose,
-			))
-		} else {
-			response.WriteString(fmt.Sprintf(
-				"🆔 Займ #%d\n👤 Заемщик: %s\n💰 Сумма: %d ₸\n📝 Цель: %s\n➖➖➖➖➖➖➖➖➖➖\n\n",
-				loan.ID, loan.Borrower, loan.Amount, loan.Purpose,
-			))
+	now := m.UserNow(chatID)
+	overdue := 0
+	for _, loan := range activeLoans {
+		if loanDaysOverdue(loan, now) > 0 {
+			overdue++
 		}
 	}
 
-	// Send response
-	m.SendMessage(chatID, response.String())
-	m.ShowMainMenu(chatID)
+	return fmt.Sprintf(
+		"📌 Сводка по займам\n\n📋 Активных займов: %d\n💼 Вам должны: %s\n🔴 Просрочено: %d\n\n🕓 Обновлено: %s",
+		len(activeLoans), m.Money(chatID, outstanding), overdue, now.Format("2006-01-02 15:04"),
+	), nil
 }
 
-// GetLoanByID retrieves a loan by its ID
-func (m *BotManager) GetLoanByID(chatID int64, loanID int) (Loan, error) {
-	var loan Loan
-	loan.UserID = chatID
-	loan.ID = loanID
-
-	err := m.db.QueryRow(
-		"SELECT borrower_name, amount, purpose, repaid FROM loans WHERE user_id = ? AND loan_id = ?",
-		chatID, loanID,
-	).Scan(&loan.Borrower, &loan.Amount, &loan.Purpose, &loan.Repaid)
+// SendPinnedSummary sends a new summary message, pins it and remembers its ID
+func (m *BotManager) SendPinnedSummary(chatID int64) error {
+	text, err := m.SummaryText(chatID)
+	if err != nil {
+		return err
+	}
 
+	sent, err := m.Send(tgbotapi.NewMessage(chatID, text))
 	if err != nil {
-		return Loan{}, err
+		return err
 	}
 
-	return loan, nil
+	pin := tgbotapi.PinChatMessageConfig{ChatID: chatID, MessageID: sent.MessageID, DisableNotification: true}
+	if _, err := m.bot.Request(pin); err != nil {
+		// The summary still gets edited in place, it just isn't at the top of the chat
+		log.Printf("Error pinning summary for user %d: %v", chatID, err)
+	}
+
+	return m.SetSetting(chatID, SettingPinnedSummary, strconv.Itoa(sent.MessageID))
 }
 
-// DeleteLoan removes a loan and its repayments from the database
-func (m *BotManager) DeleteLoan(chatID int64, loanID int) error {
-	// Start a transaction
-	tx, err := m.db.Begin()
-	if err != nil {
-		return err
+// MarkSummaryStale schedules a refresh of the user's pinned summary. Summaries are
+// refreshed by RefreshPinnedSummaries once an update or a scheduled batch is done, so
+// an action that logs many events edits the summary only once.
+func (m *BotManager) MarkSummaryStale(chatID int64) {
+	m.summaryMutex.Lock()
+	defer m.summaryMutex.Unlock()
+
+	if m.staleSummaries == nil {
+		m.staleSummaries = make(map[int64]bool)
+	}
+	m.staleSummaries[chatID] = true
+}
+
+// RefreshPinnedSummaries updates the pinned summary of every user marked by MarkSummaryStale
+func (m *BotManager) RefreshPinnedSummaries() {
+	m.summaryMutex.Lock()
+	stale := m.staleSummaries
+	m.staleSummaries = nil
+	m.summaryMutex.Unlock()
+
+	for chatID := range stale {
+		m.UpdatePinnedSummary(chatID)
 	}
+}
 
-	// Delete repayments first (due to foreign key constraints)
-	_, err = tx.Exec("DELETE FROM repayments WHERE user_id = ? AND loan_id = ?", chatID, loanID)
+// UpdatePinnedSummary edits the pinned summary in place. If the message can no longer
+// be edited, e.g. because it was deleted, a new one is sent and pinned instead.
+func (m *BotManager) UpdatePinnedSummary(chatID int64) {
+	messageID, err := strconv.Atoi(m.GetSetting(chatID, SettingPinnedSummary, ""))
 	if err != nil {
-		tx.Rollback()
-		return err
+		// The pinned summary is turned off
+		return
 	}
 
-	// Delete the loan
-	_, err = tx.Exec("DELETE FROM loans WHERE user_id = ? AND loan_id = ?", chatID, loanID)
+	text, err := m.SummaryText(chatID)
 	if err != nil {
-		tx.Rollback()
-		return err
+		log.Printf("Error building pinned summary for user %d: %v", chatID, err)
+		return
+	}
+	if render := m.TextRenderer(chatID); render != nil {
+		text = render(text)
 	}
 
-	// Commit the transaction
-	return tx.Commit()
+	_, err = m.bot.Send(tgbotapi.NewEditMessageText(chatID, messageID, text))
+	if err == nil || strings.Contains(err.Error(), "message is not modified") {
+		return
+	}
+
+	log.Printf("Error editing pinned summary for user %d, sending a new one: %v", chatID, err)
+	if err := m.SendPinnedSummary(chatID); err != nil {
+		log.Printf("Error sending pinned summary: %v", err)
+	}
 }
 
-// ShowLoanRepaymentHistory displays the repayment history for a specific loan
-func (m *BotManager) ShowLoanRepaymentHistory(chatID int64, loanID int) {
-	// Get loan details
+// StartReassignLoanFlow begins moving a loan's debt to a different borrower
+func (m *BotManager) StartReassignLoanFlow(chatID int64, loanID int) {
+	// First clear any existing state
+	m.ClearState(chatID)
+
 	loan, err := m.GetLoanByID(chatID, loanID)
 	if err != nil {
 		log.Printf("Error getting loan details: %v", err)
-		m.SendMessage(chatID, "❌ Не удалось получить информацию о займе.")
+		m.SendMessage(chatID, "❌ Займ не найден.")
 		m.ShowMainMenu(chatID)
 		return
 	}
 
-	// Get repayment history
-	rows, err := m.db.Query(
-		"SELECT amount, repayment_date, note FROM repayments WHERE user_id = ? AND loan_id = ? ORDER BY repayment_date",
-		chatID, loanID,
-	)
+	m.SaveStateData(chatID, "loan_id", strconv.Itoa(loanID))
+	m.SetState(chatID, OpReassignLoan, 1)
+
+	// Suggest borrowers the user already lends to
+	names, err := m.GetBorrowerNames(chatID)
 	if err != nil {
-		log.Printf("Error getting repayment history: %v", err)
-		m.SendMessage(chatID, "❌ Не удалось получить историю платежей.")
-		m.ShowMainMenu(chatID)
-		return
+		log.Printf("Error getting borrower names: %v", err)
 	}
-	defer rows.Close()
 
-	// Build response
-	var response strings.Builder
-	response.WriteString(fmt.Sprintf("📋 История платежей по займу #%d:\n\n", loanID))
-	response.WriteString(fmt.Sprintf("👤 Заемщик: %s\n", loan.Borrower))
-	response.WriteString(fmt.Sprintf("💰 Общая сумма: %d ₸\n\n", loan.Amount))
+	var keyboard [][]tgbotapi.InlineKeyboardButton
+	for _, name := range names {
+		if sameBorrower(name, loan.Borrower) || len(keyboard) == maxBorrowerSuggestions {
+			continue
+		}
 
-	// Calculate total repaid
-	var totalRepaid int64
-	var repayments []struct {
-		Amount int64
-		Date   string
-		Note   string
+		key := strconv.Itoa(len(keyboard))
+		m.SaveStateData(chatID, "suggestion_"+key, name)
+		keyboard = append(keyboard, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("👤 "+name, "reassign_pick_"+key),
+		))
 	}
 
-	for rows.Next() {
-		var amount int64
-		var date string
-		var note string
+	msg := tgbotapi.NewMessage(chatID, fmt.Sprintf(
+		"🔄 Займ #%d сейчас числится за %s.\n👤 Введите имя нового заёмщика:",
+		loan.ID, loan.Borrower,
+	))
+	if len(keyboard) > 0 {
+		msg.Text += "\nИли выберите из списка:"
+		msg.ReplyMarkup = tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+	}
+	if _, err := m.Send(msg); err != nil {
+		log.Printf("Error starting reassign flow: %v", err)
+	}
+}
 
-		if err := rows.Scan(&amount, &date, &note); err != nil {
-			log.Printf("Error scanning repayment: %v", err)
-			continue
-		}
+// HandleReassignLoanStep processes user input for moving a loan to a different borrower
+func (m *BotManager) HandleReassignLoanStep(chatID int64, text string) {
+	state := m.GetState(chatID)
 
-		totalRepaid += amount
-		repayments = append(repayments, struct {
-			Amount int64
-			Date   string
-			Note   string
-		}{
-			Amount: amount,
-			Date:   date,
-			Note:   note,
-		})
+	loanIDStr, _ := m.GetStateData(chatID, "loan_id")
+	loanID, err := strconv.Atoi(loanIDStr)
+	if err != nil {
+		log.Printf("Error converting loan ID: %v", err)
+		m.SendMessage(chatID, "❌ Произошла ошибка при смене заёмщика.")
+		m.ClearState(chatID)
+		m.ShowMainMenu(chatID)
+		return
 	}
 
-	// Display individual repayments
-	if len(repayments) == 0 {
-		response.WriteString("Нет записей о платежах по этому займу.\n")
-	} else {
-		for i, repayment := range repayments {
-			noteDisplay := ""
-			if repayment.Note != "" {
-				noteDisplay = fmt.Sprintf("\n📝 Примечание: %s", repayment.Note)
-			}
+	switch state.Step {
+	case 1: // New borrower name
+		if text == "" {
+			m.SendMessage(chatID, "❌ Имя заемщика не может быть пустым. Пожалуйста, введите корректное имя:")
+			return
+		}
 
-			response.WriteString(fmt.Sprintf(
-				"%d. 📅 %s\n💵 Сумма: %d ₸%s\n\n",
-				i+1, repayment.Date, repayment.Amount, noteDisplay,
-			))
+		m.SaveStateData(chatID, "new_borrower", text)
+		m.SetState(chatID, OpReassignLoan, 2)
+		m.SendMessage(chatID, "📝 Укажите причину передачи долга (или отправьте \"-\" чтобы пропустить):")
+
+	case 2: // Optional reason
+		newBorrower, _ := m.GetStateData(chatID, "new_borrower")
+
+		loan, err := m.GetLoanByID(chatID, loanID)
+		if err != nil {
+			log.Printf("Error getting loan details: %v", err)
+			m.SendMessage(chatID, "❌ Займ не найден.")
+			m.ClearState(chatID)
+			m.ShowMainMenu(chatID)
+			return
 		}
-	}
 
-	// Add summary
-	remainingAmount := loan.Amount - totalRepaid
-	status := "✅ Возвращен полностью"
-	if !loan.Repaid {
-		status = fmt.Sprintf("⏳ Остаток: %d ₸", remainingAmount)
-	}
+		_, err = m.db.Exec(
+			"UPDATE loans SET borrower_name = ? WHERE user_id = ? AND loan_id = ? AND deleted = 0",
+			newBorrower, chatID, loanID,
+		)
+		if err != nil {
+			log.Printf("Error reassigning loan: %v", err)
+			m.SendMessage(chatID, "❌ Не удалось сменить заёмщика.")
+			m.ClearState(chatID)
+			m.ShowMainMenu(chatID)
+			return
+		}
 
-	response.WriteString(fmt.Sprintf(
-		"💵 Итого выплачено: %d ₸\n📊 Статус: %s",
-		totalRepaid, status,
-	))
+		details := fmt.Sprintf("Долг передан: %s → %s", loan.Borrower, newBorrower)
+		if text != "-" && text != "" {
+			details += fmt.Sprintf(" (причина: %s)", text)
+		}
+		m.LogLoanEvent(chatID, loanID, EventReassigned, details)
 
-	// Send response and show back button
-	m.SendMessage(chatID, response.String())
+		m.SendMessage(chatID, fmt.Sprintf("✅ Займ #%d теперь числится за %s.", loanID, newBorrower))
+		m.ClearState(chatID)
+		m.ShowMainMenu(chatID)
+	}
+}
 
-	// Provide a button to go back
-	keyboard := tgbotapi.NewInlineKeyboardMarkup(
-		tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData("🔙 Назад", "back_to_manage"),
-		),
+// SettlementLoan is an active loan of a borrower with what is still owed on it
+type SettlementLoan struct {
+	ID        int
+	Amount    int64
+	Remaining int64
+	Paid      int64
+	Closed    bool
+}
+
+// GetSettlementLoans returns the borrower's active loans, oldest first
+func (m *BotManager) GetSettlementLoans(chatID int64, borrower string) ([]SettlementLoan, error) {
+	rows, err := m.db.Query(
+		`SELECT loan_id, borrower_name, amount,
+			COALESCE((SELECT SUM(r.amount) FROM repayments r WHERE r.user_id = loans.user_id AND r.loan_id = loans.loan_id), 0)
+		FROM loans WHERE user_id = ? AND repaid = 0 AND deleted = 0
+		ORDER BY created_at, loan_id`,
+		chatID,
 	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-	msg := tgbotapi.NewMessage(chatID, "Выберите действие:")
-	msg.ReplyMarkup = keyboard
-	m.bot.Send(msg)
+	var loans []SettlementLoan
+	for rows.Next() {
+		var loan SettlementLoan
+		var name string
+		var repaid int64
+		if err := rows.Scan(&loan.ID, &name, &loan.Amount, &repaid); err != nil {
+			return nil, err
+		}
+		if !sameBorrower(name, borrower) {
+			continue
+		}
+
+		loan.Remaining = loan.Amount - repaid
+		loans = append(loans, loan)
+	}
+
+	return loans, rows.Err()
 }
 
-// StartSearchByNameFlow begins the process of searching for loans by borrower name
-func (m *BotManager) StartSearchByNameFlow(chatID int64) {
+// StartSettleUpFlow begins applying one payment to all active loans of a borrower.
+// The borrower is asked for unless given.
+func (m *BotManager) StartSettleUpFlow(chatID int64, borrower string) {
 	// First clear any existing state
 	m.ClearState(chatID)
+	m.SetState(chatID, OpSettleUp, 0)
 
-	// Set state for search by name
-	m.SetState(chatID, OpSearchLoan, 0)
-	m.SaveStateData(chatID, "search_type", "by_name")
+	if borrower != "" {
+		m.HandleSettleUpStep(chatID, borrower)
+		return
+	}
 
-	// Send prompt for borrower name
-	m.SendMessage(chatID, "Введите имя заемщика для поиска:")
+	// Suggest borrowers who still owe something
+	activeLoans, err := m.GetActiveLoansForUser(chatID)
+	if err != nil {
+		log.Printf("Error getting active loans: %v", err)
+	}
+
+	var keyboard [][]tgbotapi.InlineKeyboardButton
+	var suggested []string
+	for _, loan := range activeLoans {
+		known := false
+		for _, name := range suggested {
+			if sameBorrower(name, loan.Borrower) {
+				known = true
+				break
+			}
+		}
+		if known || len(keyboard) == maxBorrowerSuggestions {
+			continue
+		}
+
+		key := strconv.Itoa(len(keyboard))
+		suggested = append(suggested, loan.Borrower)
+		m.SaveStateData(chatID, "suggestion_"+key, loan.Borrower)
+		keyboard = append(keyboard, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("👤 "+loan.Borrower, "settle_pick_"+key),
+		))
+	}
+
+	msg := tgbotapi.NewMessage(chatID, "🤝 Общее погашение: сумма распределяется по активным займам заемщика, начиная с самого старого.\n👤 Введите имя заемщика:")
+	if len(keyboard) > 0 {
+		msg.Text += "\nИли выберите из списка:"
+		msg.ReplyMarkup = tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+	}
+	if _, err := m.Send(msg); err != nil {
+		log.Printf("Error starting settle up flow: %v", err)
+	}
 }
 
-// StartSearchByStatusFlow begins the process of searching for loans by status
-func (m *BotManager) StartSearchByStatusFlow(chatID int64) {
-	// Create inline keyboard for status selection
-	keyboard := tgbotapi.NewInlineKeyboardMarkup(
-		tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData("⏳ Активные", "status_active"),
-			tgbotapi.NewInlineKeyboardButtonData("✅ Возвращенные", "status_repaid"),
-		),
-		tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData("🔙 Назад", "back_to_search"),
-		),
-	)
+// HandleSettleUpStep processes user input for the settle up flow
+func (m *BotManager) HandleSettleUpStep(chatID int64, text string) {
+	state := m.GetState(chatID)
+
+	switch state.Step {
+	case 0: // Borrower name
+		loans, err := m.GetSettlementLoans(chatID, text)
+		if err != nil {
+			log.Printf("Error getting loans for settlement: %v", err)
+			m.SendMessage(chatID, "❌ Не удалось получить займы заемщика.")
+			m.ClearState(chatID)
+			m.ShowMainMenu(chatID)
+			return
+		}
+		if len(loans) == 0 {
+			m.SendMessage(chatID, fmt.Sprintf("❌ У заемщика \"%s\" нет активных займов. Введите другое имя:", text))
+			return
+		}
+
+		var total int64
+		for _, loan := range loans {
+			total += loan.Remaining
+		}
+
+		m.SaveStateData(chatID, "borrower_name", text)
+		m.SetState(chatID, OpSettleUp, 1)
+		m.SendAmountPrompt(chatID, fmt.Sprintf(
+			"👤 %s: активных займов — %d, общий остаток — %s.\n💰 Введите сумму, которую вернул заемщик:",
+			text, len(loans), m.Money(chatID, total),
+		), nil)
+
+	case 1: // Total amount
+		amount, err := parseAmount(text)
+		if err != nil || amount <= 0 {
+			m.SendMessage(chatID, "❌ Некорректная сумма. Пожалуйста, введите целое положительное число:")
+			return
+		}
+
+		borrower, _ := m.GetStateData(chatID, "borrower_name")
+		loans, err := m.SettleUp(chatID, borrower, amount)
+		if errors.Is(err, errSettlementTooLarge) {
+			m.SendMessage(chatID, "❌ Сумма больше общего остатка по займам заемщика. Введите сумму заново:")
+			return
+		}
+		if err != nil {
+			log.Printf("Error settling loans of %s: %v", borrower, err)
+			m.SendMessage(chatID, "❌ Не удалось записать погашение.")
+			m.ClearState(chatID)
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		// Show how the amount was split
+		var response strings.Builder
+		response.WriteString(fmt.Sprintf("✅ Погашение %s от %s записано:\n", m.Money(chatID, amount), borrower))
+		for _, loan := range loans {
+			if loan.Paid == 0 {
+				continue
+			}
+			if loan.Closed {
+				response.WriteString(fmt.Sprintf("\n🎉 #%d: %s — займ погашен", loan.ID, m.Money(chatID, loan.Paid)))
+			} else {
+				response.WriteString(fmt.Sprintf("\n💵 #%d: %s — остаток %s", loan.ID, m.Money(chatID, loan.Paid), m.Money(chatID, loan.Remaining-loan.Paid)))
+			}
+		}
+		m.SendMessage(chatID, response.String())
 
-	msg := tgbotapi.NewMessage(chatID, "Выберите статус займов для поиска:")
-	msg.ReplyMarkup = keyboard
-	m.bot.Send(msg)
+		m.ClearState(chatID)
+		m.ShowMainMenu(chatID)
+	}
 }
 
-// ShowAllLoans displays all loans for a user
-func (m *BotManager) ShowAllLoans(chatID int64) {
-	allLoans, err := m.GetAllLoansForUser(chatID)
+// errSettlementTooLarge is returned by SettleUp when the amount exceeds what the borrower owes
+var errSettlementTooLarge = errors.New("settlement exceeds the outstanding balance")
+
+// SettleUp spreads an amount over the borrower's active loans, oldest first, recording a
+// repayment on each and closing the loans it covers. It returns the loans with what was paid.
+func (m *BotManager) SettleUp(chatID int64, borrower string, amount int64) ([]SettlementLoan, error) {
+	loans, err := m.GetSettlementLoans(chatID, borrower)
 	if err != nil {
-		log.Printf("Error getting loans: %v", err)
-		m.SendMessage(chatID, "❌ Не удалось получить список займов.")
-		m.ShowMainMenu(chatID)
-		return
+		return nil, err
 	}
 
-	if len(allLoans) == 0 {
-		m.SendMessage(chatID, "У вас нет займов.")
-		m.ShowMainMenu(chatID)
-		return
+	var total int64
+	for _, loan := range loans {
+		total += loan.Remaining
+	}
+	if amount > total {
+		return nil, errSettlementTooLarge
 	}
 
-	// Build response
-	var response strings.Builder
-	response.WriteString("📋 Все займы:\n\n")
+	today := m.UserToday(chatID)
+	err = m.db.Transact(func(tx *sql.Tx) error {
+		left := amount
+		for i := range loans {
+			// A retried transaction spreads the amount again
+			loan := &loans[i]
+			loan.Paid, loan.Closed = 0, false
+			if left == 0 || loan.Remaining <= 0 {
+				continue
+			}
 
-	for _, loan := range allLoans {
-		status := "✅ Возвращен"
-		if !loan.Repaid {
-			status = "⏳ Активен"
+			loan.Paid = min(left, loan.Remaining)
+			left -= loan.Paid
 
-			// Calculate remaining amount for active loans
-			repaidAmount := m.GetTotalRepaidAmount(chatID, loan.ID)
-			remainingAmount := loan.Amount - repaidAmount
+			_, err := tx.Exec(
+				"INSERT INTO repayments (user_id, loan_id, amount, repayment_date, note) VALUES (?, ?, ?, ?, 'Общее погашение')",
+				chatID, loan.ID, loan.Paid, today,
+			)
+			if err != nil {
+				return err
+			}
 
-			response.WriteString(fmt.Sprintf(
-				"🆔 Займ #%d\n👤 Заемщик: %s\n💰 Сумма: %d ₸\n💵 Остаток: %d ₸\n📝 Цель: %s\n📊 Статус: %s\n➖➖➖➖➖➖➖➖➖➖\n\n",
-				loan.ID, loan.Borrower, loan.Amount, remainingAmount, loan.Purpose, status,
-			))
-		} else {
-			response.WriteString(fmt.Sprintf(
-				"🆔 Займ #%d\n👤 Заемщик: %s\n💰 Сумма: %d ₸\n📝 Цель: %s\n📊 Статус: %s\n➖➖➖➖➖➖➖➖➖➖\n\n",
-				loan.ID, loan.Borrower, loan.Amount, loan.Purpose, status,
-			))
+			if loan.Remaining-loan.Paid <= m.config.RepaidTolerance {
+				_, err := tx.Exec("UPDATE loans SET repaid = 1 WHERE user_id = ? AND loan_id = ?", chatID, loan.ID)
+				if err != nil {
+					return err
+				}
+				loan.Closed = true
+			}
 		}
-	}
-
-	// Send response
-	m.SendMessage(chatID, response.String())
-	m.ShowMainMenu(chatID)
-}
-
-// Loan represents a loan record
-type Loan struct {
-	ID       int
-	UserID   int64
-	Borrower string
-	Amount   int64
-	Purpose  string
-	Repaid   bool
-}
-
-// GetActiveLoansForUser retrieves all active loans for a user
-func (m *BotManager) GetActiveLoansForUser(chatID int64) ([]Loan, error) {
-	rows, err := m.db.Query(
-		"SELECT loan_id, borrower_name, amount, purpose FROM loans WHERE user_id = ? AND repaid = 0",
-		chatID,
-	)
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-
-	var loans []Loan
-	for rows.Next() {
-		var loan Loan
-		loan.UserID = chatID
-		loan.Repaid = false
 
-		if err := rows.Scan(&loan.ID, &loan.Borrower, &loan.Amount, &loan.Purpose); err != nil {
-			return nil, err
+	for _, loan := range loans {
+		if loan.Paid <= 0 {
+			continue
+		}
+		m.LogLoanEvent(chatID, loan.ID, EventPartialRepayment, fmt.Sprintf("Общее погашение: %s от %s", m.Money(chatID, loan.Paid), today))
+		if loan.Closed {
+			m.LogLoanEvent(chatID, loan.ID, EventRepaid, "Займ погашен общим платежом")
 		}
-
-		loans = append(loans, loan)
 	}
 
 	return loans, nil
 }
 
-// GetAllLoansForUser retrieves all loans for a user
-func (m *BotManager) GetAllLoansForUser(chatID int64) ([]Loan, error) {
+// DuplicateBorrower is a set of spellings that look like the same borrower
+type DuplicateBorrower struct {
+	Spellings  []string
+	LoanCounts []int
+}
+
+// FindDuplicateBorrowers groups the borrower names that differ only by case or
+// surrounding spaces, e.g. "Иван" and "иван "
+func (m *BotManager) FindDuplicateBorrowers(chatID int64) ([]DuplicateBorrower, error) {
 	rows, err := m.db.Query(
-		"SELECT loan_id, borrower_name, amount, purpose, repaid FROM loans WHERE user_id = ?",
+		"SELECT borrower_name, COUNT(*) FROM loans WHERE user_id = ? AND deleted = 0 GROUP BY borrower_name ORDER BY borrower_name",
 		chatID,
 	)
 	if err != nil {
@@ -1311,175 +9696,198 @@ func (m *BotManager) GetAllLoansForUser(chatID int64) ([]Loan, error) {
 	}
 	defer rows.Close()
 
-	var loans []Loan
+	// SQLite only folds ASCII case, so the names are grouped here
+	groups := make(map[string]*DuplicateBorrower)
+	var keys []string
 	for rows.Next() {
-		var loan Loan
-		loan.UserID = chatID
-
-		if err := rows.Scan(&loan.ID, &loan.Borrower, &loan.Amount, &loan.Purpose, &loan.Repaid); err != nil {
+		var name string
+		var count int
+		if err := rows.Scan(&name, &count); err != nil {
 			return nil, err
 		}
 
-		loans = append(loans, loan)
+		key := borrowerKey(name)
+		group, ok := groups[key]
+		if !ok {
+			group = &DuplicateBorrower{}
+			groups[key] = group
+			keys = append(keys, key)
+		}
+		group.Spellings = append(group.Spellings, name)
+		group.LoanCounts = append(group.LoanCounts, count)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
 
-	return loans, nil
+	sort.Strings(keys)
+	var duplicates []DuplicateBorrower
+	for _, key := range keys {
+		if len(groups[key].Spellings) > 1 {
+			duplicates = append(duplicates, *groups[key])
+		}
+	}
+	return duplicates, nil
 }
 
-// GetTotalRepaidAmount calculates the total amount repaid for a loan
-func (m *BotManager) GetTotalRepaidAmount(chatID int64, loanID int) int64 {
-	var totalRepaid int64
-	err := m.db.QueryRow(
-		"SELECT COALESCE(SUM(amount), 0) FROM repayments WHERE user_id = ? AND loan_id = ?",
-		chatID, loanID,
-	).Scan(&totalRepaid)
-
-	if err != nil {
-		log.Printf("Error calculating repaid amount: %v", err)
-		return 0
+// loansWord returns the Russian word for "loans" agreeing with n, e.g. 1 займ, 2 займа, 5 займов
+func loansWord(n int) string {
+	switch {
+	case n%100 >= 11 && n%100 <= 14:
+		return "займов"
+	case n%10 == 1:
+		return "займ"
+	case n%10 >= 2 && n%10 <= 4:
+		return "займа"
+	default:
+		return "займов"
 	}
-
-	return totalRepaid
 }
 
-// Start runs the bot and begins processing updates
-func (m *BotManager) Start() {
-	log.Println("Starting bot...")
+// ShowDuplicateBorrowers lists suspected duplicate borrower names, one message per
+// group, with a button for each spelling to merge the group into
+func (m *BotManager) ShowDuplicateBorrowers(chatID int64) {
+	duplicates, err := m.FindDuplicateBorrowers(chatID)
+	if err != nil {
+		log.Printf("Error finding duplicate borrowers: %v", err)
+		m.SendMessage(chatID, "❌ Не удалось проверить имена заемщиков.")
+		return
+	}
 
-	// Configure update channel
-	u := tgbotapi.NewUpdate(0)
-	u.Timeout = 60
-	updates := m.bot.GetUpdatesChan(u)
+	m.ClearState(chatID)
+	if len(duplicates) == 0 {
+		m.SendMessage(chatID, "✅ Похожих написаний имен заемщиков не найдено.")
+		m.ShowMainMenu(chatID)
+		return
+	}
 
-	// Start reminder scheduler
-	m.StartReminderScheduler()
+	m.SetState(chatID, OpMergeNames, 0)
+	m.SaveStateData(chatID, "dup_groups", strconv.Itoa(len(duplicates)))
 
-	// Process updates
-	for update := range updates {
-		// Skip already processed updates
-		if update.UpdateID <= m.lastProcessedID {
-			continue
-		}
-		m.lastProcessedID = update.UpdateID
+	for g, group := range duplicates {
+		var text strings.Builder
+		text.WriteString("👥 Похоже, это один и тот же заемщик:\n")
 
-		// Process callback queries (button presses)
-		if update.CallbackQuery != nil {
-			m.HandleCallbackQuery(update.CallbackQuery)
-			continue
+		var keyboard [][]tgbotapi.InlineKeyboardButton
+		for s, spelling := range group.Spellings {
+			m.SaveStateData(chatID, fmt.Sprintf("dup_%d_%d", g, s), spelling)
+			text.WriteString(fmt.Sprintf("• «%s» — %d %s\n", spelling, group.LoanCounts[s], loansWord(group.LoanCounts[s])))
+			keyboard = append(keyboard, tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("✅ «%s»", strings.TrimSpace(spelling)), fmt.Sprintf("dupmerge_%d_%d", g, s)),
+			))
 		}
+		text.WriteString("\nВыберите правильное написание, чтобы объединить имена:")
+		keyboard = append(keyboard, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("⏭️ Оставить как есть", fmt.Sprintf("dupskip_%d", g)),
+		))
 
-		// Process messages
-		if update.Message != nil && update.Message.Text != "" {
-			m.HandleMessage(update.Message)
+		msg := tgbotapi.NewMessage(chatID, text.String())
+		msg.ReplyMarkup = tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+		if _, err := m.Send(msg); err != nil {
+			log.Printf("Error sending duplicate borrowers: %v", err)
 		}
 	}
 }
 
-// StartReminderScheduler sends weekly reminders about outstanding loans
-func (m *BotManager) StartReminderScheduler() {
-	go func() {
-		ticker := time.NewTicker(7 * 24 * time.Hour)
-		for {
-			<-ticker.C
-			m.SendReminders()
-		}
-	}()
-}
-
-// SendReminders sends reminder messages to users with outstanding loans
-func (m *BotManager) SendReminders() {
-	// Get distinct users with active loans
-	rows, err := m.db.Query("SELECT DISTINCT user_id FROM loans WHERE repaid = 0")
-	if err != nil {
-		log.Printf("Error querying users for reminders: %v", err)
-		return
-	}
-	defer rows.Close()
+// FinishDuplicateGroup marks a group of duplicate names as handled and ends the flow
+// once every group is done
+func (m *BotManager) FinishDuplicateGroup(chatID int64, group string) {
+	m.SaveStateData(chatID, "dup_"+group+"_done", "1")
 
-	// Build list of users
-	var userIDs []int64
-	for rows.Next() {
-		var userID int64
-		if err := rows.Scan(&userID); err != nil {
-			log.Printf("Error scanning user ID: %v", err)
-			continue
+	state := m.GetState(chatID)
+	groups, _ := strconv.Atoi(state.Data["dup_groups"])
+	for g := 0; g < groups; g++ {
+		if state.Data[fmt.Sprintf("dup_%d_done", g)] == "" {
+			return
 		}
-		userIDs = append(userIDs, userID)
 	}
 
-	// Send reminders to each user
-	for _, userID := range userIDs {
-		// Get active loans for this user
-		loanRows, err := m.db.Query(
-			"SELECT loan_id, borrower_name, amount FROM loans WHERE user_id = ? AND repaid = 0",
-			userID,
-		)
-		if err != nil {
-			log.Printf("Error querying loans for user %d: %v", userID, err)
-			continue
-		}
-
-		// Build reminder message
-		reminderMsg := "⏰ Еженедельное напоминание: У вас есть активные займы:\n\n"
+	m.ClearState(chatID)
+	m.ShowMainMenu(chatID)
+}
 
-		for loanRows.Next() {
-			var id int
-			var borrower string
-			var amount int64
+// MergeBorrowerSpellings renames the loans of every spelling to the chosen one, trimmed
+// of surrounding spaces, and returns how many loans were renamed
+func (m *BotManager) MergeBorrowerSpellings(chatID int64, canonical string, spellings []string) (int, error) {
+	canonical = strings.TrimSpace(canonical)
+	type renamedLoan struct {
+		ID   int
+		From string
+	}
+	var renamed []renamedLoan
 
-			if err := loanRows.Scan(&id, &borrower, &amount); err != nil {
-				log.Printf("Error scanning loan: %v", err)
+	err := m.db.Transact(func(tx *sql.Tx) error {
+		renamed = nil
+		for _, spelling := range spellings {
+			if spelling == canonical {
 				continue
 			}
 
-			reminderMsg += fmt.Sprintf("🆔 Займ #%d - %s: %d ₸\n", id, borrower, amount)
+			rows, err := tx.Query(
+				"SELECT loan_id FROM loans WHERE user_id = ? AND borrower_name = ? AND deleted = 0",
+				chatID, spelling,
+			)
+			if err != nil {
+				return err
+			}
+			for rows.Next() {
+				var loanID int
+				if err := rows.Scan(&loanID); err != nil {
+					rows.Close()
+					return err
+				}
+				renamed = append(renamed, renamedLoan{ID: loanID, From: spelling})
+			}
+			rows.Close()
+
+			_, err = tx.Exec(
+				"UPDATE loans SET borrower_name = ? WHERE user_id = ? AND borrower_name = ? AND deleted = 0",
+				canonical, chatID, spelling,
+			)
+			if err != nil {
+				return err
+			}
 		}
-		loanRows.Close()
 
-		// Send the reminder
-		m.SendMessage(userID, reminderMsg)
+		// The saved contact keeps the chosen spelling too
+		_, err := tx.Exec(
+			"UPDATE borrowers SET name = ? WHERE user_id = ? AND name_key = ?",
+			canonical, chatID, borrowerKey(canonical),
+		)
+		return err
+	})
+	if err != nil {
+		return 0, err
 	}
-}
 
-// HandleMessage processes text messages
-func (m *BotManager) HandleMessage(message *tgbotapi.Message) {
-	chatID := message.Chat.ID
-	text := strings.TrimSpace(message.Text)
+	for _, loan := range renamed {
+		m.LogLoanEvent(chatID, loan.ID, EventReassigned, fmt.Sprintf("Написание имени исправлено: «%s» → «%s»", loan.From, canonical))
+	}
 
-	log.Printf("Message from user %d: %s", chatID, text)
+	return len(renamed), nil
+}
 
-	// Handle commands
-	if message.IsCommand() {
-		switch message.Command() {
-		case "start":
-			m.ClearState(chatID)
-			m.ShowMainMenu(chatID)
-		default:
-			m.SendMessage(chatID, "🤔 Неизвестная команда. Используйте /start для начала работы.")
-		}
-		return
+// GetBorrowerNames returns the distinct borrower names of a user's loans
+func (m *BotManager) GetBorrowerNames(chatID int64) ([]string, error) {
+	rows, err := m.db.Query(
+		"SELECT DISTINCT borrower_name FROM loans WHERE user_id = ? AND deleted = 0 ORDER BY borrower_name",
+		chatID,
+	)
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
-	// Handle conversation state
-	state := m.GetState(chatID)
-
-	switch state.Operation {
-	case OpAddLoan:
-		m.HandleAddLoanStep(chatID, text)
-	case OpRepayLoan:
-		m.HandleRepayLoanStep(chatID, text)
-	case OpEditLoan:
-		m.HandleEditLoanStep(chatID, text)
-	case OpPartialRepay:
-		m.HandlePartialRepaymentStep(chatID, text)
-	case OpSearchLoan:
-		m.HandleSearchStep(chatID, text)
-	case OpNone: // No active conversation
-		m.ShowMainMenu(chatID)
-	default:
-		log.Printf("Unknown operation: %s", state.Operation)
-		m.ShowMainMenu(chatID)
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
 	}
+
+	return names, nil
 }
 
 // HandleEditLoanStep processes user input for the loan editing flow
@@ -1501,6 +9909,16 @@ func (m *BotManager) HandleEditLoanStep(chatID int64, text string) {
 
 	editField, _ := m.GetStateData(chatID, "edit_field")
 
+	// Keep the current values for the activity log
+	oldLoan, err := m.GetLoanByID(chatID, loanID)
+	if err != nil {
+		log.Printf("Error getting loan details: %v", err)
+		m.SendMessage(chatID, "❌ Займ не найден.")
+		m.ClearState(chatID)
+		m.ShowMainMenu(chatID)
+		return
+	}
+
 	switch state.Step {
 	case 1: // Edit field
 		// Update the specified field
@@ -1519,21 +9937,30 @@ func (m *BotManager) HandleEditLoanStep(chatID int64, text string) {
 				return
 			}
 
+			m.LogLoanEvent(chatID, loanID, EventEdited, fmt.Sprintf("Имя заемщика: %s → %s", oldLoan.Borrower, text))
 			m.SendMessage(chatID, fmt.Sprintf("✅ Имя заемщика успешно изменено на \"%s\"!", text))
 
 		case "amount":
 			// Parse and validate amount
-			amount, err := strconv.ParseInt(text, 10, 64)
+			amount, err := parseAmount(text)
 			if err != nil || amount <= 0 {
 				m.SendMessage(chatID, "❌ Пожалуйста, введите корректную сумму (целое положительное число).")
 				return
 			}
 
-			// Update amount
-			_, err = m.db.Exec(
-				"UPDATE loans SET amount = ? WHERE user_id = ? AND loan_id = ?",
-				amount, chatID, loanID,
-			)
+			// The loan can't be smaller than what has already been paid back
+			repaidAmount := m.GetTotalRepaidAmount(chatID, loanID)
+			if amount < repaidAmount {
+				m.SendMessage(chatID, fmt.Sprintf(
+					"❌ По займу уже возвращено %s, поэтому сумма не может быть меньше.\nВведите сумму не меньше %s:",
+					m.Money(chatID, repaidAmount), m.Money(chatID, repaidAmount),
+				))
+				return
+			}
+
+			// Update amount; a loan that is now covered up to RepaidTolerance becomes repaid
+			repaid := amount-repaidAmount <= m.config.RepaidTolerance
+			err = m.UpdateLoanAmount(chatID, loanID, oldLoan.Amount, amount, repaid)
 			if err != nil {
 				log.Printf("Error updating loan amount: %v", err)
 				m.SendMessage(chatID, "❌ Не удалось обновить сумму займа.")
@@ -1542,9 +9969,19 @@ func (m *BotManager) HandleEditLoanStep(chatID int64, text string) {
 				return
 			}
 
-			m.SendMessage(chatID, fmt.Sprintf("✅ Сумма займа успешно изменена на %d ₸!", amount))
+			m.LogLoanEvent(chatID, loanID, EventEdited, fmt.Sprintf("Сумма: %s → %s", m.Money(chatID, oldLoan.Amount), m.Money(chatID, amount)))
+			m.SendMessage(chatID, fmt.Sprintf("✅ Сумма займа успешно изменена на %s!", m.Money(chatID, amount)))
+			if repaid && !oldLoan.Repaid {
+				m.LogLoanEvent(chatID, loanID, EventRepaid, "Займ полностью погашен после изменения суммы")
+				m.SendMessage(chatID, "🎉 Займ полностью погашен!")
+			}
+
+		case "purpose":
+			if noteTooLong(text) {
+				m.SendMessage(chatID, noteTooLongMessage(text))
+				return
+			}
 
-		case "purpose":
 			// Update purpose
 			_, err := m.db.Exec(
 				"UPDATE loans SET purpose = ? WHERE user_id = ? AND loan_id = ?",
@@ -1558,7 +9995,8 @@ func (m *BotManager) HandleEditLoanStep(chatID int64, text string) {
 				return
 			}
 
-			m.SendMessage(chatID, fmt.Sprintf("✅ Цель займа успешно изменена на \"%s\"!", text))
+			m.LogLoanEvent(chatID, loanID, EventEdited, fmt.Sprintf("Цель: %s → %s", oldLoan.Purpose, text))
+			m.SendMarkdown(chatID, markdownf("✅ Цель займа успешно изменена на \"%s\"!", userMarkdown(text)))
 
 		default:
 			log.Printf("Unknown edit field: %s", editField)
@@ -1591,43 +10029,126 @@ func (m *BotManager) HandlePartialRepaymentStep(chatID int64, text string) {
 
 	switch state.Step {
 	case 1: // Enter repayment amount
+		// A share of the remaining balance such as "50%" is confirmed before use
+		if percent, ok, err := parsePercent(text); ok {
+			if err != nil || percent <= 0 {
+				m.SendMessage(chatID, "❌ Введите корректный процент, например 50%.")
+				return
+			}
+			if percent > 100 {
+				m.SendMessage(chatID, "❌ Процент не может быть больше 100%. Введите сумму заново:")
+				return
+			}
+
+			amount := int64(float64(remaining)*percent/100 + 0.5)
+			if amount <= 0 || amount > remaining {
+				m.SendMessage(chatID, fmt.Sprintf("❌ %s от остатка (%s) дает некорректную сумму. Введите сумму заново:", text, m.Money(chatID, remaining)))
+				return
+			}
+
+			m.SaveStateData(chatID, "percent_amount", fmt.Sprintf("%d", amount))
+			keyboard := tgbotapi.NewInlineKeyboardMarkup(
+				tgbotapi.NewInlineKeyboardRow(
+					tgbotapi.NewInlineKeyboardButtonData("✅ Да", "percent_confirm"),
+					tgbotapi.NewInlineKeyboardButtonData("✏️ Другая сумма", "percent_change"),
+				),
+			)
+			msg := tgbotapi.NewMessage(chatID, fmt.Sprintf(
+				"💯 %s от остатка %s — это %s.\nЗаписать возврат на эту сумму?",
+				strings.TrimSpace(text), m.Money(chatID, remaining), m.Money(chatID, amount),
+			))
+			msg.ReplyMarkup = keyboard
+			m.Send(msg)
+			return
+		}
+
 		// Parse and validate amount
-		amount, err := strconv.ParseInt(text, 10, 64)
-		if err != nil || amount <= 0 {
+		amount, err := parseAmount(text)
+		if err != nil {
 			m.SendMessage(chatID, "❌ Пожалуйста, введите корректную сумму (целое положительное число).")
 			return
 		}
+		if amount <= 0 {
+			m.SendMessage(chatID, "❌ Сумма возврата должна быть больше нуля. Введите сумму заново:")
+			return
+		}
 
 		// Check if amount exceeds remaining balance
 		if amount > remaining {
 			m.SendMessage(chatID, fmt.Sprintf(
-				"❌ Сумма возврата (%d ₸) превышает остаток по займу (%d ₸).\nПожалуйста, введите корректную сумму или используйте полный возврат займа.",
-				amount, remaining,
+				"❌ Сумма возврата (%s) превышает остаток по займу (%s).\nПожалуйста, введите корректную сумму или используйте полный возврат займа.",
+				m.Money(chatID, amount), m.Money(chatID, remaining),
 			))
 			return
 		}
 
-		// Save repayment amount and ask for optional note
-		m.SaveStateData(chatID, "repayment_amount", fmt.Sprintf("%d", amount))
-		m.SetState(chatID, OpPartialRepay, 2)
-
-		// Prompt for optional note
-		m.SendMessage(chatID, "Введите примечание к платежу (или отправьте \"-\" чтобы пропустить):")
+		m.AskPartialRepaymentNote(chatID, amount)
 
 	case 2: // Enter note
-		// Get the repayment amount
-		amountStr, _ := m.GetStateData(chatID, "repayment_amount")
-		amount, _ := strconv.ParseInt(amountStr, 10, 64)
-
 		// Process note
 		note := text
 		if note == "-" {
 			note = ""
 		}
+		if noteTooLong(note) {
+			m.SendMessage(chatID, noteTooLongMessage(note))
+			return
+		}
+
+		// Save note and ask for the payment date
+		m.SaveStateData(chatID, "repayment_note", note)
+		m.SetState(chatID, OpPartialRepay, 3)
+		m.SendMessage(chatID, "📅 Введите дату платежа (ДД.ММ.ГГГГ) или отправьте \"-\", если платеж был сегодня:")
+
+	case 3: // Enter payment date
+		// Get the repayment amount and note
+		amountStr, _ := m.GetStateData(chatID, "repayment_amount")
+		amount, parseErr := strconv.ParseInt(amountStr, 10, 64)
+		note, _ := m.GetStateData(chatID, "repayment_note")
+
+		// Re-check the amount against the current balance, which may have changed meanwhile
+		loan, err := m.GetLoanByID(chatID, loanID)
+		if err != nil {
+			log.Printf("Error getting loan details: %v", err)
+			m.SendMessage(chatID, "❌ Займ не найден.")
+			m.ClearState(chatID)
+			m.ShowMainMenu(chatID)
+			return
+		}
+		remaining = loan.Amount - m.GetTotalRepaidAmount(chatID, loanID)
+		if parseErr != nil || amount <= 0 || amount > remaining {
+			m.SaveStateData(chatID, "remaining_amount", fmt.Sprintf("%d", remaining))
+			m.SetState(chatID, OpPartialRepay, 1)
+			m.SendMessage(chatID, fmt.Sprintf(
+				"❌ Сумма платежа больше не действительна. Остаток по займу: %s.\nВведите сумму частичного возврата заново:",
+				m.Money(chatID, remaining),
+			))
+			return
+		}
+
+		// Default to today when skipped
+		today := m.UserToday(chatID)
+		date := today
+		if text != "-" {
+			parsed, err := parseDate(text)
+			if err != nil {
+				m.SendMessage(chatID, "❌ Некорректная дата. Введите дату в формате ДД.ММ.ГГГГ или \"-\":")
+				return
+			}
+			date = parsed.Format(dateLayout)
+		}
+
+		if date > today {
+			m.SendMessage(chatID, "❌ Дата платежа не может быть в будущем. Введите другую дату:")
+			return
+		}
+		if createdDate := m.GetLoanCreatedDate(chatID, loanID); createdDate != "" && date < createdDate {
+			m.SendMessage(chatID, fmt.Sprintf("❌ Дата платежа не может быть раньше даты займа (%s). Введите другую дату:", createdDate))
+			return
+		}
 
 		// Record the repayment in the database
-		date := time.Now().Format("2006-01-02")
-		_, err := m.db.Exec(
+		_, err = m.db.Exec(
 			"INSERT INTO repayments (user_id, loan_id, amount, repayment_date, note) VALUES (?, ?, ?, ?, ?)",
 			chatID, loanID, amount, date, note,
 		)
@@ -1639,9 +10160,17 @@ func (m *BotManager) HandlePartialRepaymentStep(chatID int64, text string) {
 			return
 		}
 
-		// Check if the loan is now fully repaid
-		newRemaining := remaining - amount
-		if newRemaining == 0 {
+		m.LogLoanEvent(chatID, loanID, EventPartialRepayment, fmt.Sprintf("Частичный возврат: %s от %s", m.Money(chatID, amount), date))
+
+		// Check if the loan is now fully repaid, using the recorded total in case
+		// another repayment was added meanwhile
+		newRemaining := loan.Amount - m.GetTotalRepaidAmount(chatID, loanID)
+		if newRemaining < 0 {
+			log.Printf("Loan %d of user %d is overpaid by %d", loanID, chatID, -newRemaining)
+			m.LogLoanEvent(chatID, loanID, EventOverpaid, fmt.Sprintf("Выплачено больше суммы займа на %s", m.Money(chatID, -newRemaining)))
+		}
+
+		if newRemaining <= m.config.RepaidTolerance {
 			// Mark loan as repaid
 			_, err := m.db.Exec(
 				"UPDATE loans SET repaid = 1 WHERE user_id = ? AND loan_id = ?",
@@ -1649,16 +10178,109 @@ func (m *BotManager) HandlePartialRepaymentStep(chatID int64, text string) {
 			)
 			if err != nil {
 				log.Printf("Error updating loan status: %v", err)
+			} else {
+				m.LogLoanEvent(chatID, loanID, EventRepaid, "Займ полностью погашен частичными возвратами")
 			}
 
+			closedMsg := fmt.Sprintf(
+				"✅ Частичный возврат в размере %s записан!\nПоздравляем! Займ полностью погашен! 🎉",
+				m.Money(chatID, amount),
+			)
+			if newRemaining > 0 {
+				closedMsg += fmt.Sprintf("\nНепогашенный остаток %s списан.", m.Money(chatID, newRemaining))
+			}
+			m.SendMessage(chatID, closedMsg)
+		} else {
 			m.SendMessage(chatID, fmt.Sprintf(
-				"✅ Частичный возврат в размере %d ₸ записан!\nПоздравляем! Займ полностью погашен! 🎉",
-				amount,
+				"✅ Частичный возврат в размере %s записан!\nОстаток по займу: %s",
+				m.Money(chatID, amount), m.Money(chatID, newRemaining),
 			))
-		} else {
+		}
+
+		// Clear state and show main menu
+		m.ClearState(chatID)
+		m.ShowMainMenu(chatID)
+	}
+}
+
+// AskPartialRepaymentNote saves the partial repayment amount and asks for an optional note
+func (m *BotManager) AskPartialRepaymentNote(chatID int64, amount int64) {
+	m.SaveStateData(chatID, "repayment_amount", fmt.Sprintf("%d", amount))
+	m.SetState(chatID, OpPartialRepay, 2)
+
+	// Prompt for optional note
+	m.SendMessage(chatID, "Введите примечание к платежу (или отправьте \"-\" чтобы пропустить):")
+}
+
+// HandleEditRepaymentStep processes user input for correcting a repayment amount
+func (m *BotManager) HandleEditRepaymentStep(chatID int64, text string) {
+	state := m.GetState(chatID)
+
+	// Get stored repayment ID
+	repaymentIDStr, _ := m.GetStateData(chatID, "repayment_id")
+	repaymentID, err := strconv.ParseInt(repaymentIDStr, 10, 64)
+	if err != nil {
+		log.Printf("Error converting repayment ID: %v", err)
+		m.SendMessage(chatID, "❌ Произошла ошибка при редактировании платежа.")
+		m.ClearState(chatID)
+		m.ShowMainMenu(chatID)
+		return
+	}
+
+	switch state.Step {
+	case 1: // Enter new amount
+		// Parse and validate amount
+		amount, err := parseAmount(text)
+		if err != nil || amount <= 0 {
+			m.SendMessage(chatID, "❌ Пожалуйста, введите корректную сумму (целое положительное число).")
+			return
+		}
+
+		// Keep the previous amount for the activity log
+		oldRepayment, err := m.GetRepaymentByID(chatID, repaymentID)
+		if err != nil {
+			log.Printf("Error getting repayment details: %v", err)
+			m.SendMessage(chatID, "❌ Платеж не найден.")
+			m.ClearState(chatID)
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		// Update the repayment and loan status
+		remaining, err := m.UpdateRepaymentAmount(chatID, repaymentID, amount)
+		if errors.Is(err, errRepaymentExceedsLoan) {
+			m.SendMessage(chatID, "❌ С этой суммой выплаты превысят сумму займа.\nПожалуйста, введите меньшую сумму:")
+			return
+		}
+		if err != nil {
+			log.Printf("Error updating repayment amount: %v", err)
+			m.SendMessage(chatID, "❌ Не удалось изменить сумму платежа.")
+			m.ClearState(chatID)
+			m.ShowMainMenu(chatID)
+			return
+		}
+
+		m.LogLoanEvent(chatID, oldRepayment.LoanID, EventRepaymentEdited, fmt.Sprintf(
+			"Платеж от %s: %s → %s", oldRepayment.Date, m.Money(chatID, oldRepayment.Amount), m.Money(chatID, amount),
+		))
+
+		// A forgiven loan stays closed whatever its payments add up to
+		loan, err := m.GetLoanByID(chatID, oldRepayment.LoanID)
+		switch {
+		case err == nil && loan.Forgiven:
+			m.SendMessage(chatID, fmt.Sprintf(
+				"✅ Сумма платежа изменена на %s!\n🙏 Долг по займу прощен, займ остается закрытым.",
+				m.Money(chatID, amount),
+			))
+		case remaining <= m.config.RepaidTolerance:
 			m.SendMessage(chatID, fmt.Sprintf(
-				"✅ Частичный возврат в размере %d ₸ записан!\nОстаток по займу: %d ₸",
-				amount, newRemaining,
+				"✅ Сумма платежа изменена на %s!\nЗайм полностью погашен! 🎉",
+				m.Money(chatID, amount),
+			))
+		default:
+			m.SendMessage(chatID, fmt.Sprintf(
+				"✅ Сумма платежа изменена на %s!\nОстаток по займу: %s",
+				m.Money(chatID, amount), m.Money(chatID, remaining),
 			))
 		}
 
@@ -1678,71 +10300,357 @@ func (m *BotManager) HandleSearchStep(chatID int64, text string) {
 	switch state.Step {
 	case 0: // Search by name
 		if searchType == "by_name" {
-			// Search loans by borrower name
-			searchName := "%" + text + "%"
-			rows, err := m.db.Query(
-				"SELECT loan_id, borrower_name, amount, purpose, repaid FROM loans WHERE user_id = ? AND borrower_name LIKE ?",
-				chatID, searchName,
-			)
-			if err != nil {
-				log.Printf("Error searching loans: %v", err)
-				m.SendMessage(chatID, "❌ Не удалось выполнить поиск.")
-				m.ClearState(chatID)
-				m.ShowMainMenu(chatID)
-				return
-			}
-			defer rows.Close()
+			// Clear state, then show the results and the main menu
+			m.ClearState(chatID)
+			m.SearchLoansByName(chatID, text)
+			m.ShowMainMenu(chatID)
+		} else if searchType == "by_purpose" || searchType == "all_fields" {
+			m.ClearState(chatID)
+			m.SearchLoansByText(chatID, text, searchType == "all_fields")
+			m.ShowMainMenu(chatID)
+		}
+	}
+}
 
-			// Process results
-			var loans []Loan
-			for rows.Next() {
-				var loan Loan
-				loan.UserID = chatID
+// FindLoansByText returns the loans whose purpose contains the given text. With allFields
+// the borrower name, location and repayment notes are searched too, as is the loan ID when
+// the text is a number; each loan's SearchMatch lists the fields that matched. Matching
+// happens in Go because SQLite's LIKE only ignores case for ASCII letters, not for Cyrillic.
+func (m *BotManager) FindLoansByText(chatID int64, text string, allFields bool) ([]Loan, error) {
+	query := strings.ToLower(strings.TrimSpace(text))
+	queryID, idErr := strconv.Atoi(strings.TrimPrefix(query, "#"))
 
-				if err := rows.Scan(&loan.ID, &loan.Borrower, &loan.Amount, &loan.Purpose, &loan.Repaid); err != nil {
-					log.Printf("Error scanning loan: %v", err)
-					continue
-				}
+	rows, err := m.db.Query(
+		`SELECT loan_id, borrower_name, amount, purpose, repaid, COALESCE(due_date, ''), COALESCE(location, ''), latitude, longitude,
+			COALESCE(disputed, 0), COALESCE(dispute_note, ''), COALESCE(currency, ''), COALESCE(fx_rate, 0), COALESCE(forgiven, 0),
+			COALESCE((SELECT group_concat(note, ' ') FROM repayments r WHERE r.user_id = loans.user_id AND r.loan_id = loans.loan_id), '')
+		FROM loans WHERE user_id = ? AND deleted = 0`,
+		chatID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// A loan found by its ID is listed before loans that only mention the number
+	var idMatches, loans []Loan
+	for rows.Next() {
+		var loan Loan
+		var notes string
+		loan.UserID = chatID
+
+		if err := rows.Scan(&loan.ID, &loan.Borrower, &loan.Amount, &loan.Purpose, &loan.Repaid, &loan.DueDate, &loan.Location, &loan.Latitude, &loan.Longitude, &loan.Disputed, &loan.DisputeNote, &loan.Currency, &loan.FxRate, &loan.Forgiven, &notes); err != nil {
+			log.Printf("Error scanning loan: %v", err)
+			continue
+		}
 
+		if !allFields {
+			if strings.Contains(strings.ToLower(loan.Purpose), query) {
 				loans = append(loans, loan)
 			}
+			continue
+		}
+
+		var matches []string
+		if idErr == nil && queryID == loan.ID {
+			matches = append(matches, "номер займа")
+		}
+		fields := []struct {
+			Value string
+			Label string
+		}{
+			{loan.Borrower, "имя"},
+			{loan.Purpose, "цель"},
+			{notes, "заметки к возвратам"},
+			{loan.Location, "место"},
+		}
+		for _, field := range fields {
+			if strings.Contains(strings.ToLower(field.Value), query) {
+				matches = append(matches, field.Label)
+			}
+		}
+		if len(matches) == 0 {
+			continue
+		}
+
+		loan.SearchMatch = strings.Join(matches, ", ")
+		if matches[0] == "номер займа" {
+			idMatches = append(idMatches, loan)
+		} else {
+			loans = append(loans, loan)
+		}
+	}
+
+	return append(idMatches, loans...), nil
+}
+
+// FindLoansByName returns the loans whose borrower name or location contains the given text
+func (m *BotManager) FindLoansByName(chatID int64, text string) ([]Loan, error) {
+	searchName := "%" + text + "%"
+	rows, err := m.db.Query(
+		`SELECT loan_id, borrower_name, amount, purpose, repaid, COALESCE(due_date, ''), COALESCE(location, ''), latitude, longitude,
+			COALESCE(disputed, 0), COALESCE(dispute_note, ''), COALESCE(currency, ''), COALESCE(fx_rate, 0), COALESCE(forgiven, 0)
+		FROM loans WHERE user_id = ? AND (borrower_name LIKE ? OR location LIKE ?) AND deleted = 0`,
+		chatID, searchName, searchName,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Process results
+	var loans []Loan
+	for rows.Next() {
+		var loan Loan
+		loan.UserID = chatID
+
+		if err := rows.Scan(&loan.ID, &loan.Borrower, &loan.Amount, &loan.Purpose, &loan.Repaid, &loan.DueDate, &loan.Location, &loan.Latitude, &loan.Longitude, &loan.Disputed, &loan.DisputeNote, &loan.Currency, &loan.FxRate, &loan.Forgiven); err != nil {
+			log.Printf("Error scanning loan: %v", err)
+			continue
+		}
+
+		loans = append(loans, loan)
+	}
+
+	return loans, nil
+}
+
+// SearchLoansByName sends the loans whose borrower name or location contains the given text
+func (m *BotManager) SearchLoansByName(chatID int64, text string) {
+	m.SearchLoans(chatID, "by_name", text, 0)
+}
+
+// SearchLoansByText sends the loans whose purpose, or with allFields any field, contains the given text
+func (m *BotManager) SearchLoansByText(chatID int64, text string, allFields bool) {
+	searchType := "by_purpose"
+	if allFields {
+		searchType = "all_fields"
+	}
+	m.SearchLoans(chatID, searchType, text, 0)
+}
+
+// SearchLoans sends one page of search results starting at offset. When more results
+// remain, the query is kept in the state for the "показать ещё" button.
+func (m *BotManager) SearchLoans(chatID int64, searchType string, text string, offset int) {
+	if strings.TrimSpace(text) == "" {
+		m.SendMessage(chatID, "❌ Введите текст для поиска.")
+		return
+	}
+
+	var loans []Loan
+	var err error
+	switch searchType {
+	case "by_name":
+		loans, err = m.FindLoansByName(chatID, text)
+	case "by_purpose", "all_fields":
+		loans, err = m.FindLoansByText(chatID, text, searchType == "all_fields")
+	default:
+		err = fmt.Errorf("unknown search type %q", searchType)
+	}
+	if err != nil {
+		log.Printf("Error searching loans: %v", err)
+		m.SendMessage(chatID, "❌ Не удалось выполнить поиск.")
+		return
+	}
+
+	// Display results
+	if len(loans) == 0 {
+		m.SendMessage(chatID, fmt.Sprintf("🔍 По запросу \"%s\" ничего не найдено.", text))
+		return
+	}
+	if offset >= len(loans) {
+		// Loans were deleted since the previous page
+		m.SendMessage(chatID, fmt.Sprintf("🔍 Больше результатов по \"%s\" нет.", text))
+		return
+	}
+
+	end := min(offset+searchPageSize, len(loans))
+	header := fmt.Sprintf("🔍 Результаты поиска по \"%s\"\nНайдено: %d\n\n", text, len(loans))
+	if offset > 0 {
+		header = fmt.Sprintf("🔍 Результаты поиска по \"%s\" (%d–%d из %d):\n\n", text, offset+1, end, len(loans))
+	}
+	m.SendLoansWithActions(chatID, header, loans[offset:end])
+
+	if end == len(loans) {
+		m.SaveStateData(chatID, "search_query", "")
+		return
+	}
+
+	m.SaveStateData(chatID, "search_type", searchType)
+	m.SaveStateData(chatID, "search_query", text)
+	m.SaveStateData(chatID, "search_offset", strconv.Itoa(end))
+
+	msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("Показано %d из %d.", end, len(loans)))
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("⬇️ Показать ещё (%d)", len(loans)-end), "search_more"),
+		),
+	)
+	m.Send(msg)
+}
+
+// ShowMoreSearchResults continues the search saved by SearchLoans
+func (m *BotManager) ShowMoreSearchResults(chatID int64) {
+	searchType, _ := m.GetStateData(chatID, "search_type")
+	query, _ := m.GetStateData(chatID, "search_query")
+	offsetStr, _ := m.GetStateData(chatID, "search_offset")
+	offset, _ := strconv.Atoi(offsetStr)
+
+	m.SearchLoans(chatID, searchType, query, offset)
+}
+
+// amountSuffixes are currency markers users commonly type after an amount
+var amountSuffixes = []string{"тенге", "тг", "kzt", "tg", "т"}
+
+// thousandSuffixes multiply an amount by a thousand, as in "5к" or "1,5 тыс"
+var thousandSuffixes = []string{"тыс", "к", "k"}
+
+// parseAmount parses an amount typed by the user, tolerating digit-group spaces, commas
+// and dots, thousand suffixes and currency markers such as "5 000 ₸", "5,000", "5к" or "5000тг"
+func parseAmount(text string) (int64, error) {
+	cleaned := strings.ToLower(strings.TrimSpace(text))
+
+	// Remove spaces used to group digits, including non-breaking ones
+	cleaned = strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\u00a0', '\u202f':
+			return -1
+		}
+		return r
+	}, cleaned)
+
+	// Remove the currency sign and a trailing abbreviation like "тг."
+	cleaned = strings.ReplaceAll(cleaned, "₸", "")
+	cleaned = strings.TrimSuffix(cleaned, ".")
+	for _, suffix := range amountSuffixes {
+		if strings.HasSuffix(cleaned, suffix) {
+			cleaned = strings.TrimSuffix(cleaned, suffix)
+			break
+		}
+	}
+
+	// "5 тыс." may carry its own dot
+	cleaned = strings.TrimSuffix(cleaned, ".")
+	for _, suffix := range thousandSuffixes {
+		if strings.HasSuffix(cleaned, suffix) {
+			return parseThousands(strings.TrimSuffix(cleaned, suffix))
+		}
+	}
+
+	if groupedDigits(cleaned) {
+		cleaned = strings.NewReplacer(",", "", ".", "").Replace(cleaned)
+	}
+	return strconv.ParseInt(cleaned, 10, 64)
+}
+
+// parseThousands parses the number in front of a thousand suffix, which may have up to
+// three decimals, e.g. "1,5" for 1500
+func parseThousands(number string) (int64, error) {
+	whole, fraction, _ := strings.Cut(strings.ReplaceAll(number, ",", "."), ".")
+	if !allDigits(whole) || len(fraction) > 3 || (fraction != "" && !allDigits(fraction)) {
+		return 0, fmt.Errorf("invalid amount: %q", number)
+	}
+
+	thousands, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if thousands > (math.MaxInt64-999)/1000 {
+		return 0, fmt.Errorf("amount out of range: %q", number)
+	}
+
+	var rest int64
+	if fraction != "" {
+		rest, _ = strconv.ParseInt(fraction+strings.Repeat("0", 3-len(fraction)), 10, 64)
+	}
+	return thousands*1000 + rest, nil
+}
+
+// groupedDigits reports whether text is digits grouped in threes with commas or dots,
+// like "5,000" or "1.000.000"
+func groupedDigits(text string) bool {
+	separator := ","
+	if strings.Contains(text, ".") {
+		separator = "."
+	}
+	groups := strings.Split(text, separator)
+	if len(groups) < 2 || len(groups[0]) > 3 || !allDigits(groups[0]) {
+		return false
+	}
+	for _, group := range groups[1:] {
+		if len(group) != 3 || !allDigits(group) {
+			return false
+		}
+	}
+	return true
+}
+
+// allDigits reports whether text is a non-empty run of ASCII digits
+func allDigits(text string) bool {
+	if text == "" {
+		return false
+	}
+	for _, r := range text {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// parsePercent parses a percentage typed as "50%" or "12,5 %". The second result
+// reports whether the text is a percentage at all.
+func parsePercent(text string) (float64, bool, error) {
+	cleaned := strings.TrimSpace(text)
+	if !strings.HasSuffix(cleaned, "%") {
+		return 0, false, nil
+	}
+
+	cleaned = strings.TrimSpace(strings.TrimSuffix(cleaned, "%"))
+	cleaned = strings.Replace(cleaned, ",", ".", 1)
+	percent, err := strconv.ParseFloat(cleaned, 64)
+	return percent, true, err
+}
+
+// parseDate parses a date typed as ДД.ММ.ГГГГ, ДД.ММ (current year) or ГГГГ-ММ-ДД
+func parseDate(text string) (time.Time, error) {
+	text = strings.TrimSpace(text)
+
+	for _, layout := range []string{"02.01.2006", "2.1.2006", dateLayout} {
+		if date, err := time.ParseInLocation(layout, text, time.Local); err == nil {
+			return date, nil
+		}
+	}
+
+	// Without a year the date is assumed to be in the current year
+	for _, layout := range []string{"02.01", "2.1"} {
+		if date, err := time.ParseInLocation(layout, text, time.Local); err == nil {
+			return date.AddDate(time.Now().Year(), 0, 0), nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("invalid date: %s", text)
+}
 
-			// Display results
-			if len(loans) == 0 {
-				m.SendMessage(chatID, fmt.Sprintf("🔍 По запросу \"%s\" ничего не найдено.", text))
-			} else {
-				var response strings.Builder
-				response.WriteString(fmt.Sprintf("🔍 Результаты поиска по \"%s\":\n\n", text))
-
-				for _, loan := range loans {
-					status := "✅ Возвращен"
-					if !loan.Repaid {
-						status = "⏳ Активен"
-
-						// Calculate remaining amount for active loans
-						repaidAmount := m.GetTotalRepaidAmount(chatID, loan.ID)
-						remainingAmount := loan.Amount - repaidAmount
-
-						response.WriteString(fmt.Sprintf(
-							"🆔 Займ #%d\n👤 Заемщик: %s\n💰 Сумма: %d ₸\n💵 Остаток: %d ₸\n📝 Цель: %s\n📊 Статус: %s\n➖➖➖➖➖➖➖➖➖➖\n\n",
-							loan.ID, loan.Borrower, loan.Amount, remainingAmount, loan.Purpose, status,
-						))
-					} else {
-						response.WriteString(fmt.Sprintf(
-							"🆔 Займ #%d\n👤 Заемщик: %s\n💰 Сумма: %d ₸\n📝 Цель: %s\n📊 Статус: %s\n➖➖➖➖➖➖➖➖➖➖\n\n",
-							loan.ID, loan.Borrower, loan.Amount, loan.Purpose, status,
-						))
-					}
-				}
+// noteTooLong reports whether a purpose or note exceeds maxNoteLength characters
+func noteTooLong(text string) bool {
+	return utf8.RuneCountInString(text) > maxNoteLength
+}
 
-				m.SendMessage(chatID, response.String())
-			}
+// noteTooLongMessage asks the user to shorten a text rejected by noteTooLong
+func noteTooLongMessage(text string) string {
+	return fmt.Sprintf(
+		"❌ Текст слишком длинный: %d символов, допускается не больше %d. Сократите его и отправьте заново:",
+		utf8.RuneCountInString(text), maxNoteLength,
+	)
+}
 
-			// Clear state and show main menu
-			m.ClearState(chatID)
-			m.ShowMainMenu(chatID)
-		}
+// dueDateLabel returns the due date for display, or a placeholder when there is none
+func dueDateLabel(dueDate string) string {
+	if dueDate == "" {
+		return "не указан"
 	}
+	return dueDate
 }
 
 // GetStateData retrieves data stored in the user state
@@ -1774,11 +10682,15 @@ func main() {
 	log.Printf("Authorized as @%s", bot.Self.UserName)
 
 	// Open database connection
-	db, err := sql.Open("sqlite", "./lending.db")
+	// Writes are queued for a single goroutine (see timeoutDB), but a read still
+	// holds a lock the writer has to wait for instead of failing immediately
+	db, err := sql.Open("sqlite", fmt.Sprintf("%s?_pragma=busy_timeout(%d)", dbPath, dbBusyTimeoutMs))
 	if err != nil {
 		log.Fatalf("Error opening database: %v", err)
 	}
 	defer db.Close()
+	db.SetMaxOpenConns(dbMaxOpenConns)
+	db.SetMaxIdleConns(dbMaxIdleConns)
 
 	// Initialize database schema
 	if err := initializeDatabase(db); err != nil {
@@ -1786,10 +10698,118 @@ func main() {
 	}
 
 	// Create and start bot manager
-	manager := NewBotManager(bot, db)
+	manager := NewBotManager(bot, db, loadConfig())
 	manager.Start()
 }
 
+// loadConfig reads optional settings from the environment
+func loadConfig() Config {
+	config := Config{
+		AdminIDs:        parseIDList(os.Getenv("ADMIN_IDS")),
+		BackupInterval:  defaultBackupInterval,
+		ReminderWeekday: defaultReminderWeekday,
+		ReminderHour:    defaultReminderHour,
+	}
+
+	if value := os.Getenv("BACKUP_INTERVAL_HOURS"); value != "" {
+		hours, err := strconv.Atoi(value)
+		if err != nil {
+			log.Printf("Invalid BACKUP_INTERVAL_HOURS %q, using default: %v", value, err)
+		} else {
+			config.BackupInterval = time.Duration(hours) * time.Hour
+		}
+	}
+
+	if value := os.Getenv("REMINDER_DAY"); value != "" {
+		weekday, err := parseWeekday(value)
+		if err != nil {
+			log.Printf("Invalid REMINDER_DAY %q, using default: %v", value, err)
+		} else {
+			config.ReminderWeekday = weekday
+		}
+	}
+
+	if value := os.Getenv("REMINDER_HOUR"); value != "" {
+		hour, err := strconv.Atoi(value)
+		if err != nil || hour < 0 || hour > 23 {
+			log.Printf("Invalid REMINDER_HOUR %q, using default", value)
+		} else {
+			config.ReminderHour = hour
+		}
+	}
+
+	if value := os.Getenv("REPAID_TOLERANCE"); value != "" {
+		tolerance, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || tolerance < 0 {
+			log.Printf("Invalid REPAID_TOLERANCE %q, loans close only when fully repaid", value)
+		} else {
+			config.RepaidTolerance = tolerance
+		}
+	}
+
+	config.OutstandingAlertThreshold = defaultOutstandingAlertThreshold
+	if value := os.Getenv("OUTSTANDING_ALERT_THRESHOLD"); value != "" {
+		threshold, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || threshold <= 0 {
+			log.Printf("Invalid OUTSTANDING_ALERT_THRESHOLD %q, using %d", value, defaultOutstandingAlertThreshold)
+		} else {
+			config.OutstandingAlertThreshold = threshold
+		}
+	}
+
+	config.WelcomeMessage = defaultWelcomeMessage
+	if value := strings.TrimSpace(os.Getenv("WELCOME_MESSAGE")); value != "" {
+		// Allow line breaks written as \n in a single-line environment variable
+		config.WelcomeMessage = strings.ReplaceAll(value, `\n`, "\n")
+	}
+
+	if value := os.Getenv("MAX_LOANS_PER_USER"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			log.Printf("Invalid MAX_LOANS_PER_USER %q, loans are not limited", value)
+		} else {
+			config.MaxLoansPerUser = limit
+		}
+	}
+
+	return config
+}
+
+// parseWeekday parses a day of the week given as a number (0 = Sunday) or an English name
+func parseWeekday(value string) (time.Weekday, error) {
+	value = strings.TrimSpace(value)
+	if day, err := strconv.Atoi(value); err == nil && day >= 0 && day <= 6 {
+		return time.Weekday(day), nil
+	}
+
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		if strings.EqualFold(day.String(), value) || strings.EqualFold(day.String()[:3], value) {
+			return day, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown weekday: %s", value)
+}
+
+// parseIDList parses a comma-separated list of Telegram IDs
+func parseIDList(value string) []int64 {
+	var ids []int64
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		id, err := strconv.ParseInt(part, 10, 64)
+		if err != nil {
+			log.Printf("Ignoring invalid ID %q: %v", part, err)
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
 // Initialize database schema
 func initializeDatabase(db *sql.DB) error {
 	// Create or update the loans table
@@ -1802,6 +10822,23 @@ func initializeDatabase(db *sql.DB) error {
 		purpose TEXT,
 		repaid BOOLEAN DEFAULT 0,
 		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		deleted BOOLEAN DEFAULT 0,
+		merged_into INTEGER,
+		due_date TEXT,
+		location TEXT,
+		latitude REAL,
+		longitude REAL,
+		snooze_until TEXT,
+		group_id INTEGER,
+		disputed BOOLEAN DEFAULT 0,
+		dispute_note TEXT,
+		reminder_interval_days INTEGER,
+		last_reminded TIMESTAMP,
+		installments BOOLEAN DEFAULT 0,
+		currency TEXT,
+		fx_rate REAL,
+		forgiven BOOLEAN DEFAULT 0,
+		my_share_percent INTEGER DEFAULT 100,
 		PRIMARY KEY (user_id, loan_id)
 	);`
 
@@ -1817,6 +10854,139 @@ func initializeDatabase(db *sql.DB) error {
 		FOREIGN KEY (user_id, loan_id) REFERENCES loans(user_id, loan_id)
 	);`
 
+	// Create the reminders table to remember when each user was last reminded
+	remindersTableSQL := `
+	CREATE TABLE IF NOT EXISTS reminders (
+		user_id INTEGER PRIMARY KEY,
+		last_reminded TIMESTAMP NOT NULL
+	);`
+
+	// Create the user_settings table for per-user preferences
+	userSettingsTableSQL := `
+	CREATE TABLE IF NOT EXISTS user_settings (
+		user_id INTEGER NOT NULL,
+		key TEXT NOT NULL,
+		value TEXT NOT NULL,
+		PRIMARY KEY (user_id, key)
+	);`
+
+	// Create the bot_meta table for bot-wide bookkeeping values
+	botMetaTableSQL := `
+	CREATE TABLE IF NOT EXISTS bot_meta (
+		key TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	);`
+
+	// Create the transfers table for loans handed over between users
+	transfersTableSQL := `
+	CREATE TABLE IF NOT EXISTS transfers (
+		transfer_id INTEGER PRIMARY KEY AUTOINCREMENT,
+		from_user_id INTEGER NOT NULL,
+		loan_id INTEGER NOT NULL,
+		to_user_id INTEGER NOT NULL,
+		status TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	// Create the loan_events table for the per-loan activity log
+	loanEventsTableSQL := `
+	CREATE TABLE IF NOT EXISTS loan_events (
+		event_id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		loan_id INTEGER NOT NULL,
+		event_type TEXT NOT NULL,
+		details TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL
+	);`
+
+	// Create the due_notifications table so each due-date notification is sent once
+	dueNotificationsTableSQL := `
+	CREATE TABLE IF NOT EXISTS due_notifications (
+		user_id INTEGER NOT NULL,
+		loan_id INTEGER NOT NULL,
+		due_date TEXT NOT NULL,
+		days_before INTEGER NOT NULL,
+		PRIMARY KEY (user_id, loan_id, due_date, days_before)
+	);`
+
+	// Create the disbursements table for the parts of loans given out in installments
+	disbursementsTableSQL := `
+	CREATE TABLE IF NOT EXISTS disbursements (
+		disbursement_id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		loan_id INTEGER NOT NULL,
+		amount INTEGER NOT NULL,
+		disbursement_date TEXT NOT NULL,
+		note TEXT,
+		FOREIGN KEY (user_id, loan_id) REFERENCES loans(user_id, loan_id)
+	);`
+
+	// Create the loan_amount_history table so edited amounts leave a trail
+	loanAmountHistoryTableSQL := `
+	CREATE TABLE IF NOT EXISTS loan_amount_history (
+		history_id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		loan_id INTEGER NOT NULL,
+		old_amount INTEGER NOT NULL,
+		new_amount INTEGER NOT NULL,
+		changed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_id, loan_id) REFERENCES loans(user_id, loan_id)
+	);`
+
+	// Create the extensions table for due dates that were moved
+	extensionsTableSQL := `
+	CREATE TABLE IF NOT EXISTS extensions (
+		extension_id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		loan_id INTEGER NOT NULL,
+		old_due_date TEXT,
+		new_due_date TEXT NOT NULL,
+		extended_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_id, loan_id) REFERENCES loans(user_id, loan_id)
+	);`
+
+	// Create the loan_counters table with the last loan ID handed out to each user
+	loanCountersTableSQL := `
+	CREATE TABLE IF NOT EXISTS loan_counters (
+		user_id INTEGER PRIMARY KEY,
+		last_loan_id INTEGER NOT NULL
+	);`
+
+	// Create the deferred_messages table for reminders held back by quiet hours
+	deferredMessagesTableSQL := `
+	CREATE TABLE IF NOT EXISTS deferred_messages (
+		message_id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		text TEXT NOT NULL,
+		keyboard TEXT,
+		send_after INTEGER NOT NULL
+	);`
+
+	// Create the recurring_loans table for templates that create a loan every few days
+	recurringLoansTableSQL := `
+	CREATE TABLE IF NOT EXISTS recurring_loans (
+		recurring_id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		borrower_name TEXT NOT NULL,
+		amount INTEGER NOT NULL,
+		purpose TEXT,
+		interval_days INTEGER NOT NULL,
+		next_date TEXT NOT NULL,
+		paused BOOLEAN DEFAULT 0,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	// Create the borrowers table for contact details shared by all loans of a borrower
+	borrowersTableSQL := `
+	CREATE TABLE IF NOT EXISTS borrowers (
+		user_id INTEGER NOT NULL,
+		name_key TEXT NOT NULL,
+		name TEXT NOT NULL,
+		phone TEXT,
+		payment_link TEXT,
+		PRIMARY KEY (user_id, name_key)
+	);`
+
 	// Execute the SQL statements
 	_, err := db.Exec(loansTableSQL)
 	if err != nil {
@@ -1828,10 +10998,139 @@ func initializeDatabase(db *sql.DB) error {
 		return fmt.Errorf("error creating repayments table: %v", err)
 	}
 
+	_, err = db.Exec(remindersTableSQL)
+	if err != nil {
+		return fmt.Errorf("error creating reminders table: %v", err)
+	}
+
+	_, err = db.Exec(userSettingsTableSQL)
+	if err != nil {
+		return fmt.Errorf("error creating user_settings table: %v", err)
+	}
+
+	_, err = db.Exec(botMetaTableSQL)
+	if err != nil {
+		return fmt.Errorf("error creating bot_meta table: %v", err)
+	}
+
+	_, err = db.Exec(transfersTableSQL)
+	if err != nil {
+		return fmt.Errorf("error creating transfers table: %v", err)
+	}
+
+	_, err = db.Exec(loanEventsTableSQL)
+	if err != nil {
+		return fmt.Errorf("error creating loan_events table: %v", err)
+	}
+
+	_, err = db.Exec(dueNotificationsTableSQL)
+	if err != nil {
+		return fmt.Errorf("error creating due_notifications table: %v", err)
+	}
+
+	_, err = db.Exec(borrowersTableSQL)
+	if err != nil {
+		return fmt.Errorf("error creating borrowers table: %v", err)
+	}
+
+	_, err = db.Exec(disbursementsTableSQL)
+	if err != nil {
+		return fmt.Errorf("error creating disbursements table: %v", err)
+	}
+
+	_, err = db.Exec(loanAmountHistoryTableSQL)
+	if err != nil {
+		return fmt.Errorf("error creating loan_amount_history table: %v", err)
+	}
+
+	_, err = db.Exec(extensionsTableSQL)
+	if err != nil {
+		return fmt.Errorf("error creating extensions table: %v", err)
+	}
+
+	_, err = db.Exec(loanCountersTableSQL)
+	if err != nil {
+		return fmt.Errorf("error creating loan_counters table: %v", err)
+	}
+
+	_, err = db.Exec(deferredMessagesTableSQL)
+	if err != nil {
+		return fmt.Errorf("error creating deferred_messages table: %v", err)
+	}
+
+	_, err = db.Exec(recurringLoansTableSQL)
+	if err != nil {
+		return fmt.Errorf("error creating recurring_loans table: %v", err)
+	}
+
+	// Add columns introduced after the loans table was first created
+	loanColumns := []struct {
+		Name       string
+		Definition string
+	}{
+		// ALTER TABLE cannot add a CURRENT_TIMESTAMP default, so inserts set created_at explicitly
+		{"created_at", "TIMESTAMP"},
+		{"deleted", "BOOLEAN DEFAULT 0"},
+		{"merged_into", "INTEGER"},
+		{"due_date", "TEXT"},
+		{"location", "TEXT"},
+		{"latitude", "REAL"},
+		{"longitude", "REAL"},
+		{"snooze_until", "TEXT"},
+		{"group_id", "INTEGER"},
+		{"disputed", "BOOLEAN DEFAULT 0"},
+		{"dispute_note", "TEXT"},
+		{"reminder_interval_days", "INTEGER"},
+		{"last_reminded", "TIMESTAMP"},
+		{"installments", "BOOLEAN DEFAULT 0"},
+		{"currency", "TEXT"},
+		{"fx_rate", "REAL"},
+		{"forgiven", "BOOLEAN DEFAULT 0"},
+		{"my_share_percent", "INTEGER DEFAULT 100"},
+	}
+	for _, column := range loanColumns {
+		if err := addColumnIfMissing(db, "loans", column.Name, column.Definition); err != nil {
+			return err
+		}
+	}
+	if err := addColumnIfMissing(db, "borrowers", "payment_link", "TEXT"); err != nil {
+		return err
+	}
+
 	log.Println("Database tables created successfully")
 	return nil
 }
 
+// addColumnIfMissing adds a column to an existing table when upgrading an older database
+func addColumnIfMissing(db *sql.DB, table string, column string, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return fmt.Errorf("error reading %s columns: %v", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, primaryKey int
+		var name, columnType string
+		var defaultValue sql.NullString
+
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &primaryKey); err != nil {
+			return fmt.Errorf("error reading %s columns: %v", table, err)
+		}
+
+		if name == column {
+			return nil
+		}
+	}
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		return fmt.Errorf("error adding %s.%s column: %v", table, column, err)
+	}
+
+	return nil
+}
+
 // StartEditLoanFlow begins the process of editing a loan
 func (m *BotManager) StartEditLoanFlow(chatID int64) {
 	// First clear any existing state
@@ -1856,7 +11155,7 @@ func (m *BotManager) StartEditLoanFlow(chatID int64) {
 	var keyboard [][]tgbotapi.InlineKeyboardButton
 	for _, loan := range activeLoans {
 		button := tgbotapi.NewInlineKeyboardButtonData(
-			fmt.Sprintf("ID %d: %s - %d ₸", loan.ID, loan.Borrower, loan.Amount),
+			fmt.Sprintf("ID %d: %s - %s", loan.ID, loan.Borrower, m.Money(chatID, loan.Amount)),
 			fmt.Sprintf("edit_%d", loan.ID),
 		)
 		keyboard = append(keyboard, tgbotapi.NewInlineKeyboardRow(button))
@@ -1869,7 +11168,7 @@ func (m *BotManager) StartEditLoanFlow(chatID int64) {
 
 	msg := tgbotapi.NewMessage(chatID, "Выберите займ для редактирования:")
 	msg.ReplyMarkup = tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
-	m.bot.Send(msg)
+	m.Send(msg)
 
 	// Set state for next step
 	m.SetState(chatID, OpEditLoan, 0)
@@ -1904,7 +11203,7 @@ func (m *BotManager) StartDeleteLoanFlow(chatID int64) {
 		}
 
 		button := tgbotapi.NewInlineKeyboardButtonData(
-			fmt.Sprintf("ID %d: %s - %d ₸ (%s)", loan.ID, loan.Borrower, loan.Amount, status),
+			fmt.Sprintf("ID %d: %s - %s (%s)", loan.ID, loan.Borrower, m.Money(chatID, loan.Amount), status),
 			fmt.Sprintf("delete_%d", loan.ID),
 		)
 		keyboard = append(keyboard, tgbotapi.NewInlineKeyboardRow(button))
@@ -1917,7 +11216,7 @@ func (m *BotManager) StartDeleteLoanFlow(chatID int64) {
 
 	msg := tgbotapi.NewMessage(chatID, "Выберите займ для удаления:")
 	msg.ReplyMarkup = tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
-	m.bot.Send(msg)
+	m.Send(msg)
 
 	// Set state for next step
 	m.SetState(chatID, OpDeleteLoan, 0)
@@ -1948,7 +11247,7 @@ func (m *BotManager) StartPartialRepaymentFlow(chatID int64) {
 	for _, loan := range activeLoans {
 		remainingAmount := loan.Amount - m.GetTotalRepaidAmount(chatID, loan.ID)
 		button := tgbotapi.NewInlineKeyboardButtonData(
-			fmt.Sprintf("ID %d: %s - Осталось: %d ₸", loan.ID, loan.Borrower, remainingAmount),
+			fmt.Sprintf("ID %d: %s - Осталось: %s", loan.ID, loan.Borrower, m.Money(chatID, remainingAmount)),
 			fmt.Sprintf("partial_%d", loan.ID),
 		)
 		keyboard = append(keyboard, tgbotapi.NewInlineKeyboardRow(button))
@@ -1961,12 +11260,169 @@ func (m *BotManager) StartPartialRepaymentFlow(chatID int64) {
 
 	msg := tgbotapi.NewMessage(chatID, "Выберите займ для частичного возврата:")
 	msg.ReplyMarkup = tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
-	m.bot.Send(msg)
+	m.Send(msg)
 
 	// Set state for next step
 	m.SetState(chatID, OpPartialRepay, 0)
 }
 
+// StartMergeLoansFlow begins the process of merging several loans of one borrower
+func (m *BotManager) StartMergeLoansFlow(chatID int64) {
+	// First clear any existing state
+	m.ClearState(chatID)
+
+	m.SetState(chatID, OpMergeLoans, 0)
+	m.ShowMergeSelection(chatID)
+}
+
+// ShowMergeSelection displays active loans with checkboxes for choosing which to merge
+func (m *BotManager) ShowMergeSelection(chatID int64) {
+	activeLoans, err := m.GetActiveLoansForUser(chatID)
+	if err != nil {
+		log.Printf("Error getting active loans: %v", err)
+		m.SendMessage(chatID, "❌ Не удалось получить список активных займов.")
+		m.ClearState(chatID)
+		m.ShowMainMenu(chatID)
+		return
+	}
+
+	if len(activeLoans) < 2 {
+		m.SendMessage(chatID, "Для объединения нужно минимум два активных займа.")
+		m.ClearState(chatID)
+		m.ShowMainMenu(chatID)
+		return
+	}
+
+	selected := make(map[int]bool)
+	for _, loanID := range m.GetMergeSelection(chatID) {
+		selected[loanID] = true
+	}
+
+	// Display loans with a checkbox each
+	var keyboard [][]tgbotapi.InlineKeyboardButton
+	for _, loan := range activeLoans {
+		mark := "⬜"
+		if selected[loan.ID] {
+			mark = "☑️"
+		}
+
+		button := tgbotapi.NewInlineKeyboardButtonData(
+			fmt.Sprintf("%s ID %d: %s - %s", mark, loan.ID, loan.Borrower, m.Money(chatID, loan.Amount)),
+			fmt.Sprintf("merge_toggle_%d", loan.ID),
+		)
+		keyboard = append(keyboard, tgbotapi.NewInlineKeyboardRow(button))
+	}
+
+	// Add continue and back buttons
+	keyboard = append(keyboard, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("🔗 Объединить выбранные", "merge_review"),
+	))
+	keyboard = append(keyboard, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("🔙 Назад", "back_to_manage"),
+	))
+
+	msg := tgbotapi.NewMessage(chatID, "Отметьте два или более займа одного заемщика для объединения:")
+	msg.ReplyMarkup = tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
+	m.Send(msg)
+}
+
+// GetMergeSelection returns the loan IDs currently selected for merging
+func (m *BotManager) GetMergeSelection(chatID int64) []int {
+	value, _ := m.GetStateData(chatID, "merge_ids")
+
+	var loanIDs []int
+	for _, part := range strings.Split(value, ",") {
+		if loanID, err := strconv.Atoi(part); err == nil {
+			loanIDs = append(loanIDs, loanID)
+		}
+	}
+	return loanIDs
+}
+
+// ToggleMergeSelection adds or removes a loan from the merge selection
+func (m *BotManager) ToggleMergeSelection(chatID int64, loanID int) {
+	var parts []string
+	found := false
+	for _, selectedID := range m.GetMergeSelection(chatID) {
+		if selectedID == loanID {
+			found = true
+			continue
+		}
+		parts = append(parts, strconv.Itoa(selectedID))
+	}
+	if !found {
+		parts = append(parts, strconv.Itoa(loanID))
+	}
+
+	m.SaveStateData(chatID, "merge_ids", strings.Join(parts, ","))
+	m.SetState(chatID, OpMergeLoans, 0)
+}
+
+// ShowMergeConfirmation validates the selection and asks the user to confirm the merge
+func (m *BotManager) ShowMergeConfirmation(chatID int64) {
+	loanIDs := m.GetMergeSelection(chatID)
+	if len(loanIDs) < 2 {
+		m.SendMessage(chatID, "❌ Выберите минимум два займа.")
+		m.ShowMergeSelection(chatID)
+		return
+	}
+
+	// Collect the selected loans and check they belong to one borrower
+	var loans []Loan
+	for _, loanID := range loanIDs {
+		loan, err := m.GetLoanByID(chatID, loanID)
+		if err != nil || loan.Repaid {
+			m.SendMessage(chatID, fmt.Sprintf("❌ Займ #%d не найден или уже погашен.", loanID))
+			m.ClearState(chatID)
+			m.ShowMainMenu(chatID)
+			return
+		}
+		loans = append(loans, loan)
+	}
+
+	for _, loan := range loans[1:] {
+		if !sameBorrower(loan.Borrower, loans[0].Borrower) {
+			m.SendMessage(chatID, "❌ Можно объединять только займы одного заемщика. Измените выбор.")
+			m.ShowMergeSelection(chatID)
+			return
+		}
+	}
+
+	// Summarize the merged loan
+	var response strings.Builder
+	response.WriteString(fmt.Sprintf("🔗 Объединение займов заемщика %s:\n\n", loans[0].Borrower))
+
+	var totalAmount, totalRemaining int64
+	for _, loan := range loans {
+		remainingAmount := loan.Amount - m.GetTotalRepaidAmount(chatID, loan.ID)
+		totalAmount += loan.Amount
+		totalRemaining += remainingAmount
+
+		response.WriteString(fmt.Sprintf("🆔 Займ #%d: %s (остаток %s)\n", loan.ID, m.Money(chatID, loan.Amount), m.Money(chatID, remainingAmount)))
+	}
+
+	response.WriteString(fmt.Sprintf(
+		"\n💰 Сумма нового займа: %s\n💵 Остаток: %s\n\nИстория платежей будет перенесена в новый займ. Подтверждаете?",
+		m.Money(chatID, totalAmount), m.Money(chatID, totalRemaining),
+	))
+
+	keyboard := tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("✅ Да, объединить", "merge_execute"),
+			tgbotapi.NewInlineKeyboardButtonData("❌ Нет, отмена", "back_to_manage"),
+		),
+	)
+
+	msg := tgbotapi.NewMessage(chatID, response.String())
+	msg.ReplyMarkup = keyboard
+	m.Send(msg)
+}
+
+// sameBorrower reports whether two borrower names refer to the same person
+func sameBorrower(a string, b string) bool {
+	return strings.EqualFold(strings.TrimSpace(a), strings.TrimSpace(b))
+}
+
 // ShowRepaymentHistory displays the repayment history for a user's loans
 func (m *BotManager) ShowRepaymentHistory(chatID int64) {
 	// Show all loans to select from
@@ -1988,7 +11444,7 @@ func (m *BotManager) ShowRepaymentHistory(chatID int64) {
 	var keyboard [][]tgbotapi.InlineKeyboardButton
 	for _, loan := range allLoans {
 		button := tgbotapi.NewInlineKeyboardButtonData(
-			fmt.Sprintf("ID %d: %s - %d ₸", loan.ID, loan.Borrower, loan.Amount),
+			fmt.Sprintf("ID %d: %s - %s", loan.ID, loan.Borrower, m.Money(chatID, loan.Amount)),
 			fmt.Sprintf("history_%d", loan.ID),
 		)
 		keyboard = append(keyboard, tgbotapi.NewInlineKeyboardRow(button))
@@ -2001,5 +11457,5 @@ func (m *BotManager) ShowRepaymentHistory(chatID int64) {
 
 	msg := tgbotapi.NewMessage(chatID, "Выберите займ для просмотра истории платежей:")
 	msg.ReplyMarkup = tgbotapi.InlineKeyboardMarkup{InlineKeyboard: keyboard}
-	m.bot.Send(msg)
+	m.Send(msg)
 }
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseAmount(t *testing.T) {
+	tests := []struct {
+		input string
+		want  int64
+		ok    bool
+	}{
+		// Plain numbers and digit-group spaces
+		{"5000", 5000, true},
+		{"  5000  ", 5000, true},
+		{"5 000", 5000, true},
+		{"1 000 000", 1000000, true},
+		{"5\u00a0000", 5000, true},
+		{"5\u202f000", 5000, true},
+
+		// Commas and dots grouping digits
+		{"5,000", 5000, true},
+		{"5.000", 5000, true},
+		{"1,000,000", 1000000, true},
+		{"1.000.000", 1000000, true},
+
+		// Thousand suffixes
+		{"5к", 5000, true},
+		{"5 К", 5000, true},
+		{"5k", 5000, true},
+		{"1,5к", 1500, true},
+		{"2.25k", 2250, true},
+		{"5 тыс", 5000, true},
+		{"5 тыс.", 5000, true},
+		{"5 тыс. тг", 5000, true},
+		{"5ктг", 5000, true},
+
+		// Currency signs and abbreviations
+		{"5000 ₸", 5000, true},
+		{"₸5000", 5000, true},
+		{"5 000₸", 5000, true},
+		{"5000тг", 5000, true},
+		{"5000 тг.", 5000, true},
+		{"5000 тенге", 5000, true},
+		{"5000 KZT", 5000, true},
+		{"5000т", 5000, true},
+
+		// Rejected input
+		{"", 0, false},
+		{"abc", 0, false},
+		{"пять тысяч", 0, false},
+		{"5,5", 0, false},
+		{"5.00", 0, false},
+		{"5,000.50", 0, false},
+		{"50,00", 0, false},
+		{"1,2345к", 0, false},
+		{"к", 0, false},
+		{",5к", 0, false},
+		{"-1,5к", 0, false},
+		{"5000 USD", 0, false},
+		{"99999999999999999999", 0, false},
+		{"9999999999999999к", 0, false},
+	}
+
+	for _, tt := range tests {
+		got, err := parseAmount(tt.input)
+		if tt.ok && (err != nil || got != tt.want) {
+			t.Errorf("parseAmount(%q) = %d, %v; want %d", tt.input, got, err, tt.want)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("parseAmount(%q) = %d; want an error", tt.input, got)
+		}
+	}
+}
+
+func TestNoteTooLong(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want bool
+	}{
+		{"empty", "", false},
+		{"latin at the limit", strings.Repeat("a", maxNoteLength), false},
+		{"latin over the limit", strings.Repeat("a", maxNoteLength+1), true},
+		// Cyrillic letters take two bytes each, but the limit counts characters
+		{"cyrillic at the limit", strings.Repeat("ж", maxNoteLength), false},
+		{"cyrillic over the limit", strings.Repeat("ж", maxNoteLength+1), true},
+		{"emoji at the limit", strings.Repeat("💰", maxNoteLength), false},
+		{"emoji over the limit", strings.Repeat("💰", maxNoteLength+1), true},
+	}
+
+	for _, tt := range tests {
+		if got := noteTooLong(tt.text); got != tt.want {
+			t.Errorf("noteTooLong(%s) = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNoteTooLongMessage(t *testing.T) {
+	message := noteTooLongMessage(strings.Repeat("ж", maxNoteLength+1))
+
+	// The message counts characters, not bytes
+	for _, want := range []string{strconv.Itoa(maxNoteLength + 1), strconv.Itoa(maxNoteLength)} {
+		if !strings.Contains(message, want) {
+			t.Errorf("noteTooLongMessage() = %q; want it to mention %s", message, want)
+		}
+	}
+	if strings.Contains(message, strconv.Itoa(2*(maxNoteLength+1))) {
+		t.Errorf("noteTooLongMessage() = %q; counts bytes instead of characters", message)
+	}
+}
+
+// newTestDB opens a fresh database file with at most conns connections. A file is
+// used instead of :memory:, where every connection would get its own database.
+func newTestDB(t *testing.T, conns int) *timeoutDB {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "lending.db")
+	db, err := sql.Open("sqlite", fmt.Sprintf("%s?_pragma=busy_timeout(%d)", path, dbBusyTimeoutMs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	db.SetMaxOpenConns(conns)
+	if err := initializeDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+	return newTimeoutDB(db, dbQueryTimeout)
+}
+
+// nestedQuery runs a query while the rows of another are still open, as some handlers do
+func nestedQuery(db *timeoutDB, timeout time.Duration) error {
+	rows, err := db.Query("SELECT 1")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var n int
+	return db.QueryRowContext(ctx, "SELECT 1").Scan(&n)
+}
+
+func TestNestedQueryNeedsSecondConnection(t *testing.T) {
+	// With a single connection the inner query waits for the outer rows forever,
+	// so it only returns once its context expires
+	if err := nestedQuery(newTestDB(t, 1), 100*time.Millisecond); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("nested query on one connection: err = %v; want %v", err, context.DeadlineExceeded)
+	}
+	if err := nestedQuery(newTestDB(t, dbMaxOpenConns), 100*time.Millisecond); err != nil {
+		t.Errorf("nested query on %d connections: %v", dbMaxOpenConns, err)
+	}
+}
+
+func TestTimeoutDBReleasesConnections(t *testing.T) {
+	db := newTestDB(t, 1)
+
+	// Every result is released when it is closed, scanned or committed, so a single
+	// connection serves them, and the writer goroutine, one after another
+	for i := 0; i < 100; i++ {
+		rows, err := db.Query("SELECT 1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for rows.Next() {
+		}
+		rows.Close()
+
+		var n int
+		if err := db.QueryRow("SELECT 1").Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+
+		err = db.Transact(func(tx *sql.Tx) error {
+			_, err := tx.Exec("INSERT INTO user_settings (user_id, key, value) VALUES (?, 'k', 'v')", i)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTransactRetriesBusyTransaction(t *testing.T) {
+	db := newTestDB(t, 2)
+
+	attempts := 0
+	other := make(chan error, 1)
+	err := db.Transact(func(tx *sql.Tx) error {
+		attempts++
+		var count int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM user_settings").Scan(&count); err != nil {
+			return err
+		}
+		if attempts == 1 {
+			// Another connection writes while this transaction has only read. Its commit
+			// waits for this transaction to end, so the write below fails at once.
+			go func() {
+				_, err := db.DB.Exec("INSERT INTO user_settings (user_id, key, value) VALUES (1, 'other', 'v')")
+				other <- err
+			}()
+			time.Sleep(100 * time.Millisecond)
+		}
+		_, err := tx.Exec("INSERT INTO user_settings (user_id, key, value) VALUES (1, 'mine', 'v')")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Transact() = %v; want the transaction retried", err)
+	}
+	if attempts < 2 {
+		t.Errorf("Transact() ran the transaction %d times; want it retried", attempts)
+	}
+	if err := <-other; err != nil {
+		t.Errorf("concurrent write: %v", err)
+	}
+
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM user_settings WHERE user_id = 1").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("found %d settings; want both writes", count)
+	}
+}
+
+func TestWriteQueueUnderLoad(t *testing.T) {
+	db := newTestDB(t, dbMaxOpenConns)
+	if _, err := db.Exec("INSERT INTO bot_meta (key, value) VALUES ('counter', '0')"); err != nil {
+		t.Fatal(err)
+	}
+
+	const workers, rounds = 50, 20
+	errs := make(chan error, workers*rounds*3)
+	var wg sync.WaitGroup
+	for worker := 0; worker < workers; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for round := 0; round < rounds; round++ {
+				// Read-modify-write transactions lose updates, or fail on the lock,
+				// unless they run one at a time
+				errs <- db.Transact(func(tx *sql.Tx) error {
+					var counter int
+					if err := tx.QueryRow("SELECT CAST(value AS INTEGER) FROM bot_meta WHERE key = 'counter'").Scan(&counter); err != nil {
+						return err
+					}
+					// Widen the window in which another writer could get in
+					time.Sleep(time.Millisecond)
+					_, err := tx.Exec("UPDATE bot_meta SET value = ? WHERE key = 'counter'", strconv.Itoa(counter+1))
+					return err
+				})
+
+				_, err := db.Exec("INSERT INTO user_settings (user_id, key, value) VALUES (?, ?, 'v')", worker, strconv.Itoa(round))
+				errs <- err
+
+				// Reads run alongside the queued writes
+				var count int
+				errs <- db.QueryRow("SELECT COUNT(*) FROM user_settings").Scan(&count)
+			}
+		}(worker)
+	}
+	wg.Wait()
+	close(errs)
+
+	failed := 0
+	for err := range errs {
+		if err != nil {
+			failed++
+			if failed <= 3 {
+				t.Errorf("operation failed under load: %v", err)
+			}
+		}
+	}
+	if failed > 3 {
+		t.Errorf("%d operations failed under load in total", failed)
+	}
+
+	var counter, settings int
+	if err := db.QueryRow("SELECT CAST(value AS INTEGER) FROM bot_meta WHERE key = 'counter'").Scan(&counter); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow("SELECT COUNT(*) FROM user_settings").Scan(&settings); err != nil {
+		t.Fatal(err)
+	}
+	if counter != workers*rounds {
+		t.Errorf("counter = %d; want %d", counter, workers*rounds)
+	}
+	if settings != workers*rounds {
+		t.Errorf("found %d settings; want %d", settings, workers*rounds)
+	}
+}
+
+func TestWriteGivesUpWhenContextEnds(t *testing.T) {
+	db := newTestDB(t, dbMaxOpenConns)
+
+	// Hold the writer goroutine busy, so the next write has to wait in the queue
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go db.write(context.Background(), func() error {
+		close(started)
+		<-release
+		return nil
+	})
+	<-started
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := db.ExecContext(ctx, "INSERT INTO user_settings (user_id, key, value) VALUES (1, 'k', 'v')"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("ExecContext() behind a busy writer = %v; want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestNestedWriteFails(t *testing.T) {
+	db := newTestDB(t, dbMaxOpenConns)
+
+	// A write from inside a transaction would wait on the writer running it
+	result := make(chan error, 1)
+	go func() {
+		result <- db.Transact(func(tx *sql.Tx) error {
+			_, err := db.Exec("INSERT INTO user_settings (user_id, key, value) VALUES (1, 'k', 'v')")
+			return err
+		})
+	}()
+
+	select {
+	case err := <-result:
+		if !errors.Is(err, errNestedWrite) {
+			t.Errorf("nested write = %v; want %v", err, errNestedWrite)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("nested write blocked the writer")
+	}
+
+	// The writer keeps serving later writes
+	if _, err := db.Exec("INSERT INTO user_settings (user_id, key, value) VALUES (1, 'k', 'v')"); err != nil {
+		t.Errorf("write after a nested write: %v", err)
+	}
+}
+
+func TestInsertLoanConcurrentIDs(t *testing.T) {
+	// A single connection keeps every query on the same in-memory database
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	db.SetMaxOpenConns(1)
+	if err := initializeDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+	m := &BotManager{db: newTimeoutDB(db, dbQueryTimeout), userStates: make(map[int64]*UserState)}
+
+	const chatID, loans = 1, 50
+	insert := func() (int, error) {
+		return m.insertLoan(chatID, func(tx *sql.Tx, loanID int) error {
+			_, err := tx.Exec(
+				"INSERT INTO loans (user_id, loan_id, borrower_name, amount, purpose, repaid, created_at) VALUES (?, ?, 'Иван', 1000, 'Тест', 0, CURRENT_TIMESTAMP)",
+				chatID, loanID,
+			)
+			return err
+		})
+	}
+
+	ids := make([]int, loans)
+	errs := make([]error, loans)
+	var wg sync.WaitGroup
+	for i := 0; i < loans; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ids[i], errs[i] = insert()
+		}(i)
+	}
+	wg.Wait()
+
+	seen := make(map[int]bool)
+	highest := 0
+	for i, id := range ids {
+		if errs[i] != nil {
+			t.Fatalf("insertLoan() = %v", errs[i])
+		}
+		if seen[id] {
+			t.Errorf("loan ID %d was handed out twice", id)
+		}
+		seen[id] = true
+		highest = max(highest, id)
+	}
+
+	// Deleting the newest loan must not free its ID for the next one
+	if err := m.DeleteLoan(chatID, highest); err != nil {
+		t.Fatal(err)
+	}
+	next, err := insert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next <= highest {
+		t.Errorf("loan ID after deleting #%d = %d; want a new one", highest, next)
+	}
+}